@@ -3,9 +3,12 @@ package main
 import (
 	//"gopkg.in/dedis/onet.v1/app"
 	"os"
+	"time"
 
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
 	"gopkg.in/dedis/onet.v1/app"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -40,6 +43,16 @@ const (
 	optionGroupBy      = "groupBy"
 	optionGroupByShort = "g"
 
+	optionTimeout = "timeout"
+
+	optionKeySwitchingChunk    = "ksChunk"
+	optionParallelKeySwitching = "ksParallel"
+	optionPartialResults       = "partial"
+	optionFormat               = "format"
+	optionOutDir               = "outDir"
+	optionParallel             = "parallel"
+	optionVocabulary           = "vocabulary"
+
 	// decryption flags
 
 	optionDecryptKey      = "key"
@@ -48,6 +61,14 @@ const (
 	optionEncryptKey      = "key"
 	optionEncryptKeyShort = "k"
 
+	// key management flags
+
+	optionKeystore        = "keystore"
+	optionKeyName         = "keyName"
+	optionPublicKeyFile   = "public"
+	optionPrivateKeyFile  = "private"
+	optionEncryptKeystore = "encrypt"
+
 	// csv manipulation flags
 
 	optionCsvFileIn      = "csvIn"
@@ -58,6 +79,52 @@ const (
 
 	attributeToEncrypt      = "attribute"
 	attributeToEncryptShort = "a"
+
+	optionRangeBits   = "rangeBits"
+	optionPadTo       = "padTo"
+	optionEmptyValues = "empty"
+	optionCheckpoint  = "checkpoint"
+	optionResume      = "resume"
+
+	// collective key flags
+
+	optionThreshold      = "threshold"
+	optionThresholdShort = "t"
+	optionOverwrite      = "overwrite"
+
+	optionSuite = "suite"
+
+	// re-keying flags
+
+	optionNewGroupFile = "newFile"
+	optionDbConfig     = "db"
+	optionDryRun       = "dryRun"
+	optionBatchSize    = "batch"
+
+	// data loading flags
+
+	optionSourceDb    = "sourceDb"
+	optionCrcSchema   = "crc"
+	optionTotalsTable = "totals"
+	optionReplace     = "replace"
+
+	// server setup flags
+
+	optionAddress      = "address"
+	optionDescription  = "description"
+	optionPublicConfig = "public"
+	optionDbUser       = "dbUser"
+	optionDbPassword   = "dbPassword"
+	optionDbPassEnv    = "dbPasswordEnv"
+	optionDbPassFile   = "dbPasswordFile"
+	optionDbName       = "dbName"
+	optionDbTable      = "dbTable"
+	optionForce        = "force"
+
+	optionAdd         = "add"
+	optionRemove      = "remove"
+	optionRekeyWindow = "for"
+	optionCloseWindow = "close"
 )
 
 func main() {
@@ -72,13 +139,26 @@ func main() {
 			Value: 0,
 			Usage: "debug-level: 1 for terse, 5 for maximal",
 		},
+		cli.StringFlag{
+			Name:  optionSuite,
+			Usage: "cipher `SUITE` used for keys and ciphertexts of the local commands (the servers only use " + network.Suite.String() + ")",
+		},
+		cli.StringFlag{
+			Name:  optionKeystore,
+			Usage: "keystore `FILE` of the keys commands and of --" + optionKeyName + " (default: " + keystoreFile + " in the configuration directory)",
+		},
+	}
+
+	keyNameFlag := cli.StringFlag{
+		Name:  optionKeyName,
+		Usage: "`NAME` of a key of the keystore (instead of --" + optionEncryptKey + ")",
 	}
 
 	manipulateCsvFlags := []cli.Flag{
 		cli.StringFlag{
 			Name: optionGroupFile + ", " + optionGroupFileShort,
 			//Value: DefaultGroupFile,
-			Usage: "Servers' group definition `FILE`",
+			Usage: "Servers' group definition `FILE` (the data is encrypted under the collective key its servers hold)",
 		},
 		cli.StringFlag{
 			Name:  optionCsvFileIn + ", " + optionCsvFileInShort,
@@ -99,8 +179,34 @@ func main() {
 			Name:  attributeToEncrypt + ", " + attributeToEncryptShort,
 			Usage: "name of the header attribute in the CSV file to encrypt/decrypted",
 		},
+		keyNameFlag,
 	}
 
+	encryptCsvFlags := append([]cli.Flag{
+		cli.IntFlag{
+			Name:  optionRangeBits,
+			Usage: "if > 0, add a <attribute>_range_proof column proving that each value is in [0, 2^`BITS`)",
+		},
+		cli.IntFlag{
+			Name:  optionPadTo,
+			Usage: "mix dummy records (encrypting 0) with the real ones until the output holds `N` records",
+		},
+		cli.StringFlag{
+			Name:  optionEmptyValues,
+			Value: emptyError,
+			Usage: "`POLICY` for the empty (or NULL) values to encrypt: error, zero (encrypt 0) or skip (drop the record)",
+		},
+		cli.IntFlag{
+			Name:  optionCheckpoint,
+			Value: 100000,
+			Usage: "save the progress every `N` records so that an interrupted encryption can be resumed (0 to disable)",
+		},
+		cli.BoolFlag{
+			Name:  optionResume,
+			Usage: "resume an interrupted encryption from its last checkpoint",
+		},
+	}, manipulateCsvFlags...)
+
 	encryptFlags := []cli.Flag{
 		cli.StringFlag{
 			Name: optionGroupFile + ", " + optionGroupFileShort,
@@ -111,6 +217,7 @@ func main() {
 			Name:  optionEncryptKey + ", " + optionEncryptKeyShort,
 			Usage: "`FILE` with base64-encoded public key",
 		},
+		keyNameFlag,
 	}
 
 	decryptFlags := []cli.Flag{
@@ -118,8 +225,27 @@ func main() {
 			Name:  optionDecryptKey + ", " + optionDecryptKeyShort,
 			Usage: "`FILE` with base64-encoded secret key",
 		},
+		keyNameFlag,
 	}
 
+	keysEncryptFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  optionEncryptKeystore,
+			Usage: "encrypt the private key with a passphrase (asked on the terminal)",
+		},
+	}
+
+	keysImportFlags := append([]cli.Flag{
+		cli.StringFlag{
+			Name:  optionPublicKeyFile,
+			Usage: "`FILE` with base64-encoded public key",
+		},
+		cli.StringFlag{
+			Name:  optionPrivateKeyFile,
+			Usage: "`FILE` with base64-encoded secret key (the public key is derived from it)",
+		},
+	}, keysEncryptFlags...)
+
 	queryFlags := []cli.Flag{
 		cli.StringFlag{
 			Name:  optionGroupFile + ", " + optionGroupFileShort,
@@ -147,7 +273,199 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:  optionCsvFileOut + ", " + optionCsvFileOutShort,
-			Usage: "Specify the output csv `FILE`",
+			Usage: "Specify the output `FILE` (stdout if empty)",
+		},
+		cli.DurationFlag{
+			Name:  optionTimeout,
+			Usage: "maximum `DURATION` of each protocol run by the servers (e.g. 30s, 5m; default 10m)",
+		},
+		cli.IntFlag{
+			Name:  optionKeySwitchingChunk,
+			Usage: "key switch the results in chunks of `N` groups pipelined through the servers (0 sends all groups at once)",
+		},
+		cli.BoolFlag{
+			Name:  optionParallelKeySwitching,
+			Usage: "key switch the results on all servers at the same time (with proofs, not with a threshold key)",
+		},
+		cli.BoolFlag{
+			Name:  optionPartialResults,
+			Usage: "go on without the servers which do not send their data before the timeout (needs a threshold key to key switch without them)",
+		},
+		cli.StringFlag{
+			Name:  optionFormat,
+			Usage: "output `FORMAT`: table, csv, json or xml (i2b2 breakdown); default table on stdout, csv with --" + optionCsvFileOut + " (its description going to FILE" + metadataExtension + ")",
+		},
+		cli.StringFlag{
+			Name:  optionKeyName,
+			Usage: "`NAME` of the key pair of the keystore to which the results are switched (default: a new key pair)",
+		},
+	}
+
+	batchFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Servers' definition `FILE`",
+		},
+		cli.StringFlag{
+			Name:  optionOutDir,
+			Value: ".",
+			Usage: "`DIRECTORY` in which the output of each query and the manifest of the batch are written",
+		},
+		cli.StringFlag{
+			Name:  optionFormat,
+			Usage: "output `FORMAT` of the queries: table, csv (default), json or xml (i2b2 breakdown)",
+		},
+		cli.IntFlag{
+			Name:  optionParallel,
+			Value: 1,
+			Usage: "number of queries run at the same time",
+		},
+	}
+	batchFlags = append(batchFlags, queryOptionFlags(queryFlags)...)
+
+	shellFlags := append([]cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Servers' definition `FILE`",
+		},
+		cli.StringFlag{
+			Name:  optionVocabulary,
+			Usage: "TOML `FILE` listing the Concepts, Locations and Times proposed by the completion",
+		},
+	}, queryOptionFlags(queryFlags)...)
+
+	collectiveKeyFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Servers' definition `FILE`",
+		},
+	}
+
+	dkgFlags := append([]cli.Flag{
+		cli.IntFlag{
+			Name:  optionThreshold + ", " + optionThresholdShort,
+			Usage: "number of servers needed to key switch the data encrypted under the collective key (default: all)",
+		},
+		cli.StringFlag{
+			Name:  optionKeyName,
+			Usage: "`NAME` of the keystore key of the administrator signing the request",
+		},
+	}, collectiveKeyFlags...)
+
+	generateKeyFlags := append([]cli.Flag{
+		cli.BoolFlag{
+			Name:  optionOverwrite,
+			Usage: "replace the threshold key the servers already hold (kept in a versioned file by each server)",
+		},
+	}, dkgFlags...)
+
+	rotateKeyFlags := append([]cli.Flag{
+		cli.DurationFlag{
+			Name:  optionTimeout,
+			Usage: "maximum `DURATION` given to the servers to re-encrypt their data (e.g. 30m; default 10m)",
+		},
+	}, dkgFlags...)
+
+	rekeyFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Value: DefaultGroupFile,
+			Usage: "Servers' definition `FILE` before the membership change",
+		},
+		cli.StringFlag{
+			Name:  optionNewGroupFile,
+			Usage: "Servers' definition `FILE` after the membership change",
+		},
+		cli.StringFlag{
+			Name:  optionConfig + ", " + optionConfigShort,
+			Value: app.GetDefaultConfigFile(BinaryName),
+			Usage: "configuration `FILE` of a server of the roster, whose key signs the re-keying requests",
+		},
+		cli.StringFlag{
+			Name:  optionCsvFileIn + ", " + optionCsvFileInShort,
+			Usage: "encrypted CSV `FILE` to re-key",
+		},
+		cli.StringFlag{
+			Name:  optionCsvFileOut + ", " + optionCsvFileOutShort,
+			Usage: "re-keyed CSV `FILE` (can be the input file)",
+		},
+		cli.StringFlag{
+			Name:  attributeToEncrypt + ", " + attributeToEncryptShort,
+			Usage: "name of the encrypted attribute(s) of the CSV file, separated by commas",
+		},
+		cli.StringFlag{
+			Name:  optionDbConfig,
+			Usage: "database configuration `FILE` (db.toml or server configuration) of the table to re-key (its count column)",
+		},
+		cli.IntFlag{
+			Name:  optionBatchSize,
+			Value: 1000,
+			Usage: "number of `RECORDS` sent to the servers at once",
+		},
+		cli.BoolFlag{
+			Name:  optionDryRun,
+			Usage: "only check the data and that the servers accept re-keying, nothing is written",
+		},
+	}
+
+	rekeyWindowFlags := []cli.Flag{
+		cli.BoolFlag{
+			Name:  optionAdd,
+			Usage: "accept to add the contribution of this server to the collective key (server joining the roster)",
+		},
+		cli.BoolFlag{
+			Name:  optionRemove,
+			Usage: "accept to remove the contribution of this server from the collective key (server leaving the roster)",
+		},
+		cli.DurationFlag{
+			Name:  optionRekeyWindow,
+			Value: time.Hour,
+			Usage: "`DURATION` during which re-keying requests are accepted",
+		},
+		cli.BoolFlag{
+			Name:  optionCloseWindow,
+			Usage: "stop accepting re-keying requests",
+		},
+	}
+
+	loadFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionGroupFile + ", " + optionGroupFileShort,
+			Usage: "Servers' group definition `FILE` (the counts are encrypted under the collective key its servers hold)",
+		},
+		cli.StringFlag{
+			Name:  optionEncryptKey + ", " + optionEncryptKeyShort,
+			Usage: "`FILE` with base64-encoded public key",
+		},
+		keyNameFlag,
+		cli.StringFlag{
+			Name:  optionDbConfig,
+			Usage: "database configuration `FILE` (db.toml or server configuration) of the encrypted table queried by the servers",
+		},
+		cli.StringFlag{
+			Name:  optionSourceDb,
+			Usage: "database configuration `FILE` of the i2b2 CRC database (default: the one of --" + optionDbConfig + ")",
+		},
+		cli.StringFlag{
+			Name:  optionCrcSchema,
+			Value: "i2b2demodata",
+			Usage: "`SCHEMA` of the i2b2 CRC tables whose observation_fact is counted",
+		},
+		cli.StringFlag{
+			Name:  optionTotalsTable,
+			Usage: "precomputed `TABLE` (location_cd, time, concept_cd, totalnum) read instead of observation_fact",
+		},
+		cli.IntFlag{
+			Name:  optionBatchSize,
+			Value: 1000,
+			Usage: "number of `ROWS` inserted in each transaction",
+		},
+		cli.BoolFlag{
+			Name:  optionReplace,
+			Usage: "replace the rows of the encrypted table, in one transaction",
 		},
 	}
 
@@ -159,6 +477,61 @@ func main() {
 		},
 	}
 
+	serverSetupFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  optionAddress,
+			Usage: "`HOST:PORT` of the server (without it, the configuration is asked interactively)",
+		},
+		cli.StringFlag{
+			Name:  optionDescription,
+			Usage: "`DESCRIPTION` of the server in the group file",
+		},
+		cli.StringFlag{
+			Name:  optionConfig + ", " + optionConfigShort,
+			Value: app.GetDefaultConfigFile(BinaryName),
+			Usage: "`FILE` of the server configuration (with its private key and database configuration)",
+		},
+		cli.StringFlag{
+			Name:  optionPublicConfig,
+			Usage: "`FILE` of the public description of the server (default: public.toml next to the server configuration)",
+		},
+		cli.StringFlag{
+			Name:  optionDbUser,
+			Value: "i2b2demodata",
+			Usage: "`USER` of the database of the server",
+		},
+		cli.StringFlag{
+			Name:  optionDbPassword,
+			Usage: "`PASSWORD` of the database user (visible to the other users of the machine, prefer --" + optionDbPassEnv + " or --" + optionDbPassFile + ")",
+		},
+		cli.StringFlag{
+			Name:  optionDbPassEnv,
+			Usage: "environment `VARIABLE` holding the password of the database user when the server starts",
+		},
+		cli.StringFlag{
+			Name:  optionDbPassFile,
+			Usage: "`FILE` holding the password of the database user (not readable by all users)",
+		},
+		cli.StringFlag{
+			Name:  optionDbName,
+			Value: "i2b2demodata",
+			Usage: "`NAME` of the database",
+		},
+		cli.StringFlag{
+			Name:  optionDbTable,
+			Value: "public.demo_data_encrypted",
+			Usage: "encrypted `TABLE` queried by the server",
+		},
+		cli.IntFlag{
+			Name:  optionRangeBits,
+			Usage: "size in `BITS` of the range proofs stored with the counts (0: no range proof column)",
+		},
+		cli.BoolFlag{
+			Name:  optionForce,
+			Usage: "overwrite existing configuration files",
+		},
+	}
+
 	cliApp.Commands = []cli.Command{
 		// BEGIN CLIENT: DATA ENCRYPTION ----------
 		{
@@ -174,9 +547,9 @@ func main() {
 		{
 			Name:    "encryptCsv",
 			Aliases: []string{"ecsv"},
-			Usage:   "Encrypt a CSV file attribute with an ElGamal public key",
+			Usage:   "Encrypt CSV file attribute(s) with an ElGamal public key (files ending with .gz are gzip-compressed)",
 			Action:  encryptCsvFileFromApp,
-			Flags:   manipulateCsvFlags,
+			Flags:   encryptCsvFlags,
 		},
 		// CLIENT END: DATA ENCRYPTION ------------
 
@@ -190,6 +563,15 @@ func main() {
 		},
 		// CLIENT END: DATA ENCRYPTION ------------
 
+		// BEGIN CLIENT: DATA LOADING ----------
+		{
+			Name:   "load",
+			Usage:  "Encrypt the patient counts per location, year and concept of an i2b2 CRC schema into the table queried by the servers",
+			Action: loadFromApp,
+			Flags:  loadFlags,
+		},
+		// CLIENT END: DATA LOADING ------------
+
 		// BEGIN CLIENT: DATA DECRYPTION ----------
 		{
 			Name:    "decrypt",
@@ -209,6 +591,80 @@ func main() {
 		},
 		// CLIENT END: KEY GENERATION ------------
 
+		// BEGIN CLIENT: KEY MANAGEMENT ----------
+		{
+			Name:  "keys",
+			Usage: "Manage the keys of the keystore (file only readable by its owner)",
+			Subcommands: []cli.Command{
+				{
+					Name:      "generate",
+					Usage:     "Generate a pair of public/private keys and store it",
+					ArgsUsage: "NAME",
+					Action:    keysGenerateFromApp,
+					Flags:     keysEncryptFlags,
+				},
+				{
+					Name:      "import",
+					Usage:     "Store existing keys read from base64-encoded key files",
+					ArgsUsage: "NAME",
+					Action:    keysImportFromApp,
+					Flags:     keysImportFlags,
+				},
+				{
+					Name:   "list",
+					Usage:  "List the stored keys with the fingerprints of their public keys",
+					Action: keysListFromApp,
+				},
+				{
+					Name:      "export",
+					Usage:     "Print the base64-encoded public part of a stored key",
+					ArgsUsage: "NAME",
+					Action:    keysExportFromApp,
+				},
+			},
+		},
+		// CLIENT END: KEY MANAGEMENT ------------
+
+		// BEGIN CLIENT: COLLECTIVE KEY ----------
+		{
+			Name:   "dkg",
+			Usage:  "Generate a threshold collective key with the servers of the group and print it",
+			Action: dkgFromApp,
+			Flags:  generateKeyFlags,
+		},
+		{
+			Name:   "rotateKey",
+			Usage:  "Re-encrypt the data of all servers under a new threshold collective key and print it",
+			Action: rotateKeyFromApp,
+			Flags:  rotateKeyFlags,
+		},
+		{
+			Name:    "collectiveKey",
+			Aliases: []string{"ck"},
+			Usage:   "Print the threshold collective key of the group (to be used with --key by the encrypt commands)",
+			Action:  collectiveKeyFromApp,
+			Flags:   collectiveKeyFlags,
+		},
+		// CLIENT END: COLLECTIVE KEY ------------
+
+		// BEGIN CLIENT: ROSTER CHECK ----------
+		{
+			Name:   "roster",
+			Usage:  "Print the collective key of the group with its fingerprint and check the keys held by the servers",
+			Action: rosterFromApp,
+			Flags:  collectiveKeyFlags,
+		},
+		// CLIENT END: ROSTER CHECK ------------
+
+		// BEGIN CLIENT: ROSTER MEMBERSHIP ----------
+		{
+			Name:   "rekey",
+			Usage:  "Re-key encrypted data (CSV file or database table) after a server joined or left the roster",
+			Action: rekeyFromApp,
+			Flags:  rekeyFlags,
+		},
+		// CLIENT END: ROSTER MEMBERSHIP ------------
+
 		// BEGIN CLIENT: QUERIER ----------
 		{
 			Name:    "run",
@@ -217,6 +673,19 @@ func main() {
 			Action:  runQuery,
 			Flags:   queryFlags,
 		},
+		{
+			Name:   "shell",
+			Usage:  "Type queries interactively and see their results as tables",
+			Action: shellFromApp,
+			Flags:  shellFlags,
+		},
+		{
+			Name:      "run-batch",
+			Usage:     "Run the named queries of a TOML, JSON or YAML file and write one output file per query",
+			ArgsUsage: "BATCH_FILE",
+			Action:    runBatchFromApp,
+			Flags:     batchFlags,
+		},
 		// CLIENT END: QUERIER ----------
 
 		// BEGIN SERVER --------
@@ -224,25 +693,33 @@ func main() {
 			Name:  "server",
 			Usage: "Start i2b2dc server",
 			Action: func(c *cli.Context) error {
-				runServer(c)
-				return nil
+				return runServer(c)
 			},
 			Flags: serverFlags,
 			Subcommands: []cli.Command{
 				{
 					Name:    "setup",
 					Aliases: []string{"s"},
-					Usage:   "Setup server configuration (interactive)",
-					Action: func(c *cli.Context) error {
-						if c.String(optionConfig) != "" {
-							log.Fatal("[-] Configuration file option cannot be used for the 'setup' command")
-						}
-						if c.GlobalIsSet("debug") {
-							log.Fatal("[-] Debug option cannot be used for the 'setup' command")
-						}
-						app.InteractiveConfig(BinaryName)
-						return nil
-					},
+					Usage:   "Setup server configuration (interactive without --" + optionAddress + ")",
+					Action:  serverSetupFromApp,
+					Flags:   serverSetupFlags,
+				},
+				{
+					Name:   "check-config",
+					Usage:  "Check the server configuration and the connection to its database without starting the server",
+					Action: serverCheckConfigFromApp,
+					Flags:  serverFlags,
+				},
+				{
+					Name:   "encrypt-password",
+					Usage:  "Encrypt the database password of the server configuration with a passphrase asked when the server starts",
+					Action: serverEncryptPasswordFromApp,
+				},
+				{
+					Name:   "rekey",
+					Usage:  "Open (or close) a window during which this server re-keys the data of the others for a membership change",
+					Action: rekeyWindowFromApp,
+					Flags:  rekeyWindowFlags,
 				},
 			},
 		},
@@ -252,8 +729,25 @@ func main() {
 	cliApp.Flags = binaryFlags
 	cliApp.Before = func(c *cli.Context) error {
 		log.SetDebugVisible(c.GlobalInt("debug"))
+		if name := c.GlobalString(optionSuite); name != "" {
+			if err := lib.SetSuite(name); err != nil {
+				return cli.NewExitError(err, 1)
+			}
+		}
 		return nil
 	}
 	err := cliApp.Run(os.Args)
 	log.ErrFatal(err)
 }
+
+// queryOptionFlags returns the flags of the query options (not of the query statement) among the query flags.
+func queryOptionFlags(queryFlags []cli.Flag) []cli.Flag {
+	var flags []cli.Flag
+	for _, f := range queryFlags {
+		switch f.GetName() {
+		case optionTimeout, optionKeySwitchingChunk, optionParallelKeySwitching, optionPartialResults:
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
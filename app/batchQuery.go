@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+	"gopkg.in/yaml.v2"
+)
+
+// batchFile is a file (TOML, JSON or YAML) of named queries run by run-batch.
+type batchFile struct {
+	Queries []batchQuery `toml:"queries" json:"queries" yaml:"queries"`
+}
+
+// batchQuery is a query of a batch file. Its name is used for the name of its output file.
+type batchQuery struct {
+	Name      string   `toml:"name" json:"name" yaml:"name"`
+	Locations []string `toml:"locations" json:"locations" yaml:"locations"`
+	Times     []string `toml:"times" json:"times" yaml:"times"`
+	Concepts  []string `toml:"concepts" json:"concepts" yaml:"concepts"`
+	GroupBy   []string `toml:"groupBy" json:"groupBy" yaml:"groupBy"`
+}
+
+// batchManifest is the summary of a batch written along the query outputs.
+type batchManifest struct {
+	Batch   string              `json:"batch"`
+	Start   time.Time           `json:"start"`
+	Total   int64               `json:"totalMs"`
+	Queries []batchManifestItem `json:"queries"`
+}
+
+// batchManifestItem is the status of one query of the batch.
+type batchManifestItem struct {
+	Name    string `json:"name"`
+	QueryID string `json:"queryId,omitempty"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	File    string `json:"file,omitempty"`
+	// Duration is the time (in milliseconds) taken by the query seen by the client
+	Duration int64 `json:"durationMs"`
+}
+
+// batchManifestFile is the name of the manifest in the output directory.
+const batchManifestFile = "manifest.json"
+
+// batchQueryName restricts the query names to ones usable as file names.
+var batchQueryName = regexp.MustCompile("^[A-Za-z0-9_.-]+$")
+
+// readBatchFile reads a batch file, whose format is given by its extension (.toml, .json, .yaml or .yml).
+func readBatchFile(path string) (*batchFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := batchFile{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &batch)
+	case ".json":
+		err = json.Unmarshal(data, &batch)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &batch)
+	default:
+		return nil, errors.New("unknown batch file format " + filepath.Ext(path) + " (.toml, .json, .yaml or .yml)")
+	}
+	if err != nil {
+		return nil, errors.New("invalid batch file " + path + ": " + err.Error())
+	}
+
+	if len(batch.Queries) == 0 {
+		return nil, errors.New("no query in batch file " + path)
+	}
+	names := make(map[string]bool)
+	for i, q := range batch.Queries {
+		if !batchQueryName.MatchString(q.Name) {
+			return nil, errors.New("query " + strconv.Itoa(i) + " of " + path + " has an invalid name \"" + q.Name +
+				"\" (letters, digits, '_', '.' and '-' only)")
+		}
+		if names[q.Name] {
+			return nil, errors.New("query name " + q.Name + " is used twice in " + path)
+		}
+		names[q.Name] = true
+	}
+	return &batch, nil
+}
+
+// runBatchFromApp runs the queries of a batch file and writes their results in an output directory, with a manifest.
+func runBatchFromApp(c *cli.Context) error {
+	if c.NArg() != 1 {
+		err := errors.New("Wrong number of arguments (only the batch file is allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	batch, err := readBatchFile(c.Args().Get(0))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	format := c.String(optionFormat)
+	if format == "" {
+		format = formatCsv
+	}
+	if _, err := outputExtension(format); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	outDir := c.String(optionOutDir)
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	parallel := c.Int(optionParallel)
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	// all results are switched to the same key
+	keys := config.NewKeyPair(lib.CurrentSuite())
+	manifest := runBatch(el, batch, c.Args().Get(0), keys, queryOptionsFromApp(c), outDir, format, parallel)
+
+	failed := manifest.failed()
+	log.Lvl1(len(batch.Queries)-failed, "of", len(batch.Queries), "queries succeeded in", time.Since(manifest.Start))
+
+	if err := writeBatchManifest(outDir, manifest); err != nil {
+		log.Error("The manifest cannot be written: ", err)
+		return cli.NewExitError(err, 4)
+	}
+	if failed > 0 {
+		err := errors.New(strconv.Itoa(failed) + " of the " + strconv.Itoa(len(batch.Queries)) + " queries failed, see " +
+			filepath.Join(outDir, batchManifestFile))
+		log.Error(err)
+		return cli.NewExitError(err, 5)
+	}
+	return nil
+}
+
+// runBatch runs the queries of a batch, parallel at a time, and returns their manifest.
+func runBatch(el *onet.Roster, batch *batchFile, name string, keys *config.KeyPair, opts queryOptions, outDir, format string, parallel int) *batchManifest {
+	manifest := &batchManifest{Batch: name, Start: time.Now(), Queries: make([]batchManifestItem, len(batch.Queries))}
+	slots := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for i, q := range batch.Queries {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, q batchQuery) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			manifest.Queries[i] = runBatchQuery(el, q, keys, opts, outDir, format)
+		}(i, q)
+	}
+	wg.Wait()
+	manifest.Total = milliseconds(time.Since(manifest.Start))
+	return manifest
+}
+
+// failed returns the number of queries of the batch which failed.
+func (m *batchManifest) failed() int {
+	failed := 0
+	for _, item := range m.Queries {
+		if item.Status != "ok" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// writeBatchManifest writes the manifest of a batch in its output directory.
+func writeBatchManifest(outDir string, manifest *batchManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(outDir, batchManifestFile), append(data, '\n'), 0644)
+}
+
+// runBatchQuery runs a query of a batch and writes its output file.
+func runBatchQuery(el *onet.Roster, q batchQuery, keys *config.KeyPair, opts queryOptions, outDir, format string) batchManifestItem {
+	item := batchManifestItem{Name: q.Name}
+	start := time.Now()
+	client := newQueryClient(el, q.Name, keys, opts)
+
+	report, err := executeQuery(client, el, q.Locations, q.Times, q.Concepts, q.GroupBy)
+	if err == nil {
+		item.QueryID = report.QueryID
+		ext, _ := outputExtension(format)
+		item.File = filepath.Join(outDir, q.Name+"."+ext)
+		err = writeQueryReportFile(item.File, report, format)
+	}
+	item.Duration = milliseconds(time.Since(start))
+
+	if err != nil {
+		log.Error("Query ", q.Name, " failed: ", err)
+		item.Status = "failed"
+		item.Error = err.Error()
+		return item
+	}
+	item.Status = "ok"
+	return item
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// newTestRoster returns a roster of one server.
+func newTestRoster() *onet.Roster {
+	_, public := lib.GenKey()
+	return onet.NewRoster([]*network.ServerIdentity{network.NewServerIdentity(public,
+		network.NewTCPAddress("127.0.0.1:2000"))})
+}
+
+// stubExecuteQuery replaces the servers answering the queries: the count of each location is its length times 100,
+// decrypted as the servers' results are, and the queries of the concept "failing" fail. It returns the function
+// restoring executeQuery.
+func stubExecuteQuery() func() {
+	previous := executeQuery
+	executeQuery = func(client *serviceI2B2dc.API, servers *onet.Roster, locations, times, concepts, groupBy []string) (*queryReport, error) {
+		for _, c := range concepts {
+			if c == "failing" {
+				return nil, errors.New("Query could not be executed: failing concept")
+			}
+		}
+		secKey, pubKey := lib.GenKey()
+		result := &serviceI2B2dc.QueryResult{QueryID: serviceI2B2dc.QueryID(client.String())}
+		for _, l := range locations {
+			result.Groups = append(result.Groups, l)
+			result.Counts = append(result.Counts, lib.DecryptInt(secKey, *lib.EncryptInt(pubKey, int64(100*len(l)))))
+		}
+		return newQueryReport(servers, groupBy, result, 0), nil
+	}
+	return func() { executeQuery = previous }
+}
+
+func TestRunBatch(t *testing.T) {
+	defer stubExecuteQuery()()
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	batch := &batchFile{}
+	for i := 0; i < 8; i++ {
+		q := batchQuery{Name: "q" + strconv.Itoa(i), Locations: []string{"L" + strconv.Itoa(i*1000)},
+			Concepts: []string{"C1"}, GroupBy: []string{"location_cd"}}
+		if i == 5 {
+			q.Concepts = []string{"failing"}
+		}
+		batch.Queries = append(batch.Queries, q)
+	}
+
+	keys := config.NewKeyPair(lib.CurrentSuite())
+	manifest := runBatch(newTestRoster(), batch, "batch.toml", keys, queryOptions{}, dir, formatJSON, 4)
+	assert.Equal(t, 1, manifest.failed())
+	assert.NoError(t, writeBatchManifest(dir, manifest))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, batchManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := batchManifest{}
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "batch.toml", written.Batch)
+	if !assert.Len(t, written.Queries, len(batch.Queries)) {
+		return
+	}
+	for i, item := range written.Queries {
+		// the items are in the order of the batch file
+		assert.Equal(t, batch.Queries[i].Name, item.Name)
+		if i == 5 {
+			assert.Equal(t, "failed", item.Status)
+			assert.Equal(t, "Query could not be executed: failing concept", item.Error)
+			assert.Empty(t, item.File)
+			continue
+		}
+		assert.Equal(t, "ok", item.Status)
+		assert.Equal(t, "[Client-"+item.Name+"]", item.QueryID)
+		assert.Equal(t, filepath.Join(dir, item.Name+".json"), item.File)
+
+		report := queryReport{}
+		data, err := ioutil.ReadFile(item.File)
+		if assert.NoError(t, err) && assert.NoError(t, json.Unmarshal(data, &report)) && assert.Len(t, report.Groups, 1) {
+			assert.Equal(t, int64(100*len(batch.Queries[i].Locations[0])), report.Groups[0].Count)
+		}
+	}
+}
@@ -1,78 +1,128 @@
 package main
 
 import (
+	"io"
 	"os"
 
 	"regexp"
 	"strconv"
 	"strings"
 
-	"encoding/csv"
-
 	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
 	"github.com/JLRgithub/PrivateDCi2b2/services"
 	"github.com/btcsuite/goleveldb/leveldb/errors"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/app"
 	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 	"gopkg.in/urfave/cli.v1"
 )
 
 // BEGIN CLIENT: QUERIER ----------
-func startQuery(servers *onet.Roster, locations, times, concepts, groupBy []string, out string) {
 
+// queryOptions are the options of the queries sent to the servers.
+type queryOptions struct {
+	timeout     time.Duration
+	ksChunkSize int
+	ksParallel  bool
+	partial     bool
+}
+
+// newQueryClient creates a client sending queries with the given options to the first server of the roster.
+func newQueryClient(servers *onet.Roster, clientID string, keys *config.KeyPair, opts queryOptions) *serviceI2B2dc.API {
+	client := serviceI2B2dc.NewClientWithKeys(servers.List[0], clientID, keys)
+	client.Timeouts = serviceI2B2dc.ProtocolTimeouts{Aggregation: opts.timeout, KeySwitching: opts.timeout, Shuffling: opts.timeout}
+	client.KeySwitchingChunkSize = opts.ksChunkSize
+	client.ParallelKeySwitching = opts.ksParallel
+	client.PartialResults = opts.partial
+	return client
+}
+
+// executeQuery runs a query on the servers and returns its report. The tests of the commands running queries replace
+// it to do without servers.
+var executeQuery = func(client *serviceI2B2dc.API, servers *onet.Roster, locations, times, concepts, groupBy []string) (*queryReport, error) {
 	start := time.Now()
-	// create
-	client := serviceI2B2dc.NewClient(servers.List[0], strconv.Itoa(0))
 	queryID, err := client.SendQuery(servers, serviceI2B2dc.QueryID(""), nil, locations, times, concepts, groupBy)
 	if err != nil {
-		log.Fatal("Service did not start.", err)
+		return nil, errors.New("Service did not start: " + err.Error())
 	}
 
 	// execute query
-	grps, aggr, err := client.ExecuteQuery(*queryID)
+	result, err := client.ExecuteQueryResult(*queryID)
 	if err != nil {
-		log.Fatal("Query could not be executed.", err)
+		return nil, errors.New("Query could not be executed: " + err.Error())
 	}
 	end := time.Since(start)
 
-	// print output
-	log.Lvl1(client, "outputs query resuls: ", *grps, *aggr)
-
-	// save output in Csv file
-	// print output
-	log.Lvl1(client, "writes results to: ", out)
-	if out != "" {
-		csvOut, err := os.Create(out)
-		if err != nil {
-			log.Fatal(err)
+	log.Lvl1(client, "outputs query resuls: ", result.Groups, result.Counts)
+	if len(result.Contributors) < len(servers.List) {
+		log.Warn(client, " only ", len(result.Contributors), " of the ", len(servers.List), " servers contributed to the results:")
+		for _, si := range result.Contributors {
+			log.Warn("  ", si)
 		}
-		w := csv.NewWriter(csvOut)
-		defer csvOut.Close()
+	}
+	for _, m := range result.Misbehaving {
+		log.Warn(client, " ", m.Server, " sent a wrong contribution (excluded: ", m.Excluded, "): ", m.Reason)
+	}
+	log.Lvl1("Total query response time:", end)
+	return newQueryReport(servers, groupBy, result, end), nil
+}
 
-		//writing header with elements in the groupBy statement + totalnum
-		if len(groupBy) > 0 {
-			groupBy = append(groupBy, "totalnum")
-			err = w.Write(groupBy)
-			if err != nil {
-				log.Fatal("the output Csv file cannot be written", err)
-			}
-		}
+// writeQueryReportFile writes the report to a file (stdout if out is empty). A CSV file only holds the results, the
+// description of the query being written next to it (out + metadataExtension).
+func writeQueryReportFile(out string, report *queryReport, format string) error {
+	if out == "" {
+		return writeQueryReport(os.Stdout, report, format)
+	}
+	if err := writeReportFile(out, func(w io.Writer) error { return writeQueryReport(w, report, format) }); err != nil {
+		return err
+	}
+	if format == formatCsv {
+		return writeReportFile(out+metadataExtension, report.writeMetadata)
+	}
+	return nil
+}
 
-		var record []string
-		for i := 0; i < len(*grps); i++ {
-			record = strings.Split((*grps)[i], ",")
-			record = append(record, strconv.FormatInt((*aggr)[i], 10))
-			err = w.Write(record)
-			if err != nil {
-				log.Fatal("the output Csv file cannot be written", err)
-			}
-			w.Flush()
+// writeReportFile creates a file and writes it with write.
+func writeReportFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func startQuery(servers *onet.Roster, locations, times, concepts, groupBy []string, out, format string, keys *config.KeyPair, opts queryOptions) {
+	// the results are written to stdout as a table unless an output file is given (as csv by default)
+	if format == "" {
+		format = formatTable
+		if out != "" {
+			format = formatCsv
 		}
 	}
-	log.Lvl1("Total query response time:", end)
+	if _, err := outputExtension(format); err != nil {
+		log.Fatal(err)
+	}
+
+	client := newQueryClient(servers, strconv.Itoa(0), keys, opts)
+	report, err := executeQuery(client, servers, locations, times, concepts, groupBy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Lvl1(client, "writes results to: ", out)
+	if err := writeQueryReportFile(out, report, format); err != nil {
+		log.Fatal("the output cannot be written", err)
+	}
 }
 
 func runQuery(c *cli.Context) error {
@@ -111,11 +161,30 @@ func runQuery(c *cli.Context) error {
 		return err
 	}
 
-	startQuery(el, location, time, concept, groupBy, out)
+	// the key pair is read once the suite of the roster is known
+	keys, err := keyPairFromApp(c)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	startQuery(el, location, time, concept, groupBy, out, c.String(optionFormat), keys, queryOptionsFromApp(c))
 
 	return nil
 }
 
+// queryOptionsFromApp reads the query options of the command line.
+func queryOptionsFromApp(c *cli.Context) queryOptions {
+	return queryOptions{
+		timeout:     c.Duration(optionTimeout),
+		ksChunkSize: c.Int(optionKeySwitchingChunk),
+		ksParallel:  c.Bool(optionParallelKeySwitching),
+		partial:     c.Bool(optionPartialResults),
+	}
+}
+
+// openGroupToml reads the roster of a group file. The servers only use the suite of their identities: a group file
+// cannot choose another one, and --suite only applies to the local commands.
 func openGroupToml(tomlFileName string) (*onet.Roster, error) {
 	f, err := os.Open(tomlFileName)
 	if err != nil {
@@ -130,9 +199,40 @@ func openGroupToml(tomlFileName string) (*onet.Roster, error) {
 		return nil, errors.New("Empty or invalid unlynx group file:" + tomlFileName)
 	}
 
+	// group files written for a per-roster suite are refused rather than read with another suite than they say
+	group := groupSuite{}
+	if _, err := toml.DecodeFile(tomlFileName, &group); err != nil {
+		return nil, err
+	}
+	if group.Suite != "" && group.Suite != network.Suite.String() {
+		return nil, errors.New("group file " + tomlFileName + " sets Suite = \"" + group.Suite + "\" but the servers " +
+			"only use the " + network.Suite.String() + " suite (remove the key)")
+	}
+	// the secret contribution of a server to the collective key is the private key of its identity
+	if lib.CurrentSuite().String() != network.Suite.String() {
+		return nil, errors.New("the servers of " + tomlFileName + " only use the " + network.Suite.String() +
+			" suite, not " + lib.CurrentSuite().String() + " (--" + optionSuite + " only applies to the local commands)")
+	}
+
 	return el, nil
 }
 
+// groupSuite is the Suite key of the group files written when a roster could choose its suite.
+type groupSuite struct {
+	Suite string
+}
+
+// rosterAggregateKey returns the aggregate of the public keys of the roster, the collective key of the servers which
+// hold no threshold key.
+func rosterAggregateKey(el *onet.Roster) (abstract.Point, error) {
+	// the aggregate is computed from the servers' identities which always use the network suite
+	if lib.CurrentSuite().String() != network.Suite.String() {
+		return nil, errors.New("the roster's collective key is a " + network.Suite.String() + " key, a " +
+			lib.CurrentSuite().String() + " public key has to be given with --" + optionEncryptKey)
+	}
+	return el.Aggregate, nil
+}
+
 func checkRegex(input, expression, errorMessage string) {
 	var aux = regexp.MustCompile(expression)
 
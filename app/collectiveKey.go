@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// dkgFromApp generates a threshold collective key with the servers of the group and prints it on stdout.
+func dkgFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	threshold := c.Int(optionThreshold)
+	if threshold == 0 {
+		threshold = len(el.List)
+	}
+
+	// the request is signed with the key of the administrator
+	keys, err := keyPairFromApp(c)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	client := serviceI2B2dc.NewClientWithKeys(el.List[0], strconv.Itoa(0), keys)
+	resp, err := client.GenerateThresholdKey(el, threshold, c.Bool(optionOverwrite))
+	if err != nil {
+		log.Error("Key generation failed: ", err)
+		return cli.NewExitError(err, 4)
+	}
+	return printCollectiveKey(resp)
+}
+
+// rotateKeyFromApp moves the data of the servers of the group to a new threshold collective key and prints it on
+// stdout.
+func rotateKeyFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	threshold := c.Int(optionThreshold)
+	if threshold == 0 {
+		threshold = len(el.List)
+	}
+
+	// the request is signed with the key of the administrator
+	keys, err := keyPairFromApp(c)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	client := serviceI2B2dc.NewClientWithKeys(el.List[0], strconv.Itoa(0), keys)
+	resp, err := client.RotateCollectiveKey(el, threshold, c.Duration(optionTimeout))
+	if err != nil {
+		log.Error("Key rotation failed: ", err)
+		return cli.NewExitError(err, 4)
+	}
+	return printCollectiveKey(resp)
+}
+
+// collectiveKeyFromApp prints the threshold collective key of the group on stdout.
+func collectiveKeyFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	client := serviceI2B2dc.NewClient(el.List[0], strconv.Itoa(0))
+	resp, err := client.GetCollectiveKey()
+	if err != nil {
+		log.Error("Could not get the collective key: ", err)
+		return cli.NewExitError(err, 4)
+	}
+	return printCollectiveKey(resp)
+}
+
+// printCollectiveKey writes the serialized key on stdout so that it can be redirected to a key file
+func printCollectiveKey(resp *serviceI2B2dc.CollectiveKeyResponse) error {
+	log.Lvl1("Collective key usable by any", resp.T, "of the", resp.N, "servers")
+	if _, err := io.WriteString(os.Stdout, resp.CollectiveKey+"\n"); err != nil {
+		log.Error("Error while writing result.", err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
@@ -4,13 +4,13 @@ import (
 	"encoding/csv"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/urfave/cli.v1"
 )
@@ -21,7 +21,6 @@ func decryptCsvFileFromApp(c *cli.Context) error {
 	csvFileInPath := c.String("csvIn")
 	csvFileOutPath := c.String("csvOut")
 	attributeToEncrypt := c.String("attribute")
-	keyFilePath := c.String("key")
 
 	//check that the number of arguments is 0
 	if c.NArg() != 0 {
@@ -30,8 +29,14 @@ func decryptCsvFileFromApp(c *cli.Context) error {
 		return cli.NewExitError(err, 3)
 	}
 
+	secKey, err := privateKeyFromApp(c)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
 	start := time.Now()
-	err := decryptCsvFile(&csvFileInPath, &csvFileOutPath, &attributeToEncrypt, &keyFilePath)
+	err = decryptCsvFile(&csvFileInPath, &csvFileOutPath, &attributeToEncrypt, secKey)
 	if err != nil {
 		log.Error(err)
 		return cli.NewExitError(err, 3)
@@ -41,7 +46,7 @@ func decryptCsvFileFromApp(c *cli.Context) error {
 	return nil
 }
 
-func decryptCsvFile(inPath, outPath, attribute, key *string) error {
+func decryptCsvFile(inPath, outPath, attribute *string, secKey abstract.Scalar) error {
 	//setup reader
 	csvIn, err := os.Open(*inPath)
 	if err != nil {
@@ -60,14 +65,6 @@ func decryptCsvFile(inPath, outPath, attribute, key *string) error {
 	w := csv.NewWriter(csvOut)
 	defer csvOut.Close()
 
-	//setup public key for encryption
-	b, err := ioutil.ReadFile(*key)
-	secKey, err := lib.DeserializeScalar(string(b))
-	if err != nil {
-		log.Error(err)
-		return cli.NewExitError(err, 4)
-	}
-
 	//read and write header
 	rec, err := r.Read()
 	if err != nil {
@@ -82,8 +79,17 @@ func decryptCsvFile(inPath, outPath, attribute, key *string) error {
 		return cli.NewExitError(err, 4)
 	}
 
-	//loop over records
-	for {
+	listAttributes := strings.Split(*attribute, ",")
+	for _, a := range listAttributes {
+		if _, ok := headerMap[a]; !ok {
+			err := errors.New("attribute " + a + " is not in the header of " + *inPath)
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+	}
+
+	//loop over records (the header is on line 1)
+	for line := 2; ; line++ {
 		// read record
 		rec, err = r.Read()
 		if err != nil {
@@ -94,9 +100,14 @@ func decryptCsvFile(inPath, outPath, attribute, key *string) error {
 			return cli.NewExitError(err, 4)
 		}
 		// decrypt record's fields corresponding to the input attributes
-		listAttributes := strings.Split(*attribute, ",")
 		for i := 0; i < len(listAttributes); i++ {
-			toDecrypt := lib.NewCipherTextFromBase64(rec[headerMap[listAttributes[i]]])
+			toDecrypt, err := lib.NewCipherTextFromBase64(rec[headerMap[listAttributes[i]]])
+			if err != nil {
+				err = errors.New("invalid ciphertext in " + *inPath + " at line " + strconv.Itoa(line) + ", column " +
+					listAttributes[i] + ": " + err.Error())
+				log.Error(err)
+				return cli.NewExitError(err, 4)
+			}
 			decVal := lib.DecryptInt(secKey, *toDecrypt)
 			rec[headerMap[listAttributes[i]]] = strconv.FormatInt(decVal, 10)
 		}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/csv"
 	"errors"
 	"io"
-	"io/ioutil"
+	"math"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,32 +20,24 @@ import (
 	"gopkg.in/urfave/cli.v1"
 )
 
+// policies for the empty (or NULL) values of the encrypted attributes (an empty value cannot be left in the output:
+// the servers could not aggregate it)
+const (
+	emptyError = "error"
+	emptyZero  = "zero"
+	emptySkip  = "skip"
+)
+
 func encryptCsvFileFromApp(c *cli.Context) error {
 
 	//cli arguments
 	csvFileInPath := c.String("csvIn")
 	csvFileOutPath := c.String("csvOut")
-	attributeToEncrypt := c.String("attribute")
-	keyFilePath := c.String("key")
-	serversFilePath := c.String("file")
+	rangeBits := c.Int(optionRangeBits)
+	padTo := c.Int(optionPadTo)
 
-	var encryptionKey abstract.Point
-
-	if serversFilePath != "" && keyFilePath == "" {
-		el, err := openGroupToml(serversFilePath)
-		if err != nil {
-			return cli.NewExitError(err, 4)
-		}
-		encryptionKey = el.Aggregate
-	} else if serversFilePath == "" && keyFilePath != "" {
-		b, err := ioutil.ReadFile(keyFilePath)
-		encryptionKey, err = lib.DeserializePoint(string(b))
-		if err != nil {
-			log.Error(err)
-			return cli.NewExitError(err, 4)
-		}
-	} else {
-		err := errors.New("Key Error")
+	encryptionKey, err := encryptionKeyFromApp(c)
+	if err != nil {
 		log.Error(err)
 		return cli.NewExitError(err, 4)
 	}
@@ -53,82 +49,554 @@ func encryptCsvFileFromApp(c *cli.Context) error {
 		return cli.NewExitError(err, 3)
 	}
 
-	start := time.Now()
-	err := encryptCsvFile(&csvFileInPath, &csvFileOutPath, &attributeToEncrypt, &encryptionKey)
+	if csvFileInPath == "" || csvFileOutPath == "" {
+		err := errors.New("the input and output files have to be given with --" + optionCsvFileIn + " and --" +
+			optionCsvFileOut)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	attributes, err := parseCsvAttributes(c.String("attribute"))
 	if err != nil {
 		log.Error(err)
 		return cli.NewExitError(err, 3)
 	}
+
+	if rangeBits < 0 || rangeBits > lib.MaxRangeProofBits {
+		err := errors.New("rangeBits must be between 0 and " + strconv.Itoa(lib.MaxRangeProofBits))
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	if padTo < 0 {
+		err := errors.New("padTo must be positive")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	emptyValues := c.String(optionEmptyValues)
+	switch emptyValues {
+	case emptyError, emptyZero, emptySkip:
+	default:
+		err := errors.New("unknown policy " + emptyValues + " for the empty values (" + emptyError + ", " + emptyZero +
+			" or " + emptySkip + ")")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	// the positions of the dummies are not saved, a padded encryption cannot be resumed
+	checkpointEvery := c.Int(optionCheckpoint)
+	if padTo > 0 {
+		if c.Bool(optionResume) {
+			err := errors.New("an encryption with --" + optionPadTo + " cannot be resumed")
+			log.Error(err)
+			return cli.NewExitError(err, 3)
+		}
+		checkpointEvery = 0
+	}
+
+	enc := &csvEncryption{
+		inPath:          csvFileInPath,
+		outPath:         csvFileOutPath,
+		attributes:      attributes,
+		pubKey:          encryptionKey,
+		rangeBits:       rangeBits,
+		padTo:           padTo,
+		emptyValues:     emptyValues,
+		checkpointEvery: checkpointEvery,
+		resume:          c.Bool(optionResume),
+	}
+
+	start := time.Now()
+	if err := enc.run(); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
 	log.LLvl1("Encryption time: ", time.Since(start))
 
 	return nil
 }
 
-func encryptCsvFile(inPath, outPath, attribute *string, pubKey *abstract.Point) error {
+// encryptionKeyFromApp returns the public key given with --key or --keyName, or the collective key of the servers of
+// the group file given with --file: their threshold collective key if they hold one (see rosterCollectiveKey).
+func encryptionKeyFromApp(c *cli.Context) (abstract.Point, error) {
+	serversFilePath := c.String(optionGroupFile)
+	encryptionKey, err := publicKeyFromApp(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if serversFilePath != "" && encryptionKey == nil {
+		el, err := openGroupToml(serversFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return rosterCollectiveKey(el)
+	} else if serversFilePath != "" || encryptionKey == nil {
+		return nil, errors.New("Key Error: give either the group file or a public key (--" + optionEncryptKey +
+			" or --" + optionKeyName + ")")
+	}
+	return encryptionKey, nil
+}
+
+// parseCsvAttributes reads the comma-separated names of the attributes to encrypt.
+func parseCsvAttributes(list string) ([]string, error) {
+	var attributes []string
+	seen := make(map[string]bool)
+	for _, a := range strings.Split(list, ",") {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			return nil, errors.New("empty attribute name in \"" + list + "\" (--" + attributeToEncrypt + ")")
+		}
+		if seen[a] {
+			return nil, errors.New("attribute " + a + " is given twice")
+		}
+		seen[a] = true
+		attributes = append(attributes, a)
+	}
+	return attributes, nil
+}
+
+// rangeProofColumn is the name of the column holding the range proofs of an encrypted attribute
+func rangeProofColumn(attribute string) string {
+	return attribute + "_range_proof"
+}
+
+// csvEncryption is the encryption of attributes of a CSV file, compressed with gzip if its name ends with .gz (the
+// output as well). The output is written to a partial file (<output>.part) renamed at the end. Every checkpointEvery
+// records, the progress is saved (<output>.checkpoint) so that an interrupted encryption can be resumed.
+// If rangeBits > 0, a range proof column is appended for each attribute, proving that the encrypted value is in
+// [0, 2^rangeBits).
+// If padTo is larger than the number of records, dummy records are inserted at random positions until the output holds
+// padTo records. Each clear value of a dummy is drawn at random among the values of its column (its domain), so that a
+// dummy is not the copy of a real record, and the dummy encrypts 0 for each attribute, so that it never changes a total.
+type csvEncryption struct {
+	inPath, outPath string
+	attributes      []string
+	pubKey          abstract.Point
+	rangeBits       int
+	padTo           int
+	// emptyValues is the policy for the empty (or NULL) values of the attributes
+	emptyValues     string
+	checkpointEvery int
+	resume          bool
+
+	headerMap map[string]int
+}
+
+// run encrypts the file.
+func (e *csvEncryption) run() error {
+	// a first pass counts the records and reads the domains the values of the dummies are drawn from
+	var dummySlots []bool
+	var domains [][]string
+	if e.padTo > 0 {
+		nbrRecords, columns, err := csvDomains(e.inPath)
+		if err != nil {
+			return err
+		}
+		if nbrRecords > e.padTo {
+			log.Lvl1("CSV file already holds", nbrRecords, "records (more than", e.padTo, "), no dummy is added")
+		} else if nbrRecords == 0 {
+			return errors.New("cannot pad a CSV file without records")
+		} else {
+			if dummySlots, err = randomSlots(e.padTo, e.padTo-nbrRecords); err != nil {
+				return err
+			}
+			domains = columns
+		}
+	}
+
 	//setup reader
-	csvIn, err := os.Open(*inPath)
+	csvIn, err := openCsvInput(e.inPath)
 	if err != nil {
-		log.Fatal(err)
-		return cli.NewExitError(err, 4)
+		return err
 	}
-	r := csv.NewReader(csvIn)
 	defer csvIn.Close()
+	r := csv.NewReader(csvIn)
 
-	//setup writer
-	csvOut, err := os.Create(*outPath)
+	//read header and check the attributes before anything is written
+	header, err := r.Read()
 	if err != nil {
-		log.Fatal(err)
-		return cli.NewExitError(err, 4)
+		return errors.New("cannot read the header of " + e.inPath + ": " + err.Error())
+	}
+	if err := e.checkHeader(header); err != nil {
+		return err
+	}
+	for _, a := range e.attributes {
+		if e.rangeBits > 0 {
+			header = append(header, rangeProofColumn(a))
+		}
 	}
-	w := csv.NewWriter(csvOut)
-	defer csvOut.Close()
 
-	//read and write header
-	rec, err := r.Read()
+	partPath, checkpointPath := e.outPath+".part", e.outPath+".checkpoint"
+	current, err := e.newCheckpoint()
 	if err != nil {
-		log.Fatal(err)
-		return cli.NewExitError(err, 4)
+		return err
+	}
+	var checkpoint *csvCheckpoint
+	if e.checkpointEvery > 0 {
+		checkpoint = current
+	}
+	var skip, offset int64
+	if e.resume {
+		saved, err := loadCsvCheckpoint(checkpointPath)
+		if err != nil {
+			return err
+		}
+		if saved == nil {
+			log.Lvl1("No checkpoint", checkpointPath, "found, the encryption starts from the beginning")
+		} else if !saved.sameEncryption(current) {
+			return errors.New("checkpoint " + checkpointPath + " was saved by another encryption (input file or " +
+				"parameters differ), remove it to start again")
+		} else {
+			skip, offset = saved.Records, saved.Offset
+			log.Lvl1("Resuming the encryption after", skip, "records")
+		}
 	}
 
-	headerMap := convertSliceToMap(&rec)
+	//setup writer
+	out, err := newCsvOutput(partPath, isGzip(e.outPath), offset)
+	if err != nil {
+		return err
+	}
+	// an interrupted encryption can be resumed from its last checkpoint, an invalid input has to be fixed first
+	fail := func(err error) error {
+		out.file.Close()
+		if checkpoint == nil {
+			os.Remove(partPath)
+		} else {
+			log.Error("Encryption stopped, the same command with --" + optionResume + " goes on from the last checkpoint")
+		}
+		return err
+	}
+	invalid := func(err error) error {
+		out.file.Close()
+		os.Remove(partPath)
+		os.Remove(checkpointPath)
+		return err
+	}
+	if offset == 0 {
+		if err := out.Write(header); err != nil {
+			return fail(err)
+		}
+	}
 
-	if err = w.Write(rec); err != nil {
-		log.Fatal(err)
-		return cli.NewExitError(err, 4)
+	// the records already encrypted are only read
+	line := 1
+	for records := int64(0); records < skip; records++ {
+		if _, err := r.Read(); err != nil {
+			return fail(errors.New("cannot skip the " + strconv.FormatInt(skip, 10) + " records already encrypted: " +
+				err.Error()))
+		}
+		line++
+	}
+
+	// writeDummies writes the dummy records of the next slots until a real record is expected
+	slot := 0
+	writeDummies := func() error {
+		for ; slot < len(dummySlots) && dummySlots[slot]; slot++ {
+			dummy, err := randomRecord(domains)
+			if err != nil {
+				return err
+			}
+			for _, a := range e.attributes {
+				dummy[e.headerMap[a]] = "0"
+			}
+			dummy, _, err = e.encryptRecord(dummy, 0)
+			if err != nil {
+				return err
+			}
+			if err := out.Write(dummy); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	//loop over records
+	records, skipped := skip, 0
 	for {
+		if err = writeDummies(); err != nil {
+			return fail(err)
+		}
+
 		// read record
-		rec, err = r.Read()
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			return invalid(err)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		line++
+
+		rec, keep, err := e.encryptRecord(rec, line)
+		if err != nil {
+			return invalid(err)
+		}
+		if keep {
+			err = out.Write(rec)
+		} else {
+			skipped++
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
+			return fail(err)
+		}
+		records++
+		slot++
+
+		if checkpoint != nil && records%int64(e.checkpointEvery) == 0 {
+			if checkpoint.Offset, err = out.checkpoint(); err != nil {
+				return fail(err)
+			}
+			checkpoint.Records = records
+			if err := checkpoint.save(checkpointPath); err != nil {
+				return fail(err)
 			}
-			log.Fatal(err)
-			return cli.NewExitError(err, 4)
+			log.Lvl1("Encrypted", records, "records")
 		}
-		// encrypt record's fields corresponding to the input attributes
-		listAttributes := strings.Split(*attribute, ",")
-		for i := 0; i < len(listAttributes); i++ {
-			toEncryptInt, err := strconv.ParseInt(rec[headerMap[listAttributes[i]]], 10, 64)
-			if err != nil {
-				log.Error(err)
-				return cli.NewExitError(err, 4)
+	}
+	if skipped > 0 {
+		log.Lvl1(skipped, "records with empty values were skipped")
+	}
+
+	if err := out.Close(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(partPath, e.outPath); err != nil {
+		return err
+	}
+	if err := os.Remove(checkpointPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// checkHeader checks that each attribute is exactly once in the header and has no range proof column yet.
+func (e *csvEncryption) checkHeader(header []string) error {
+	e.headerMap = convertSliceToMap(&header)
+	count := make(map[string]int)
+	for _, h := range header {
+		count[h]++
+	}
+	for _, a := range e.attributes {
+		switch {
+		case count[a] == 0:
+			return errors.New("attribute " + a + " is not in the CSV header")
+		case count[a] > 1:
+			return errors.New("attribute " + a + " is " + strconv.Itoa(count[a]) + " times in the CSV header")
+		case e.rangeBits > 0 && count[rangeProofColumn(a)] > 0:
+			return errors.New("the CSV header already has a " + rangeProofColumn(a) + " column")
+		}
+	}
+	return nil
+}
+
+// newCheckpoint returns a checkpoint of this encryption before any record is encrypted.
+func (e *csvEncryption) newCheckpoint() (*csvCheckpoint, error) {
+	info, err := os.Stat(e.inPath)
+	if err != nil {
+		return nil, err
+	}
+	input, err := filepath.Abs(e.inPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := lib.SerializePoint(e.pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return &csvCheckpoint{Input: input, InputSize: info.Size(), InputModified: info.ModTime(),
+		Attributes: e.attributes, Key: key, RangeBits: e.rangeBits, EmptyValues: e.emptyValues}, nil
+}
+
+// encryptRecord encrypts the attributes of a record (appending their range proofs if rangeBits > 0). It returns false
+// if the record has to be skipped (empty value with the skip policy). line is the line of the record in the input
+// file, 0 for a dummy.
+func (e *csvEncryption) encryptRecord(rec []string, line int) ([]string, bool, error) {
+	where := func(a string) string {
+		if line == 0 {
+			return "attribute " + a + " of a dummy record"
+		}
+		return "attribute " + a + " in line " + strconv.Itoa(line)
+	}
+
+	// encrypt record's fields corresponding to the input attributes
+	for _, a := range e.attributes {
+		i := e.headerMap[a]
+		value := strings.TrimSpace(rec[i])
+		if isEmptyValue(value) {
+			switch e.emptyValues {
+			case emptySkip:
+				return nil, false, nil
+			case emptyZero:
+				value = "0"
+			default:
+				return nil, false, errors.New("empty value for " + where(a) + " (see --" + optionEmptyValues + ")")
 			}
-			encryptedInt := lib.EncryptInt(*pubKey, toEncryptInt)
-			rec[headerMap[listAttributes[i]]] = (*encryptedInt).Serialize()
 		}
-		// write record
-		if err = w.Write(rec); err != nil {
-			log.Fatal(err)
-			return cli.NewExitError(err, 4)
+
+		toEncryptInt, err := parseCount(value)
+		if err != nil {
+			return nil, false, errors.New(where(a) + ": " + err.Error())
+		}
+		if e.rangeBits == 0 {
+			encryptedInt := lib.EncryptInt(e.pubKey, toEncryptInt)
+			rec[i] = (*encryptedInt).Serialize()
+			continue
+		}
+
+		encryptedInt, proof, err := lib.EncryptIntWithRangeProof(e.pubKey, toEncryptInt, e.rangeBits)
+		if err != nil {
+			return nil, false, errors.New(where(a) + ": " + err.Error())
+		}
+		serializedProof, err := proof.Serialize()
+		if err != nil {
+			return nil, false, err
 		}
-		w.Flush()
+		rec[i] = (*encryptedInt).Serialize()
+		rec = append(rec, serializedProof)
 	}
+	return rec, true, nil
+}
 
-	return nil
+// isEmptyValue tells whether a value is missing: empty, or NULL as exported by databases.
+func isEmptyValue(value string) bool {
+	return value == "" || strings.EqualFold(value, "null") || value == `\N`
+}
 
+// parseCount reads a non-negative integer. The decimal notation of integers used by i2b2 for numeric values
+// (e.g. 12.00000) is accepted.
+func parseCount(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		f, errF := strconv.ParseFloat(value, 64)
+		if errF != nil || f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return 0, errors.New(value + " is not an integer")
+		}
+		n = int64(f)
+	}
+	// the decryption only finds non-negative values
+	if n < 0 {
+		return 0, errors.New("negative value " + value + " cannot be encrypted")
+	}
+	return n, nil
+}
+
+// countCsvRecords counts the records of a CSV file (without its header)
+func countCsvRecords(path string) (int, error) {
+	csvIn, err := openCsvInput(path)
+	if err != nil {
+		return 0, err
+	}
+	defer csvIn.Close()
+	r := csv.NewReader(csvIn)
+
+	if _, err := r.Read(); err != nil {
+		return 0, err
+	}
+	nbrRecords := 0
+	for {
+		if _, err := r.Read(); err == io.EOF {
+			return nbrRecords, nil
+		} else if err != nil {
+			return 0, err
+		}
+		nbrRecords++
+	}
+}
+
+// csvDomains counts the records of a CSV file (without its header) and returns the distinct values of each of its
+// columns, sorted
+func csvDomains(path string) (int, [][]string, error) {
+	csvIn, err := openCsvInput(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer csvIn.Close()
+	r := csv.NewReader(csvIn)
+
+	header, err := r.Read()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	seen := make([]map[string]bool, len(header))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+	nbrRecords := 0
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		nbrRecords++
+		for i, value := range rec {
+			seen[i][value] = true
+		}
+	}
+
+	domains := make([][]string, len(header))
+	for i, values := range seen {
+		for value := range values {
+			domains[i] = append(domains[i], value)
+		}
+		sort.Strings(domains[i])
+	}
+	return nbrRecords, domains, nil
+}
+
+// randomRecord returns a record whose values are drawn independently and uniformly from the domain of their column
+func randomRecord(domains [][]string) ([]string, error) {
+	rec := make([]string, len(domains))
+	for i, domain := range domains {
+		if len(domain) == 0 {
+			continue
+		}
+		j, err := randomIndex(len(domain))
+		if err != nil {
+			return nil, err
+		}
+		rec[i] = domain[j]
+	}
+	return rec, nil
+}
+
+// randomSlots returns a list of nbrSlots booleans where nbrChosen of them, picked uniformly at random, are true
+func randomSlots(nbrSlots, nbrChosen int) ([]bool, error) {
+	slots := make([]bool, nbrSlots)
+	perm := make([]int, nbrSlots)
+	for i := range perm {
+		perm[i] = i
+	}
+	// partial Fisher-Yates shuffle
+	for i := 0; i < nbrChosen; i++ {
+		j, err := randomIndex(nbrSlots - i)
+		if err != nil {
+			return nil, err
+		}
+		j += i
+		perm[i], perm[j] = perm[j], perm[i]
+		slots[perm[i]] = true
+	}
+	return slots, nil
+}
+
+// randomIndex returns a uniformly random integer in [0, n) drawn from a cryptographically secure source, so that the
+// position and the values of the dummies cannot be guessed
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, errors.New("cannot draw a random number: " + err.Error())
+	}
+	return int(i.Int64()), nil
 }
 
 func convertSliceToMap(s *[]string) map[string]int {
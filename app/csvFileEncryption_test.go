@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// writeTestCsv writes a CSV file in a temporary directory and returns its path.
+func writeTestCsv(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readTestCsv reads all the records of a CSV file.
+func readTestCsv(t *testing.T, path string) [][]string {
+	f, err := openCsvInput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// decryptTestCount decrypts an encrypted cell.
+func decryptTestCount(t *testing.T, secKey abstract.Scalar, cell string) int64 {
+	ct, err := lib.NewCipherTextFromBase64(cell)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lib.DecryptInt(secKey, *ct)
+}
+
+func TestCsvPadding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeTestCsv(t, dir, "in.csv", "location,concept,count\nL1,C1,3\nL2,C2,4\nL2,C3,5\n")
+	out := filepath.Join(dir, "out.csv")
+	secKey, pubKey := lib.GenKey()
+	enc := &csvEncryption{inPath: in, outPath: out, attributes: []string{"count"}, pubKey: pubKey, padTo: 10,
+		emptyValues: emptyError}
+	assert.Nil(t, enc.run())
+
+	records := readTestCsv(t, out)
+	assert.Equal(t, []string{"location", "concept", "count"}, records[0])
+	assert.Equal(t, 11, len(records))
+
+	// the dummies take their values in the domains of the columns and never change the total
+	locations := map[string]bool{"L1": true, "L2": true}
+	concepts := map[string]bool{"C1": true, "C2": true, "C3": true}
+	total, zeros := int64(0), 0
+	for _, rec := range records[1:] {
+		assert.True(t, locations[rec[0]], "unexpected location "+rec[0])
+		assert.True(t, concepts[rec[1]], "unexpected concept "+rec[1])
+		count := decryptTestCount(t, secKey, rec[2])
+		total += count
+		if count == 0 {
+			zeros++
+		}
+	}
+	assert.Equal(t, int64(12), total)
+	assert.Equal(t, 7, zeros)
+
+	_, err = os.Stat(out + ".part")
+	assert.True(t, os.IsNotExist(err))
+
+	// a file holding more records than padTo is not padded
+	enc.padTo = 2
+	assert.Nil(t, enc.run())
+	assert.Equal(t, 4, len(readTestCsv(t, out)))
+}
+
+func TestRandomSlots(t *testing.T) {
+	slots, err := randomSlots(20, 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 20, len(slots))
+	chosen := 0
+	for _, s := range slots {
+		if s {
+			chosen++
+		}
+	}
+	assert.Equal(t, 7, chosen)
+}
+
+// writeTestGzip writes a gzip-compressed CSV file in a temporary directory and returns its path.
+func writeTestGzip(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	out, err := newCsvOutput(path, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(content)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		assert.Nil(t, out.Write(rec))
+	}
+	assert.Nil(t, out.Close())
+	return path
+}
+
+// assertNoPartialFiles checks that an encryption left neither its partial output nor its checkpoint.
+func assertNoPartialFiles(t *testing.T, out string) {
+	for _, path := range []string{out + ".part", out + ".checkpoint"} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path+" was left")
+	}
+}
+
+func TestCsvResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := "concept,count\nC1,1\nC2,2\nC3,3\nC4,4\nC5,5\n"
+	for _, names := range [][2]string{{"in.csv", "out.csv"}, {"in.csv.gz", "out.csv.gz"}} {
+		var in string
+		if isGzip(names[0]) {
+			in = writeTestGzip(t, dir, names[0], content)
+		} else {
+			in = writeTestCsv(t, dir, names[0], content)
+		}
+		out := filepath.Join(dir, names[1])
+		secKey, pubKey := lib.GenKey()
+		enc := &csvEncryption{inPath: in, outPath: out, attributes: []string{"count"}, pubKey: pubKey,
+			emptyValues: emptyError, checkpointEvery: 2}
+		assert.Nil(t, enc.run())
+		complete := readTestCsv(t, out)
+		assert.Equal(t, 6, len(complete))
+		assertNoPartialFiles(t, out)
+
+		// an encryption interrupted after a checkpoint of 2 records, while it was writing the third one
+		part, err := newCsvOutput(out+".part", isGzip(out), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range complete[:3] {
+			assert.Nil(t, part.Write(rec))
+		}
+		offset, err := part.checkpoint()
+		assert.Nil(t, err)
+		assert.Nil(t, part.Write([]string{"C3", "partially written"}))
+		assert.Nil(t, part.Close())
+		checkpoint, err := enc.newCheckpoint()
+		assert.Nil(t, err)
+		checkpoint.Records, checkpoint.Offset = 2, offset
+		assert.Nil(t, checkpoint.save(out+".checkpoint"))
+		assert.Nil(t, os.Remove(out))
+
+		// a checkpoint of another encryption is refused
+		other := *enc
+		_, other.pubKey = lib.GenKey()
+		other.resume = true
+		assert.NotNil(t, other.run())
+
+		// the resumed encryption keeps the records of the checkpoint and encrypts the others
+		enc.resume = true
+		assert.Nil(t, enc.run())
+		resumed := readTestCsv(t, out)
+		assert.Equal(t, complete[:3], resumed[:3])
+		assert.Equal(t, 6, len(resumed))
+		for i, rec := range resumed[1:] {
+			assert.Equal(t, "C"+strconv.Itoa(i+1), rec[0])
+			assert.Equal(t, int64(i+1), decryptTestCount(t, secKey, rec[1]))
+		}
+		assertNoPartialFiles(t, out)
+	}
+}
+
+func TestCsvEmptyValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	in := writeTestCsv(t, dir, "in.csv", "concept,count\nC1,1\nC2,\nC3,NULL\nC4,\\N\nC5,5\n")
+	out := filepath.Join(dir, "out.csv")
+	secKey, pubKey := lib.GenKey()
+	enc := &csvEncryption{inPath: in, outPath: out, attributes: []string{"count"}, pubKey: pubKey, checkpointEvery: 2}
+
+	// an empty value is an error by default: nothing is written and there is nothing to resume
+	enc.emptyValues = emptyError
+	assert.NotNil(t, enc.run())
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+	assertNoPartialFiles(t, out)
+
+	enc.emptyValues = emptyZero
+	assert.Nil(t, enc.run())
+	var counts []int64
+	for _, rec := range readTestCsv(t, out)[1:] {
+		counts = append(counts, decryptTestCount(t, secKey, rec[1]))
+	}
+	assert.Equal(t, []int64{1, 0, 0, 0, 5}, counts)
+
+	enc.emptyValues = emptySkip
+	assert.Nil(t, enc.run())
+	records := readTestCsv(t, out)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "C1", records[1][0])
+	assert.Equal(t, "C5", records[2][0])
+}
+
+func TestCsvInvalidInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a failed encryption leaves the previous output as it was
+	out := writeTestCsv(t, dir, "out.csv", "previous output\n")
+	_, pubKey := lib.GenKey()
+	for _, content := range []string{"concept,count\nC1,1\nC2,2\nC3,-3\n", "concept,count\nC1,1\nC2,2\nC3,\"3\n"} {
+		in := writeTestCsv(t, dir, "in.csv", content)
+		enc := &csvEncryption{inPath: in, outPath: out, attributes: []string{"count"}, pubKey: pubKey,
+			emptyValues: emptyError, checkpointEvery: 1}
+		assert.NotNil(t, enc.run())
+		assertNoPartialFiles(t, out)
+		data, err := ioutil.ReadFile(out)
+		assert.Nil(t, err)
+		assert.Equal(t, "previous output\n", string(data))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// isGzip tells whether a CSV file is (to be) compressed, from its name.
+func isGzip(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ".gz")
+}
+
+// gzipFile decompresses a file while it is read.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+// Close closes the decompressor and the file.
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openCsvInput opens a CSV file, decompressing it if its name ends with .gz.
+func openCsvInput(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !isGzip(path) {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, errors.New(path + " is not a gzip file: " + err.Error())
+	}
+	return &gzipFile{Reader: gz, file: f}, nil
+}
+
+// csvOutput writes CSV records to a partial file, compressed if compress is set. At each checkpoint, all the records
+// written so far are on the disk and the partial file can be truncated to the returned size to resume the writing.
+type csvOutput struct {
+	file *os.File
+	buf  *bufio.Writer
+	gz   *gzip.Writer
+	w    *csv.Writer
+}
+
+// newCsvOutput opens a partial file and truncates it at offset (0 starts a new file).
+func newCsvOutput(path string, compress bool, offset int64) (*csvOutput, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	out := &csvOutput{file: f, buf: bufio.NewWriterSize(f, 1<<20)}
+	if compress {
+		out.gz = gzip.NewWriter(out.buf)
+		out.w = csv.NewWriter(out.gz)
+	} else {
+		out.w = csv.NewWriter(out.buf)
+	}
+	return out, nil
+}
+
+// Write writes a record.
+func (o *csvOutput) Write(rec []string) error {
+	return o.w.Write(rec)
+}
+
+// checkpoint writes the pending records to the disk and returns the size of the partial file. A compressed file gets
+// one gzip member per checkpoint, which gzip readers decompress as a single stream.
+func (o *csvOutput) checkpoint() (int64, error) {
+	o.w.Flush()
+	if err := o.w.Error(); err != nil {
+		return 0, err
+	}
+	if o.gz != nil {
+		if err := o.gz.Close(); err != nil {
+			return 0, err
+		}
+		o.gz.Reset(o.buf)
+	}
+	if err := o.buf.Flush(); err != nil {
+		return 0, err
+	}
+	if err := o.file.Sync(); err != nil {
+		return 0, err
+	}
+	return o.file.Seek(0, io.SeekCurrent)
+}
+
+// Close writes the pending records and closes the partial file.
+func (o *csvOutput) Close() error {
+	if _, err := o.checkpoint(); err != nil {
+		o.file.Close()
+		return err
+	}
+	return o.file.Close()
+}
+
+// csvCheckpoint is the progress of the encryption of a CSV file, saved next to its partial output so that it can be
+// resumed after an interruption. The encryption parameters are saved to check that the resumed one is the same.
+type csvCheckpoint struct {
+	Input         string
+	InputSize     int64
+	InputModified time.Time
+	Attributes    []string
+	Key           string
+	RangeBits     int
+	EmptyValues   string
+	// Records is the number of input records processed, whose output is in the first Offset bytes of the partial file
+	Records int64
+	Offset  int64
+}
+
+// sameEncryption tells whether two checkpoints were saved by the encryption of the same file with the same parameters.
+func (cp *csvCheckpoint) sameEncryption(other *csvCheckpoint) bool {
+	return cp.Input == other.Input && cp.InputSize == other.InputSize && cp.InputModified.Equal(other.InputModified) &&
+		strings.Join(cp.Attributes, ",") == strings.Join(other.Attributes, ",") && cp.Key == other.Key &&
+		cp.RangeBits == other.RangeBits && cp.EmptyValues == other.EmptyValues
+}
+
+// loadCsvCheckpoint reads a checkpoint file; it returns nil if there is none.
+func loadCsvCheckpoint(path string) (*csvCheckpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := &csvCheckpoint{}
+	if err := json.Unmarshal(data, cp); err != nil {
+		return nil, errors.New("invalid checkpoint " + path + ": " + err.Error())
+	}
+	return cp, nil
+}
+
+// save replaces the checkpoint file, so that an interruption never leaves a truncated checkpoint.
+func (cp *csvCheckpoint) save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
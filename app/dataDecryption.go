@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 
@@ -15,9 +14,7 @@ import (
 func decryptIntFromApp(c *cli.Context) error {
 
 	// cli arguments
-	keyFilePath := c.String("key")
-	b1, err := ioutil.ReadFile(keyFilePath)
-	secKey, err := lib.DeserializeScalar(string(b1))
+	secKey, err := privateKeyFromApp(c)
 	if err != nil {
 		log.Error(err)
 		return cli.NewExitError(err, 4)
@@ -36,7 +33,11 @@ func decryptIntFromApp(c *cli.Context) error {
 
 	// value to decrypt form command line
 	toDecryptSerialized := c.Args().Get(0)
-	toDecrypt := lib.NewCipherTextFromBase64(toDecryptSerialized)
+	toDecrypt, err := lib.NewCipherTextFromBase64(toDecryptSerialized)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
 
 	// decryption
 	decVal := lib.DecryptInt(secKey, *toDecrypt)
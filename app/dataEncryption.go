@@ -3,7 +3,6 @@ package main
 import (
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 
@@ -15,9 +14,10 @@ import (
 func encryptIntFromApp(c *cli.Context) error {
 
 	//cli arguments
-	keyFilePath := c.String("key")
-	b, err := ioutil.ReadFile(keyFilePath)
-	pubKey, err := lib.DeserializePoint(string(b))
+	pubKey, err := publicKeyFromApp(c)
+	if err == nil && pubKey == nil {
+		err = errors.New("a public key has to be given with --" + optionEncryptKey + " or --" + optionKeyName)
+	}
 	if err != nil {
 		log.Error(err)
 		return cli.NewExitError(err, 4)
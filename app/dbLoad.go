@@ -0,0 +1,343 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// readDatabaseConfig reads a database configuration file (like db.toml) or the Database section of a server
+// configuration, with its credentials.
+func readDatabaseConfig(path string) (*serviceI2B2dc.DatabaseConfig, error) {
+	dbc, err := serviceI2B2dc.LoadDatabaseConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := dbc.ResolveCredentials(databasePassphrase); err != nil {
+		return nil, err
+	}
+	return dbc, nil
+}
+
+// databasePassphrase asks for the passphrase of an encrypted database password.
+func databasePassphrase() (string, error) {
+	return promptPassphrase("Passphrase of the database password: ", false)
+}
+
+// BEGIN CLIENT: DATA LOADING ----------
+
+// loadedRow is a group of the i2b2 data with its count, encrypted (with its range proof) before it is inserted.
+type loadedRow struct {
+	location, time, concept string
+	count                   int64
+	encrypted, rangeProof   string
+	err                     error
+}
+
+// dbLoader encrypts the counts of the groups read from an i2b2 CRC schema and inserts them in the table queried by the
+// servers (described by dbc), in batches committed one after the other. With replace, the table is emptied and loaded
+// in one transaction: the servers read either the previous rows or all the new ones.
+type dbLoader struct {
+	source    *sql.DB
+	query     string
+	dest      *sql.DB
+	dbc       *serviceI2B2dc.DatabaseConfig
+	pubKey    abstract.Point
+	batchSize int
+	replace   bool
+}
+
+// loadFromApp reads the patient counts per location, year and concept from observation_fact (or a precomputed totals
+// table), encrypts them and writes them to the table of the database configuration.
+func loadFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	if c.String(optionDbConfig) == "" {
+		err := errors.New("the database configuration of the encrypted table has to be given with --" + optionDbConfig)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	if c.Int(optionBatchSize) < 1 {
+		err := errors.New(optionBatchSize + " must be positive")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	dbc, err := readDatabaseConfig(c.String(optionDbConfig))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	// the CRC schema is in the same database unless another configuration is given
+	sourceConfig := dbc
+	if path := c.String(optionSourceDb); path != "" {
+		if sourceConfig, err = readDatabaseConfig(path); err != nil {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+	}
+
+	pubKey, err := encryptionKeyFromApp(c)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	query := observationFactQuery(c.String(optionCrcSchema))
+	if table := c.String(optionTotalsTable); table != "" {
+		query = totalsQuery(table)
+	}
+
+	loader := &dbLoader{query: query, dbc: dbc, pubKey: pubKey, batchSize: c.Int(optionBatchSize),
+		replace: c.Bool(optionReplace)}
+	if loader.source, err = sourceConfig.Open(); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	defer loader.source.Close()
+	if loader.dest, err = dbc.Open(); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	defer loader.dest.Close()
+
+	start := time.Now()
+	loaded, err := loader.run()
+	if err != nil {
+		log.Error(err)
+		if loaded > 0 {
+			log.Error(loaded, " rows were already committed to ", dbc.Table)
+		}
+		return cli.NewExitError(err, 4)
+	}
+	log.LLvl1("Loaded", loaded, "encrypted rows into", dbc.Table, "in", time.Since(start))
+	return nil
+}
+
+// observationFactQuery returns the query counting the distinct patients of the observations of each location, year
+// and concept of an i2b2 CRC schema.
+func observationFactQuery(schema string) string {
+	return "SELECT location_cd, to_char(start_date, 'YYYY') AS year, concept_cd, COUNT(DISTINCT patient_num) " +
+		"FROM " + schema + ".observation_fact " +
+		"WHERE location_cd IS NOT NULL AND start_date IS NOT NULL AND concept_cd IS NOT NULL " +
+		"GROUP BY 1, 2, 3 ORDER BY 1, 2, 3"
+}
+
+// totalsQuery returns the query summing the counts of a precomputed table with the layout of the encrypted table
+// (location_cd, time, concept_cd, totalnum) in clear.
+func totalsQuery(table string) string {
+	return "SELECT location_cd, \"time\", concept_cd, SUM(totalnum) FROM " + table + " " +
+		"WHERE location_cd IS NOT NULL AND \"time\" IS NOT NULL AND concept_cd IS NOT NULL " +
+		"GROUP BY 1, 2, 3 ORDER BY 1, 2, 3"
+}
+
+// prepareTable creates the encrypted table if it does not exist, checks its columns otherwise, and empties it if
+// replace is set (in the transaction of the whole load).
+func (l *dbLoader) prepareTable(tx *sql.Tx) error {
+	columns := l.dbc.Columns()
+	quoted := l.dbc.QuotedColumns()
+	definitions := []string{quoted[0] + " character varying(50)", quoted[1] + " character varying(7)",
+		quoted[2] + " character varying(50)"}
+	for _, c := range quoted[3:] {
+		definitions = append(definitions, c+" text")
+	}
+	if _, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + l.dbc.Table + " (" + strings.Join(definitions, ", ") + ")"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query("SELECT * FROM " + l.dbc.Table + " LIMIT 0")
+	if err != nil {
+		return err
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if strings.Join(existing, ",") != strings.Join(columns, ",") {
+		return errors.New("table " + l.dbc.Table + " has the columns (" + strings.Join(existing, ", ") +
+			"), the servers read (" + strings.Join(columns, ", ") + ")")
+	}
+
+	if l.replace {
+		if _, err := tx.Exec("DELETE FROM " + l.dbc.Table); err != nil {
+			return err
+		}
+		log.Lvl1("Rows of", l.dbc.Table, "deleted")
+	}
+	return nil
+}
+
+// run loads the groups and returns the number of rows committed.
+func (l *dbLoader) run() (int, error) {
+	log.Lvl1("Reading the groups:", l.query)
+	rows, err := l.source.Query(l.query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// with replace, every batch goes in the transaction deleting the previous rows, committed at the end
+	var tx *sql.Tx
+	if l.replace {
+		if tx, err = l.dest.Begin(); err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		if err := l.prepareTable(tx); err != nil {
+			return 0, err
+		}
+	}
+
+	loaded, committed := 0, 0
+	first := true
+	batch := make([]loadedRow, 0, l.batchSize)
+	for {
+		if batch, err = l.readBatch(rows, batch[:0]); err != nil {
+			return committed, err
+		}
+		// the table is prepared even if there is no group to load
+		if len(batch) == 0 && (!first || l.replace) {
+			break
+		}
+
+		l.encrypt(batch)
+		if l.replace {
+			if err := l.insert(tx, batch); err != nil {
+				return committed, err
+			}
+		} else {
+			if err := l.commitBatch(batch, first); err != nil {
+				return committed, err
+			}
+			committed += len(batch)
+			log.Lvl1("Committed", committed, "rows")
+		}
+		first = false
+		loaded += len(batch)
+	}
+	if l.replace {
+		if err := tx.Commit(); err != nil {
+			return committed, err
+		}
+		committed = loaded
+		log.Lvl1("Committed", committed, "rows")
+	}
+	return committed, nil
+}
+
+// readBatch appends to batch the next groups of rows, up to the batch size.
+func (l *dbLoader) readBatch(rows *sql.Rows, batch []loadedRow) ([]loadedRow, error) {
+	for len(batch) < l.batchSize && rows.Next() {
+		row := loadedRow{}
+		var count sql.NullInt64
+		if err := rows.Scan(&row.location, &row.time, &row.concept, &count); err != nil {
+			return batch, err
+		}
+		if err := row.setCount(count); err != nil {
+			return batch, err
+		}
+		batch = append(batch, row)
+	}
+	return batch, rows.Err()
+}
+
+// setCount sets the count of a group, which has to be given and not negative.
+func (row *loadedRow) setCount(count sql.NullInt64) error {
+	group := "location_cd=" + row.location + ", time=" + row.time + ", concept_cd=" + row.concept
+	if !count.Valid {
+		return errors.New("no count for " + group)
+	}
+	if count.Int64 < 0 {
+		return errors.New("negative count for " + group)
+	}
+	row.count = count.Int64
+	return nil
+}
+
+// encrypt encrypts the counts of a batch in parallel.
+func (l *dbLoader) encrypt(batch []loadedRow) {
+	wg := lib.StartParallelize(0)
+	for i := 0; i < len(batch); i = i + lib.VPARALLELIZE {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < i+lib.VPARALLELIZE && j < len(batch); j++ {
+				row := &batch[j]
+				if l.dbc.RangeProofBits == 0 {
+					row.encrypted = lib.EncryptInt(l.pubKey, row.count).Serialize()
+					continue
+				}
+				encrypted, proof, err := lib.EncryptIntWithRangeProof(l.pubKey, row.count, l.dbc.RangeProofBits)
+				if err == nil {
+					row.encrypted = encrypted.Serialize()
+					row.rangeProof, err = proof.Serialize()
+				}
+				row.err = err
+			}
+		}(i)
+	}
+	lib.EndParallelize(wg)
+}
+
+// commitBatch writes a batch in its own transaction, preparing the table with the first one.
+func (l *dbLoader) commitBatch(batch []loadedRow, first bool) error {
+	tx, err := l.dest.Begin()
+	if err != nil {
+		return err
+	}
+	if first {
+		if err := l.prepareTable(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := l.insert(tx, batch); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insert writes a batch in the transaction tx.
+func (l *dbLoader) insert(tx *sql.Tx, batch []loadedRow) error {
+	columns := l.dbc.QuotedColumns()
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = "$" + strconv.Itoa(i+1)
+	}
+	stmt, err := tx.Prepare("INSERT INTO " + l.dbc.Table + " (" + strings.Join(columns, ", ") + ") VALUES (" +
+		strings.Join(placeholders, ", ") + ")")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range batch {
+		if row.err != nil {
+			return errors.New("cannot encrypt the count of location_cd=" + row.location + ", time=" + row.time +
+				", concept_cd=" + row.concept + ": " + row.err.Error())
+		}
+		values := []interface{}{row.location, row.time, row.concept, row.encrypted}
+		if l.dbc.RangeProofBits > 0 {
+			values = append(values, row.rangeProof)
+		}
+		if _, err := stmt.Exec(values...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CLIENT END: DATA LOADING ------------
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// testDatabase is the state of an in-memory database of the testdb driver: the groups returned by the source query
+// and the committed rows of the encrypted table, whose ctid is their index.
+type testDatabase struct {
+	mutex   sync.Mutex
+	groups  [][]driver.Value
+	table   [][]driver.Value
+	inserts int
+	// countColumn is the column of the encrypted counts (totalnum if empty), the fourth of the table
+	countColumn string
+	// failInsert makes the insert of this number (counting from 1) fail
+	failInsert int
+}
+
+var testDatabases = struct {
+	sync.Mutex
+	byName map[string]*testDatabase
+	once   sync.Once
+}{byName: make(map[string]*testDatabase)}
+
+// openTestDatabase registers db and returns a connection to it.
+func openTestDatabase(t *testing.T, db *testDatabase) *sql.DB {
+	testDatabases.once.Do(func() { sql.Register("testdb", testDriver{}) })
+	testDatabases.Lock()
+	testDatabases.byName[t.Name()] = db
+	testDatabases.Unlock()
+	conn, err := sql.Open("testdb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	testDatabases.Lock()
+	defer testDatabases.Unlock()
+	db, ok := testDatabases.byName[name]
+	if !ok {
+		return nil, errors.New("unknown database " + name)
+	}
+	return &testConn{db: db}, nil
+}
+
+// testConn buffers the changes of its transaction until it is committed.
+type testConn struct {
+	db      *testDatabase
+	deleted bool
+	pending [][]driver.Value
+	updates map[int]driver.Value
+}
+
+func (c *testConn) Prepare(query string) (driver.Stmt, error) { return &testStmt{c, query}, nil }
+func (c *testConn) Close() error                              { return nil }
+func (c *testConn) Begin() (driver.Tx, error)                 { return c, nil }
+
+func (c *testConn) Commit() error {
+	c.db.mutex.Lock()
+	defer c.db.mutex.Unlock()
+	if c.deleted {
+		c.db.table = nil
+	}
+	c.db.table = append(c.db.table, c.pending...)
+	for i, value := range c.updates {
+		c.db.table[i][3] = value
+	}
+	c.deleted, c.pending, c.updates = false, nil, nil
+	return nil
+}
+
+func (c *testConn) Rollback() error {
+	c.deleted, c.pending, c.updates = false, nil, nil
+	return nil
+}
+
+// checkCountColumn returns an error if a query does not use the count column of the table.
+func (c *testConn) checkCountColumn(query string) error {
+	column := c.db.countColumn
+	if column == "" {
+		column = "totalnum"
+	}
+	if !strings.Contains(query, `"`+column+`"`) {
+		return errors.New("the count column " + column + " is not in " + query)
+	}
+	return nil
+}
+
+type testStmt struct {
+	conn  *testConn
+	query string
+}
+
+func (s *testStmt) Close() error  { return nil }
+func (s *testStmt) NumInput() int { return -1 }
+
+func (s *testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	switch {
+	case strings.HasPrefix(s.query, "DELETE"):
+		s.conn.deleted = true
+	case strings.HasPrefix(s.query, "INSERT"):
+		s.conn.db.mutex.Lock()
+		s.conn.db.inserts++
+		fail := s.conn.db.inserts == s.conn.db.failInsert
+		s.conn.db.mutex.Unlock()
+		if fail {
+			return nil, errors.New("insert failed")
+		}
+		s.conn.pending = append(s.conn.pending, args)
+	case strings.HasPrefix(s.query, "UPDATE"):
+		if err := s.conn.checkCountColumn(s.query); err != nil {
+			return nil, err
+		}
+		var i int
+		if _, err := fmt.Sscanf(args[1].(string), "(0,%d)", &i); err != nil {
+			return nil, err
+		}
+		if s.conn.updates == nil {
+			s.conn.updates = make(map[int]driver.Value)
+		}
+		s.conn.updates[i] = args[0]
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if strings.HasSuffix(s.query, "LIMIT 0") {
+		return &testRows{columns: []string{"location_cd", "time", "concept_cd", "totalnum"}}, nil
+	}
+	s.conn.db.mutex.Lock()
+	defer s.conn.db.mutex.Unlock()
+	if strings.HasPrefix(s.query, "SELECT ctid") {
+		if err := s.conn.checkCountColumn(s.query); err != nil {
+			return nil, err
+		}
+		rows := &testRows{columns: []string{"ctid", "count"}}
+		for i, row := range s.conn.db.table {
+			rows.values = append(rows.values, []driver.Value{"(0," + strconv.Itoa(i) + ")", row[3]})
+		}
+		return rows, nil
+	}
+	return &testRows{columns: []string{"location_cd", "year", "concept_cd", "count"}, values: s.conn.db.groups}, nil
+}
+
+type testRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *testRows) Columns() []string { return r.columns }
+func (r *testRows) Close() error      { return nil }
+
+func (r *testRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// testGroups are the groups of the source query of the tests.
+func testGroups() [][]driver.Value {
+	return [][]driver.Value{{"L1", "2017", "C1", int64(3)}, {"L1", "2017", "C2", int64(4)},
+		{"L2", "2018", "C1", int64(5)}}
+}
+
+// newTestLoader returns a loader of db (as source and destination) in batches of 2 rows, and the private key of its
+// encryption key.
+func newTestLoader(t *testing.T, db *testDatabase, replace bool) (*dbLoader, abstract.Scalar) {
+	conn := openTestDatabase(t, db)
+	secKey, pubKey := lib.GenKey()
+	return &dbLoader{source: conn, query: observationFactQuery("i2b2demodata"), dest: conn,
+		dbc: &serviceI2B2dc.DatabaseConfig{Table: "dc_data"}, pubKey: pubKey, batchSize: 2, replace: replace}, secKey
+}
+
+func TestDbLoad(t *testing.T) {
+	db := &testDatabase{groups: testGroups(), table: [][]driver.Value{{"L0", "2016", "C0", "old"}}}
+	loader, secKey := newTestLoader(t, db, true)
+	defer loader.dest.Close()
+
+	loaded, err := loader.run()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, loaded)
+	if assert.Len(t, db.table, 3) {
+		for i, row := range db.table {
+			assert.Equal(t, testGroups()[i][:3], row[:3])
+			assert.Equal(t, testGroups()[i][3], decryptTestCount(t, secKey, row[3].(string)))
+		}
+	}
+}
+
+func TestDbLoadReplaceAtomic(t *testing.T) {
+	old := [][]driver.Value{{"L0", "2016", "C0", "old"}}
+	db := &testDatabase{groups: testGroups(), table: old, failInsert: 3}
+	loader, _ := newTestLoader(t, db, true)
+	defer loader.dest.Close()
+
+	// the failure in the second batch leaves the previous rows
+	loaded, err := loader.run()
+	assert.EqualError(t, err, "insert failed")
+	assert.Equal(t, 0, loaded)
+	assert.Equal(t, old, db.table)
+}
+
+func TestDbLoadBatches(t *testing.T) {
+	db := &testDatabase{groups: testGroups(), failInsert: 3}
+	loader, _ := newTestLoader(t, db, false)
+	defer loader.dest.Close()
+
+	// without replace, the batches before the failure stay committed
+	loaded, err := loader.run()
+	assert.EqualError(t, err, "insert failed")
+	assert.Equal(t, 2, loaded)
+	assert.Len(t, db.table, 2)
+}
+
+func TestDbLoadNullCount(t *testing.T) {
+	old := [][]driver.Value{{"L0", "2016", "C0", "old"}}
+	groups := append(testGroups(), []driver.Value{"L2", "2018", "C2", nil})
+	db := &testDatabase{groups: groups, table: old}
+	loader, _ := newTestLoader(t, db, true)
+	defer loader.dest.Close()
+
+	loaded, err := loader.run()
+	assert.EqualError(t, err, "no count for location_cd=L2, time=2018, concept_cd=C2")
+	assert.Equal(t, 0, loaded)
+	assert.Equal(t, old, db.table)
+}
+
+func TestDbLoadNegativeCount(t *testing.T) {
+	row := loadedRow{location: "L1", time: "2017", concept: "C1"}
+	assert.EqualError(t, row.setCount(sql.NullInt64{Int64: -1, Valid: true}),
+		"negative count for location_cd=L1, time=2017, concept_cd=C1")
+	assert.NoError(t, row.setCount(sql.NullInt64{Int64: 0, Valid: true}))
+}
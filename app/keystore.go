@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/peterh/liner"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/app"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// keystoreFile is the name of the default keystore, in the configuration directory of the app.
+const keystoreFile = "keys.toml"
+
+// keystore is the content of a keystore file: named key pairs (or public keys only).
+type keystore struct {
+	Keys []*keystoreEntry
+}
+
+// keystoreEntry is a named key. Private is empty for an imported public key. If Encrypted, Private is sealed with
+// AES-GCM under a key derived (scrypt) from a passphrase with Salt.
+type keystoreEntry struct {
+	Name      string
+	Suite     string
+	Public    string
+	Private   string
+	Encrypted bool
+	Salt      string
+	Nonce     string
+	Created   time.Time
+}
+
+// keystorePath returns the keystore given with --keystore, or the default one.
+func keystorePath(c *cli.Context) string {
+	if path := c.GlobalString(optionKeystore); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(app.GetDefaultConfigFile(BinaryName)), keystoreFile)
+}
+
+// readKeystore reads a keystore file, which must not be accessible to the other users. A missing file is an empty
+// keystore.
+func readKeystore(path string) (*keystore, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return &keystore{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, errors.New("keystore " + path + " is accessible to other users (" + info.Mode().Perm().String() +
+			"), restrict it with chmod 600")
+	}
+
+	ks := &keystore{}
+	if _, err := toml.DecodeFile(path, ks); err != nil {
+		return nil, errors.New("invalid keystore " + path + ": " + err.Error())
+	}
+	return ks, nil
+}
+
+// write replaces the keystore file by a file only readable by its owner.
+func (ks *keystore) write(path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// the temporary file is created with mode 0600
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := toml.NewEncoder(tmp).Encode(ks); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// entry returns the key with the given name.
+func (ks *keystore) entry(name string) (*keystoreEntry, error) {
+	for _, e := range ks.Keys {
+		if e.Name == name {
+			return e, nil
+		}
+	}
+	return nil, errors.New("no key named " + name + " in the keystore")
+}
+
+// add adds a key whose name is not used yet.
+func (ks *keystore) add(e *keystoreEntry) error {
+	if _, err := ks.entry(e.Name); err == nil {
+		return errors.New("a key named " + e.Name + " is already in the keystore")
+	}
+	ks.Keys = append(ks.Keys, e)
+	return nil
+}
+
+// newKeystoreEntry creates the entry of a key of the current suite. secKey can be nil, and is encrypted if a passphrase
+// is given.
+func newKeystoreEntry(name string, pubKey abstract.Point, secKey abstract.Scalar, passphrase string) (*keystoreEntry, error) {
+	e := &keystoreEntry{Name: name, Suite: lib.CurrentSuite().String(), Created: time.Now().UTC().Truncate(time.Second)}
+	var err error
+	if e.Public, err = lib.SerializePoint(pubKey); err != nil {
+		return nil, err
+	}
+	if secKey == nil {
+		return e, nil
+	}
+	if e.Private, err = lib.SerializeScalar(secKey); err != nil {
+		return nil, err
+	}
+	if passphrase != "" {
+		err = e.seal(passphrase)
+	}
+	return e, err
+}
+
+// seal encrypts the private key with the passphrase.
+func (e *keystoreEntry) seal(passphrase string) error {
+	// the name is authenticated so that an encrypted key cannot be moved to another entry
+	sealed, salt, nonce, err := lib.SealWithPassphrase(passphrase, []byte(e.Private), []byte(e.Name))
+	if err != nil {
+		return err
+	}
+
+	e.Private = base64.StdEncoding.EncodeToString(sealed)
+	e.Salt = base64.StdEncoding.EncodeToString(salt)
+	e.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	e.Encrypted = true
+	return nil
+}
+
+// checkSuite checks that the key belongs to the current suite.
+func (e *keystoreEntry) checkSuite() error {
+	if e.Suite != lib.CurrentSuite().String() {
+		return errors.New("key " + e.Name + " is a " + e.Suite + " key but the suite in use is " +
+			lib.CurrentSuite().String() + " (see --" + optionSuite + ")")
+	}
+	return nil
+}
+
+// publicKey returns the public key of the entry.
+func (e *keystoreEntry) publicKey() (abstract.Point, error) {
+	if err := e.checkSuite(); err != nil {
+		return nil, err
+	}
+	return lib.DeserializePoint(e.Public)
+}
+
+// privateKey returns the private key of the entry, asking for its passphrase if it is encrypted.
+func (e *keystoreEntry) privateKey() (abstract.Scalar, error) {
+	if err := e.checkSuite(); err != nil {
+		return nil, err
+	}
+	if e.Private == "" {
+		return nil, errors.New("key " + e.Name + " has no private part (only its public key was imported)")
+	}
+	if !e.Encrypted {
+		return lib.DeserializeScalar(e.Private)
+	}
+
+	passphrase, err := promptPassphrase("Passphrase of key "+e.Name+": ", false)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(passphrase)
+}
+
+// open decrypts the private key sealed with the passphrase.
+func (e *keystoreEntry) open(passphrase string) (abstract.Scalar, error) {
+	sealed, err1 := base64.StdEncoding.DecodeString(e.Private)
+	salt, err2 := base64.StdEncoding.DecodeString(e.Salt)
+	nonce, err3 := base64.StdEncoding.DecodeString(e.Nonce)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, errors.New("encrypted key " + e.Name + " is corrupted")
+	}
+	private, err := lib.OpenWithPassphrase(passphrase, sealed, salt, nonce, []byte(e.Name))
+	if err != nil {
+		return nil, errors.New("cannot decrypt key " + e.Name + ": " + err.Error())
+	}
+	return lib.DeserializeScalar(string(private))
+}
+
+// promptPassphrase reads a passphrase on the terminal without echoing it, twice if it has to be confirmed.
+func promptPassphrase(prompt string, confirm bool) (string, error) {
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+
+	passphrase, err := line.PasswordPrompt(prompt)
+	if err != nil {
+		return "", errors.New("cannot read the passphrase: " + err.Error())
+	}
+	if passphrase == "" {
+		return "", errors.New("empty passphrase")
+	}
+	if confirm {
+		again, err := line.PasswordPrompt("Repeat the passphrase: ")
+		if err != nil {
+			return "", errors.New("cannot read the passphrase: " + err.Error())
+		}
+		if again != passphrase {
+			return "", errors.New("the passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// readKeyFile reads a base64-encoded key from a file (surrounding whitespace is ignored).
+func readKeyFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// storedKey returns the keystore entry named by --keyName, nil if the flag is not given.
+func storedKey(c *cli.Context) (*keystoreEntry, error) {
+	name := c.String(optionKeyName)
+	if name == "" {
+		return nil, nil
+	}
+	if c.String(optionEncryptKey) != "" {
+		return nil, errors.New("--" + optionEncryptKey + " and --" + optionKeyName + " cannot be used together")
+	}
+	ks, err := readKeystore(keystorePath(c))
+	if err != nil {
+		return nil, err
+	}
+	return ks.entry(name)
+}
+
+// publicKeyFromApp returns the public key given with --key (FILE) or --keyName, nil if none is given.
+func publicKeyFromApp(c *cli.Context) (abstract.Point, error) {
+	e, err := storedKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		return e.publicKey()
+	}
+	if path := c.String(optionEncryptKey); path != "" {
+		encoded, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return lib.DeserializePoint(encoded)
+	}
+	return nil, nil
+}
+
+// privateKeyFromApp returns the private key given with --key (FILE) or --keyName.
+func privateKeyFromApp(c *cli.Context) (abstract.Scalar, error) {
+	e, err := storedKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		return e.privateKey()
+	}
+	if path := c.String(optionDecryptKey); path != "" {
+		encoded, err := readKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return lib.DeserializeScalar(encoded)
+	}
+	return nil, errors.New("a private key has to be given with --" + optionDecryptKey + " or --" + optionKeyName)
+}
+
+// keyPairFromApp returns the key pair named by --keyName, or a fresh one if the flag is not given.
+func keyPairFromApp(c *cli.Context) (*config.KeyPair, error) {
+	e, err := storedKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil {
+		return config.NewKeyPair(lib.CurrentSuite()), nil
+	}
+	pubKey, err := e.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	secKey, err := e.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	return &config.KeyPair{Suite: lib.CurrentSuite(), Public: pubKey, Secret: secKey}, nil
+}
+
+// BEGIN CLIENT: KEY MANAGEMENT ----------
+
+// keysGenerateFromApp generates a key pair and stores it in the keystore.
+func keysGenerateFromApp(c *cli.Context) error {
+	if c.NArg() != 1 {
+		err := errors.New("Wrong number of arguments (only the name of the key is allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	secKey, pubKey := lib.GenKey()
+	if err := storeKey(c, c.Args().Get(0), pubKey, secKey); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
+
+// keysImportFromApp stores a key read from base64-encoded key files in the keystore.
+func keysImportFromApp(c *cli.Context) error {
+	if c.NArg() != 1 {
+		err := errors.New("Wrong number of arguments (only the name of the key is allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	publicFile, privateFile := c.String(optionPublicKeyFile), c.String(optionPrivateKeyFile)
+	if publicFile == "" && privateFile == "" {
+		err := errors.New("a key has to be given with --" + optionPublicKeyFile + " and/or --" + optionPrivateKeyFile)
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	var pubKey abstract.Point
+	var secKey abstract.Scalar
+	if privateFile != "" {
+		encoded, err := readKeyFile(privateFile)
+		if err == nil {
+			secKey, err = lib.DeserializeScalar(encoded)
+		}
+		if err != nil {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		pubKey = lib.CurrentSuite().Point().Mul(nil, secKey)
+	}
+	if publicFile != "" {
+		encoded, err := readKeyFile(publicFile)
+		if err != nil {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		public, err := lib.DeserializePoint(encoded)
+		if err != nil {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		if pubKey != nil && !pubKey.Equal(public) {
+			err := errors.New("the public key of " + publicFile + " does not match the private key of " + privateFile)
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		pubKey = public
+	}
+
+	if err := storeKey(c, c.Args().Get(0), pubKey, secKey); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
+
+// storeKey adds a key to the keystore, encrypting its private part if --encrypt is given, and prints its fingerprint.
+func storeKey(c *cli.Context, name string, pubKey abstract.Point, secKey abstract.Scalar) error {
+	path := keystorePath(c)
+	ks, err := readKeystore(path)
+	if err != nil {
+		return err
+	}
+	if _, err := ks.entry(name); err == nil {
+		return errors.New("a key named " + name + " is already in the keystore")
+	}
+
+	passphrase := ""
+	if c.Bool(optionEncryptKeystore) && secKey != nil {
+		if passphrase, err = promptPassphrase("Passphrase of key "+name+": ", true); err != nil {
+			return err
+		}
+	}
+	e, err := newKeystoreEntry(name, pubKey, secKey, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := ks.add(e); err != nil {
+		return err
+	}
+	if err := ks.write(path); err != nil {
+		return err
+	}
+
+	fingerprint, err := lib.PointFingerprint(pubKey)
+	if err != nil {
+		return err
+	}
+	fmt.Println(name, fingerprint)
+	log.Lvl1("Key", name, "stored in", path)
+	return nil
+}
+
+// keysListFromApp prints the keys of the keystore with the fingerprints of their public part.
+func keysListFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	ks, err := readKeystore(keystorePath(c))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSUITE\tPRIVATE\tCREATED\tFINGERPRINT")
+	for _, e := range ks.Keys {
+		private := "no"
+		if e.Private != "" {
+			private = "yes"
+			if e.Encrypted {
+				private = "encrypted"
+			}
+		}
+		// the fingerprint can only be computed for the keys of the current suite
+		fingerprint := "-"
+		if pubKey, err := e.publicKey(); err == nil {
+			if fingerprint, err = lib.PointFingerprint(pubKey); err != nil {
+				fingerprint = "-"
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", e.Name, e.Suite, private, e.Created.Format(time.RFC3339), fingerprint)
+	}
+	if err := tw.Flush(); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
+
+// keysExportFromApp prints the base64-encoded public part of a stored key (the format read by --key).
+func keysExportFromApp(c *cli.Context) error {
+	if c.NArg() != 1 {
+		err := errors.New("Wrong number of arguments (only the name of the key is allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	ks, err := readKeystore(keystorePath(c))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	e, err := ks.entry(c.Args().Get(0))
+	if err == nil {
+		err = e.checkSuite()
+	}
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	if _, err := fmt.Println(e.Public); err != nil {
+		log.Error("Error while writing result.", err)
+		return cli.NewExitError(err, 4)
+	}
+	return nil
+}
+
+// CLIENT END: KEY MANAGEMENT ------------
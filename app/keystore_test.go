@@ -0,0 +1,282 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func TestKeystoreEntrySeal(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	e, err := newKeystoreEntry("alice", pubKey, secKey, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, e.Encrypted)
+	private, err := lib.SerializeScalar(secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, e.Private, private)
+
+	opened, err := e.open("correct horse")
+	if assert.NoError(t, err) {
+		assert.True(t, opened.Equal(secKey))
+	}
+	_, err = e.open("wrong horse")
+	assert.Error(t, err)
+
+	// the name is bound to the sealed key: it cannot be moved to another entry
+	moved := *e
+	moved.Name = "bob"
+	_, err = moved.open("correct horse")
+	assert.Error(t, err)
+
+	corrupted := *e
+	corrupted.Salt = "not base64!"
+	_, err = corrupted.open("correct horse")
+	assert.EqualError(t, err, "encrypted key alice is corrupted")
+}
+
+func TestKeystoreEntryPlain(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	e, err := newKeystoreEntry("alice", pubKey, secKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, e.Encrypted)
+	private, err := e.privateKey()
+	if assert.NoError(t, err) {
+		assert.True(t, private.Equal(secKey))
+	}
+
+	public, err := newKeystoreEntry("bob", pubKey, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = public.privateKey()
+	assert.EqualError(t, err, "key bob has no private part (only its public key was imported)")
+
+	public.Suite = "other"
+	_, err = public.publicKey()
+	assert.Error(t, err)
+}
+
+func TestReadKeystorePermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, keystoreFile)
+
+	// a missing keystore is empty
+	ks, err := readKeystore(path)
+	if assert.NoError(t, err) {
+		assert.Empty(t, ks.Keys)
+	}
+
+	_, pubKey := lib.GenKey()
+	e, err := newKeystoreEntry("alice", pubKey, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks = &keystore{}
+	assert.NoError(t, ks.add(e))
+	assert.Error(t, ks.add(e))
+	if err := ks.write(path); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	ks, err = readKeystore(path)
+	if assert.NoError(t, err) && assert.Len(t, ks.Keys, 1) {
+		assert.Equal(t, "alice", ks.Keys[0].Name)
+	}
+
+	if err := os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	_, err = readKeystore(path)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "restrict it with chmod 600")
+	}
+}
+
+// keysTestContext returns the context of a keys command run with args on the keystore path.
+func keysTestContext(t *testing.T, path string, flags map[string]string, args ...string) *cli.Context {
+	global := flag.NewFlagSet("global", flag.ContinueOnError)
+	global.String(optionKeystore, path, "")
+
+	set := flag.NewFlagSet("keys", flag.ContinueOnError)
+	set.String(optionPublicKeyFile, flags[optionPublicKeyFile], "")
+	set.String(optionPrivateKeyFile, flags[optionPrivateKeyFile], "")
+	set.Bool(optionEncryptKeystore, false, "")
+	if err := set.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cli.NewContext(cli.NewApp(), set, cli.NewContext(cli.NewApp(), global, nil))
+}
+
+// captureStdout returns what run writes to stdout.
+func captureStdout(t *testing.T, run func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = run()
+	os.Stdout = stdout
+	w.Close()
+	out, readErr := ioutil.ReadAll(r)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(out), err
+}
+
+// writeKeyFile writes a base64-encoded key to a file of dir.
+func writeKeyFile(t *testing.T, dir, name, key string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestKeysImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, keystoreFile)
+
+	secKey, pubKey := lib.GenKey()
+	_, otherKey := lib.GenKey()
+	private, err := lib.SerializeScalar(secKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := lib.SerializePoint(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := lib.SerializePoint(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateFile := writeKeyFile(t, dir, "private", private)
+	publicFile := writeKeyFile(t, dir, "public", public)
+	otherFile := writeKeyFile(t, dir, "other", other)
+
+	tests := []struct {
+		name  string
+		flags map[string]string
+		args  []string
+		code  int
+	}{
+		{"no key", nil, []string{"alice"}, 3},
+		{"no name", map[string]string{optionPublicKeyFile: publicFile}, nil, 3},
+		{"mismatch", map[string]string{optionPublicKeyFile: otherFile, optionPrivateKeyFile: privateFile}, []string{"alice"}, 4},
+		{"missing file", map[string]string{optionPublicKeyFile: filepath.Join(dir, "missing")}, []string{"alice"}, 4},
+		{"pair", map[string]string{optionPublicKeyFile: publicFile, optionPrivateKeyFile: privateFile}, []string{"alice"}, 0},
+		{"duplicate", map[string]string{optionPublicKeyFile: otherFile}, []string{"alice"}, 4},
+		{"public only", map[string]string{optionPublicKeyFile: otherFile}, []string{"bob"}, 0},
+	}
+	for _, test := range tests {
+		_, err := captureStdout(t, func() error {
+			return keysImportFromApp(keysTestContext(t, path, test.flags, test.args...))
+		})
+		if test.code == 0 {
+			assert.NoError(t, err, test.name)
+			continue
+		}
+		if exitErr, ok := err.(*cli.ExitError); assert.True(t, ok, test.name) {
+			assert.Equal(t, test.code, exitErr.ExitCode(), test.name)
+		}
+	}
+
+	ks, err := readKeystore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, ks.Keys, 2) {
+		// the duplicate did not replace the first key
+		alice, err := ks.entry("alice")
+		if assert.NoError(t, err) {
+			assert.Equal(t, public, alice.Public)
+			assert.Equal(t, private, alice.Private)
+		}
+		bob, err := ks.entry("bob")
+		if assert.NoError(t, err) {
+			assert.Equal(t, other, bob.Public)
+			assert.Empty(t, bob.Private)
+		}
+	}
+}
+
+func TestKeysExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, keystoreFile)
+
+	out, err := captureStdout(t, func() error { return keysGenerateFromApp(keysTestContext(t, path, nil, "alice")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(out, "alice "))
+
+	exported, err := captureStdout(t, func() error { return keysExportFromApp(keysTestContext(t, path, nil, "alice")) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = captureStdout(t, func() error { return keysExportFromApp(keysTestContext(t, path, nil, "bob")) })
+	assert.Error(t, err)
+
+	// the exported key is the format read by the import
+	publicFile := writeKeyFile(t, dir, "alice.pub", strings.TrimSpace(exported))
+	_, err = captureStdout(t, func() error {
+		return keysImportFromApp(keysTestContext(t, path, map[string]string{optionPublicKeyFile: publicFile}, "bob"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := readKeystore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := ks.entry("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ks.entry("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alicePublic, err := alice.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobPublic, err := bob.publicKey()
+	if assert.NoError(t, err) {
+		assert.True(t, bobPublic.Equal(alicePublic))
+	}
+	alicePrivate, err := alice.privateKey()
+	if assert.NoError(t, err) {
+		assert.True(t, lib.CurrentSuite().Point().Mul(nil, alicePrivate).Equal(bobPublic))
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// output formats of the run command
+const (
+	formatTable = "table"
+	formatCsv   = "csv"
+	formatJSON  = "json"
+	formatXML   = "xml"
+)
+
+// noise added to the counts of a report
+const (
+	noiseNone    = "none"
+	noiseLaplace = "laplace"
+)
+
+// metadataExtension is appended to the name of a CSV output file to make the one of its description.
+const metadataExtension = ".meta"
+
+// queryReport is the output of a query: its results and how they were computed.
+type queryReport struct {
+	QueryID string   `json:"queryId"`
+	Roster  []string `json:"roster"`
+	// Contributors are the servers whose data is in the results
+	Contributors []string `json:"contributors"`
+	// Misbehaving are the servers whose contribution to the aggregation was found wrong
+	Misbehaving []reportMisbehavior `json:"misbehaving,omitempty"`
+	Privacy     reportPrivacy       `json:"differentialPrivacy"`
+	GroupBy     []string            `json:"groupBy"`
+	Groups      []reportGroup       `json:"groups"`
+	Timings     reportTimings       `json:"timings"`
+}
+
+// reportPrivacy is the noise added to the counts: none, or drawn from the Laplace distribution of the given scale
+// (sensitivity / epsilon).
+type reportPrivacy struct {
+	Noise       string  `json:"noise"`
+	Epsilon     float64 `json:"epsilon,omitempty"`
+	Sensitivity float64 `json:"sensitivity,omitempty"`
+	Scale       float64 `json:"scale,omitempty"`
+}
+
+// reportMisbehavior is a server whose contribution to the aggregation was found wrong.
+type reportMisbehavior struct {
+	Server   string `json:"server"`
+	Reason   string `json:"reason"`
+	Excluded bool   `json:"excluded"`
+}
+
+// reportGroup is the count of one group, with one label per group-by attribute.
+type reportGroup struct {
+	Labels []string `json:"labels"`
+	Count  int64    `json:"count"`
+}
+
+// reportTimings are the durations (in milliseconds) of the phases run by the entry point and of the whole query
+// seen by the client.
+type reportTimings struct {
+	SQL                   int64 `json:"sqlMs"`
+	LocalAggregation      int64 `json:"localAggregationMs"`
+	CollectiveAggregation int64 `json:"collectiveAggregationMs"`
+	Shuffling             int64 `json:"shufflingMs"`
+	ReEncryption          int64 `json:"reEncryptionMs"`
+	Total                 int64 `json:"totalMs"`
+}
+
+// newQueryReport makes the report of a query run on the servers of the roster.
+func newQueryReport(servers *onet.Roster, groupBy []string, result *serviceI2B2dc.QueryResult, total time.Duration) *queryReport {
+	report := &queryReport{
+		QueryID: string(result.QueryID),
+		GroupBy: groupBy,
+		Timings: reportTimings{
+			SQL:                   milliseconds(result.Timings.SQL),
+			LocalAggregation:      milliseconds(result.Timings.LocalAggregation),
+			CollectiveAggregation: milliseconds(result.Timings.CollectiveAggregation),
+			Shuffling:             milliseconds(result.Timings.Shuffling),
+			ReEncryption:          milliseconds(result.Timings.KeySwitching),
+			Total:                 milliseconds(total),
+		},
+	}
+	for _, si := range servers.List {
+		report.Roster = append(report.Roster, si.String())
+	}
+	for _, si := range result.Contributors {
+		report.Contributors = append(report.Contributors, si.String())
+	}
+	report.Privacy = reportPrivacy{Noise: noiseNone}
+	if dp := result.DifferentialPrivacy; dp.Epsilon > 0 {
+		report.Privacy = reportPrivacy{Noise: noiseLaplace, Epsilon: dp.Epsilon, Sensitivity: dp.Sensitivity,
+			Scale: dp.Sensitivity / dp.Epsilon}
+	}
+	for _, m := range result.Misbehaving {
+		report.Misbehaving = append(report.Misbehaving, reportMisbehavior{Server: m.Server.String(), Reason: m.Reason,
+			Excluded: m.Excluded})
+	}
+	for i, group := range result.Groups {
+		report.Groups = append(report.Groups, reportGroup{Labels: groupLabels(group, len(groupBy)), Count: result.Counts[i]})
+	}
+	return report
+}
+
+// groupLabels splits the (comma-separated) value of a group in one label per group-by attribute.
+func groupLabels(group string, attributes int) []string {
+	if attributes == 0 {
+		return []string{}
+	}
+	return strings.SplitN(group, ",", attributes)
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// outputExtension returns the extension of the files written in the given format.
+func outputExtension(format string) (string, error) {
+	switch format {
+	case formatTable:
+		return "txt", nil
+	case formatCsv, formatJSON, formatXML:
+		return format, nil
+	}
+	return "", errors.New("unknown output format " + format + " (" + strings.Join([]string{formatTable, formatCsv,
+		formatJSON, formatXML}, ", ") + ")")
+}
+
+// writeQueryReport writes the report in the given format.
+func writeQueryReport(w io.Writer, report *queryReport, format string) error {
+	switch format {
+	case formatTable:
+		return report.writeTable(w)
+	case formatCsv:
+		return report.writeCsv(w)
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	case formatXML:
+		return report.writeXML(w)
+	}
+	_, err := outputExtension(format)
+	return err
+}
+
+// header returns the names of the columns of the results.
+func (r *queryReport) header() []string {
+	return append(append([]string{}, r.GroupBy...), "totalnum")
+}
+
+// metadata returns the description of the query as key-value pairs.
+func (r *queryReport) metadata() [][2]string {
+	metadata := [][2]string{
+		{"query", r.QueryID},
+		{"roster", strings.Join(r.Roster, " ")},
+		{"contributors", strconv.Itoa(len(r.Contributors)) + " of " + strconv.Itoa(len(r.Roster)) + ": " +
+			strings.Join(r.Contributors, " ")},
+		{"timings", fmt.Sprintf("sql %dms, local aggregation %dms, collective aggregation %dms, shuffling %dms, "+
+			"re-encryption %dms, total %dms", r.Timings.SQL, r.Timings.LocalAggregation, r.Timings.CollectiveAggregation,
+			r.Timings.Shuffling, r.Timings.ReEncryption, r.Timings.Total)},
+		{"differential privacy", r.Privacy.String()},
+	}
+	for _, m := range r.Misbehaving {
+		metadata = append(metadata, [2]string{"misbehaving", fmt.Sprintf("%s (excluded: %t): %s", m.Server, m.Excluded,
+			m.Reason)})
+	}
+	return metadata
+}
+
+func (p reportPrivacy) String() string {
+	if p.Noise != noiseLaplace {
+		return "none (exact counts)"
+	}
+	return fmt.Sprintf("Laplace noise of scale %g (epsilon %g, sensitivity %g)", p.Scale, p.Epsilon, p.Sensitivity)
+}
+
+// writeMetadata writes the description of the query as "key: value" lines.
+func (r *queryReport) writeMetadata(w io.Writer) error {
+	for _, m := range r.metadata() {
+		if _, err := fmt.Fprintf(w, "%s: %s\n", m[0], m[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTable pretty-prints the description of the query followed by its results.
+func (r *queryReport) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, m := range r.metadata() {
+		fmt.Fprintf(tw, "%s:\t%s\n", m[0], m[1])
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, strings.Join(r.header(), "\t"))
+	for _, g := range r.Groups {
+		fmt.Fprintln(tw, strings.Join(append(append([]string{}, g.Labels...), strconv.FormatInt(g.Count, 10)), "\t"))
+	}
+	return tw.Flush()
+}
+
+// writeCsv writes the results with a header (the description of the query is written apart, see
+// writeQueryReportFile).
+func (r *queryReport) writeCsv(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(r.header()); err != nil {
+		return err
+	}
+	for _, g := range r.Groups {
+		if err := cw.Write(append(append([]string{}, g.Labels...), strconv.FormatInt(g.Count, 10))); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// i2b2ResultEnvelope is the XML document in which i2b2 returns the breakdowns of a query.
+type i2b2ResultEnvelope struct {
+	XMLName   xml.Name `xml:"ns10:i2b2_result_envelope"`
+	Namespace string   `xml:"xmlns:ns10,attr"`
+	// the description of the query is a comment so that the document stays valid for i2b2
+	Metadata string       `xml:",comment"`
+	Results  []i2b2Result `xml:"body>ns10:result"`
+}
+
+type i2b2Result struct {
+	Name string     `xml:"name,attr"`
+	Data []i2b2Data `xml:"data"`
+}
+
+type i2b2Data struct {
+	Type   string `xml:"type,attr"`
+	Column string `xml:"column,attr"`
+	Value  int64  `xml:",chardata"`
+}
+
+// writeXML writes the results as an i2b2 breakdown whose columns are the (comma-separated) group labels.
+func (r *queryReport) writeXML(w io.Writer) error {
+	name := "PATIENT_COUNT_XML"
+	if len(r.GroupBy) > 0 {
+		name = "PATIENT_" + strings.ToUpper(strings.Join(r.GroupBy, "_")) + "_COUNT_XML"
+	}
+	result := i2b2Result{Name: name}
+	for _, g := range r.Groups {
+		result.Data = append(result.Data, i2b2Data{Type: "int", Column: strings.Join(g.Labels, ","), Value: g.Count})
+	}
+
+	var metadata []string
+	for _, m := range r.metadata() {
+		// "--" cannot appear in an XML comment
+		metadata = append(metadata, m[0]+": "+strings.Replace(m[1], "--", "- -", -1))
+	}
+	envelope := i2b2ResultEnvelope{
+		Namespace: "http://www.i2b2.org/xsd/hive/msg/result/1.1/",
+		Metadata:  " " + strings.Join(metadata, "; ") + " ",
+		Results:   []i2b2Result{result},
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(envelope); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
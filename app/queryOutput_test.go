@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// testQueryReport makes the report of a query with two groups and noise added to the counts.
+func testQueryReport() *queryReport {
+	result := &serviceI2B2dc.QueryResult{QueryID: "query", Groups: []string{"L1,C1", "L2,C2"}, Counts: []int64{3, 5},
+		DifferentialPrivacy: serviceI2B2dc.DifferentialPrivacyConfig{Epsilon: 0.5, Sensitivity: 2}}
+	return newQueryReport(&onet.Roster{}, []string{"location_cd", "concept_cd"}, result, 0)
+}
+
+func TestQueryReportCsv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the CSV file only holds the results, its description is written next to it
+	out := filepath.Join(dir, "results.csv")
+	assert.Nil(t, writeQueryReportFile(out, testQueryReport(), formatCsv))
+	data, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "location_cd,concept_cd,totalnum\nL1,C1,3\nL2,C2,5\n", string(data))
+
+	data, err = ioutil.ReadFile(out + metadataExtension)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "query: query\n")
+	assert.Contains(t, string(data), "differential privacy: Laplace noise of scale 4 (epsilon 0.5, sensitivity 2)\n")
+
+	// the other formats have no description file
+	out = filepath.Join(dir, "results.json")
+	assert.Nil(t, writeQueryReportFile(out, testQueryReport(), formatJSON))
+	_, err = os.Stat(out + metadataExtension)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestQueryReportPrivacy(t *testing.T) {
+	var b strings.Builder
+	assert.Nil(t, writeQueryReport(&b, testQueryReport(), formatJSON))
+	report := queryReport{}
+	assert.Nil(t, json.Unmarshal([]byte(b.String()), &report))
+	assert.Equal(t, reportPrivacy{Noise: noiseLaplace, Epsilon: 0.5, Sensitivity: 2, Scale: 4}, report.Privacy)
+
+	// without noise, the counts are exact
+	r := newQueryReport(&onet.Roster{}, nil, &serviceI2B2dc.QueryResult{}, 0)
+	assert.Equal(t, reportPrivacy{Noise: noiseNone}, r.Privacy)
+}
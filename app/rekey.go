@@ -0,0 +1,517 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	_ "github.com/lib/pq"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// A server joining (leaving) the roster adds its contribution to (removes it from) the collective key of the data
+// stored by the sites, with the add/rm server protocol. The requests are signed with the key of a server of the roster
+// (--config). The data encrypted under a threshold collective key (dkg) are not concerned: the servers refuse to
+// re-key them, the key has to be rotated instead.
+
+// rekeyOperation is the addition or removal of the contribution of one server to the collective key.
+type rekeyOperation struct {
+	server *network.ServerIdentity
+	add    bool
+	// roster is the one the server joins (or leaves)
+	roster *onet.Roster
+}
+
+// rekeyPlan returns the operations re-keying data from the collective key of the roster before a membership change to
+// the one after it. The joining servers come first so that the leaving ones are still there when they are needed.
+func rekeyPlan(before, after *onet.Roster) []rekeyOperation {
+	var ops []rekeyOperation
+	for _, si := range after.List {
+		if !inRoster(before, si) {
+			ops = append(ops, rekeyOperation{server: si, add: true, roster: after})
+		}
+	}
+	for _, si := range before.List {
+		if !inRoster(after, si) {
+			ops = append(ops, rekeyOperation{server: si, add: false, roster: before})
+		}
+	}
+	return ops
+}
+
+// rekeyKeys returns the keys under which the data are encrypted before each operation and after the last one.
+func rekeyKeys(key abstract.Point, ops []rekeyOperation) []abstract.Point {
+	keys := []abstract.Point{key}
+	for _, op := range ops {
+		if op.add {
+			key = network.Suite.Point().Add(key, op.server.Public)
+		} else {
+			key = network.Suite.Point().Sub(key, op.server.Public)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// rekeySigner reads the key pair of the server whose configuration is at path, which signs the requests of the
+// operations. It has to be part of the roster of each of them.
+func rekeySigner(path string, ops []rekeyOperation) (*config.KeyPair, error) {
+	conf, err := serviceI2B2dc.LoadServerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	private, err := crypto.StringHexToScalar(network.Suite, conf.Private)
+	if err != nil {
+		return nil, errors.New("invalid private key in " + path + ": " + err.Error())
+	}
+	signer := network.NewServerIdentity(network.Suite.Point().Mul(nil, private), conf.Address)
+	for _, op := range ops {
+		if !inRoster(op.roster, signer) {
+			return nil, errors.New("the server of " + path + " cannot sign the requests to " + op.String() +
+				", it is not part of the roster")
+		}
+	}
+	return &config.KeyPair{Suite: network.Suite, Public: signer.Public, Secret: private}, nil
+}
+
+// inRoster checks if a server (identified by its public key) is part of a roster.
+func inRoster(el *onet.Roster, si *network.ServerIdentity) bool {
+	for _, s := range el.List {
+		if s.Public.Equal(si.Public) {
+			return true
+		}
+	}
+	return false
+}
+
+func (op rekeyOperation) String() string {
+	if op.add {
+		return "add the contribution of " + op.server.String()
+	}
+	return "remove the contribution of " + op.server.String()
+}
+
+// rekeyFromApp re-keys the encrypted data of a CSV file or database table after a membership change of the roster.
+func rekeyFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	before, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	after, err := openGroupToml(c.String(optionNewGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	keyBefore, err := rosterAggregateKey(before)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	keyAfter, err := lib.SerializePoint(after.Aggregate)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	ops := rekeyPlan(before, after)
+	if len(ops) == 0 {
+		err := errors.New("the servers are the same in both group files, there is nothing to re-key")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	batchSize := c.Int(optionBatchSize)
+	if batchSize <= 0 {
+		err := errors.New("batch must be positive")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+	signer, err := rekeySigner(c.String(optionConfig), ops)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	keys := rekeyKeys(keyBefore, ops)
+
+	dryRun := c.Bool(optionDryRun)
+	store, err := openRekeyStore(c, dryRun)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	serializedBefore, err := lib.SerializePoint(keyBefore)
+	if err != nil {
+		store.Close(false)
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	log.LLvl1("Re-keying", store.Len(), "records from collective key", serializedBefore, "to", keyAfter)
+	clients := make([]*serviceI2B2dc.API, len(ops))
+	for i, op := range ops {
+		log.LLvl1("Step", i+1, "of", len(ops), ":", op)
+		clients[i] = serviceI2B2dc.NewClientWithKeys(op.server, strconv.Itoa(i), signer)
+	}
+	transform := func(i int, op rekeyOperation, key abstract.Point, records []lib.DpResponse) ([]lib.DpResponse, error) {
+		return clients[i].AddRmServer(op.roster, op.add, key, records)
+	}
+
+	start := time.Now()
+	if err := rekeyRecords(store, ops, keys, transform, batchSize, dryRun); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	if dryRun {
+		log.LLvl1("Dry run: all servers accept re-keying, nothing was written")
+		return nil
+	}
+	log.LLvl1("Re-keying time: ", time.Since(start))
+	return nil
+}
+
+// rekeyTransform applies the operation i of a plan to records encrypted under key and returns them re-keyed. The
+// servers of the operations do it (see API.AddRmServer).
+type rekeyTransform func(i int, op rekeyOperation, key abstract.Point, records []lib.DpResponse) ([]lib.DpResponse, error)
+
+// rekeyRecords re-keys the records of the store in batches with the operations of the plan (keys being the keys
+// before each operation, see rekeyKeys) and closes it, keeping the re-keyed records only if all were. With dryRun,
+// nothing is read nor written: an empty request checks that each server is reachable and accepts its operation.
+func rekeyRecords(store rekeyStore, ops []rekeyOperation, keys []abstract.Point, transform rekeyTransform, batchSize int, dryRun bool) error {
+	if dryRun {
+		store.Close(false)
+		for i, op := range ops {
+			if _, err := transform(i, op, keys[i], nil); err != nil {
+				return errors.New("dry run: could not " + op.String() + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+
+	done := 0
+	for {
+		records, err := store.Next(batchSize)
+		if err != nil {
+			store.Close(false)
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+
+		for i, op := range ops {
+			if records, err = transform(i, op, keys[i], records); err != nil {
+				store.Close(false)
+				return errors.New("could not " + op.String() + ": " + err.Error())
+			}
+		}
+		if err := store.Write(records); err != nil {
+			store.Close(false)
+			return err
+		}
+		done += len(records)
+		log.LLvl1("Re-keyed", done, "/", store.Len(), "records")
+	}
+	return store.Close(true)
+}
+
+// rekeyWindowFromApp opens (or closes) the re-keying window of the server running in the current directory.
+func rekeyWindowFromApp(c *cli.Context) error {
+	if c.Bool(optionCloseWindow) {
+		if err := os.Remove(serviceI2B2dc.RekeyFile); err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		log.LLvl1("Re-keying window closed")
+		return nil
+	}
+
+	add, remove := c.Bool(optionAdd), c.Bool(optionRemove)
+	if add == remove {
+		err := errors.New("exactly one of --" + optionAdd + " and --" + optionRemove + " must be given")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	w := serviceI2B2dc.RekeyWindow{Add: add, Expires: time.Now().Add(c.Duration(optionRekeyWindow))}
+	if err := serviceI2B2dc.SaveRekeyWindow(serviceI2B2dc.RekeyFile, w); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	log.LLvl1("Re-keying window open until", w.Expires)
+	return nil
+}
+
+// Data to re-key
+//______________________________________________________________________________________________________________________
+
+// rekeyStore holds encrypted records which are re-keyed in batches.
+type rekeyStore interface {
+	// Len returns the number of records
+	Len() int
+	// Next returns the next batch of at most n records (none when all records were read)
+	Next(n int) ([]lib.DpResponse, error)
+	// Write replaces the records of the last batch by their re-keyed version
+	Write(records []lib.DpResponse) error
+	// Close ends the re-keying, the written records are only kept if commit is true
+	Close(commit bool) error
+}
+
+// openRekeyStore opens the CSV file or the database table given on the command line.
+func openRekeyStore(c *cli.Context, dryRun bool) (rekeyStore, error) {
+	csvIn, dbFile := c.String(optionCsvFileIn), c.String(optionDbConfig)
+	switch {
+	case csvIn != "" && dbFile == "":
+		csvOut := c.String(optionCsvFileOut)
+		if csvOut == "" && !dryRun {
+			return nil, errors.New("--" + optionCsvFileOut + " is required to re-key a CSV file")
+		}
+		return newCsvRekeyStore(csvIn, csvOut, strings.Split(c.String(attributeToEncrypt), ","), dryRun)
+	case csvIn == "" && dbFile != "":
+		dbc, err := readDatabaseConfig(dbFile)
+		if err != nil {
+			return nil, err
+		}
+		if dbc.RangeProofBits > 0 {
+			return nil, errors.New("range proofs cannot be re-keyed, the data of " + dbc.Table + " has to be encrypted again")
+		}
+		db, err := dbc.Open()
+		if err != nil {
+			return nil, err
+		}
+		return newDbRekeyStore(db, dbc)
+	default:
+		return nil, errors.New("exactly one of --" + optionCsvFileIn + " and --" + optionDbConfig + " must be given")
+	}
+}
+
+// csvRekeyStore re-keys the encrypted attributes of a CSV file. The re-keyed file is written next to the output file
+// and only renamed at the end, so that the output can be the input file.
+type csvRekeyStore struct {
+	nbrRecords int
+	attributes []string
+	headerMap  map[string]int
+
+	in      *os.File
+	r       *csv.Reader
+	line    int
+	pending [][]string
+
+	out     *os.File
+	w       *csv.Writer
+	outPath string
+}
+
+func newCsvRekeyStore(inPath, outPath string, attributes []string, dryRun bool) (*csvRekeyStore, error) {
+	nbrRecords, err := countCsvRecords(inPath)
+	if err != nil {
+		return nil, err
+	}
+	in, err := os.Open(inPath)
+	if err != nil {
+		return nil, err
+	}
+	st := &csvRekeyStore{nbrRecords: nbrRecords, attributes: attributes, in: in, r: csv.NewReader(in), line: 1,
+		outPath: outPath}
+
+	header, err := st.r.Read()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	st.headerMap = convertSliceToMap(&header)
+	for _, a := range attributes {
+		if _, ok := st.headerMap[a]; !ok {
+			in.Close()
+			return nil, errors.New("attribute " + a + " is not in the CSV header")
+		}
+		// a range proof is bound to the key under which the value was encrypted
+		if _, ok := st.headerMap[rangeProofColumn(a)]; ok {
+			in.Close()
+			return nil, errors.New("range proofs (" + rangeProofColumn(a) + ") cannot be re-keyed, the data has to be encrypted again")
+		}
+	}
+
+	if !dryRun {
+		if st.out, err = os.Create(outPath + ".rekey"); err != nil {
+			in.Close()
+			return nil, err
+		}
+		st.w = csv.NewWriter(st.out)
+		if err := st.w.Write(header); err != nil {
+			st.Close(false)
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (st *csvRekeyStore) Len() int {
+	return st.nbrRecords
+}
+
+func (st *csvRekeyStore) Next(n int) ([]lib.DpResponse, error) {
+	st.pending = st.pending[:0]
+	records := make([]lib.DpResponse, 0, n)
+	for len(records) < n {
+		rec, err := st.r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		st.line++
+
+		attributes := make(map[string]lib.CipherText, len(st.attributes))
+		for _, a := range st.attributes {
+			ct, err := lib.NewCipherTextFromBase64(rec[st.headerMap[a]])
+			if err != nil {
+				return nil, errors.New("invalid ciphertext for attribute " + a + " in line " +
+					strconv.Itoa(st.line) + ": " + err.Error())
+			}
+			attributes[a] = *ct
+		}
+		st.pending = append(st.pending, rec)
+		records = append(records, lib.DpResponse{AggregatingAttributesEnc: attributes})
+	}
+	return records, nil
+}
+
+func (st *csvRekeyStore) Write(records []lib.DpResponse) error {
+	for i, rec := range st.pending {
+		for _, a := range st.attributes {
+			ct := records[i].AggregatingAttributesEnc[a]
+			rec[st.headerMap[a]] = ct.Serialize()
+		}
+		if err := st.w.Write(rec); err != nil {
+			return err
+		}
+	}
+	st.w.Flush()
+	return st.w.Error()
+}
+
+func (st *csvRekeyStore) Close(commit bool) error {
+	st.in.Close()
+	if st.out == nil {
+		return nil
+	}
+	err := st.out.Close()
+	if !commit || err != nil {
+		os.Remove(st.out.Name())
+		return err
+	}
+	return os.Rename(st.out.Name(), st.outPath)
+}
+
+// dbRekeyStore re-keys the encrypted counts of a database table (the count column of its configuration) in a single
+// transaction, rows being identified by their ctid.
+type dbRekeyStore struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	update *sql.Stmt
+
+	ctids   []string
+	values  []string
+	pos     int
+	pending []string
+}
+
+// newDbRekeyStore reads the ctid and encrypted count of all the rows of the table of dbc, in the database db which it
+// closes with the store.
+func newDbRekeyStore(db *sql.DB, dbc *serviceI2B2dc.DatabaseConfig) (*dbRekeyStore, error) {
+	column := dbc.QuotedColumns()[3]
+	st := &dbRekeyStore{db: db}
+	var err error
+	if st.tx, err = db.Begin(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	rows, err := st.tx.Query("SELECT ctid, " + column + " FROM " + dbc.Table)
+	if err != nil {
+		st.Close(false)
+		return nil, err
+	}
+	for rows.Next() {
+		var ctid, value string
+		if err := rows.Scan(&ctid, &value); err != nil {
+			rows.Close()
+			st.Close(false)
+			return nil, err
+		}
+		st.ctids = append(st.ctids, ctid)
+		st.values = append(st.values, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		st.Close(false)
+		return nil, err
+	}
+
+	if st.update, err = st.tx.Prepare("UPDATE " + dbc.Table + " SET " + column + " = $1 WHERE ctid = $2::tid"); err != nil {
+		st.Close(false)
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *dbRekeyStore) Len() int {
+	return len(st.ctids)
+}
+
+func (st *dbRekeyStore) Next(n int) ([]lib.DpResponse, error) {
+	end := st.pos + n
+	if end > len(st.ctids) {
+		end = len(st.ctids)
+	}
+	st.pending = st.ctids[st.pos:end]
+
+	records := make([]lib.DpResponse, 0, end-st.pos)
+	for i := st.pos; i < end; i++ {
+		ct, err := lib.NewCipherTextFromBase64(st.values[i])
+		if err != nil {
+			return nil, errors.New("invalid ciphertext in row " + st.ctids[i] + ": " + err.Error())
+		}
+		records = append(records, lib.DpResponse{AggregatingAttributesEnc: map[string]lib.CipherText{"value": *ct}})
+	}
+	st.pos = end
+	return records, nil
+}
+
+func (st *dbRekeyStore) Write(records []lib.DpResponse) error {
+	for i, ctid := range st.pending {
+		ct := records[i].AggregatingAttributesEnc["value"]
+		if _, err := st.update.Exec(ct.Serialize(), ctid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *dbRekeyStore) Close(commit bool) error {
+	defer st.db.Close()
+	if !commit {
+		return st.tx.Rollback()
+	}
+	return st.tx.Commit()
+}
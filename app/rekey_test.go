@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// rekeyTestServers are servers with their private keys, which re-key the records locally.
+type rekeyTestServers struct {
+	identities []*network.ServerIdentity
+	secrets    map[string]abstract.Scalar
+}
+
+func newRekeyTestServers(n int) *rekeyTestServers {
+	servers := &rekeyTestServers{secrets: make(map[string]abstract.Scalar)}
+	for i := 0; i < n; i++ {
+		secret, public := lib.GenKey()
+		si := network.NewServerIdentity(public, network.NewTCPAddress("127.0.0.1:"+strconv.Itoa(2000+i)))
+		servers.identities = append(servers.identities, si)
+		servers.secrets[public.String()] = secret
+	}
+	return servers
+}
+
+// roster returns the roster of the servers of the given indexes.
+func (servers *rekeyTestServers) roster(indexes ...int) *onet.Roster {
+	var list []*network.ServerIdentity
+	for _, i := range indexes {
+		list = append(list, servers.identities[i])
+	}
+	return onet.NewRoster(list)
+}
+
+// key returns the collective key of the servers of the given indexes and its private key.
+func (servers *rekeyTestServers) key(indexes ...int) (abstract.Scalar, abstract.Point) {
+	secret := network.Suite.Scalar().Zero()
+	for _, i := range indexes {
+		secret.Add(secret, servers.secrets[servers.identities[i].Public.String()])
+	}
+	return secret, network.Suite.Point().Mul(nil, secret)
+}
+
+// transform applies an operation as its server does, after checking the key the records are encrypted under.
+func (servers *rekeyTestServers) transform(t *testing.T, keys []abstract.Point) rekeyTransform {
+	return func(i int, op rekeyOperation, key abstract.Point, records []lib.DpResponse) ([]lib.DpResponse, error) {
+		assert.True(t, key.Equal(keys[i]))
+		secret := servers.secrets[op.server.Public.String()]
+		result := make([]lib.DpResponse, len(records))
+		for j, r := range records {
+			result[j].AggregatingAttributesEnc = make(map[string]lib.CipherText)
+			for a, ct := range r.AggregatingAttributesEnc {
+				contribution := network.Suite.Point().Mul(ct.K, secret)
+				if op.add {
+					ct.C = network.Suite.Point().Add(ct.C, contribution)
+				} else {
+					ct.C = network.Suite.Point().Sub(ct.C, contribution)
+				}
+				result[j].AggregatingAttributesEnc[a] = ct
+			}
+		}
+		return result, nil
+	}
+}
+
+func TestRekeyPlan(t *testing.T) {
+	servers := newRekeyTestServers(4)
+	before, after := servers.roster(0, 1, 2), servers.roster(0, 2, 3)
+
+	// the joining server comes before the leaving one
+	ops := rekeyPlan(before, after)
+	if assert.Len(t, ops, 2) {
+		assert.True(t, ops[0].add)
+		assert.True(t, ops[0].server.Public.Equal(servers.identities[3].Public))
+		assert.Equal(t, after, ops[0].roster)
+		assert.False(t, ops[1].add)
+		assert.True(t, ops[1].server.Public.Equal(servers.identities[1].Public))
+		assert.Equal(t, before, ops[1].roster)
+	}
+	assert.Empty(t, rekeyPlan(before, servers.roster(2, 1, 0)))
+
+	_, keyBefore := servers.key(0, 1, 2)
+	_, keyAdded := servers.key(0, 1, 2, 3)
+	_, keyAfter := servers.key(0, 2, 3)
+	keys := rekeyKeys(keyBefore, ops)
+	if assert.Len(t, keys, 3) {
+		assert.True(t, keys[0].Equal(keyBefore))
+		assert.True(t, keys[1].Equal(keyAdded))
+		assert.True(t, keys[2].Equal(keyAfter))
+	}
+}
+
+func TestRekeyCsv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	servers := newRekeyTestServers(4)
+	_, keyBefore := servers.key(0, 1, 2)
+	secretAfter, _ := servers.key(0, 2, 3)
+	ops := rekeyPlan(servers.roster(0, 1, 2), servers.roster(0, 2, 3))
+	keys := rekeyKeys(keyBefore, ops)
+
+	content := "location,count\n"
+	for i := 0; i < 5; i++ {
+		content += "L" + strconv.Itoa(i) + "," + lib.EncryptInt(keyBefore, int64(10*i)).Serialize() + "\n"
+	}
+	in := writeTestCsv(t, dir, "in.csv", content)
+	out := filepath.Join(dir, "out.csv")
+
+	// a dry run only asks each server for its operation
+	store, err := newCsvRekeyStore(in, out, []string{"count"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	asked := 0
+	dryRun := func(i int, op rekeyOperation, key abstract.Point, records []lib.DpResponse) ([]lib.DpResponse, error) {
+		asked++
+		assert.Empty(t, records)
+		return nil, nil
+	}
+	assert.NoError(t, rekeyRecords(store, ops, keys, dryRun, 2, true))
+	assert.Equal(t, len(ops), asked)
+	assertNoRekeyOutput(t, out)
+
+	// a failure leaves no output
+	store, err = newCsvRekeyStore(in, out, []string{"count"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := func(i int, op rekeyOperation, key abstract.Point, records []lib.DpResponse) ([]lib.DpResponse, error) {
+		return nil, errors.New("window closed")
+	}
+	assert.Error(t, rekeyRecords(store, ops, keys, failing, 2, false))
+	assertNoRekeyOutput(t, out)
+
+	store, err = newCsvRekeyStore(in, out, []string{"count"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5, store.Len())
+	assert.NoError(t, rekeyRecords(store, ops, keys, servers.transform(t, keys), 2, false))
+
+	records := readTestCsv(t, out)
+	if assert.Len(t, records, 6) {
+		assert.Equal(t, []string{"location", "count"}, records[0])
+		for i, rec := range records[1:] {
+			assert.Equal(t, "L"+strconv.Itoa(i), rec[0])
+			assert.Equal(t, int64(10*i), decryptTestCount(t, secretAfter, rec[1]))
+		}
+	}
+}
+
+// assertNoRekeyOutput checks that no re-keyed file was left.
+func assertNoRekeyOutput(t *testing.T, out string) {
+	for _, path := range []string{out, out + ".rekey"} {
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), path)
+	}
+}
+
+func TestRekeyDb(t *testing.T) {
+	servers := newRekeyTestServers(3)
+	_, keyBefore := servers.key(0, 1)
+	secretAfter, _ := servers.key(0, 1, 2)
+	ops := rekeyPlan(servers.roster(0, 1), servers.roster(0, 1, 2))
+	keys := rekeyKeys(keyBefore, ops)
+
+	// the counts are in the column of the configuration
+	db := &testDatabase{countColumn: "encrypted_count"}
+	for i := 0; i < 3; i++ {
+		db.table = append(db.table, []driver.Value{"L" + strconv.Itoa(i), "2017", "C1",
+			lib.EncryptInt(keyBefore, int64(i+1)).Serialize()})
+	}
+	dbc := &serviceI2B2dc.DatabaseConfig{Table: "dc_data", CountColumn: "encrypted_count"}
+	store, err := newDbRekeyStore(openTestDatabase(t, db), dbc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 3, store.Len())
+	assert.NoError(t, rekeyRecords(store, ops, keys, servers.transform(t, keys), 2, false))
+
+	for i, row := range db.table {
+		assert.Equal(t, int64(i+1), decryptTestCount(t, secretAfter, row[3].(string)))
+	}
+
+	// the default column is not the one of the table
+	_, err = newDbRekeyStore(openTestDatabase(t, db), &serviceI2B2dc.DatabaseConfig{Table: "dc_data"})
+	assert.Error(t, err)
+}
+
+func TestRekeyWindow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	window := func(add, remove, close bool) error {
+		set := flag.NewFlagSet("rekeyWindow", flag.ContinueOnError)
+		set.Bool(optionAdd, add, "")
+		set.Bool(optionRemove, remove, "")
+		set.Bool(optionCloseWindow, close, "")
+		set.Duration(optionRekeyWindow, time.Hour, "")
+		return rekeyWindowFromApp(cli.NewContext(cli.NewApp(), set, nil))
+	}
+
+	assert.Error(t, window(true, true, false))
+	assert.Error(t, window(false, false, false))
+
+	assert.NoError(t, window(false, true, false))
+	w, err := serviceI2B2dc.LoadRekeyWindow(serviceI2B2dc.RekeyFile)
+	if assert.NoError(t, err) && assert.NotNil(t, w) {
+		assert.False(t, w.Add)
+		assert.WithinDuration(t, time.Now().Add(time.Hour), w.Expires, time.Minute)
+	}
+	info, err := os.Stat(serviceI2B2dc.RekeyFile)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	assert.NoError(t, window(false, false, true))
+	_, err = os.Stat(serviceI2B2dc.RekeyFile)
+	assert.True(t, os.IsNotExist(err))
+	// closing a closed window is not an error
+	assert.NoError(t, window(false, false, true))
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// rosterServer is a server of the group file and what it answered about its keys.
+type rosterServer struct {
+	si   *network.ServerIdentity
+	info *serviceI2B2dc.ServerInfoResponse
+	err  error
+}
+
+// BEGIN CLIENT: ROSTER CHECK ----------
+
+// rosterFromApp prints the collective key under which the data of the group has to be encrypted, with its fingerprint,
+// and checks that every server of the group file is reachable and holds the keys the group file says it does.
+func rosterFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	servers, err := queryRosterServers(el)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	problems := rosterProblems(el, servers)
+
+	collectiveKey, source, err := serversCollectiveKey(el, servers)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	if err := printRoster(collectiveKey, source, servers); err != nil {
+		log.Error("Error while writing result.", err)
+		return cli.NewExitError(err, 4)
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Error(p)
+		}
+		err := errors.New("the group file and the servers disagree (" + strconv.Itoa(len(problems)) + " problems)")
+		log.Error(err)
+		return cli.NewExitError(err, 5)
+	}
+	return nil
+}
+
+// queryRosterServers asks every server of the roster (in parallel) for the keys it holds, with a random nonce that the
+// servers have to sign to prove they hold their private key.
+func queryRosterServers(el *onet.Roster) ([]rosterServer, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.New("couldn't draw the nonce of the servers: " + err.Error())
+	}
+
+	servers := make([]rosterServer, len(el.List))
+	wg := sync.WaitGroup{}
+	for i, si := range el.List {
+		wg.Add(1)
+		go func(i int, si *network.ServerIdentity) {
+			defer wg.Done()
+			info, err := serviceI2B2dc.NewClient(si, "roster").GetServerInfo(nonce)
+			if err == nil {
+				err = info.Verify(nonce)
+			}
+			servers[i] = rosterServer{si: si, info: info, err: err}
+		}(i, si)
+	}
+	wg.Wait()
+	return servers, nil
+}
+
+// rosterProblems lists the disagreements between the group file and what its servers answered.
+func rosterProblems(el *onet.Roster, servers []rosterServer) []string {
+	var problems []string
+	thresholdKeys := make(map[string]int)
+	for _, s := range servers {
+		switch {
+		case s.err != nil:
+			problems = append(problems, s.si.String()+" is not reachable or did not prove its identity: "+s.err.Error())
+			continue
+		case !s.info.Public.Equal(s.si.Public):
+			problems = append(problems, s.si.String()+" holds another public key than the one of the group file")
+		case s.info.Suite != lib.CurrentSuite().String():
+			problems = append(problems, s.si.String()+" uses suite "+s.info.Suite+" instead of "+
+				lib.CurrentSuite().String())
+		}
+		thresholdKeys[s.info.CollectiveKey]++
+		if s.info.CollectiveKey != "" && s.info.N != len(el.List) {
+			problems = append(problems, s.si.String()+" holds a share of a threshold key generated by "+
+				strconv.Itoa(s.info.N)+" servers, the group file lists "+strconv.Itoa(len(el.List)))
+		}
+	}
+	if len(thresholdKeys) > 1 {
+		problems = append(problems, "the servers do not hold the same threshold collective key ("+
+			strconv.Itoa(len(thresholdKeys))+" different keys, run dkg or rotateKey again)")
+	}
+	return problems
+}
+
+// serversCollectiveKey returns the key under which the servers encrypt their data and where it comes from: the
+// threshold collective key of the servers if they generated one, the aggregate of the public keys of the group file
+// otherwise. The aggregate is only returned when no server which answered holds a threshold key.
+func serversCollectiveKey(el *onet.Roster, servers []rosterServer) (abstract.Point, string, error) {
+	var thresholdKey string
+	for _, s := range servers {
+		if s.err != nil || s.info.CollectiveKey == "" {
+			continue
+		}
+		if thresholdKey != "" && s.info.CollectiveKey != thresholdKey {
+			return nil, "", errors.New("the servers do not hold the same threshold collective key")
+		}
+		thresholdKey = s.info.CollectiveKey
+	}
+	if thresholdKey != "" {
+		key, err := lib.DeserializePoint(thresholdKey)
+		return key, "threshold collective key of the servers", err
+	}
+	key, err := rosterAggregateKey(el)
+	return key, "aggregate of the public keys of the group file", err
+}
+
+// rosterCollectiveKey returns the key under which the servers of the roster encrypt their data (see
+// serversCollectiveKey). It fails unless all the servers answered and agree with the group file: the key given to
+// encrypt data cannot be guessed.
+func rosterCollectiveKey(el *onet.Roster) (abstract.Point, error) {
+	servers, err := queryRosterServers(el)
+	if err != nil {
+		return nil, err
+	}
+	if problems := rosterProblems(el, servers); len(problems) > 0 {
+		return nil, errors.New("the collective key of the group file cannot be checked with its servers (" +
+			strings.Join(problems, "; ") + "), see the roster command or give the key with --" + optionEncryptKey)
+	}
+	key, source, err := serversCollectiveKey(el, servers)
+	if err != nil {
+		return nil, err
+	}
+	log.Lvl1("Encrypting under the", source)
+	return key, nil
+}
+
+// printRoster writes the collective key and the keys held by each server on stdout.
+func printRoster(collectiveKey abstract.Point, source string, servers []rosterServer) error {
+	key, err := lib.SerializePoint(collectiveKey)
+	if err != nil {
+		return err
+	}
+	fingerprint, err := lib.PointFingerprint(collectiveKey)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "collective key:\t%s\n", key)
+	fmt.Fprintf(tw, "fingerprint:\t%s\n", fingerprint)
+	fmt.Fprintf(tw, "source:\t%s\n", source)
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "SERVER\tSTATUS\tSUITE\tTHRESHOLD KEY\tPUBLIC KEY FINGERPRINT")
+	for _, s := range servers {
+		if s.err != nil {
+			fmt.Fprintf(tw, "%s\tunreachable\t-\t-\t-\n", s.si)
+			continue
+		}
+		status := "ok"
+		if !s.info.Public.Equal(s.si.Public) {
+			status = "key mismatch"
+		} else if s.info.Suite != lib.CurrentSuite().String() {
+			status = "suite mismatch"
+		}
+		threshold := "-"
+		if s.info.CollectiveKey != "" {
+			threshold = strconv.Itoa(s.info.T) + "-of-" + strconv.Itoa(s.info.N)
+		}
+		fingerprint, err := lib.PointFingerprint(s.info.Public)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.si, status, s.info.Suite, threshold, fingerprint)
+	}
+	return tw.Flush()
+}
+
+// CLIENT END: ROSTER CHECK ------------
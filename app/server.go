@@ -1,12 +1,24 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
 	"gopkg.in/urfave/cli.v1"
 
 	// Empty imports to have the init-functions called which should
 	// register the protocol
 	_ "github.com/JLRgithub/PrivateDCi2b2/protocols"
-	_ "github.com/JLRgithub/PrivateDCi2b2/services"
 	"gopkg.in/dedis/onet.v1/app"
 )
 
@@ -14,7 +26,223 @@ func runServer(ctx *cli.Context) error {
 	// first check the options
 	config := ctx.String("config")
 
+	// the secret contribution of a server to the collective key is the private key of its identity
+	if lib.CurrentSuite().String() != network.Suite.String() {
+		return cli.NewExitError(errors.New("a server can only use the "+network.Suite.String()+" suite of its identity"), 1)
+	}
+
+	// the configuration is checked once, before the conode starts answering queries
+	conf, problems := loadServerConfig(config)
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Error(p)
+		}
+		return cli.NewExitError(errors.New("invalid server configuration "+config+" (see server check-config)"), 1)
+	}
+	if err := conf.Database.ResolveCredentials(databasePassphrase); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 1)
+	}
+	serviceI2B2dc.SetServerConfig(conf)
+	log.Lvl1("Using database configuration of", conf.DatabaseSource())
+
 	app.RunServer(config)
 
 	return nil
 }
+
+// loadServerConfig reads and validates a server configuration; it returns the problems found.
+func loadServerConfig(path string) (*serviceI2B2dc.ServerConfig, []error) {
+	conf, err := serviceI2B2dc.LoadServerConfig(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	return conf, conf.Validate()
+}
+
+// serverCheckConfigFromApp reports the problems of a server configuration, including the connection to its database,
+// without starting the server.
+func serverCheckConfigFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	path := c.String(optionConfig)
+	conf, problems := loadServerConfig(path)
+	if conf != nil && len(problems) == 0 {
+		if err := conf.Database.ResolveCredentials(databasePassphrase); err != nil {
+			problems = append(problems, err)
+		} else if err := conf.CheckDatabase(); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Println("[-]", p)
+		}
+		err := errors.New("the server configuration " + path + " has " + strconv.Itoa(len(problems)) + " problems")
+		log.Error(err)
+		return cli.NewExitError(err, 5)
+	}
+	fmt.Println("[+] server configuration " + path + " is valid (database configuration of " +
+		conf.DatabaseSource() + ")")
+	return nil
+}
+
+// serverSetupFromApp writes the configuration of a server: its identity and database configuration (private.toml) and
+// its public description to add to the group file (public.toml, also printed). Without --address, the configuration is
+// asked interactively.
+func serverSetupFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	if c.String(optionAddress) == "" {
+		if c.GlobalIsSet("debug") {
+			log.Fatal("[-] Debug option cannot be used for the interactive setup")
+		}
+		app.InteractiveConfig(BinaryName)
+		return nil
+	}
+
+	sources := 0
+	for _, option := range []string{optionDbPassword, optionDbPassEnv, optionDbPassFile} {
+		if c.String(option) != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		err := errors.New("only one of --" + optionDbPassword + ", --" + optionDbPassEnv + " and --" + optionDbPassFile +
+			" can be given")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	address := network.NewTCPAddress(c.String(optionAddress))
+	if !address.Valid() {
+		err := errors.New("invalid address " + c.String(optionAddress) + " (HOST:PORT expected)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	privatePath := c.String(optionConfig)
+	dir := filepath.Dir(privatePath)
+	publicPath := c.String(optionPublicConfig)
+	if publicPath == "" {
+		publicPath = filepath.Join(dir, "public.toml")
+	}
+	if !c.Bool(optionForce) {
+		for _, path := range []string{privatePath, publicPath} {
+			if fileExists(path) {
+				err := errors.New(path + " already exists (use --" + optionForce + " to overwrite it)")
+				log.Error(err)
+				return cli.NewExitError(err, 4)
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	// the identity of a server always uses the network suite
+	kp := config.NewKeyPair(network.Suite)
+	private, err := crypto.ScalarToStringHex(network.Suite, kp.Secret)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	public, err := crypto.PointToStringHex(network.Suite, kp.Public)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	description := c.String(optionDescription)
+	conf := &serviceI2B2dc.ServerConfig{Public: public, Private: private, Address: address, Description: description,
+		Database: serviceI2B2dc.DatabaseConfig{
+			Username:       c.String(optionDbUser),
+			Password:       c.String(optionDbPassword),
+			PasswordEnv:    c.String(optionDbPassEnv),
+			PasswordFile:   c.String(optionDbPassFile),
+			DbName:         c.String(optionDbName),
+			Table:          c.String(optionDbTable),
+			RangeProofBits: c.Int(optionRangeBits),
+		}}
+	if err := writeServerConfig(privatePath, conf); err != nil {
+		log.Error("Cannot write the server configuration: ", err)
+		return cli.NewExitError(err, 4)
+	}
+
+	server := app.NewServerToml(network.Suite, kp.Public, address)
+	server.Description = description
+	group := app.NewGroupToml(server)
+	if err := group.Save(publicPath); err != nil {
+		log.Error("Cannot write the public configuration: ", err)
+		return cli.NewExitError(err, 4)
+	}
+
+	log.Lvl1("Server configuration written to", privatePath)
+	fmt.Println("# add this server to the group file (" + publicPath + ")")
+	fmt.Print(group.String())
+	return nil
+}
+
+// serverEncryptPasswordFromApp prints the EncryptedPassword of a database configuration, for the password and the
+// passphrase typed in the terminal. The passphrase is then asked each time the server starts.
+func serverEncryptPasswordFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	password, err := promptPassphrase("Database password: ", true)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	passphrase, err := promptPassphrase("Passphrase protecting it: ", true)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+	encrypted, err := serviceI2B2dc.EncryptPassword(password, passphrase)
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	fmt.Println("# replace Password in the Database section of the server configuration with")
+	fmt.Println("EncryptedPassword = \"" + encrypted + "\"")
+	return nil
+}
+
+// writeServerConfig writes a server configuration readable only by its owner (it holds the private key and the
+// database password).
+func writeServerConfig(path string, conf *serviceI2B2dc.ServerConfig) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// an existing file keeps its permissions when it is truncated
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if err := toml.NewEncoder(f).Encode(conf); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// runTestSetup runs the non-interactive setup of a server, writing its configuration to path, with the given values of
+// the database password flags.
+func runTestSetup(path string, force bool, password map[string]string) error {
+	set := flag.NewFlagSet("setup", flag.ContinueOnError)
+	set.String(optionAddress, "127.0.0.1:2000", "")
+	set.String(optionDescription, "test server", "")
+	set.String(optionConfig, path, "")
+	set.String(optionPublicConfig, "", "")
+	set.String(optionDbUser, "i2b2demodata", "")
+	for _, option := range []string{optionDbPassword, optionDbPassEnv, optionDbPassFile} {
+		set.String(option, password[option], "")
+	}
+	set.String(optionDbName, "i2b2demodata", "")
+	set.String(optionDbTable, "public.demo_data_encrypted", "")
+	set.Int(optionRangeBits, 16, "")
+	set.Bool(optionForce, force, "")
+	return serverSetupFromApp(cli.NewContext(cli.NewApp(), set, nil))
+}
+
+func TestServerSetup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the directory of the configuration is created
+	private := filepath.Join(dir, "server", "private.toml")
+	assert.NoError(t, runTestSetup(private, false, nil))
+
+	info, err := os.Stat(private)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+	conf := serviceI2B2dc.ServerConfig{}
+	if _, err := toml.DecodeFile(private, &conf); assert.NoError(t, err) {
+		assert.Equal(t, "tcp://127.0.0.1:2000", conf.Address.String())
+		assert.Equal(t, "test server", conf.Description)
+		assert.NotEmpty(t, conf.Private)
+		assert.NotEmpty(t, conf.Public)
+		assert.Equal(t, "public.demo_data_encrypted", conf.Database.Table)
+		assert.Equal(t, 16, conf.Database.RangeProofBits)
+	}
+	_, err = os.Stat(filepath.Join(dir, "server", "public.toml"))
+	assert.NoError(t, err)
+}
+
+func TestServerSetupForce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "private.toml")
+	if err := ioutil.WriteFile(private, []byte("# existing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an existing configuration is only overwritten with --force
+	assert.Error(t, runTestSetup(private, false, nil))
+	content, err := ioutil.ReadFile(private)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "# existing\n", string(content))
+	}
+	_, err = os.Stat(filepath.Join(dir, "public.toml"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, runTestSetup(private, true, nil))
+	conf := serviceI2B2dc.ServerConfig{}
+	if _, err := toml.DecodeFile(private, &conf); assert.NoError(t, err) {
+		assert.NotEmpty(t, conf.Private)
+	}
+	// the overwritten configuration is no longer readable by the others
+	info, err := os.Stat(private)
+	if assert.NoError(t, err) {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+}
+
+func TestServerSetupPassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "private.toml")
+
+	// the password is not given on the command line
+	assert.NoError(t, runTestSetup(private, false, map[string]string{optionDbPassEnv: "I2B2DC_DB_PASSWORD"}))
+	conf := serviceI2B2dc.ServerConfig{}
+	if _, err := toml.DecodeFile(private, &conf); assert.NoError(t, err) {
+		assert.Equal(t, "I2B2DC_DB_PASSWORD", conf.Database.PasswordEnv)
+		assert.Empty(t, conf.Database.Password)
+	}
+
+	assert.NoError(t, runTestSetup(private, true, map[string]string{optionDbPassFile: "/etc/i2b2dc/db_password"}))
+	conf = serviceI2B2dc.ServerConfig{}
+	if _, err := toml.DecodeFile(private, &conf); assert.NoError(t, err) {
+		assert.Equal(t, "/etc/i2b2dc/db_password", conf.Database.PasswordFile)
+		assert.Empty(t, conf.Database.PasswordEnv)
+	}
+
+	// a single source of the password is accepted
+	other := filepath.Join(dir, "other.toml")
+	assert.Error(t, runTestSetup(other, false, map[string]string{optionDbPassword: "secret",
+		optionDbPassEnv: "I2B2DC_DB_PASSWORD"}))
+	_, err = os.Stat(other)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/peterh/liner"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// shellHelp describes the syntax of the lines read by the shell.
+const shellHelp = `A query is a list of terms KEY=VALUE[,VALUE...] where KEY is one of
+  concept   concept codes (e.g. concept=ICD10:E08,ICD10:E09)
+  location  location codes (e.g. location=hosp1)
+  time      time frames (e.g. time=2015,2016)
+  groupBy   attributes of the groups: location_cd, concept_cd, year
+The results are printed as a table. Other commands:
+  save FILE [FORMAT]  write the results of the last query (csv by default, or table, json, xml)
+  help                print this help
+  quit                leave the shell (or Ctrl-D)
+`
+
+// shellGroupByAttributes are the attributes by which the results of a query can be grouped.
+var shellGroupByAttributes = []string{"location_cd", "concept_cd", "year"}
+
+// shellGroupByKeys gives the key of the query terms whose codes are the labels of each group-by attribute.
+var shellGroupByKeys = map[string]string{"location_cd": "location", "concept_cd": "concept", "year": "time"}
+
+// shellVocabulary is the content of a vocabulary file: the codes proposed by the completion of the shell.
+type shellVocabulary struct {
+	Concepts  []string
+	Locations []string
+	Times     []string
+}
+
+// queryShell runs the queries typed by a user with the same client (and key pair).
+type queryShell struct {
+	servers    *onet.Roster
+	client     *serviceI2B2dc.API
+	vocabulary map[string]map[string]bool
+	last       *queryReport
+}
+
+// shellFromApp starts an interactive shell running the queries typed by the user on the servers of the group.
+func shellFromApp(c *cli.Context) error {
+	if c.NArg() != 0 {
+		err := errors.New("Wrong number of arguments (none allowed, except for the flags)")
+		log.Error(err)
+		return cli.NewExitError(err, 3)
+	}
+
+	el, err := openGroupToml(c.String(optionGroupFile))
+	if err != nil {
+		log.Error(err)
+		return cli.NewExitError(err, 4)
+	}
+
+	sh := newQueryShell(el, newQueryClient(el, "shell", config.NewKeyPair(lib.CurrentSuite()), queryOptionsFromApp(c)))
+	if file := c.String(optionVocabulary); file != "" {
+		voc := shellVocabulary{}
+		if _, err := toml.DecodeFile(file, &voc); err != nil {
+			log.Error("Invalid vocabulary file: ", err)
+			return cli.NewExitError(err, 4)
+		}
+		sh.learn("concept", voc.Concepts)
+		sh.learn("location", voc.Locations)
+		sh.learn("time", voc.Times)
+	}
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetWordCompleter(sh.complete)
+
+	fmt.Println("Connected to", len(el.List), "servers, type help for the syntax of the queries")
+	for {
+		input, err := line.Prompt(BinaryName + "> ")
+		if err == io.EOF || err == liner.ErrPromptAborted {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			log.Error(err)
+			return cli.NewExitError(err, 4)
+		}
+		input = strings.TrimSpace(input)
+		if input == "" {
+			continue
+		}
+		line.AppendHistory(input)
+		if quit := sh.execute(input); quit {
+			return nil
+		}
+	}
+}
+
+// newQueryShell creates a shell sending its queries with the client, which only knows the group-by attributes.
+func newQueryShell(servers *onet.Roster, client *serviceI2B2dc.API) *queryShell {
+	sh := &queryShell{
+		servers: servers,
+		client:  client,
+		vocabulary: map[string]map[string]bool{
+			"concept":  {},
+			"location": {},
+			"time":     {},
+			"groupBy":  {},
+		},
+	}
+	sh.learn("groupBy", shellGroupByAttributes)
+	return sh
+}
+
+// execute runs a line typed by the user and reports whether the shell has to stop.
+func (sh *queryShell) execute(input string) bool {
+	fields := strings.Fields(input)
+	switch fields[0] {
+	case "quit", "exit":
+		return true
+	case "help":
+		fmt.Print(shellHelp)
+	case "save":
+		if err := sh.save(fields[1:]); err != nil {
+			fmt.Println("Error:", err)
+		}
+	default:
+		if err := sh.query(fields); err != nil {
+			fmt.Println("Error:", err)
+		}
+	}
+	return false
+}
+
+// query runs the query described by the terms and prints its results.
+func (sh *queryShell) query(terms []string) error {
+	values := make(map[string][]string)
+	for _, term := range terms {
+		kv := strings.SplitN(term, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return errors.New("invalid term " + term + " (KEY=VALUE[,VALUE...], see help)")
+		}
+		if _, ok := sh.vocabulary[kv[0]]; !ok {
+			return errors.New("unknown key " + kv[0] + " (concept, location, time or groupBy)")
+		}
+		values[kv[0]] = append(values[kv[0]], strings.Split(kv[1], ",")...)
+	}
+	for _, attribute := range values["groupBy"] {
+		if !sh.vocabulary["groupBy"][attribute] {
+			return errors.New("cannot group by " + attribute + " (" + strings.Join(shellGroupByAttributes, ", ") + ")")
+		}
+	}
+
+	report, err := executeQuery(sh.client, sh.servers, values["location"], values["time"], values["concept"],
+		values["groupBy"])
+	if err != nil {
+		return err
+	}
+	sh.last = report
+	for key, codes := range values {
+		sh.learn(key, codes)
+	}
+	// the group labels are codes that can be used in the next queries
+	for i, attribute := range report.GroupBy {
+		for _, g := range report.Groups {
+			if i < len(g.Labels) {
+				sh.learn(shellGroupByKeys[attribute], []string{g.Labels[i]})
+			}
+		}
+	}
+	return writeQueryReport(os.Stdout, report, formatTable)
+}
+
+// save writes the results of the last query to a file.
+func (sh *queryShell) save(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: save FILE [FORMAT]")
+	}
+	if sh.last == nil {
+		return errors.New("no results to save")
+	}
+	format := formatCsv
+	if len(args) == 2 {
+		format = args[1]
+	}
+	if _, err := outputExtension(format); err != nil {
+		return err
+	}
+	return writeQueryReportFile(args[0], sh.last, format)
+}
+
+// learn adds codes to the ones proposed for a key.
+func (sh *queryShell) learn(key string, codes []string) {
+	for _, code := range codes {
+		if code != "" {
+			sh.vocabulary[key][code] = true
+		}
+	}
+}
+
+// complete proposes the keys, the commands or the known codes for the word at the cursor.
+func (sh *queryShell) complete(line string, pos int) (string, []string, string) {
+	// pos counts runes, the indexes below are byte offsets in before
+	runes := []rune(line)
+	before, tail := string(runes[:pos]), string(runes[pos:])
+	start := strings.LastIndexAny(before, " \t") + 1
+	head, word := before[:start], before[start:]
+
+	var candidates []string
+	if eq := strings.Index(word, "="); eq >= 0 {
+		// the last value of the term is completed
+		key := word[:eq]
+		sep := strings.LastIndex(word, ",")
+		if sep < eq {
+			sep = eq
+		}
+		head += word[:sep+1]
+		word = word[sep+1:]
+		for code := range sh.vocabulary[key] {
+			candidates = append(candidates, code)
+		}
+	} else {
+		for key := range sh.vocabulary {
+			candidates = append(candidates, key+"=")
+		}
+		if head == "" {
+			candidates = append(candidates, "save ", "help", "quit")
+		}
+	}
+
+	var completions []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			completions = append(completions, c)
+		}
+	}
+	sort.Strings(completions)
+	return head, completions, tail
+}
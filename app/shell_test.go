@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/services"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// shellTestQuery are the parameters of the last query of the stub of executeQuery.
+type shellTestQuery struct {
+	locations, times, concepts, groupBy []string
+}
+
+// stubShellQuery replaces the servers answering the queries of the shell: each query returns one group of count 7,
+// labelled hosp2 by location_cd, and its parameters are recorded in last. It returns the function restoring
+// executeQuery.
+func stubShellQuery(last *shellTestQuery) func() {
+	previous := executeQuery
+	executeQuery = func(client *serviceI2B2dc.API, servers *onet.Roster, locations, times, concepts, groupBy []string) (*queryReport, error) {
+		*last = shellTestQuery{locations, times, concepts, groupBy}
+		if len(concepts) > 0 && concepts[0] == "failing" {
+			return nil, errors.New("Query could not be executed: failing concept")
+		}
+		result := &serviceI2B2dc.QueryResult{QueryID: "shell", Counts: []int64{7}}
+		group := ""
+		for i, attribute := range groupBy {
+			if i > 0 {
+				group += ","
+			}
+			group += map[string]string{"location_cd": "hosp2", "concept_cd": "C9", "year": "2019"}[attribute]
+		}
+		result.Groups = []string{group}
+		return newQueryReport(servers, groupBy, result, 0), nil
+	}
+	return func() { executeQuery = previous }
+}
+
+func TestShellQuery(t *testing.T) {
+	last := shellTestQuery{}
+	defer stubShellQuery(&last)()
+
+	tests := []struct {
+		input []string
+		err   string
+		query shellTestQuery
+	}{
+		{[]string{"concept=C1,C2", "location=hosp1"}, "",
+			shellTestQuery{locations: []string{"hosp1"}, concepts: []string{"C1", "C2"}}},
+		{[]string{"concept=C1", "time=2015,2016", "concept=C2"}, "",
+			shellTestQuery{times: []string{"2015", "2016"}, concepts: []string{"C1", "C2"}}},
+		{[]string{"concept=ICD10:E08=x"}, "", shellTestQuery{concepts: []string{"ICD10:E08=x"}}},
+		{[]string{"concept=C1", "groupBy=location_cd,year"}, "",
+			shellTestQuery{concepts: []string{"C1"}, groupBy: []string{"location_cd", "year"}}},
+		{[]string{"concept"}, "invalid term concept (KEY=VALUE[,VALUE...], see help)", shellTestQuery{}},
+		{[]string{"concept="}, "invalid term concept= (KEY=VALUE[,VALUE...], see help)", shellTestQuery{}},
+		{[]string{"=C1"}, "unknown key  (concept, location, time or groupBy)", shellTestQuery{}},
+		{[]string{"site=hosp1"}, "unknown key site (concept, location, time or groupBy)", shellTestQuery{}},
+		{[]string{"concept=C1", "groupBy=patient_num"},
+			"cannot group by patient_num (location_cd, concept_cd, year)", shellTestQuery{}},
+		{[]string{"concept=failing"}, "Query could not be executed: failing concept",
+			shellTestQuery{concepts: []string{"failing"}}},
+	}
+	for _, test := range tests {
+		sh := newQueryShell(newTestRoster(), nil)
+		last = shellTestQuery{}
+		_, err := captureStdout(t, func() error { return sh.query(test.input) })
+		if test.err == "" {
+			assert.NoError(t, err, "%v", test.input)
+			assert.NotNil(t, sh.last, "%v", test.input)
+		} else {
+			assert.EqualError(t, err, test.err, "%v", test.input)
+			assert.Nil(t, sh.last, "%v", test.input)
+		}
+		assert.Equal(t, test.query, last, "%v", test.input)
+	}
+}
+
+func TestShellQueryLearns(t *testing.T) {
+	last := shellTestQuery{}
+	defer stubShellQuery(&last)()
+	sh := newQueryShell(newTestRoster(), nil)
+
+	out, err := captureStdout(t, func() error { return sh.query([]string{"concept=C1", "groupBy=location_cd"}) })
+	assert.NoError(t, err)
+	assert.Contains(t, out, "hosp2")
+
+	// the codes of the query and the labels of the results are proposed
+	_, completions, _ := sh.complete("concept=", 8)
+	assert.Equal(t, []string{"C1"}, completions)
+	_, completions, _ = sh.complete("location=h", 10)
+	assert.Equal(t, []string{"hosp2"}, completions)
+}
+
+func TestShellSave(t *testing.T) {
+	last := shellTestQuery{}
+	defer stubShellQuery(&last)()
+	dir, err := ioutil.TempDir("", "shell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sh := newQueryShell(newTestRoster(), nil)
+	assert.EqualError(t, sh.save([]string{filepath.Join(dir, "early.csv")}), "no results to save")
+	if _, err := captureStdout(t, func() error { return sh.query([]string{"concept=C1", "groupBy=location_cd"}) }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args  []string
+		err   string
+		files []string
+	}{
+		{nil, "usage: save FILE [FORMAT]", nil},
+		{[]string{"a", "csv", "b"}, "usage: save FILE [FORMAT]", nil},
+		{[]string{"results.yaml", "yaml"}, "unknown output format yaml (table, csv, json, xml)", nil},
+		// csv by default, with the description of the query next to it
+		{[]string{"results.csv"}, "", []string{"results.csv", "results.csv" + metadataExtension}},
+		{[]string{"results.json", formatJSON}, "", []string{"results.json"}},
+		{[]string{"results.txt", formatTable}, "", []string{"results.txt"}},
+	}
+	for _, test := range tests {
+		args := append([]string{}, test.args...)
+		if len(args) > 0 {
+			args[0] = filepath.Join(dir, args[0])
+		}
+		err := sh.save(args)
+		if test.err != "" {
+			assert.EqualError(t, err, test.err, "%v", test.args)
+			continue
+		}
+		assert.NoError(t, err, "%v", test.args)
+		for _, file := range test.files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, file))
+			if assert.NoError(t, err, file) {
+				assert.NotEmpty(t, data, file)
+			}
+		}
+	}
+	_, err = os.Stat(filepath.Join(dir, "results.yaml"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "results.json"+metadataExtension))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestShellComplete(t *testing.T) {
+	sh := newQueryShell(newTestRoster(), nil)
+	sh.learn("concept", []string{"ICD10:E08", "ICD10:E09", "É:1"})
+	sh.learn("location", []string{"hôpital", "hosp1"})
+
+	tests := []struct {
+		line        string
+		pos         int
+		head        string
+		completions []string
+		tail        string
+	}{
+		{"", 0, "", []string{"concept=", "groupBy=", "help", "location=", "quit", "save ", "time="}, ""},
+		{"sa", 2, "", []string{"save "}, ""},
+		{"con", 3, "", []string{"concept="}, ""},
+		// the commands are only proposed for the first word
+		{"concept=C1 sa", 13, "concept=C1 ", nil, ""},
+		{"concept=C1 g", 12, "concept=C1 ", []string{"groupBy="}, ""},
+		{"concept=ICD10:E0", 16, "concept=", []string{"ICD10:E08", "ICD10:E09"}, ""},
+		{"concept=ICD10:E08,I", 19, "concept=ICD10:E08,", []string{"ICD10:E08", "ICD10:E09"}, ""},
+		{"groupBy=location_cd,", 20, "groupBy=location_cd,", []string{"concept_cd", "location_cd", "year"}, ""},
+		{"site=", 5, "site=", nil, ""},
+		// multibyte codes: pos counts runes
+		{"location=hô", 11, "location=", []string{"hôpital"}, ""},
+		{"concept=É", 9, "concept=", []string{"É:1"}, ""},
+		{"location=hôpital con", 20, "location=hôpital ", []string{"concept="}, ""},
+		{"location=hôpital con time=2015", 20, "location=hôpital ", []string{"concept="}, " time=2015"},
+		{"location=hôp time=2015", 12, "location=", []string{"hôpital"}, " time=2015"},
+		{"concept=É:1 location=h", 22, "concept=É:1 location=", []string{"hosp1", "hôpital"}, ""},
+	}
+	for _, test := range tests {
+		head, completions, tail := sh.complete(test.line, test.pos)
+		assert.Equal(t, test.head, head, test.line)
+		assert.Equal(t, test.completions, completions, test.line)
+		assert.Equal(t, test.tail, tail, test.line)
+	}
+}
@@ -8,6 +8,8 @@ DBG_CLIENT=1
 # For easier debugging
 BUILDDIR=$(pwd)
 STATICDIR=test
+# Password of the database user, read by the servers from the environment (see db.toml)
+export I2B2DC_DB_PASSWORD=${I2B2DC_DB_PASSWORD:-i2b2demodata}
 
 . $GOPATH/src/gopkg.in/dedis/onet.v1/app/libtest.sh
 
@@ -3,7 +3,7 @@ CREATE TABLE i2b2demodata.demo_data_encrypted
     location_cd character varying(50) COLLATE pg_catalog."default",
     "time" character varying(7) COLLATE pg_catalog."default",
     concept_cd character varying(50) COLLATE pg_catalog."default",
-    totalnum character varying(88) COLLATE pg_catalog."default"
+    totalnum text COLLATE pg_catalog."default"
 )
 WITH (
     OIDS = FALSE
@@ -12,3 +12,6 @@ TABLESPACE pg_default;
 
 ALTER TABLE i2b2demodata.demo_data_encrypted
     OWNER to i2b2demodata;
+
+-- with RangeProofBits > 0 in db.toml, the range proofs generated by "encryptCsv --rangeBits" are stored next to the counts
+-- ALTER TABLE i2b2demodata.demo_data_encrypted ADD COLUMN totalnum_range_proof text COLLATE pg_catalog."default";
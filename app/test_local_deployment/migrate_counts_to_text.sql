@@ -0,0 +1,3 @@
+-- Migration of a table created with character varying(88) counts: ciphertexts serialized with their suite header do
+-- not fit in 88 characters. The counts already stored (without header) stay readable.
+ALTER TABLE i2b2demodata.demo_data_encrypted ALTER COLUMN totalnum TYPE text;
@@ -1,9 +1,15 @@
 package lib
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"golang.org/x/crypto/scrypt"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/random"
 	"gopkg.in/dedis/onet.v1/log"
@@ -19,6 +25,9 @@ const MaxHomomorphicInt int64 = 100000
 var PointToInt = make(map[string]int64, MaxHomomorphicInt)
 var currentGreatestM abstract.Point
 var currentGreatestInt int64
+
+// discreteLogMutex protects PointToInt and the greatest point computed, which are shared by all the decryptions.
+var discreteLogMutex sync.Mutex
 var suite = network.Suite
 
 // CipherText is an ElGamal encrypted point.
@@ -45,11 +54,17 @@ func NewCipherText() *CipherText {
 	return &CipherText{K: suite.Point().Null(), C: suite.Point().Null()}
 }
 
-// NewCipherTextFromBase64 creates a ciphertext of null elements.
-func NewCipherTextFromBase64(b64Encoded string) *CipherText {
-	cipherText := &CipherText{K: suite.Point().Null(), C: suite.Point().Null()}
-	(*cipherText).Deserialize(b64Encoded)
-	return cipherText
+// NewCipherTextFromBase64 creates a ciphertext from its base64 serialization and checks that it is a valid
+// encryption (see CheckValid).
+func NewCipherTextFromBase64(b64Encoded string) (*CipherText, error) {
+	cipherText := &CipherText{}
+	if err := (*cipherText).Deserialize(b64Encoded); err != nil {
+		return nil, err
+	}
+	if err := (*cipherText).CheckValid(); err != nil {
+		return nil, err
+	}
+	return cipherText, nil
 }
 
 // NewCipherVector creates a ciphervector of null elements.
@@ -187,7 +202,14 @@ func decryptPoint(prikey abstract.Scalar, c CipherText) abstract.Point {
 // DecryptInt decrypts an integer from an ElGamal cipher text where integer are encoded in the exponent.
 func DecryptInt(prikey abstract.Scalar, cipher CipherText) int64 {
 	M := decryptPoint(prikey, cipher)
-	return discreteLog(M)
+	return discreteLog(M, false)
+}
+
+// DecryptIntWithNeg decrypts an integer which can be negative (e.g. a count with noise) from an ElGamal cipher text,
+// between -MaxHomomorphicInt and MaxHomomorphicInt.
+func DecryptIntWithNeg(prikey abstract.Scalar, cipher CipherText) int64 {
+	M := decryptPoint(prikey, cipher)
+	return discreteLog(M, true)
 }
 
 // DecryptIntVector decrypts a cipherVector.
@@ -199,8 +221,12 @@ func DecryptIntVector(prikey abstract.Scalar, cipherVector *CipherVector) []int6
 	return result
 }
 
-// Brute-Forces the discrete log for integer decoding.
-func discreteLog(P abstract.Point) int64 {
+// Brute-Forces the discrete log for integer decoding. With neg, the opposite of P is searched at the same time and
+// a negative integer is returned if it is found first.
+func discreteLog(P abstract.Point, neg bool) int64 {
+	discreteLogMutex.Lock()
+	defer discreteLogMutex.Unlock()
+
 	B := suite.Point().Base()
 	var Bi abstract.Point
 	var m int64
@@ -209,12 +235,19 @@ func discreteLog(P abstract.Point) int64 {
 	if m, ok = PointToInt[P.String()]; ok {
 		return m
 	}
+	var negP abstract.Point
+	if neg {
+		negP = suite.Point().Neg(P)
+		if m, ok = PointToInt[negP.String()]; ok {
+			return -m
+		}
+	}
 
 	if currentGreatestInt == 0 {
 		currentGreatestM = suite.Point().Null()
 	}
 
-	for Bi, m = currentGreatestM, currentGreatestInt; !Bi.Equal(P) && m < MaxHomomorphicInt; Bi, m = Bi.Add(Bi, B), m+1 {
+	for Bi, m = currentGreatestM, currentGreatestInt; !Bi.Equal(P) && !(neg && Bi.Equal(negP)) && m < MaxHomomorphicInt; Bi, m = Bi.Add(Bi, B), m+1 {
 		PointToInt[Bi.String()] = m
 	}
 	currentGreatestM = Bi
@@ -225,6 +258,9 @@ func discreteLog(P abstract.Point) int64 {
 	if m == MaxHomomorphicInt {
 		return 0
 	}
+	if neg && !Bi.Equal(P) {
+		return -m
+	}
 	return m
 }
 
@@ -483,25 +519,25 @@ func RandomPermutation(k int) []int {
 // Conversion
 //______________________________________________________________________________________________________________________
 
-// ToBytes converts a CipherVector to a byte array
-func (cv *CipherVector) ToBytes() ([]byte, int) {
-	b := make([]byte, 0)
-
-	for _, el := range *cv {
-		b = append(b, el.ToBytes()...)
+// ToBytes converts a CipherVector to a wire-encoded byte array (see WireWriter)
+func (cv *CipherVector) ToBytes() ([]byte, error) {
+	w := NewWireWriter()
+	if err := w.WriteCipherVector(*cv); err != nil {
+		return nil, err
 	}
-
-	return b, len(*cv)
+	return w.Bytes(), nil
 }
 
-// FromBytes converts a byte array to a CipherVector. Note that you need to create the (empty) object beforehand.
-func (cv *CipherVector) FromBytes(data []byte, length int) {
-	(*cv) = make(CipherVector, length)
-	for i, pos := 0, 0; i < length*64; i, pos = i+64, pos+1 {
-		ct := CipherText{}
-		ct.FromBytes(data[i : i+64])
-		(*cv)[pos] = ct
+// FromBytes converts a wire-encoded byte array to a CipherVector. Note that you need to create the (empty) object beforehand.
+func (cv *CipherVector) FromBytes(data []byte) error {
+	r, err := NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	if *cv, err = r.ReadCipherVector(); err != nil {
+		return err
 	}
+	return r.Close()
 }
 
 // ToBytes converts a CipherText to a byte array
@@ -520,28 +556,87 @@ func (c *CipherText) ToBytes() []byte {
 }
 
 // FromBytes converts a byte array to a CipherText. Note that you need to create the (empty) object beforehand.
-func (c *CipherText) FromBytes(data []byte) {
-	(*c).K = suite.Point()
-	(*c).C = suite.Point()
+func (c *CipherText) FromBytes(data []byte) error {
+	pointLen := suite.PointLen()
+	if len(data) != 2*pointLen {
+		return fmt.Errorf("invalid CipherText length %d (expected %d)", len(data), 2*pointLen)
+	}
 
-	(*c).K.UnmarshalBinary(data[:32])
-	(*c).C.UnmarshalBinary(data[32:])
+	k := suite.Point()
+	if err := k.UnmarshalBinary(data[:pointLen]); err != nil {
+		return err
+	}
+	cP := suite.Point()
+	if err := cP.UnmarshalBinary(data[pointLen:]); err != nil {
+		return err
+	}
+	(*c).K = k
+	(*c).C = cP
+	return nil
 }
 
-// Serialize encodes a CipherText in a base64 string
+// CheckValid checks that a CipherText can be the output of an encryption: both points must be set and must not be the
+// identity or a small-order element (a fresh encryption has a non-null ephemeral key and a non-null blinded message).
+func (c *CipherText) CheckValid() error {
+	if (*c).K == nil || (*c).C == nil {
+		return errors.New("invalid CipherText (missing point)")
+	}
+	if hasSmallOrder((*c).K) {
+		return errors.New("invalid CipherText (ephemeral key is the identity or a small-order element)")
+	}
+	if hasSmallOrder((*c).C) {
+		return errors.New("invalid CipherText (message point is the identity or a small-order element)")
+	}
+	return nil
+}
+
+// hasSmallOrder returns true if 8P is the identity, i.e. P is the identity or lies in the small subgroup of a curve
+// with cofactor up to 8 (such as Ed25519).
+func hasSmallOrder(P abstract.Point) bool {
+	p8 := suite.Point().Add(P, P)
+	p8.Add(p8, p8)
+	p8.Add(p8, p8)
+	return p8.Equal(suite.Point().Null())
+}
+
+// Serialize encodes a CipherText in a base64 string (prefixed by a header recording the suite)
 func (c *CipherText) Serialize() string {
-	return base64.StdEncoding.EncodeToString((*c).ToBytes())
+	w := NewWireWriter()
+	w.writeRaw((*c).ToBytes())
+	return base64.StdEncoding.EncodeToString(w.Bytes())
 }
 
 // Deserialize decodes a CipherText from a base64 string
 func (c *CipherText) Deserialize(b64Encoded string) error {
-	decoded, err := base64.StdEncoding.DecodeString(b64Encoded)
+	decoded, err := decodeSerialized(b64Encoded, 2*suite.PointLen())
 	if err != nil {
 		log.Error("Invalid CipherText (decoding failed).", err)
 		return err
 	}
-	(*c).FromBytes(decoded)
-	return nil
+	return (*c).FromBytes(decoded)
+}
+
+// decodeSerialized decodes a base64 string produced by Serialize or SerializeElement and returns the element bytes.
+// Strings without header (serialized before the suite was recorded) are accepted if they have the length of an
+// element of the current suite.
+func decodeSerialized(b64Encoded string, elemLen int) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(b64Encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == elemLen {
+		return decoded, nil
+	}
+
+	r, err := NewWireReader(decoded)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.next(elemLen)
+	if err != nil {
+		return nil, err
+	}
+	return b, r.Close()
 }
 
 // SerializeElement serializes a BinaryMarshaller-compatible element using base64 encoding (e.g. abstract.Point or abstract.Scalar)
@@ -551,7 +646,9 @@ func SerializeElement(el encoding.BinaryMarshaler) (string, error) {
 		log.Error("Error marshalling element.", err)
 		return "", err
 	}
-	return base64.StdEncoding.EncodeToString(bytes), nil
+	w := NewWireWriter()
+	w.writeRaw(bytes)
+	return base64.StdEncoding.EncodeToString(w.Bytes()), nil
 }
 
 // SerializePoint serializes a point
@@ -566,13 +663,13 @@ func SerializeScalar(scalar encoding.BinaryMarshaler) (string, error) {
 
 // DeserializePoint deserializes a point using base64 encoding
 func DeserializePoint(encodedPoint string) (abstract.Point, error) {
-	decoded, errD := base64.StdEncoding.DecodeString(encodedPoint)
+	decoded, errD := decodeSerialized(encodedPoint, suite.PointLen())
 	if errD != nil {
 		log.Error("Error decoding point.", errD)
 		return nil, errD
 	}
 
-	point := network.Suite.Point()
+	point := suite.Point()
 	errM := point.UnmarshalBinary(decoded)
 	if errM != nil {
 		log.Error("Error unmarshalling point.", errM)
@@ -584,13 +681,13 @@ func DeserializePoint(encodedPoint string) (abstract.Point, error) {
 
 // DeserializeScalar deserializes a scalar using base64 encoding
 func DeserializeScalar(encodedScalar string) (abstract.Scalar, error) {
-	decoded, errD := base64.StdEncoding.DecodeString(encodedScalar)
+	decoded, errD := decodeSerialized(encodedScalar, suite.ScalarLen())
 	if errD != nil {
 		log.Error("Error decoding scalar.", errD)
 		return nil, errD
 	}
 
-	scalar := network.Suite.Scalar()
+	scalar := suite.Scalar()
 	errM := scalar.UnmarshalBinary(decoded)
 	if errM != nil {
 		log.Error("Error unmarshalling scalar.", errM)
@@ -600,35 +697,148 @@ func DeserializeScalar(encodedScalar string) (abstract.Scalar, error) {
 	return scalar, nil
 }
 
-// AbstractPointsToBytes converts an array of abstract.Point to a byte array
-func AbstractPointsToBytes(aps []abstract.Point) []byte {
-	var err error
-	var apsBytes []byte
-	response := make([]byte, 0)
+// PointFingerprint returns a short string identifying a point (e.g. a public key) to compare it with another one:
+// the base64-encoded SHA-256 hash of its binary form.
+func PointFingerprint(point abstract.Point) (string, error) {
+	b, err := point.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(b)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:]), nil
+}
+
+// SchnorrSign signs msg with a private key. The signature is the point R = k*B (k random) followed by the scalar
+// s = k + e*private, e being the hash of R, of the public key and of msg.
+func SchnorrSign(private abstract.Scalar, msg []byte) ([]byte, error) {
+	k := suite.Scalar().Pick(random.Stream)
+	r := suite.Point().Mul(nil, k)
+	e, err := schnorrChallenge(r, suite.Point().Mul(nil, private), msg)
+	if err != nil {
+		return nil, err
+	}
+	w := &WireWriter{}
+	if err := w.WritePoint(r); err != nil {
+		return nil, err
+	}
+	if err := w.WriteScalar(suite.Scalar().Add(k, suite.Scalar().Mul(e, private))); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
 
-	for i := range aps {
-		apsBytes, err = aps[i].MarshalBinary()
+// SchnorrVerify checks that signature is a signature of msg created by SchnorrSign with the private key of public.
+func SchnorrVerify(public abstract.Point, msg, signature []byte) error {
+	rd := NewWireBodyReader(signature)
+	r, err := rd.ReadPoint()
+	if err != nil {
+		return errors.New("malformed signature: " + err.Error())
+	}
+	sc, err := rd.ReadScalar()
+	if err == nil {
+		err = rd.Close()
+	}
+	if err != nil {
+		return errors.New("malformed signature: " + err.Error())
+	}
+	e, err := schnorrChallenge(r, public, msg)
+	if err != nil {
+		return err
+	}
+	// s*B = R + e*public
+	if !suite.Point().Mul(nil, sc).Equal(suite.Point().Add(r, suite.Point().Mul(public, e))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// schnorrChallenge hashes the commitment of a signature, the public key and the message into a scalar.
+func schnorrChallenge(r, public abstract.Point, msg []byte) (abstract.Scalar, error) {
+	h := suite.Hash()
+	for _, p := range []abstract.Point{r, public} {
+		b, err := p.MarshalBinary()
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		h.Write(b)
+	}
+	h.Write(msg)
+	return suite.Scalar().Pick(suite.Cipher(h.Sum(nil))), nil
+}
 
-		response = append(response, apsBytes...)
+// scrypt parameters deriving the keys of SealWithPassphrase from a passphrase
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// passphraseCipher returns the AES-GCM cipher keyed by a passphrase and a salt.
+func passphraseCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
 	}
-	return response
+	return cipher.NewGCM(block)
 }
 
-// BytesToAbstractPoints converts a byte array to an array of abstract.Point
-func BytesToAbstractPoints(target []byte) []abstract.Point {
-	var err error
-	aps := make([]abstract.Point, 0)
+// SealWithPassphrase encrypts data with AES-GCM under a key derived (scrypt) from a passphrase and a random salt.
+// The additional data ad is authenticated but not encrypted, it has to be given again to open the sealed data.
+func SealWithPassphrase(passphrase string, data, ad []byte) (sealed, salt, nonce []byte, err error) {
+	salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, nil, err
+	}
+	aead, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, err
+	}
+	return aead.Seal(nil, nonce, data, ad), salt, nonce, nil
+}
 
-	for i := 0; i < len(target); i += 32 {
-		ap := network.Suite.Point()
-		if err = ap.UnmarshalBinary(target[i : i+32]); err != nil {
-			log.Fatal(err)
-		}
+// OpenWithPassphrase decrypts data sealed by SealWithPassphrase.
+func OpenWithPassphrase(passphrase string, sealed, salt, nonce, ad []byte) ([]byte, error) {
+	aead, err := passphraseCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce size")
+	}
+	data, err := aead.Open(nil, nonce, sealed, ad)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted data")
+	}
+	return data, nil
+}
 
-		aps = append(aps, ap)
+// AbstractPointsToBytes converts an array of abstract.Point to a wire-encoded byte array
+func AbstractPointsToBytes(aps []abstract.Point) ([]byte, error) {
+	w := NewWireWriter()
+	if err := w.WritePoints(aps); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// BytesToAbstractPoints converts a wire-encoded byte array to an array of abstract.Point
+func BytesToAbstractPoints(target []byte) ([]abstract.Point, error) {
+	r, err := NewWireReader(target)
+	if err != nil {
+		return nil, err
+	}
+	aps, err := r.ReadPoints()
+	if err != nil {
+		return nil, err
 	}
-	return aps
+	return aps, r.Close()
 }
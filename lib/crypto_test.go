@@ -1,7 +1,9 @@
 package lib_test
 
 import (
+	"encoding/base64"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
@@ -46,6 +48,37 @@ func TestEncryption(t *testing.T) {
 	}
 }
 
+// TestConcurrentDecryption decrypts integers from several goroutines, which share the discrete logarithm table (run
+// with -race).
+func TestConcurrentDecryption(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	results := make([]int64, 20)
+	wg := sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = lib.DecryptInt(secKey, *lib.EncryptInt(pubKey, int64(100*i)))
+		}(i)
+	}
+	wg.Wait()
+	for i, r := range results {
+		assert.Equal(t, int64(100*i), r)
+	}
+}
+
+// TestDecryptIntWithNeg verifies the decryption of negative integers, which DecryptInt decrypts to 0.
+func TestDecryptIntWithNeg(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	for _, i := range []int64{-12, -1, 0, 3, 250} {
+		assert.Equal(t, i, lib.DecryptIntWithNeg(secKey, *lib.EncryptInt(pubKey, i)))
+	}
+	noisy := lib.EncryptInt(pubKey, 2)
+	noisy.Add(*noisy, *lib.EncryptInt(pubKey, -5))
+	assert.Equal(t, int64(-3), lib.DecryptIntWithNeg(secKey, *noisy))
+	assert.Equal(t, int64(0), lib.DecryptInt(secKey, *noisy))
+}
+
 // TestNullCipherText verifies encryption, decryption and behavior of null cipherVectors.
 func TestNullCipherVector(t *testing.T) {
 	secKey, pubKey := lib.GenKey()
@@ -175,8 +208,10 @@ func TestAbstractPointsConverter(t *testing.T) {
 		aps = append(aps, ap)
 	}
 
-	aps_bytes := lib.AbstractPointsToBytes(aps)
-	new_aps := lib.BytesToAbstractPoints(aps_bytes)
+	aps_bytes, err := lib.AbstractPointsToBytes(aps)
+	assert.Nil(t, err)
+	new_aps, err := lib.BytesToAbstractPoints(aps_bytes)
+	assert.Nil(t, err)
 
 	for i, el := range aps {
 		if !reflect.DeepEqual(el.String(), new_aps[i].String()) {
@@ -197,7 +232,7 @@ func TestCiphertextConverter(t *testing.T) {
 	ctb := ct.ToBytes()
 
 	new_ct := lib.CipherText{}
-	new_ct.FromBytes(ctb)
+	assert.Nil(t, new_ct.FromBytes(ctb))
 
 	p := lib.DecryptInt(secKey, new_ct)
 
@@ -211,14 +246,22 @@ func TestCipherVectorConverter(t *testing.T) {
 	target := []int64{0, 1, 3, 103, 103}
 	cv := lib.EncryptIntVector(pubKey, target)
 
-	cvb, length := cv.ToBytes()
+	cvb, err := cv.ToBytes()
+	assert.Nil(t, err)
 
 	new_cv := lib.CipherVector{}
-	new_cv.FromBytes(cvb, length)
+	assert.Nil(t, new_cv.FromBytes(cvb))
 
 	p := lib.DecryptIntVector(secKey, &new_cv)
 
 	assert.Equal(t, target, p)
+
+	// truncated or corrupted inputs must fail instead of panicking
+	assert.NotNil(t, new_cv.FromBytes(cvb[:len(cvb)-1]))
+	assert.NotNil(t, new_cv.FromBytes(cvb[:3]))
+	assert.NotNil(t, new_cv.FromBytes(append(cvb, 0)))
+	assert.NotNil(t, new_cv.FromBytes(append([]byte("XXX"), cvb[3:]...)))
+	assert.NotNil(t, (&lib.CipherText{}).FromBytes(cvb[:10]))
 }
 
 // TestIntArrayToCipherVector tests the int array to CipherVector converter and IntToPoint + PointToCiphertext
@@ -245,7 +288,8 @@ func TestB64Serialization(t *testing.T) {
 		ctSerialized := ct.Serialize()
 
 		// with newciphertext
-		ctDeserialized := lib.NewCipherTextFromBase64(ctSerialized)
+		ctDeserialized, err := lib.NewCipherTextFromBase64(ctSerialized)
+		assert.Nil(t, err)
 		decVal := lib.DecryptInt(secKey, *ctDeserialized)
 		assert.Equal(t, target[i], decVal)
 
@@ -257,3 +301,73 @@ func TestB64Serialization(t *testing.T) {
 		assert.Equal(t, decVal, decValBis)
 	}
 }
+
+// TestB64DeserializationErrors tests that invalid serialized ciphertexts are rejected
+func TestB64DeserializationErrors(t *testing.T) {
+	_, pubKey := lib.GenKey()
+	ctSerialized := lib.EncryptInt(pubKey, 1).Serialize()
+	unencrypted := lib.IntToCipherText(5)
+
+	invalid := []string{
+		"",
+		"not base64!",
+		ctSerialized[:len(ctSerialized)-8],
+		base64.StdEncoding.EncodeToString(make([]byte, 64)),
+		lib.NewCipherText().Serialize(),
+		unencrypted.Serialize(),
+	}
+	for _, v := range invalid {
+		_, err := lib.NewCipherTextFromBase64(v)
+		assert.NotNil(t, err, v)
+	}
+}
+
+// TestPointFingerprint tests that the fingerprints of two keys are the same only if the keys are
+func TestPointFingerprint(t *testing.T) {
+	_, pubKey1 := lib.GenKey()
+	_, pubKey2 := lib.GenKey()
+
+	fp1, err := lib.PointFingerprint(pubKey1)
+	assert.Nil(t, err)
+	serialized, err := lib.SerializePoint(pubKey1)
+	assert.Nil(t, err)
+	samePubKey, err := lib.DeserializePoint(serialized)
+	assert.Nil(t, err)
+	fp1Bis, err := lib.PointFingerprint(samePubKey)
+	assert.Nil(t, err)
+	fp2, err := lib.PointFingerprint(pubKey2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, fp1, fp1Bis)
+	assert.NotEqual(t, fp1, fp2)
+}
+
+func TestSealWithPassphrase(t *testing.T) {
+	data := []byte("secret")
+	sealed, salt, nonce, err := lib.SealWithPassphrase("passphrase", data, []byte("ad"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, data, sealed)
+
+	opened, err := lib.OpenWithPassphrase("passphrase", sealed, salt, nonce, []byte("ad"))
+	assert.Nil(t, err)
+	assert.Equal(t, data, opened)
+
+	_, err = lib.OpenWithPassphrase("wrong", sealed, salt, nonce, []byte("ad"))
+	assert.NotNil(t, err)
+	_, err = lib.OpenWithPassphrase("passphrase", sealed, salt, nonce, []byte("other"))
+	assert.NotNil(t, err)
+}
+
+// TestSchnorrSignature checks that a signature is only valid for its message and key.
+func TestSchnorrSignature(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	msg := []byte("message")
+	signature, err := lib.SchnorrSign(secKey, msg)
+	assert.Nil(t, err)
+	assert.Nil(t, lib.SchnorrVerify(pubKey, msg, signature))
+
+	_, otherKey := lib.GenKey()
+	assert.NotNil(t, lib.SchnorrVerify(otherKey, msg, signature))
+	assert.NotNil(t, lib.SchnorrVerify(pubKey, []byte("other message"), signature))
+	assert.NotNil(t, lib.SchnorrVerify(pubKey, msg, signature[:len(signature)-1]))
+}
@@ -1,12 +1,16 @@
 package lib
 
 import (
+	"encoding/base64"
+	"errors"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/proof"
+	"gopkg.in/dedis/crypto.v0/random"
 	"gopkg.in/dedis/crypto.v0/shuffle"
 	"gopkg.in/dedis/onet.v1/log"
-	"gopkg.in/dedis/onet.v1/network"
 	"reflect"
+	"sort"
+	"strconv"
 	"sync"
 )
 
@@ -116,21 +120,21 @@ func createPredicateKeySwitch() (predicate proof.Predicate) {
 func SwitchKeyProofCreation(cBef, cAft CipherText, newRandomness, k abstract.Scalar, originEphemKey, q abstract.Point) SwitchKeyProof {
 	predicate := createPredicateKeySwitch()
 
-	B := network.Suite.Point().Base()
-	c1 := network.Suite.Point().Sub(cAft.K, cBef.K)
-	c2 := network.Suite.Point().Sub(cAft.C, cBef.C)
-	b2 := network.Suite.Point().Neg(originEphemKey)
+	B := suite.Point().Base()
+	c1 := suite.Point().Sub(cAft.K, cBef.K)
+	c2 := suite.Point().Sub(cAft.C, cBef.C)
+	b2 := suite.Point().Neg(originEphemKey)
 
-	K := network.Suite.Point().Mul(network.Suite.Point().Base(), k)
+	K := suite.Point().Mul(suite.Point().Base(), k)
 
 	sval := map[string]abstract.Scalar{"k": k, "ri": newRandomness}
 	pval := map[string]abstract.Point{"B": B, "K": K, "Q": q, "b2": b2, "c2": c2, "c1": c1}
 
-	prover := predicate.Prover(network.Suite, sval, pval, nil) // computes: commitment, challenge, response
+	prover := predicate.Prover(suite, sval, pval, nil) // computes: commitment, challenge, response
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 
-	Proof, err := proof.HashProve(network.Suite, "TEST", rand, prover)
+	Proof, err := proof.HashProve(suite, "TEST", rand, prover)
 
 	if err != nil {
 		log.Fatal("---------Prover:", err.Error())
@@ -167,13 +171,13 @@ func VectorSwitchKeyProofCreation(vBef, vAft CipherVector, newRandomnesses []abs
 // SwitchKeyCheckProof checks one proof of key switching
 func SwitchKeyCheckProof(cp SwitchKeyProof, K, Q abstract.Point, cBef, cAft CipherText) bool {
 	predicate := createPredicateKeySwitch()
-	B := network.Suite.Point().Base()
-	c1 := network.Suite.Point().Sub(cAft.K, cBef.K)
-	c2 := network.Suite.Point().Sub(cAft.C, cBef.C)
+	B := suite.Point().Base()
+	c1 := suite.Point().Sub(cAft.K, cBef.K)
+	c2 := suite.Point().Sub(cAft.C, cBef.C)
 
 	pval := map[string]abstract.Point{"B": B, "K": K, "Q": Q, "b2": cp.b2, "c2": c2, "c1": c1}
-	verifier := predicate.Verifier(network.Suite, pval)
-	if err := proof.HashVerify(network.Suite, "TEST", verifier, cp.Proof); err != nil {
+	verifier := predicate.Verifier(suite, pval)
+	if err := proof.HashVerify(suite, "TEST", verifier, cp.Proof); err != nil {
 		log.Error("---------Verifier:", err.Error())
 		return false
 	}
@@ -191,6 +195,78 @@ func PublishedSwitchKeyCheckProof(psp PublishedSwitchKeyProof) bool {
 	return true
 }
 
+// SwitchKeyCheckEphemeralKeys checks that the proofs of psp were created for the given original ephemeral keys (which
+// PublishedSwitchKeyCheckProof takes from the proofs themselves)
+func SwitchKeyCheckEphemeralKeys(psp PublishedSwitchKeyProof, originEphemKeys []abstract.Point) bool {
+	if len(psp.Skp) != len(originEphemKeys) {
+		return false
+	}
+	for i, v := range psp.Skp {
+		if v.b2 == nil || !v.b2.Equal(suite.Point().Neg(originEphemKeys[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode writes a PublishedSwitchKeyProof in a wire-encoded body
+func (psp *PublishedSwitchKeyProof) Encode(w *WireWriter) error {
+	if err := w.WriteCipherVector(psp.VectBefore); err != nil {
+		return err
+	}
+	if err := w.WriteCipherVector(psp.VectAfter); err != nil {
+		return err
+	}
+	if err := w.WritePoints([]abstract.Point{psp.K, psp.Q}); err != nil {
+		return err
+	}
+	w.WriteCount(len(psp.Skp))
+	for _, skp := range psp.Skp {
+		w.WriteBytes(skp.Proof)
+		if err := w.WritePoint(skp.b2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode reads a PublishedSwitchKeyProof from a wire-encoded body
+func (psp *PublishedSwitchKeyProof) Decode(r *WireReader) error {
+	var err error
+	if psp.VectBefore, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	if psp.VectAfter, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	keys, err := r.ReadPoints()
+	if err != nil {
+		return err
+	}
+	if len(keys) != 2 {
+		return errors.New("key switching proof has " + strconv.Itoa(len(keys)) + " keys instead of 2")
+	}
+	psp.K, psp.Q = keys[0], keys[1]
+
+	n, err := r.readCountOf(4 + suite.PointLen())
+	if err != nil {
+		return err
+	}
+	if n != len(psp.VectBefore) || n != len(psp.VectAfter) {
+		return errors.New("key switching proof does not match the size of its vectors")
+	}
+	psp.Skp = make([]SwitchKeyProof, n)
+	for i := range psp.Skp {
+		if psp.Skp[i].Proof, err = r.ReadBytes(); err != nil {
+			return err
+		}
+		if psp.Skp[i].b2, err = r.ReadPoint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // ************************************************** ADD/RM PROTOCOL **************************************************
 
 // createPredicateAddRm creates predicate for add/rm server protocol
@@ -212,26 +288,26 @@ func createPredicateAddRm() (predicate proof.Predicate) {
 func AddRmProofCreation(cBef, cAft CipherText, k abstract.Scalar, toAdd bool) AddRmProof {
 	predicate := createPredicateAddRm()
 
-	B := network.Suite.Point().Base()
-	c2 := network.Suite.Point()
+	B := suite.Point().Base()
+	c2 := suite.Point()
 	if toAdd {
-		c2 = network.Suite.Point().Sub(cAft.C, cBef.C)
+		c2 = suite.Point().Sub(cAft.C, cBef.C)
 	} else {
-		c2 = network.Suite.Point().Sub(cBef.C, cAft.C)
+		c2 = suite.Point().Sub(cBef.C, cAft.C)
 	}
 
 	rB := cBef.K
 
-	K := network.Suite.Point().Mul(network.Suite.Point().Base(), k)
+	K := suite.Point().Mul(suite.Point().Base(), k)
 
 	sval := map[string]abstract.Scalar{"k": k}
 	pval := map[string]abstract.Point{"B": B, "Krm": K, "c2": c2, "rB": rB}
 
-	prover := predicate.Prover(network.Suite, sval, pval, nil) // computes: commitment, challenge, response
+	prover := predicate.Prover(suite, sval, pval, nil) // computes: commitment, challenge, response
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 
-	Proof, err := proof.HashProve(network.Suite, "TEST", rand, prover)
+	Proof, err := proof.HashProve(suite, "TEST", rand, prover)
 
 	if err != nil {
 		log.Fatal("---------Prover:", err.Error())
@@ -272,17 +348,17 @@ func VectorAddRmProofCreation(vBef, vAft map[string]CipherText, k abstract.Scala
 // AddRmCheckProof checks one rm/add proof
 func AddRmCheckProof(cp AddRmProof, K abstract.Point, cBef, cAft CipherText, toAdd bool) bool {
 	predicate := createPredicateAddRm()
-	B := network.Suite.Point().Base()
-	c2 := network.Suite.Point()
+	B := suite.Point().Base()
+	c2 := suite.Point()
 	if toAdd {
-		c2 = network.Suite.Point().Sub(cAft.C, cBef.C)
+		c2 = suite.Point().Sub(cAft.C, cBef.C)
 	} else {
-		c2 = network.Suite.Point().Sub(cBef.C, cAft.C)
+		c2 = suite.Point().Sub(cBef.C, cAft.C)
 	}
 
 	pval := map[string]abstract.Point{"B": B, "Krm": K, "c2": c2, "rB": cBef.K}
-	verifier := predicate.Verifier(network.Suite, pval)
-	if err := proof.HashVerify(network.Suite, "TEST", verifier, cp.Proof); err != nil {
+	verifier := predicate.Verifier(suite, pval)
+	if err := proof.HashVerify(suite, "TEST", verifier, cp.Proof); err != nil {
 		log.Error("---------Verifier:", err.Error())
 		return false
 	}
@@ -292,18 +368,123 @@ func AddRmCheckProof(cp AddRmProof, K abstract.Point, cBef, cAft CipherText, toA
 	return true
 }
 
-// PublishedAddRmCheckProof checks published add/rm protocol proofs
+// PublishedAddRmCheckProof checks published add/rm protocol proofs (there must be one proof per ciphertext)
 func PublishedAddRmCheckProof(parp PublishedAddRmProof) bool {
-	counter := 0
+	if len(parp.Arp) != len(parp.VectBefore) || len(parp.Arp) != len(parp.VectAfter) {
+		return false
+	}
 	for i, v := range parp.Arp {
-		if !AddRmCheckProof(v, parp.Krm, parp.VectBefore[i], parp.VectAfter[i], parp.ToAdd) {
+		before, okBefore := parp.VectBefore[i]
+		after, okAfter := parp.VectAfter[i]
+		if !okBefore || !okAfter || !AddRmCheckProof(v, parp.Krm, before, after, parp.ToAdd) {
 			return false
 		}
-		counter++
 	}
 	return true
 }
 
+// Encode writes a PublishedAddRmProof in a wire-encoded body
+func (parp *PublishedAddRmProof) Encode(w *WireWriter) error {
+	keys := make([]string, 0, len(parp.Arp))
+	for k := range parp.Arp {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.WriteCount(len(keys))
+	for _, k := range keys {
+		w.WriteBytes([]byte(k))
+		w.WriteBytes(parp.Arp[k].Proof)
+		if err := w.WritePoint(parp.Arp[k].RB); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteCipherTextMap(parp.VectBefore); err != nil {
+		return err
+	}
+	if err := w.WriteCipherTextMap(parp.VectAfter); err != nil {
+		return err
+	}
+	if err := w.WritePoint(parp.Krm); err != nil {
+		return err
+	}
+	if parp.ToAdd {
+		w.WriteCount(1)
+	} else {
+		w.WriteCount(0)
+	}
+	return nil
+}
+
+// Decode reads a PublishedAddRmProof from a wire-encoded body
+func (parp *PublishedAddRmProof) Decode(r *WireReader) error {
+	n, err := r.readCountOf(8 + suite.PointLen())
+	if err != nil {
+		return err
+	}
+	parp.Arp = make(map[string]AddRmProof, n)
+	for i := 0; i < n; i++ {
+		k, err := r.ReadBytes()
+		if err != nil {
+			return err
+		}
+		if _, ok := parp.Arp[string(k)]; ok {
+			return errors.New("duplicate attribute " + string(k) + " in add/rm proof")
+		}
+		prf := AddRmProof{}
+		if prf.Proof, err = r.ReadBytes(); err != nil {
+			return err
+		}
+		if prf.RB, err = r.ReadPoint(); err != nil {
+			return err
+		}
+		parp.Arp[string(k)] = prf
+	}
+	if parp.VectBefore, err = r.ReadCipherTextMap(); err != nil {
+		return err
+	}
+	if parp.VectAfter, err = r.ReadCipherTextMap(); err != nil {
+		return err
+	}
+	if parp.Krm, err = r.ReadPoint(); err != nil {
+		return err
+	}
+	toAdd, err := r.ReadCount()
+	if err != nil {
+		return err
+	}
+	if toAdd > 1 {
+		return errors.New("invalid operation in add/rm proof")
+	}
+	parp.ToAdd = toAdd == 1
+	return nil
+}
+
+// AddRmProofsToBytes converts a list of PublishedAddRmProof to a byte array
+func AddRmProofsToBytes(proofs []PublishedAddRmProof) ([]byte, error) {
+	return toWire(func(w *WireWriter) error {
+		return w.WriteBodies(len(proofs), func(i int, bw *WireWriter) error {
+			return proofs[i].Encode(bw)
+		})
+	})
+}
+
+// AddRmProofsFromBytes converts a byte array to a list of PublishedAddRmProof
+func AddRmProofsFromBytes(data []byte) ([]PublishedAddRmProof, error) {
+	var proofs []PublishedAddRmProof
+	err := fromWire(data, func(r *WireReader) error {
+		bodies, err := r.ReadBodies()
+		if err != nil {
+			return err
+		}
+		proofs = make([]PublishedAddRmProof, len(bodies))
+		return DecodeBodies(bodies, func(i int, br *WireReader) error {
+			return proofs[i].Decode(br)
+		})
+	})
+	return proofs, err
+}
+
 // ************************************************** DETERMINISTIC TAGGING ******************************************
 
 // createPredicateDeterministicTag creates predicate for deterministic tagging proof
@@ -333,19 +514,19 @@ func DeterministicTagProofCreation(cBef, cAft CipherText, k, s abstract.Scalar)
 	ciminus11 := cBef.K
 	ci2 := cAft.C
 	ciminus12 := cBef.C
-	ciminus11Si := network.Suite.Point().Neg(network.Suite.Point().Mul(ciminus11, s))
-	K := network.Suite.Point().Mul(network.Suite.Point().Base(), k)
-	B := network.Suite.Point().Base()
-	SB := network.Suite.Point().Mul(B, s)
+	ciminus11Si := suite.Point().Neg(suite.Point().Mul(ciminus11, s))
+	K := suite.Point().Mul(suite.Point().Base(), k)
+	B := suite.Point().Base()
+	SB := suite.Point().Mul(B, s)
 
 	sval := map[string]abstract.Scalar{"k": k, "s": s}
 	pval := map[string]abstract.Point{"B": B, "K": K, "ciminus11Si": ciminus11Si, "ciminus12": ciminus12, "ciminus11": ciminus11, "ci2": ci2, "ci1": ci1}
 
-	prover := predicate.Prover(network.Suite, sval, pval, nil) // computes: commitment, challenge, response
+	prover := predicate.Prover(suite, sval, pval, nil) // computes: commitment, challenge, response
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 
-	Proof, err := proof.HashProve(network.Suite, "TEST", rand, prover)
+	Proof, err := proof.HashProve(suite, "TEST", rand, prover)
 	if err != nil {
 		log.Fatal("---------Prover:", err.Error())
 	}
@@ -382,15 +563,15 @@ func VectorDeterministicTagProofCreation(vBef, vAft CipherVector, s, k abstract.
 // DeterministicTagCheckProof checks one deterministic tagging proof
 func DeterministicTagCheckProof(cp DeterministicTaggingProof, K abstract.Point, cBef, cAft CipherText) bool {
 	predicate := createPredicateDeterministicTag()
-	B := network.Suite.Point().Base()
+	B := suite.Point().Base()
 	ci1 := cAft.K
 	ciminus11 := cBef.K
 	ci2 := cAft.C
 	ciminus12 := cBef.C
 
 	pval := map[string]abstract.Point{"B": B, "K": K, "ciminus11Si": cp.ciminus11Si, "ciminus12": ciminus12, "ciminus11": ciminus11, "ci2": ci2, "ci1": ci1, "SB": cp.SB}
-	verifier := predicate.Verifier(network.Suite, pval)
-	if err := proof.HashVerify(network.Suite, "TEST", verifier, cp.Proof); err != nil {
+	verifier := predicate.Verifier(suite, pval)
+	if err := proof.HashVerify(suite, "TEST", verifier, cp.Proof); err != nil {
 		log.Error("---------Verifier:", err.Error())
 		return false
 	}
@@ -500,7 +681,7 @@ func shuffleProofCreation(inputList, outputList []ProcessResponse, beta [][]abst
 
 	betaCompressed := CompressBeta(beta, e)
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 
 	// do k-shuffle of ElGamal on the (Xhat,Yhat) and check it
 	k = len(Xhat)
@@ -509,13 +690,13 @@ func shuffleProofCreation(inputList, outputList []ProcessResponse, beta [][]abst
 	}
 
 	ps := shuffle.PairShuffle{}
-	ps.Init(network.Suite, k)
+	ps.Init(suite, k)
 
 	prover := func(ctx proof.ProverContext) error {
 		return ps.Prove(pi, nil, h, betaCompressed, Xhat, Yhat, rand, ctx)
 	}
 
-	prf, err := proof.HashProve(network.Suite, "PairShuffle", rand, prover)
+	prf, err := proof.HashProve(suite, "PairShuffle", rand, prover)
 	if err != nil {
 		panic("Shuffle proof failed: " + err.Error())
 	}
@@ -530,8 +711,8 @@ func ShufflingProofCreation(originalList, shuffledList []ProcessResponse, g, h a
 
 // checkShuffleProof verifies a shuffling proof
 func checkShuffleProof(g, h abstract.Point, Xhat, Yhat, XhatBar, YhatBar []abstract.Point, prf []byte) bool {
-	verifier := shuffle.Verifier(network.Suite, g, h, Xhat, Yhat, XhatBar, YhatBar)
-	err := proof.HashVerify(network.Suite, "PairShuffle", verifier, prf)
+	verifier := shuffle.Verifier(suite, g, h, Xhat, Yhat, XhatBar, YhatBar)
+	err := proof.HashVerify(suite, "PairShuffle", verifier, prf)
 
 	if err != nil {
 		log.LLvl1("-----------verify failed (with XharBar)")
@@ -565,6 +746,69 @@ func ShufflingProofVerification(psp PublishedShufflingProof, seed abstract.Point
 	return checkShuffleProof(psp.G, psp.H, x, y, xbar, ybar, psp.HashProof)
 }
 
+// Encode writes a PublishedShufflingProof in a wire-encoded body (G is optional as the shuffles use the base point
+// when it is nil)
+func (psp *PublishedShufflingProof) Encode(w *WireWriter) error {
+	for _, list := range [][]ProcessResponse{psp.OriginalList, psp.ShuffledList} {
+		if err := w.WriteBodies(len(list), func(i int, bw *WireWriter) error {
+			return list[i].Encode(bw)
+		}); err != nil {
+			return err
+		}
+	}
+	var g []abstract.Point
+	if psp.G != nil {
+		g = append(g, psp.G)
+	}
+	if err := w.WritePoints(g); err != nil {
+		return err
+	}
+	if err := w.WritePoint(psp.H); err != nil {
+		return err
+	}
+	w.WriteBytes(psp.HashProof)
+	return nil
+}
+
+// Decode reads a PublishedShufflingProof from a wire-encoded body
+func (psp *PublishedShufflingProof) Decode(r *WireReader) error {
+	lists := make([][]ProcessResponse, 2)
+	for l := range lists {
+		bodies, err := r.ReadBodies()
+		if err != nil {
+			return err
+		}
+		lists[l] = make([]ProcessResponse, len(bodies))
+		if err := DecodeBodies(bodies, func(i int, br *WireReader) error {
+			return lists[l][i].Decode(br)
+		}); err != nil {
+			return err
+		}
+	}
+	psp.OriginalList, psp.ShuffledList = lists[0], lists[1]
+	if len(psp.OriginalList) != len(psp.ShuffledList) {
+		return errors.New("shuffling proof lists have different lengths")
+	}
+
+	g, err := r.ReadPoints()
+	if err != nil {
+		return err
+	}
+	switch len(g) {
+	case 0:
+		psp.G = nil
+	case 1:
+		psp.G = g[0]
+	default:
+		return errors.New("shuffling proof has " + strconv.Itoa(len(g)) + " generators")
+	}
+	if psp.H, err = r.ReadPoint(); err != nil {
+		return err
+	}
+	psp.HashProof, err = r.ReadBytes()
+	return err
+}
+
 // ************************************************** DETERMINISTIC TAGGING ******************************************
 
 // createPredicateDeterministicTagAddition creates predicate for deterministic tagging addition proof
@@ -580,15 +824,15 @@ func createPredicateDeterministicTagAddition() (predicate proof.Predicate) {
 // DetTagAdditionProofCreation creates proof for deterministic tagging addition on 1 abstract point
 func DetTagAdditionProofCreation(c1 abstract.Point, s abstract.Scalar, c2 abstract.Point, r abstract.Point) PublishedDetTagAdditionProof {
 	predicate := createPredicateDeterministicTagAddition()
-	B := network.Suite.Point().Base()
+	B := suite.Point().Base()
 	sval := map[string]abstract.Scalar{"s": s}
 	pval := map[string]abstract.Point{"B": B, "c1": c1, "c2": c2, "r": r}
 
-	prover := predicate.Prover(network.Suite, sval, pval, nil) // computes: commitment, challenge, response
+	prover := predicate.Prover(suite, sval, pval, nil) // computes: commitment, challenge, response
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 
-	Proof, err := proof.HashProve(network.Suite, "TEST", rand, prover)
+	Proof, err := proof.HashProve(suite, "TEST", rand, prover)
 	if err != nil {
 		log.Fatal("---------Prover:", err.Error())
 	}
@@ -599,11 +843,11 @@ func DetTagAdditionProofCreation(c1 abstract.Point, s abstract.Scalar, c2 abstra
 // DetTagAdditionProofVerification checks a deterministic tag addition proof
 func DetTagAdditionProofVerification(psap PublishedDetTagAdditionProof) bool {
 	predicate := createPredicateDeterministicTagAddition()
-	B := network.Suite.Point().Base()
+	B := suite.Point().Base()
 	pval := map[string]abstract.Point{"B": B, "c1": psap.C1, "c2": psap.C2, "r": psap.R}
-	verifier := predicate.Verifier(network.Suite, pval)
+	verifier := predicate.Verifier(suite, pval)
 	partProof := false
-	if err := proof.HashVerify(network.Suite, "TEST", verifier, psap.Proof); err != nil {
+	if err := proof.HashVerify(suite, "TEST", verifier, psap.Proof); err != nil {
 		log.Error("---------Verifier:", err.Error())
 		return false
 	}
@@ -611,6 +855,209 @@ func DetTagAdditionProofVerification(psap PublishedDetTagAdditionProof) bool {
 	partProof = true
 	//log.LLvl1("Proof verified")
 
-	cv := network.Suite.Point().Add(psap.C1, psap.C2)
+	cv := suite.Point().Add(psap.C1, psap.C2)
 	return (partProof && reflect.DeepEqual(cv, psap.R))
 }
+
+// ************************************************** RANGE ************************************************************
+
+// BitProof is a non-interactive proof that a ciphertext (K,C) encrypts 0 or 1 under a public key P, i.e. that
+// K = rB and C - bB = rP for b in {0,1} (disjunctive Chaum-Pedersen proof, the challenge being split as C0 + C1).
+type BitProof struct {
+	C0, C1 abstract.Scalar
+	Z0, Z1 abstract.Scalar
+}
+
+// RangeProof proves that a ciphertext encrypts an integer in [0, 2^len(Bits)): the ciphertext is the weighted sum
+// of the encryptions of the bits of the integer and each of these encryptions comes with a BitProof.
+type RangeProof struct {
+	Bits      CipherVector
+	BitProofs []BitProof
+}
+
+// MaxRangeProofBits is the maximum size (in bits) of a range proven with a RangeProof.
+const MaxRangeProofBits = 62
+
+// bitProofChallenge computes the Fiat-Shamir challenge of a bit proof
+func bitProofChallenge(pubKey abstract.Point, ct CipherText, commits ...abstract.Point) abstract.Scalar {
+	h := suite.Hash()
+	for _, p := range append([]abstract.Point{pubKey, ct.K, ct.C}, commits...) {
+		b, err := p.MarshalBinary()
+		if err != nil {
+			log.Fatal(err)
+		}
+		h.Write(b)
+	}
+	return suite.Scalar().Pick(suite.Cipher(h.Sum(nil)))
+}
+
+// bitProofCommits computes the commitments of the statement "ct encrypts j" from a challenge and a response
+func bitProofCommits(pubKey abstract.Point, ct CipherText, j int64, c, z abstract.Scalar) (abstract.Point, abstract.Point) {
+	B := suite.Point().Base()
+	cMinusJ := suite.Point().Sub(ct.C, suite.Point().Mul(B, suite.Scalar().SetInt64(j)))
+	A := suite.Point().Sub(suite.Point().Mul(B, z), suite.Point().Mul(ct.K, c))
+	D := suite.Point().Sub(suite.Point().Mul(pubKey, z), suite.Point().Mul(cMinusJ, c))
+	return A, D
+}
+
+// BitProofCreation creates a proof that ct = (rB, rP + bB) encrypts the bit b
+func BitProofCreation(ct CipherText, b int64, r abstract.Scalar, pubKey abstract.Point) BitProof {
+	rand := suite.Cipher(abstract.RandomKey)
+	c := make([]abstract.Scalar, 2)
+	z := make([]abstract.Scalar, 2)
+	A := make([]abstract.Point, 2)
+	D := make([]abstract.Point, 2)
+
+	// simulated statement
+	s := 1 - b
+	c[s] = suite.Scalar().Pick(rand)
+	z[s] = suite.Scalar().Pick(rand)
+	A[s], D[s] = bitProofCommits(pubKey, ct, s, c[s], z[s])
+
+	// real statement
+	w := suite.Scalar().Pick(rand)
+	A[b] = suite.Point().Mul(suite.Point().Base(), w)
+	D[b] = suite.Point().Mul(pubKey, w)
+
+	challenge := bitProofChallenge(pubKey, ct, A[0], D[0], A[1], D[1])
+	c[b] = suite.Scalar().Sub(challenge, c[s])
+	z[b] = suite.Scalar().Add(w, suite.Scalar().Mul(c[b], r))
+
+	return BitProof{C0: c[0], C1: c[1], Z0: z[0], Z1: z[1]}
+}
+
+// BitProofVerification checks that ct encrypts 0 or 1 under pubKey
+func BitProofVerification(bp BitProof, ct CipherText, pubKey abstract.Point) bool {
+	if bp.C0 == nil || bp.C1 == nil || bp.Z0 == nil || bp.Z1 == nil || ct.K == nil || ct.C == nil {
+		return false
+	}
+	A0, D0 := bitProofCommits(pubKey, ct, 0, bp.C0, bp.Z0)
+	A1, D1 := bitProofCommits(pubKey, ct, 1, bp.C1, bp.Z1)
+	challenge := bitProofChallenge(pubKey, ct, A0, D0, A1, D1)
+	return challenge.Equal(suite.Scalar().Add(bp.C0, bp.C1))
+}
+
+// EncryptIntWithRangeProof encrypts an integer in [0, 2^bits) and creates the proof that it is in this range.
+func EncryptIntWithRangeProof(pubKey abstract.Point, integer int64, bits int) (*CipherText, *RangeProof, error) {
+	if bits < 1 || bits > MaxRangeProofBits {
+		return nil, nil, errors.New("range size must be between 1 and " + strconv.Itoa(MaxRangeProofBits) + " bits")
+	}
+	if integer < 0 || integer >= int64(1)<<uint(bits) {
+		return nil, nil, errors.New(strconv.FormatInt(integer, 10) + " is not in [0, 2^" + strconv.Itoa(bits) + ")")
+	}
+
+	B := suite.Point().Base()
+	rp := RangeProof{Bits: make(CipherVector, bits), BitProofs: make([]BitProof, bits)}
+	wg := StartParallelize(bits)
+	for i := 0; i < bits; i++ {
+		if PARALLELIZE {
+			go func(i int) {
+				defer wg.Done()
+				rp.Bits[i], rp.BitProofs[i] = encryptBitWithProof(pubKey, B, (integer>>uint(i))&1)
+			}(i)
+		} else {
+			rp.Bits[i], rp.BitProofs[i] = encryptBitWithProof(pubKey, B, (integer>>uint(i))&1)
+		}
+	}
+	EndParallelize(wg)
+
+	// the ciphertext of the integer is derived from the ciphertexts of its bits so that the verifier can recompute it
+	return rp.weightedSum(), &rp, nil
+}
+
+// encryptBitWithProof encrypts a bit and creates the corresponding bit proof
+func encryptBitWithProof(pubKey, B abstract.Point, bit int64) (CipherText, BitProof) {
+	r := suite.Scalar().Pick(random.Stream)
+	ct := CipherText{K: suite.Point().Mul(B, r), C: suite.Point().Mul(pubKey, r)}
+	ct.C.Add(ct.C, suite.Point().Mul(B, suite.Scalar().SetInt64(bit)))
+	return ct, BitProofCreation(ct, bit, r, pubKey)
+}
+
+// weightedSum computes the sum of the bit ciphertexts weighted by their power of two
+func (rp *RangeProof) weightedSum() *CipherText {
+	result := NewCipherText()
+	weight := suite.Scalar().One()
+	two := suite.Scalar().SetInt64(2)
+	tmp := NewCipherText()
+	for _, b := range rp.Bits {
+		tmp.MulCipherTextbyScalar(b, weight)
+		result.Add(*result, *tmp)
+		weight = suite.Scalar().Mul(weight, two)
+	}
+	return result
+}
+
+// RangeProofVerification checks that ct encrypts an integer in [0, 2^bits) under pubKey.
+func RangeProofVerification(rp RangeProof, ct CipherText, pubKey abstract.Point, bits int) bool {
+	if len(rp.Bits) != bits || len(rp.BitProofs) != bits || ct.K == nil || ct.C == nil {
+		return false
+	}
+	for i := range rp.Bits {
+		if !BitProofVerification(rp.BitProofs[i], rp.Bits[i], pubKey) {
+			return false
+		}
+	}
+	sum := rp.weightedSum()
+	return sum.K.Equal(ct.K) && sum.C.Equal(ct.C)
+}
+
+// ToBytes converts a RangeProof to a wire-encoded byte array
+func (rp *RangeProof) ToBytes() ([]byte, error) {
+	w := NewWireWriter()
+	if err := w.WriteCipherVector(rp.Bits); err != nil {
+		return nil, err
+	}
+	w.WriteCount(len(rp.BitProofs))
+	for _, bp := range rp.BitProofs {
+		for _, sc := range []abstract.Scalar{bp.C0, bp.C1, bp.Z0, bp.Z1} {
+			if err := w.WriteScalar(sc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return w.Bytes(), nil
+}
+
+// FromBytes converts a wire-encoded byte array to a RangeProof
+func (rp *RangeProof) FromBytes(data []byte) error {
+	r, err := NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	if rp.Bits, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	n, err := r.readCountOf(4 * suite.ScalarLen())
+	if err != nil {
+		return err
+	}
+	rp.BitProofs = make([]BitProof, n)
+	for i := range rp.BitProofs {
+		scalars := make([]abstract.Scalar, 4)
+		for j := range scalars {
+			if scalars[j], err = r.ReadScalar(); err != nil {
+				return err
+			}
+		}
+		rp.BitProofs[i] = BitProof{C0: scalars[0], C1: scalars[1], Z0: scalars[2], Z1: scalars[3]}
+	}
+	return r.Close()
+}
+
+// Serialize encodes a RangeProof in a base64 string
+func (rp *RangeProof) Serialize() (string, error) {
+	b, err := rp.ToBytes()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Deserialize decodes a RangeProof from a base64 string
+func (rp *RangeProof) Deserialize(b64Encoded string) error {
+	decoded, err := base64.StdEncoding.DecodeString(b64Encoded)
+	if err != nil {
+		return err
+	}
+	return rp.FromBytes(decoded)
+}
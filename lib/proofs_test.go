@@ -72,6 +72,28 @@ func TestKeySwitchingProof(t *testing.T) {
 	assert.False(t, lib.PublishedSwitchKeyCheckProof(lib.PublishedSwitchKeyProof{Skp: cps, VectBefore: cipherVect, VectAfter: *switchedVect, K: pubKeyNew, Q: pubKeyNew}))
 }
 
+func TestSwitchKeyProofEncoding(t *testing.T) {
+	origEphemKeys := []abstract.Point{cipherOne.K, cipherOne.K}
+	switchedVect := lib.NewCipherVector(2)
+	rs := switchedVect.KeySwitching(cipherVect, origEphemKeys, pubKeyNew, secKey)
+	cps := lib.VectorSwitchKeyProofCreation(cipherVect, *switchedVect, rs, secKey, origEphemKeys, pubKeyNew)
+	psp := lib.PublishedSwitchKeyProof{Skp: cps, VectBefore: cipherVect, VectAfter: *switchedVect, K: pubKey, Q: pubKeyNew}
+
+	w := lib.NewWireWriter()
+	assert.Nil(t, psp.Encode(w))
+	r, err := lib.NewWireReader(w.Bytes())
+	assert.Nil(t, err)
+	decoded := lib.PublishedSwitchKeyProof{}
+	assert.Nil(t, decoded.Decode(r))
+	assert.Nil(t, r.Close())
+
+	assert.True(t, lib.PublishedSwitchKeyCheckProof(decoded))
+	assert.True(t, lib.SwitchKeyCheckEphemeralKeys(decoded, origEphemKeys))
+	assert.False(t, lib.SwitchKeyCheckEphemeralKeys(decoded, []abstract.Point{cipherOne.C, cipherOne.K}))
+	assert.False(t, lib.SwitchKeyCheckEphemeralKeys(decoded, origEphemKeys[:1]))
+	assert.True(t, decoded.K.Equal(pubKey) && decoded.Q.Equal(pubKeyNew))
+}
+
 // TestAddRmProof tests ADD/REMOVE SERVER PROTOCOL proofs
 func TestAddRmProof(t *testing.T) {
 	//test  at ciphertext level
@@ -151,6 +173,45 @@ func TestAddRmProof(t *testing.T) {
 
 }
 
+// TestAddRmProofEncoding tests the wire encoding of the add/rm server proofs and of the responses they transform
+func TestAddRmProofEncoding(t *testing.T) {
+	before := map[string]lib.CipherText{"a": *lib.EncryptInt(pubKey, 3), "b": *lib.EncryptInt(pubKey, 4)}
+	after := make(map[string]lib.CipherText, len(before))
+	for k, v := range before {
+		after[k] = lib.CipherText{K: v.K, C: network.Suite.Point().Add(v.C, network.Suite.Point().Mul(v.K, secKeyNew))}
+	}
+	prf := lib.PublishedAddRmProof{Arp: lib.VectorAddRmProofCreation(before, after, secKeyNew, true), VectBefore: before,
+		VectAfter: after, Krm: pubKeyNew, ToAdd: true}
+
+	data, err := lib.AddRmProofsToBytes([]lib.PublishedAddRmProof{prf, prf})
+	assert.Nil(t, err)
+	decoded, err := lib.AddRmProofsFromBytes(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(decoded))
+	assert.True(t, decoded[1].ToAdd)
+	assert.True(t, decoded[1].Krm.Equal(pubKeyNew))
+	assert.True(t, lib.PublishedAddRmCheckProof(decoded[1]))
+	secKeyAfter := network.Suite.Scalar().Add(secKey, secKeyNew)
+	assert.Equal(t, int64(4), lib.DecryptInt(secKeyAfter, decoded[1].VectAfter["b"]))
+
+	_, err = lib.AddRmProofsFromBytes(data[:len(data)-1])
+	assert.NotNil(t, err)
+
+	// a proof missing for one of the ciphertexts is rejected
+	delete(decoded[0].Arp, "a")
+	assert.False(t, lib.PublishedAddRmCheckProof(decoded[0]))
+
+	responses := []lib.DpResponse{{AggregatingAttributesEnc: before, WhereClear: map[string]int64{"w": 1}}, {}}
+	data, err = lib.DpResponsesToBytes(responses)
+	assert.Nil(t, err)
+	decodedResponses, err := lib.DpResponsesFromBytes(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(decodedResponses))
+	assert.Equal(t, int64(3), lib.DecryptInt(secKey, decodedResponses[0].AggregatingAttributesEnc["a"]))
+	assert.Nil(t, decodedResponses[0].WhereClear)
+	assert.Equal(t, 0, len(decodedResponses[1].GroupByEnc))
+}
+
 func TestDeterministicTaggingProof(t *testing.T) {
 	// test tagging switching at ciphertext level
 	cipherOneDetTagged := lib.NewCipherText()
@@ -349,3 +410,66 @@ func TestShufflingProof(t *testing.T) {
 	PublishedShufflingProof = lib.ShufflingProofCreation(responses, responses, nil, pubKey, beta, pi)
 	assert.False(t, lib.ShufflingProofVerification(PublishedShufflingProof, pubKey))
 }
+
+func TestFilteredResponseShufflingProof(t *testing.T) {
+	frs := []lib.FilteredResponse{
+		{GroupByEnc: *lib.EncryptIntVector(pubKey, []int64{0}), AggregatingAttributes: *lib.EncryptIntVector(pubKey, []int64{5})},
+		{GroupByEnc: *lib.EncryptIntVector(pubKey, []int64{1}), AggregatingAttributes: *lib.EncryptIntVector(pubKey, []int64{7})},
+	}
+	responses := lib.FilteredResponsesToProcessResponses(frs)
+	responsesShuffled, pi, beta := lib.ShuffleSequence(responses, nil, pubKey, nil)
+	psp := lib.ShufflingProofCreation(responses, responsesShuffled, nil, pubKey, beta, pi)
+
+	// the proof goes through the wire
+	w := lib.NewWireWriter()
+	assert.Nil(t, psp.Encode(w))
+	r, err := lib.NewWireReader(w.Bytes())
+	assert.Nil(t, err)
+	decoded := lib.PublishedShufflingProof{}
+	assert.Nil(t, decoded.Decode(r))
+	assert.Nil(t, r.Close())
+	assert.Nil(t, decoded.G)
+	assert.True(t, lib.ShufflingProofVerification(decoded, pubKey))
+
+	// groups and counts stay together
+	shuffled := lib.ProcessResponsesToFilteredResponses(responsesShuffled)
+	for _, fr := range shuffled {
+		group := lib.DecryptInt(secKey, fr.GroupByEnc[0])
+		assert.Equal(t, []int64{5, 7}[group], lib.DecryptInt(secKey, fr.AggregatingAttributes[0]))
+	}
+}
+
+func TestRangeProof(t *testing.T) {
+	ct, rp, err := lib.EncryptIntWithRangeProof(pubKey, 13, 8)
+	assert.Nil(t, err)
+	assert.True(t, lib.RangeProofVerification(*rp, *ct, pubKey, 8))
+	assert.Equal(t, int64(13), lib.DecryptInt(secKey, *ct))
+
+	// wrong range size or wrong key
+	assert.False(t, lib.RangeProofVerification(*rp, *ct, pubKey, 16))
+	assert.False(t, lib.RangeProofVerification(*rp, *ct, pubKeyNew, 8))
+
+	// proof of another ciphertext
+	other := lib.EncryptInt(pubKey, 13)
+	assert.False(t, lib.RangeProofVerification(*rp, *other, pubKey, 8))
+
+	// tampered bit ciphertext
+	tampered := lib.RangeProof{Bits: make(lib.CipherVector, len(rp.Bits)), BitProofs: rp.BitProofs}
+	copy(tampered.Bits, rp.Bits)
+	tampered.Bits[0] = *lib.EncryptInt(pubKey, 2)
+	assert.False(t, lib.RangeProofVerification(tampered, *ct, pubKey, 8))
+
+	// out of range values cannot be proven
+	_, _, err = lib.EncryptIntWithRangeProof(pubKey, 256, 8)
+	assert.NotNil(t, err)
+	_, _, err = lib.EncryptIntWithRangeProof(pubKey, -1, 8)
+	assert.NotNil(t, err)
+
+	// serialization
+	b64, err := rp.Serialize()
+	assert.Nil(t, err)
+	rpDeserialized := lib.RangeProof{}
+	assert.Nil(t, rpDeserialized.Deserialize(b64))
+	assert.True(t, lib.RangeProofVerification(rpDeserialized, *ct, pubKey, 8))
+	assert.NotNil(t, rpDeserialized.Deserialize(b64[:len(b64)/2]))
+}
@@ -3,7 +3,6 @@ package lib
 import (
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/random"
-	"gopkg.in/dedis/onet.v1/network"
 )
 
 // compressCipherVector (slice of ciphertexts) into one ciphertext
@@ -97,19 +96,19 @@ func CompressBeta(beta [][]abstract.Scalar, e []abstract.Scalar) []abstract.Scal
 	betaCompressed := make([]abstract.Scalar, k)
 	wg := StartParallelize(k)
 	for i := 0; i < k; i++ {
-		betaCompressed[i] = network.Suite.Scalar().Zero()
+		betaCompressed[i] = suite.Scalar().Zero()
 		if PARALLELIZE {
 			go func(i int) {
 				defer wg.Done()
 				for j := 0; j < NQ; j++ {
-					tmp := network.Suite.Scalar().Mul(beta[i][j], e[j])
-					betaCompressed[i] = network.Suite.Scalar().Add(betaCompressed[i], tmp)
+					tmp := suite.Scalar().Mul(beta[i][j], e[j])
+					betaCompressed[i] = suite.Scalar().Add(betaCompressed[i], tmp)
 				}
 			}(i)
 		} else {
 			for j := 0; j < NQ; j++ {
-				tmp := network.Suite.Scalar().Mul(beta[i][j], e[j])
-				betaCompressed[i] = network.Suite.Scalar().Add(betaCompressed[i], tmp)
+				tmp := suite.Scalar().Mul(beta[i][j], e[j])
+				betaCompressed[i] = suite.Scalar().Add(betaCompressed[i], tmp)
 			}
 		}
 
@@ -131,7 +130,7 @@ func ShuffleSequence(inputList []ProcessResponse, g, h abstract.Point, precomput
 
 	k := len(inputList) // number of clients
 
-	rand := network.Suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(abstract.RandomKey)
 	// Pick a fresh (or precomputed) ElGamal blinding factor for each pair
 	beta := make([]([]abstract.Scalar), k)
 	precomputedPoints := make([]CipherVector, k)
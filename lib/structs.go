@@ -2,9 +2,9 @@
 package lib
 
 import (
+	"errors"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/cipher"
-	"gopkg.in/dedis/onet.v1/network"
 	"strconv"
 	"strings"
 	"sync"
@@ -108,6 +108,25 @@ func NewFilteredResponse(grpEncSize, attrSize int) FilteredResponse {
 	return FilteredResponse{*NewCipherVector(grpEncSize), *NewCipherVector(attrSize)}
 }
 
+// FilteredResponsesToProcessResponses converts filtered responses to process responses (without where attributes) so
+// that they can be shuffled
+func FilteredResponsesToProcessResponses(frs []FilteredResponse) []ProcessResponse {
+	prs := make([]ProcessResponse, len(frs))
+	for i, fr := range frs {
+		prs[i] = ProcessResponse{WhereEnc: CipherVector{}, GroupByEnc: fr.GroupByEnc, AggregatingAttributes: fr.AggregatingAttributes}
+	}
+	return prs
+}
+
+// ProcessResponsesToFilteredResponses converts process responses back to filtered responses
+func ProcessResponsesToFilteredResponses(prs []ProcessResponse) []FilteredResponse {
+	frs := make([]FilteredResponse, len(prs))
+	for i, pr := range prs {
+		frs[i] = FilteredResponse{GroupByEnc: pr.GroupByEnc, AggregatingAttributes: pr.AggregatingAttributes}
+	}
+	return frs
+}
+
 // GroupingKey
 //______________________________________________________________________________________________________________________
 
@@ -186,7 +205,7 @@ func ComputeE(index int, cv ProcessResponse, seed []byte, aggrAttrLen, grpAttrLe
 	var dataC []byte
 	var dataK []byte
 
-	randomCipher := network.Suite.Cipher(seed)
+	randomCipher := suite.Cipher(seed)
 
 	if index < aggrAttrLen {
 		dataC, _ = cv.AggregatingAttributes[index].C.MarshalBinary()
@@ -202,7 +221,7 @@ func ComputeE(index int, cv ProcessResponse, seed []byte, aggrAttrLen, grpAttrLe
 	randomCipher.Message(nil, nil, dataC)
 	randomCipher.Message(nil, nil, dataK)
 
-	return network.Suite.Scalar().Pick(randomCipher)
+	return suite.Scalar().Pick(randomCipher)
 }
 
 // DpClearResponse
@@ -252,21 +271,21 @@ func CreatePrecomputedRandomize(g, h abstract.Point, rand cipher.Stream, lineSiz
 
 				for w := range result[i].CipherV {
 					mutex.Lock()
-					tmp := network.Suite.Scalar().Pick(rand)
+					tmp := suite.Scalar().Pick(rand)
 					mutex.Unlock()
 
 					result[i].S[w] = tmp
-					result[i].CipherV[w].K = network.Suite.Point().Mul(g, tmp)
-					result[i].CipherV[w].C = network.Suite.Point().Mul(h, tmp)
+					result[i].CipherV[w].K = suite.Point().Mul(g, tmp)
+					result[i].CipherV[w].C = suite.Point().Mul(h, tmp)
 				}
 
 			}(i)
 		} else {
 			for w := range result[i].CipherV {
-				tmp := network.Suite.Scalar().Pick(rand)
+				tmp := suite.Scalar().Pick(rand)
 				result[i].S[w] = tmp
-				result[i].CipherV[w].K = network.Suite.Point().Mul(g, tmp)
-				result[i].CipherV[w].C = network.Suite.Point().Mul(h, tmp)
+				result[i].CipherV[w].K = suite.Point().Mul(g, tmp)
+				result[i].CipherV[w].C = suite.Point().Mul(h, tmp)
 			}
 		}
 	}
@@ -277,168 +296,233 @@ func CreatePrecomputedRandomize(g, h abstract.Point, rand cipher.Stream, lineSiz
 // Conversion
 //______________________________________________________________________________________________________________________
 
-// ToBytes converts a Filtered to a byte array
-func (cv *FilteredResponse) ToBytes() ([]byte, int, int) {
-	b := make([]byte, 0)
-	pgaeb := make([]byte, 0)
-	pgaebLength := 0
-
-	aab, aabLength := (*cv).AggregatingAttributes.ToBytes()
-	if (*cv).GroupByEnc != nil {
-		pgaeb, pgaebLength = (*cv).GroupByEnc.ToBytes()
+// Encode writes a FilteredResponse in a wire-encoded body
+func (cv *FilteredResponse) Encode(w *WireWriter) error {
+	if err := w.WriteCipherVector((*cv).GroupByEnc); err != nil {
+		return err
 	}
+	return w.WriteCipherVector((*cv).AggregatingAttributes)
+}
 
-	b = append(b, aab...)
-	b = append(b, pgaeb...)
+// Decode reads a FilteredResponse from a wire-encoded body
+func (cv *FilteredResponse) Decode(r *WireReader) error {
+	var err error
+	if (*cv).GroupByEnc, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	(*cv).AggregatingAttributes, err = r.ReadCipherVector()
+	return err
+}
 
-	return b, pgaebLength, aabLength
+// ToBytes converts a FilteredResponse to a byte array
+func (cv *FilteredResponse) ToBytes() ([]byte, error) {
+	return toWire(cv.Encode)
 }
 
 // FromBytes converts a byte array to a FilteredResponse. Note that you need to create the (empty) object beforehand.
-func (cv *FilteredResponse) FromBytes(data []byte, aabLength, pgaebLength int) {
-	(*cv).AggregatingAttributes = make(CipherVector, aabLength)
-	(*cv).GroupByEnc = make(CipherVector, pgaebLength)
-
-	aabByteLength := (aabLength * 64) //CAREFUL: hardcoded 64 (size of el-gamal element C,K)
-	pgaebByteLength := (pgaebLength * 64)
+func (cv *FilteredResponse) FromBytes(data []byte) error {
+	return fromWire(data, cv.Decode)
+}
 
-	aab := data[:aabByteLength]
-	pgaeb := data[aabByteLength : aabByteLength+pgaebByteLength]
+// Encode writes a FilteredResponseDet in a wire-encoded body
+func (crd *FilteredResponseDet) Encode(w *WireWriter) error {
+	if err := (*crd).Fr.Encode(w); err != nil {
+		return err
+	}
+	w.WriteBytes([]byte((*crd).DetTagGroupBy))
+	return nil
+}
 
-	(*cv).AggregatingAttributes.FromBytes(aab, aabLength)
-	(*cv).GroupByEnc.FromBytes(pgaeb, pgaebLength)
+// Decode reads a FilteredResponseDet from a wire-encoded body
+func (crd *FilteredResponseDet) Decode(r *WireReader) error {
+	if err := (*crd).Fr.Decode(r); err != nil {
+		return err
+	}
+	dtbgb, err := r.ReadBytes()
+	if err != nil {
+		return err
+	}
+	(*crd).DetTagGroupBy = GroupingKey(string(dtbgb))
+	return nil
 }
 
 // ToBytes converts a FilteredResponseDet to a byte array
-func (crd *FilteredResponseDet) ToBytes() ([]byte, int, int, int) {
-	b, gacbLength, aabLength := (*crd).Fr.ToBytes()
-
-	dtbgb := []byte((*crd).DetTagGroupBy)
-	dtbgbLength := len(dtbgb)
-
-	b = append(b, dtbgb...)
-
-	return b, gacbLength, aabLength, dtbgbLength
+func (crd *FilteredResponseDet) ToBytes() ([]byte, error) {
+	return toWire(crd.Encode)
 }
 
 // FromBytes converts a byte array to a FilteredResponseDet. Note that you need to create the (empty) object beforehand.
-func (crd *FilteredResponseDet) FromBytes(data []byte, gacbLength, aabLength, dtbgbLength int) {
-	(*crd).Fr.AggregatingAttributes = make(CipherVector, aabLength)
-	(*crd).Fr.GroupByEnc = make(CipherVector, gacbLength)
-
-	aabByteLength := (aabLength * 64) //CAREFUL: hardcoded 64 (size of el-gamal element C,K)
-	gacbByteLength := (gacbLength * 64)
-
-	aab := data[:aabByteLength]
-	gacb := data[aabByteLength : gacbByteLength+aabByteLength]
-	dtbgb := data[gacbByteLength+aabByteLength : gacbByteLength+aabByteLength+dtbgbLength]
-
-	(*crd).DetTagGroupBy = GroupingKey(string(dtbgb))
-	(*crd).Fr.AggregatingAttributes.FromBytes(aab, aabLength)
-	(*crd).Fr.GroupByEnc.FromBytes(gacb, gacbLength)
+func (crd *FilteredResponseDet) FromBytes(data []byte) error {
+	return fromWire(data, crd.Decode)
 }
 
-// ToBytes converts a ProcessResponse to a byte array
-func (cv *ProcessResponse) ToBytes() ([]byte, int, int, int) {
-	b := make([]byte, 0)
-	pgaeb := make([]byte, 0)
-	pgaebLength := 0
-
-	gacb, gacbLength := (*cv).GroupByEnc.ToBytes()
-	aab, aabLength := (*cv).AggregatingAttributes.ToBytes()
-	if (*cv).WhereEnc != nil {
-		pgaeb, pgaebLength = (*cv).WhereEnc.ToBytes()
+// Encode writes a ProcessResponse in a wire-encoded body
+func (cv *ProcessResponse) Encode(w *WireWriter) error {
+	if err := w.WriteCipherVector((*cv).GroupByEnc); err != nil {
+		return err
+	}
+	if err := w.WriteCipherVector((*cv).AggregatingAttributes); err != nil {
+		return err
 	}
+	return w.WriteCipherVector((*cv).WhereEnc)
+}
 
-	b = append(b, gacb...)
-	b = append(b, aab...)
-	b = append(b, pgaeb...)
+// Decode reads a ProcessResponse from a wire-encoded body
+func (cv *ProcessResponse) Decode(r *WireReader) error {
+	var err error
+	if (*cv).GroupByEnc, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	if (*cv).AggregatingAttributes, err = r.ReadCipherVector(); err != nil {
+		return err
+	}
+	(*cv).WhereEnc, err = r.ReadCipherVector()
+	return err
+}
 
-	return b, gacbLength, aabLength, pgaebLength
+// ToBytes converts a ProcessResponse to a byte array
+func (cv *ProcessResponse) ToBytes() ([]byte, error) {
+	return toWire(cv.Encode)
 }
 
 // FromBytes converts a byte array to a ProcessResponse. Note that you need to create the (empty) object beforehand.
-func (cv *ProcessResponse) FromBytes(data []byte, gacbLength, aabLength, pgaebLength int) {
-	(*cv).AggregatingAttributes = make(CipherVector, aabLength)
-	(*cv).WhereEnc = make(CipherVector, pgaebLength)
-	(*cv).GroupByEnc = make(CipherVector, gacbLength)
+func (cv *ProcessResponse) FromBytes(data []byte) error {
+	return fromWire(data, cv.Decode)
+}
 
-	gacbByteLength := (gacbLength * 64)
-	aabByteLength := (aabLength * 64) //CAREFUL: hardcoded 64 (size of el-gamal element C,K)
-	pgaebByteLength := (pgaebLength * 64)
+// Encode writes a ProcessResponseDet in a wire-encoded body
+func (crd *ProcessResponseDet) Encode(w *WireWriter) error {
+	if err := (*crd).PR.Encode(w); err != nil {
+		return err
+	}
+	w.WriteBytes([]byte((*crd).DetTagGroupBy))
+	w.WriteCount(len((*crd).DetTagWhere))
+	for _, dtw := range (*crd).DetTagWhere {
+		w.WriteBytes([]byte(dtw))
+	}
+	return nil
+}
 
-	gacb := data[:gacbByteLength]
-	aab := data[gacbByteLength : gacbByteLength+aabByteLength]
-	pgaeb := data[gacbByteLength+aabByteLength : gacbByteLength+aabByteLength+pgaebByteLength]
+// Decode reads a ProcessResponseDet from a wire-encoded body
+func (crd *ProcessResponseDet) Decode(r *WireReader) error {
+	if err := (*crd).PR.Decode(r); err != nil {
+		return err
+	}
+	dtbgb, err := r.ReadBytes()
+	if err != nil {
+		return err
+	}
+	(*crd).DetTagGroupBy = GroupingKey(string(dtbgb))
 
-	(*cv).GroupByEnc.FromBytes(gacb, gacbLength)
-	(*cv).AggregatingAttributes.FromBytes(aab, aabLength)
-	(*cv).WhereEnc.FromBytes(pgaeb, pgaebLength)
+	n, err := r.readCountOf(4)
+	if err != nil {
+		return err
+	}
+	(*crd).DetTagWhere = make([]GroupingKey, n)
+	for i := range (*crd).DetTagWhere {
+		dtbw, err := r.ReadBytes()
+		if err != nil {
+			return err
+		}
+		(*crd).DetTagWhere[i] = GroupingKey(string(dtbw))
+	}
+	return nil
 }
 
 // ToBytes converts a ProcessResponseDet to a byte array
-func (crd *ProcessResponseDet) ToBytes() ([]byte, int, int, int, int, int) {
-	b, gacbLength, aabLength, pgaebLength := (*crd).PR.ToBytes()
+func (crd *ProcessResponseDet) ToBytes() ([]byte, error) {
+	return toWire(crd.Encode)
+}
 
-	dtbgb := []byte((*crd).DetTagGroupBy)
-	dtbgbLength := len(dtbgb)
-	dtbw := []byte((*crd).DetTagGroupBy)
-	dtbwLength := len(dtbw)
+// FromBytes converts a byte array to a ProcessResponseDet. Note that you need to create the (empty) object beforehand.
+func (crd *ProcessResponseDet) FromBytes(data []byte) error {
+	return fromWire(data, crd.Decode)
+}
 
-	b = append(b, dtbgb...)
-	b = append(b, dtbw...)
-	return b, gacbLength, aabLength, pgaebLength, dtbgbLength, dtbwLength
+// Encode writes the encrypted attributes of a DpResponse in a wire-encoded body (the clear attributes are not
+// encoded, they stay at the server holding the response)
+func (dr *DpResponse) Encode(w *WireWriter) error {
+	for _, m := range []map[string]CipherText{dr.GroupByEnc, dr.WhereEnc, dr.AggregatingAttributesEnc} {
+		if err := w.WriteCipherTextMap(m); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// FromBytes converts a byte array to a ProcessResponseDet. Note that you need to create the (empty) object beforehand.
-func (crd *ProcessResponseDet) FromBytes(data []byte, gacbLength, aabLength, pgaebLength, dtbgbLength, dtbwLength int) {
-	(*crd).PR.AggregatingAttributes = make(CipherVector, aabLength)
-	(*crd).PR.WhereEnc = make(CipherVector, pgaebLength)
-	(*crd).PR.GroupByEnc = make(CipherVector, gacbLength)
+// Decode reads the encrypted attributes of a DpResponse from a wire-encoded body
+func (dr *DpResponse) Decode(r *WireReader) error {
+	var err error
+	if dr.GroupByEnc, err = r.ReadCipherTextMap(); err != nil {
+		return err
+	}
+	if dr.WhereEnc, err = r.ReadCipherTextMap(); err != nil {
+		return err
+	}
+	dr.AggregatingAttributesEnc, err = r.ReadCipherTextMap()
+	return err
+}
 
-	aabByteLength := (aabLength * 64) //CAREFUL: hardcoded 64 (size of el-gamal element C,K)
-	pgaebByteLength := (pgaebLength * 64)
-	gacbByteLength := (gacbLength * 64)
+// DpResponsesToBytes converts the encrypted attributes of a list of DpResponse to a byte array
+func DpResponsesToBytes(drs []DpResponse) ([]byte, error) {
+	return toWire(func(w *WireWriter) error {
+		return w.WriteBodies(len(drs), func(i int, bw *WireWriter) error {
+			return drs[i].Encode(bw)
+		})
+	})
+}
 
-	gacb := data[:gacbByteLength]
-	aab := data[gacbByteLength : gacbByteLength+aabByteLength]
-	pgaeb := data[gacbByteLength+aabByteLength : gacbByteLength+aabByteLength+pgaebByteLength]
-	dtbgb := data[gacbByteLength+aabByteLength+pgaebByteLength : gacbByteLength+aabByteLength+pgaebByteLength+dtbgbLength]
-	dtbw := data[gacbByteLength+aabByteLength+pgaebByteLength+dtbgbLength : gacbByteLength+aabByteLength+pgaebByteLength+dtbgbLength+dtbgbLength+dtbwLength]
+// DpResponsesFromBytes converts a byte array to a list of DpResponse (with encrypted attributes only)
+func DpResponsesFromBytes(data []byte) ([]DpResponse, error) {
+	var drs []DpResponse
+	err := fromWire(data, func(r *WireReader) error {
+		bodies, err := r.ReadBodies()
+		if err != nil {
+			return err
+		}
+		drs = make([]DpResponse, len(bodies))
+		return DecodeBodies(bodies, func(i int, br *WireReader) error {
+			return drs[i].Decode(br)
+		})
+	})
+	return drs, err
+}
 
-	(*crd).DetTagGroupBy = GroupingKey(string(dtbgb))
-	(*crd).DetTagGroupBy = GroupingKey(string(dtbw))
-	(*crd).PR.AggregatingAttributes.FromBytes(aab, aabLength)
-	(*crd).PR.WhereEnc.FromBytes(pgaeb, pgaebLength)
-	(*crd).PR.GroupByEnc.FromBytes(gacb, gacbLength)
+// toWire encodes a single element in a wire-encoded message
+func toWire(encode func(w *WireWriter) error) ([]byte, error) {
+	w := NewWireWriter()
+	if err := encode(w); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
 
+// fromWire decodes a single element from a wire-encoded message and checks that nothing is left
+func fromWire(data []byte, decode func(r *WireReader) error) error {
+	r, err := NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	if err := decode(r); err != nil {
+		return err
+	}
+	return r.Close()
 }
 
 // FromDpResponseToSend converts a DpResponseToSend to a DpResponse
-func (dr *DpResponse) FromDpResponseToSend(dprts DpResponseToSend) {
+func (dr *DpResponse) FromDpResponseToSend(dprts DpResponseToSend) error {
+	var err error
 	dr.GroupByClear = dprts.GroupByClear
-	if len(dprts.GroupByEnc) != 0 {
-		dr.GroupByEnc = MapBytesToMapCipherText(dprts.GroupByEnc)
+	if dr.GroupByEnc, err = MapBytesToMapCipherText(dprts.GroupByEnc); err != nil {
+		return err
 	}
-
 	dr.WhereClear = dprts.WhereClear
-	if len(dprts.WhereEnc) != 0 {
-		dr.WhereEnc = make(map[string]CipherText)
-		for i, v := range dprts.WhereEnc {
-			ct := CipherText{}
-			ct.FromBytes(v)
-			dr.WhereEnc[i] = ct
-		}
+	if dr.WhereEnc, err = MapBytesToMapCipherText(dprts.WhereEnc); err != nil {
+		return err
 	}
 	dr.AggregatingAttributesClear = dprts.AggregatingAttributesClear
-	if len(dprts.AggregatingAttributesEnc) != 0 {
-		dr.AggregatingAttributesEnc = make(map[string]CipherText)
-		for i, v := range dprts.AggregatingAttributesEnc {
-			ct := CipherText{}
-			ct.FromBytes(v)
-			dr.AggregatingAttributesEnc[i] = ct
-		}
-	}
+	dr.AggregatingAttributesEnc, err = MapBytesToMapCipherText(dprts.AggregatingAttributesEnc)
+	return err
 }
 
 // joinAttributes joins clear and encrypted attributes into one encrypted container (CipherVector)
@@ -470,16 +554,18 @@ func (dcr *DpClearResponse) FromDpClearResponseToProcess(encryptionKey abstract.
 }
 
 // MapBytesToMapCipherText transform objects in a map from bytes to ciphertexts
-func MapBytesToMapCipherText(mapBytes map[string][]byte) map[string]CipherText {
+func MapBytesToMapCipherText(mapBytes map[string][]byte) (map[string]CipherText, error) {
+	if len(mapBytes) == 0 {
+		return nil, nil
+	}
+
 	result := make(map[string]CipherText)
-	if len(mapBytes) != 0 {
-		for i, v := range mapBytes {
-			ct := CipherText{}
-			ct.FromBytes(v)
-			result[i] = ct
+	for i, v := range mapBytes {
+		ct := CipherText{}
+		if err := ct.FromBytes(v); err != nil {
+			return nil, errors.New("invalid ciphertext for attribute " + i + ": " + err.Error())
 		}
-		return result
+		result[i] = ct
 	}
-
-	return nil
+	return result, nil
 }
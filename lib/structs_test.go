@@ -95,10 +95,11 @@ func TestFilteredResponseConverter(t *testing.T) {
 
 	cr := lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(pubKey, grouping), AggregatingAttributes: *lib.EncryptIntVector(pubKey, aggregating)}
 
-	crb, acbLength, aabLength := cr.ToBytes()
+	crb, err := cr.ToBytes()
+	assert.Nil(t, err)
 
 	newCr := lib.FilteredResponse{}
-	newCr.FromBytes(crb, aabLength, acbLength)
+	assert.Nil(t, newCr.FromBytes(crb))
 
 	assert.Equal(t, aggregating, lib.DecryptIntVector(secKey, &newCr.AggregatingAttributes))
 	assert.Equal(t, grouping, lib.DecryptIntVector(secKey, &newCr.GroupByEnc))
@@ -113,12 +114,43 @@ func TestClientResponseDetConverter(t *testing.T) {
 
 	crd := lib.FilteredResponseDet{DetTagGroupBy: lib.Key([]int64{1}), Fr: lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(pubKey, grouping), AggregatingAttributes: *lib.EncryptIntVector(pubKey, aggregating)}}
 
-	crb, acbLength, aabLength, dtbLength := crd.ToBytes()
+	crb, err := crd.ToBytes()
+	assert.Nil(t, err)
 
 	newCrd := lib.FilteredResponseDet{}
-	newCrd.FromBytes(crb, acbLength, aabLength, dtbLength)
+	assert.Nil(t, newCrd.FromBytes(crb))
 
 	assert.Equal(t, grouping, lib.UnKey(newCrd.DetTagGroupBy))
 	assert.Equal(t, aggregating, lib.DecryptIntVector(secKey, &newCrd.Fr.AggregatingAttributes))
 	assert.Equal(t, grouping, lib.DecryptIntVector(secKey, &newCrd.Fr.GroupByEnc))
 }
+
+// TestProcessResponseDetConverter tests the ProcessResponseDet converter (to bytes)
+func TestProcessResponseDetConverter(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+
+	grouping := []int64{1}
+	where := []int64{2, 3}
+	aggregating := []int64{0, 1, 3, 103, 103}
+
+	prd := lib.ProcessResponseDet{
+		PR: lib.ProcessResponse{GroupByEnc: *lib.EncryptIntVector(pubKey, grouping), WhereEnc: *lib.EncryptIntVector(pubKey, where),
+			AggregatingAttributes: *lib.EncryptIntVector(pubKey, aggregating)},
+		DetTagGroupBy: lib.Key([]int64{1}),
+		DetTagWhere:   []lib.GroupingKey{lib.Key([]int64{2}), lib.Key([]int64{3})},
+	}
+
+	prdb, err := prd.ToBytes()
+	assert.Nil(t, err)
+
+	newPrd := lib.ProcessResponseDet{}
+	assert.Nil(t, newPrd.FromBytes(prdb))
+
+	assert.Equal(t, prd.DetTagGroupBy, newPrd.DetTagGroupBy)
+	assert.Equal(t, prd.DetTagWhere, newPrd.DetTagWhere)
+	assert.Equal(t, grouping, lib.DecryptIntVector(secKey, &newPrd.PR.GroupByEnc))
+	assert.Equal(t, where, lib.DecryptIntVector(secKey, &newPrd.PR.WhereEnc))
+	assert.Equal(t, aggregating, lib.DecryptIntVector(secKey, &newPrd.PR.AggregatingAttributes))
+
+	assert.NotNil(t, newPrd.FromBytes(prdb[:len(prdb)-4]))
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/ed25519"
+	"gopkg.in/dedis/crypto.v0/nist"
+)
+
+// suites contains the cipher suites which can be used for the ElGamal layer, indexed by their name.
+var suites = make(map[string]abstract.Suite)
+
+// suiteMutex guards the registered suites and the current one.
+var suiteMutex sync.Mutex
+
+func init() {
+	RegisterSuite(ed25519.NewAES128SHA256Ed25519(false))
+	RegisterSuite(nist.NewAES128SHA256P256())
+}
+
+// Suites
+//______________________________________________________________________________________________________________________
+
+// RegisterSuite makes a cipher suite available to SetSuite.
+func RegisterSuite(s abstract.Suite) {
+	suiteMutex.Lock()
+	defer suiteMutex.Unlock()
+	suites[s.String()] = s
+}
+
+// SuiteByName returns the registered cipher suite with the given name.
+func SuiteByName(name string) (abstract.Suite, error) {
+	suiteMutex.Lock()
+	s, ok := suites[name]
+	suiteMutex.Unlock()
+	if !ok {
+		return nil, errors.New("unknown suite " + name + " (available: " + strings.Join(SuiteNames(), ", ") + ")")
+	}
+	return s, nil
+}
+
+// SuiteNames returns the names of the registered cipher suites.
+func SuiteNames() []string {
+	suiteMutex.Lock()
+	defer suiteMutex.Unlock()
+	names := make([]string, 0, len(suites))
+	for name := range suites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CurrentSuite returns the cipher suite used for keys and ciphertexts.
+func CurrentSuite() abstract.Suite {
+	suiteMutex.Lock()
+	defer suiteMutex.Unlock()
+	return suite
+}
+
+// SetSuite selects the cipher suite used for keys and ciphertexts. It has to be called at start-up, before any key or
+// ciphertext is created and before other goroutines use the package: the elements of different suites cannot be
+// mixed and the functions of the package read the suite without synchronization.
+// The servers only use the suite of their identities (network.Suite), the others are for local use.
+func SetSuite(name string) error {
+	s, err := SuiteByName(name)
+	if err != nil {
+		return err
+	}
+	suiteMutex.Lock()
+	defer suiteMutex.Unlock()
+	if s.String() == suite.String() {
+		return nil
+	}
+
+	suite = s
+	// the discrete logarithm table is bound to the base point of the previous suite
+	discreteLogMutex.Lock()
+	PointToInt = make(map[string]int64, MaxHomomorphicInt)
+	currentGreatestM = nil
+	currentGreatestInt = 0
+	discreteLogMutex.Unlock()
+	return nil
+}
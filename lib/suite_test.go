@@ -0,0 +1,56 @@
+package lib_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// TestSetSuite tests the selection of the suite and that serialized elements are bound to their suite
+func TestSetSuite(t *testing.T) {
+	defer lib.SetSuite(network.Suite.String())
+
+	assert.NotNil(t, lib.SetSuite("NoSuchCurve"))
+	assert.Equal(t, network.Suite.String(), lib.CurrentSuite().String())
+
+	secKey, pubKey := lib.GenKey()
+	pubKeySer, err := lib.SerializePoint(pubKey)
+	assert.Nil(t, err)
+	secKeySer, err := lib.SerializeScalar(secKey)
+	assert.Nil(t, err)
+	ctSer := lib.EncryptInt(pubKey, 7).Serialize()
+
+	assert.Nil(t, lib.SetSuite("P256"))
+	assert.Equal(t, "P256", lib.CurrentSuite().String())
+
+	_, err = lib.DeserializePoint(pubKeySer)
+	assert.NotNil(t, err)
+	_, err = lib.DeserializeScalar(secKeySer)
+	assert.NotNil(t, err)
+	assert.NotNil(t, (&lib.CipherText{}).Deserialize(ctSer))
+
+	assert.Nil(t, lib.SetSuite(network.Suite.String()))
+
+	newPubKey, err := lib.DeserializePoint(pubKeySer)
+	assert.Nil(t, err)
+	assert.True(t, pubKey.Equal(newPubKey))
+	newSecKey, err := lib.DeserializeScalar(secKeySer)
+	assert.Nil(t, err)
+	ct := lib.CipherText{}
+	assert.Nil(t, ct.Deserialize(ctSer))
+	assert.Equal(t, int64(7), lib.DecryptInt(newSecKey, ct))
+}
+
+// TestDeserializeLegacy tests that elements serialized without suite header can still be read
+func TestDeserializeLegacy(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+	ct := lib.EncryptInt(pubKey, 3)
+
+	legacy := base64.StdEncoding.EncodeToString(ct.ToBytes())
+	newCt := lib.CipherText{}
+	assert.Nil(t, newCt.Deserialize(legacy))
+	assert.Equal(t, int64(3), lib.DecryptInt(secKey, newCt))
+}
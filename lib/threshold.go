@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"errors"
+	"strconv"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+)
+
+// A t-of-n threshold collective key is generated by a distributed key generation (joint Feldman): each server i
+// deals a random polynomial f_i of degree t-1 by publishing the commitments f_i(k)B to its coefficients and sending
+// f_i(j) to each server j. The collective secret key is x = sum_i f_i(0) and is never known by anyone; server j
+// keeps the share s_j = sum_i f_i(j) and any t servers can act for the whole roster with Lagrange-weighted shares.
+
+// ThresholdKey is the part of a threshold collective key held by one server.
+type ThresholdKey struct {
+	// Index is the (1-based) index of the server in the roster of the key generation
+	Index int
+	// T is the number of servers needed to use the key
+	T int
+	// N is the number of servers which took part in the key generation
+	N             int
+	Share         abstract.Scalar
+	CollectiveKey abstract.Point
+	// PublicShares are the public keys s_jB of the shares of all servers (server j at position j-1), against which
+	// their contributions to a key switching are proven
+	PublicShares []abstract.Point
+}
+
+// DKGDeal is what a server deals during the key generation: the commitments to its polynomial and one share per server.
+type DKGDeal struct {
+	Commitments []abstract.Point
+	Shares      []abstract.Scalar
+}
+
+// Key generation
+//______________________________________________________________________________________________________________________
+
+// NewDKGDeal picks a random polynomial of degree t-1 and computes its commitments and its shares for n servers.
+func NewDKGDeal(t, n int) (*DKGDeal, error) {
+	if t < 1 || t > n {
+		return nil, errors.New("threshold must be between 1 and the number of servers (" + strconv.Itoa(n) + ")")
+	}
+	coefficients := make([]abstract.Scalar, t)
+	deal := DKGDeal{Commitments: make([]abstract.Point, t), Shares: make([]abstract.Scalar, n)}
+	for k := range coefficients {
+		coefficients[k] = suite.Scalar().Pick(random.Stream)
+		deal.Commitments[k] = suite.Point().Mul(suite.Point().Base(), coefficients[k])
+	}
+	for j := range deal.Shares {
+		deal.Shares[j] = evalPolynomial(coefficients, j+1)
+	}
+	return &deal, nil
+}
+
+// evalPolynomial computes sum_k coefficients[k] * x^k
+func evalPolynomial(coefficients []abstract.Scalar, x int) abstract.Scalar {
+	xs := suite.Scalar().SetInt64(int64(x))
+	result := suite.Scalar().Zero()
+	for k := len(coefficients) - 1; k >= 0; k-- {
+		result.Mul(result, xs)
+		result.Add(result, coefficients[k])
+	}
+	return result
+}
+
+// DKGPublicShare computes f(index)B from the commitments to the coefficients of f.
+func DKGPublicShare(commitments []abstract.Point, index int) abstract.Point {
+	xs := suite.Scalar().SetInt64(int64(index))
+	result := suite.Point().Null()
+	for k := len(commitments) - 1; k >= 0; k-- {
+		result.Mul(result, xs)
+		result.Add(result, commitments[k])
+	}
+	return result
+}
+
+// VerifyDKGShare checks that share = f(index) where commitments are the commitments to the coefficients of f.
+func VerifyDKGShare(commitments []abstract.Point, index int, share abstract.Scalar) bool {
+	if share == nil || len(commitments) == 0 {
+		return false
+	}
+	return suite.Point().Mul(suite.Point().Base(), share).Equal(DKGPublicShare(commitments, index))
+}
+
+// NewThresholdKey combines the deals of all servers into the share of the server with the given index. Every deal has
+// to contain a valid share for this server, otherwise the dealer is reported in the error.
+func NewThresholdKey(deals []DKGDeal, index, t int) (*ThresholdKey, error) {
+	tk := ThresholdKey{Index: index, T: t, N: len(deals), Share: suite.Scalar().Zero(), CollectiveKey: suite.Point().Null(),
+		PublicShares: make([]abstract.Point, len(deals))}
+	for j := range tk.PublicShares {
+		tk.PublicShares[j] = suite.Point().Null()
+	}
+	for i, d := range deals {
+		if len(d.Commitments) != t || len(d.Shares) < index {
+			return nil, errors.New("malformed deal from server " + strconv.Itoa(i+1))
+		}
+		if !VerifyDKGShare(d.Commitments, index, d.Shares[index-1]) {
+			return nil, errors.New("invalid share dealt by server " + strconv.Itoa(i+1) + " to server " + strconv.Itoa(index))
+		}
+		tk.Share.Add(tk.Share, d.Shares[index-1])
+		tk.CollectiveKey.Add(tk.CollectiveKey, d.Commitments[0])
+		for j := range tk.PublicShares {
+			tk.PublicShares[j].Add(tk.PublicShares[j], DKGPublicShare(d.Commitments, j+1))
+		}
+	}
+	return &tk, nil
+}
+
+// Threshold key switching
+//______________________________________________________________________________________________________________________
+
+// LagrangeCoefficient computes the weight of the share of server index when the secret is recovered from the shares
+// of the servers in participants (interpolation at 0).
+func LagrangeCoefficient(index int, participants []int) abstract.Scalar {
+	num := suite.Scalar().One()
+	den := suite.Scalar().One()
+	xi := suite.Scalar().SetInt64(int64(index))
+	for _, j := range participants {
+		if j == index {
+			continue
+		}
+		xj := suite.Scalar().SetInt64(int64(j))
+		num.Mul(num, xj)
+		den.Mul(den, suite.Scalar().Sub(xj, xi))
+	}
+	return num.Div(num, den)
+}
+
+// ThresholdKeySwitchingContribution computes the contribution (rB, rQ - sK) of a server holding share s to the
+// switch of a ciphertext with ephemeral key K to the key Q. The contribution does not reveal sK since it is
+// encrypted under Q.
+func (c *CipherText) ThresholdKeySwitchingContribution(originalEphemeralKey, newKey abstract.Point, share abstract.Scalar) {
+	r := suite.Scalar().Pick(random.Stream)
+	c.K = suite.Point().Mul(suite.Point().Base(), r)
+	c.C = suite.Point().Sub(suite.Point().Mul(newKey, r), suite.Point().Mul(originalEphemeralKey, share))
+}
+
+// AddThresholdKeySwitchingContribution adds a contribution weighted by the Lagrange coefficient of its server. Once
+// the contributions of t servers are added to (0, C), the receiver is an encryption of the plaintext under the new key.
+func (c *CipherText) AddThresholdKeySwitchingContribution(contribution CipherText, lambda abstract.Scalar) {
+	c.K.Add(c.K, suite.Point().Mul(contribution.K, lambda))
+	c.C.Add(c.C, suite.Point().Mul(contribution.C, lambda))
+}
+
+// Conversion
+//______________________________________________________________________________________________________________________
+
+// ToBytes converts a DKGDeal to a wire-encoded byte array
+func (d *DKGDeal) ToBytes() ([]byte, error) {
+	w := NewWireWriter()
+	if err := w.WritePoints(d.Commitments); err != nil {
+		return nil, err
+	}
+	w.WriteCount(len(d.Shares))
+	for _, s := range d.Shares {
+		if err := w.WriteScalar(s); err != nil {
+			return nil, err
+		}
+	}
+	return w.Bytes(), nil
+}
+
+// FromBytes converts a wire-encoded byte array to a DKGDeal
+func (d *DKGDeal) FromBytes(data []byte) error {
+	r, err := NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	if d.Commitments, err = r.ReadPoints(); err != nil {
+		return err
+	}
+	n, err := r.readCountOf(suite.ScalarLen())
+	if err != nil {
+		return err
+	}
+	d.Shares = make([]abstract.Scalar, n)
+	for i := range d.Shares {
+		if d.Shares[i], err = r.ReadScalar(); err != nil {
+			return err
+		}
+	}
+	return r.Close()
+}
@@ -0,0 +1,88 @@
+package lib_test
+
+import (
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// generateThresholdKeys runs a key generation between n simulated servers
+func generateThresholdKeys(t *testing.T, threshold, n int) []*lib.ThresholdKey {
+	deals := make([]lib.DKGDeal, n)
+	for i := range deals {
+		d, err := lib.NewDKGDeal(threshold, n)
+		assert.Nil(t, err)
+
+		// deals go through the wire
+		b, err := d.ToBytes()
+		assert.Nil(t, err)
+		assert.Nil(t, deals[i].FromBytes(b))
+	}
+
+	keys := make([]*lib.ThresholdKey, n)
+	for i := range keys {
+		var err error
+		keys[i], err = lib.NewThresholdKey(deals, i+1, threshold)
+		assert.Nil(t, err)
+		if i > 0 {
+			assert.True(t, keys[i].CollectiveKey.Equal(keys[0].CollectiveKey))
+		}
+	}
+
+	// every server knows the public key of the share of every other server
+	suite := lib.CurrentSuite()
+	for i := range keys {
+		publicShare := suite.Point().Mul(suite.Point().Base(), keys[i].Share)
+		for j := range keys {
+			assert.True(t, keys[j].PublicShares[i].Equal(publicShare))
+		}
+	}
+	return keys
+}
+
+// thresholdKeySwitch switches ct to newKey with the shares of the given (1-based) servers
+func thresholdKeySwitch(ct lib.CipherText, newKey abstract.Point, keys []*lib.ThresholdKey, participants []int) lib.CipherText {
+	suite := lib.CurrentSuite()
+	result := lib.CipherText{K: suite.Point().Null(), C: suite.Point().Add(suite.Point().Null(), ct.C)}
+	for _, i := range participants {
+		contribution := lib.CipherText{}
+		contribution.ThresholdKeySwitchingContribution(ct.K, newKey, keys[i-1].Share)
+		result.AddThresholdKeySwitchingContribution(contribution, lib.LagrangeCoefficient(i, participants))
+	}
+	return result
+}
+
+func TestThresholdKeySwitching(t *testing.T) {
+	keys := generateThresholdKeys(t, 3, 5)
+	ct := lib.EncryptInt(keys[0].CollectiveKey, 42)
+
+	// any 3 servers can switch the ciphertext
+	for _, participants := range [][]int{{1, 2, 3}, {2, 4, 5}, {5, 1, 3}, {1, 2, 3, 4, 5}} {
+		switched := thresholdKeySwitch(*ct, pubKeyNew, keys, participants)
+		assert.Equal(t, int64(42), lib.DecryptInt(secKeyNew, switched))
+	}
+
+	// 2 servers cannot
+	switched := thresholdKeySwitch(*ct, pubKeyNew, keys, []int{1, 4})
+	assert.NotEqual(t, int64(42), lib.DecryptInt(secKeyNew, switched))
+}
+
+func TestThresholdKeyInvalidDeal(t *testing.T) {
+	deals := make([]lib.DKGDeal, 3)
+	for i := range deals {
+		d, err := lib.NewDKGDeal(2, 3)
+		assert.Nil(t, err)
+		deals[i] = *d
+	}
+	deals[1].Shares[2] = lib.CurrentSuite().Scalar().One()
+
+	_, err := lib.NewThresholdKey(deals, 1, 2)
+	assert.Nil(t, err)
+	_, err = lib.NewThresholdKey(deals, 3, 2)
+	assert.NotNil(t, err)
+
+	_, err = lib.NewDKGDeal(4, 3)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,425 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"gopkg.in/dedis/crypto.v0/abstract"
+)
+
+// WireFormatVersion is the version of the binary encoding used for ciphertexts in protocol messages.
+const WireFormatVersion byte = 1
+
+// wireMagic prefixes every wire-encoded message.
+var wireMagic = []byte("PDC")
+
+// ErrTruncated is returned when a wire-encoded message ends before all announced elements could be read.
+var ErrTruncated = errors.New("wire-encoded message is truncated")
+
+// Wire format
+//______________________________________________________________________________________________________________________
+
+// The wire format is made of a header followed by a body:
+//	header: "PDC" | version (1 byte) | suite name length (1 byte) | suite name
+//	body:   a sequence of elements, each vector or list being prefixed by its element count (uint32, big endian)
+// Points are written with their fixed marshalled size (suite.PointLen()) so that the counts are enough to read
+// a message back; no side-channel length message is needed.
+
+// WireWriter builds a wire-encoded message.
+type WireWriter struct {
+	buf bytes.Buffer
+}
+
+// NewWireWriter creates a writer and writes the message header. A zero WireWriter writes a body without header.
+func NewWireWriter() *WireWriter {
+	w := &WireWriter{}
+	name := suite.String()
+	w.buf.Write(wireMagic)
+	w.buf.WriteByte(WireFormatVersion)
+	w.buf.WriteByte(byte(len(name)))
+	w.buf.WriteString(name)
+	return w
+}
+
+// Bytes returns the encoded message.
+func (w *WireWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// writeRaw appends data as is (its length must be implied by the suite).
+func (w *WireWriter) writeRaw(data []byte) {
+	w.buf.Write(data)
+}
+
+// WriteCount writes an element count.
+func (w *WireWriter) WriteCount(n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	w.buf.Write(b[:])
+}
+
+// WriteBytes writes a length-prefixed byte slice.
+func (w *WireWriter) WriteBytes(data []byte) {
+	w.WriteCount(len(data))
+	w.buf.Write(data)
+}
+
+// WritePoint writes a point.
+func (w *WireWriter) WritePoint(p abstract.Point) error {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.buf.Write(b)
+	return nil
+}
+
+// WritePoints writes a count followed by the points.
+func (w *WireWriter) WritePoints(ps []abstract.Point) error {
+	w.WriteCount(len(ps))
+	for _, p := range ps {
+		if err := w.WritePoint(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteScalar writes a scalar.
+func (w *WireWriter) WriteScalar(sc abstract.Scalar) error {
+	b, err := sc.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.buf.Write(b)
+	return nil
+}
+
+// WriteCipherText writes a ciphertext (K then C).
+func (w *WireWriter) WriteCipherText(c CipherText) error {
+	if err := w.WritePoint(c.K); err != nil {
+		return err
+	}
+	return w.WritePoint(c.C)
+}
+
+// WriteCipherVector writes a count followed by the ciphertexts.
+func (w *WireWriter) WriteCipherVector(cv CipherVector) error {
+	w.WriteCount(len(cv))
+	for _, c := range cv {
+		if err := w.WriteCipherText(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteCipherTextMap writes a count followed by the (key, ciphertext) pairs, sorted by key.
+func (w *WireWriter) WriteCipherTextMap(m map[string]CipherText) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.WriteCount(len(keys))
+	for _, k := range keys {
+		w.WriteBytes([]byte(k))
+		if err := w.WriteCipherText(m[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBodies writes a count followed by n length-prefixed bodies, each one encoded (in parallel) by encode.
+func (w *WireWriter) WriteBodies(n int, encode func(i int, bw *WireWriter) error) error {
+	bodies := make([][]byte, n)
+	errs := make([]error, n)
+	wg := StartParallelize(n)
+	for i := 0; i < n; i++ {
+		if PARALLELIZE {
+			go func(i int) {
+				defer wg.Done()
+				bw := &WireWriter{}
+				errs[i] = encode(i, bw)
+				bodies[i] = bw.Bytes()
+			}(i)
+		} else {
+			bw := &WireWriter{}
+			errs[i] = encode(i, bw)
+			bodies[i] = bw.Bytes()
+		}
+	}
+	EndParallelize(wg)
+
+	w.WriteCount(n)
+	for i := range bodies {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		w.WriteBytes(bodies[i])
+	}
+	return nil
+}
+
+// WireReader reads a wire-encoded message. Every read checks the remaining length so that malformed input
+// results in an error instead of a panic.
+type WireReader struct {
+	data []byte
+	pos  int
+}
+
+// NewWireReader checks the header of a wire-encoded message and returns a reader positioned on its body.
+func NewWireReader(data []byte) (*WireReader, error) {
+	r := NewWireBodyReader(data)
+	magic, err := r.next(len(wireMagic))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, wireMagic) {
+		return nil, errors.New("not a wire-encoded message (bad magic)")
+	}
+	version, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	if version[0] != WireFormatVersion {
+		return nil, fmt.Errorf("unsupported wire format version %d (expected %d)", version[0], WireFormatVersion)
+	}
+	nameLength, err := r.next(1)
+	if err != nil {
+		return nil, err
+	}
+	name, err := r.next(int(nameLength[0]))
+	if err != nil {
+		return nil, err
+	}
+	if string(name) != suite.String() {
+		return nil, fmt.Errorf("message encoded for suite %q, expected %q", string(name), suite.String())
+	}
+	return r, nil
+}
+
+// NewWireBodyReader returns a reader on a body without header (e.g. one written by WriteBodies).
+func NewWireBodyReader(data []byte) *WireReader {
+	return &WireReader{data: data}
+}
+
+// Remaining returns the number of bytes left to read.
+func (r *WireReader) Remaining() int {
+	return len(r.data) - r.pos
+}
+
+// Close checks that the whole message has been consumed.
+func (r *WireReader) Close() error {
+	if r.Remaining() != 0 {
+		return fmt.Errorf("%d unexpected trailing byte(s) in wire-encoded message", r.Remaining())
+	}
+	return nil
+}
+
+func (r *WireReader) next(n int) ([]byte, error) {
+	if n < 0 || n > r.Remaining() {
+		return nil, ErrTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// ReadCount reads an element count.
+func (r *WireReader) ReadCount() (int, error) {
+	b, err := r.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint32(b)), nil
+}
+
+// readCountOf reads a count of elements of elemSize bytes and checks that they fit in the remaining data.
+func (r *WireReader) readCountOf(elemSize int) (int, error) {
+	n, err := r.ReadCount()
+	if err != nil {
+		return 0, err
+	}
+	if elemSize > 0 && n > r.Remaining()/elemSize {
+		return 0, ErrTruncated
+	}
+	return n, nil
+}
+
+// ReadBytes reads a length-prefixed byte slice.
+func (r *WireReader) ReadBytes() ([]byte, error) {
+	n, err := r.readCountOf(1)
+	if err != nil {
+		return nil, err
+	}
+	return r.next(n)
+}
+
+// ReadPoint reads a point and checks that it is a valid encoding.
+func (r *WireReader) ReadPoint() (abstract.Point, error) {
+	b, err := r.next(suite.PointLen())
+	if err != nil {
+		return nil, err
+	}
+	p := suite.Point()
+	if err := p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ReadPoints reads a count followed by the points.
+func (r *WireReader) ReadPoints() ([]abstract.Point, error) {
+	n, err := r.readCountOf(suite.PointLen())
+	if err != nil {
+		return nil, err
+	}
+	ps := make([]abstract.Point, n)
+	for i := range ps {
+		if ps[i], err = r.ReadPoint(); err != nil {
+			return nil, err
+		}
+	}
+	return ps, nil
+}
+
+// ReadScalar reads a scalar.
+func (r *WireReader) ReadScalar() (abstract.Scalar, error) {
+	b, err := r.next(suite.ScalarLen())
+	if err != nil {
+		return nil, err
+	}
+	sc := suite.Scalar()
+	if err := sc.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// ReadCipherText reads a ciphertext.
+func (r *WireReader) ReadCipherText() (CipherText, error) {
+	k, err := r.ReadPoint()
+	if err != nil {
+		return CipherText{}, err
+	}
+	c, err := r.ReadPoint()
+	if err != nil {
+		return CipherText{}, err
+	}
+	return CipherText{K: k, C: c}, nil
+}
+
+// ReadCipherVector reads a count followed by the ciphertexts. Points are decoded in parallel.
+func (r *WireReader) ReadCipherVector() (CipherVector, error) {
+	elemSize := 2 * suite.PointLen()
+	n, err := r.readCountOf(elemSize)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := r.next(n * elemSize)
+	if err != nil {
+		return nil, err
+	}
+
+	cv := make(CipherVector, n)
+	errs := make([]error, n)
+	var wg = StartParallelize(0)
+	if PARALLELIZE {
+		for i := 0; i < n; i = i + VPARALLELIZE {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < VPARALLELIZE && (j+i < n); j++ {
+					errs[i+j] = cv[i+j].FromBytes(raw[(i+j)*elemSize : (i+j+1)*elemSize])
+				}
+			}(i)
+		}
+		EndParallelize(wg)
+	} else {
+		for i := range cv {
+			errs[i] = cv[i].FromBytes(raw[i*elemSize : (i+1)*elemSize])
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cv, nil
+}
+
+// ReadCipherTextMap reads the (key, ciphertext) pairs written by WriteCipherTextMap.
+func (r *WireReader) ReadCipherTextMap() (map[string]CipherText, error) {
+	n, err := r.readCountOf(4 + 2*suite.PointLen())
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]CipherText, n)
+	for i := 0; i < n; i++ {
+		k, err := r.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := m[string(k)]; ok {
+			return nil, errors.New("duplicate attribute " + string(k) + " in ciphertext map")
+		}
+		if m[string(k)], err = r.ReadCipherText(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ReadBodies reads the bodies written by WriteBodies and returns one reader per body.
+func (r *WireReader) ReadBodies() ([]*WireReader, error) {
+	n, err := r.readCountOf(4)
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([]*WireReader, n)
+	for i := range bodies {
+		b, err := r.ReadBytes()
+		if err != nil {
+			return nil, err
+		}
+		bodies[i] = NewWireBodyReader(b)
+	}
+	return bodies, nil
+}
+
+// DecodeBodies decodes bodies (in parallel) with decode and returns the first error encountered.
+func DecodeBodies(bodies []*WireReader, decode func(i int, br *WireReader) error) error {
+	errs := make([]error, len(bodies))
+	wg := StartParallelize(len(bodies))
+	for i := range bodies {
+		if PARALLELIZE {
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = decode(i, bodies[i])
+				if errs[i] == nil {
+					errs[i] = bodies[i].Close()
+				}
+			}(i)
+		} else {
+			errs[i] = decode(i, bodies[i])
+			if errs[i] == nil {
+				errs[i] = bodies[i].Close()
+			}
+		}
+	}
+	EndParallelize(wg)
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -3,7 +3,8 @@ package lib
 
 import (
 	"encoding/xml"
-	"gopkg.in/dedis/onet.v1"
+	"fmt"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1/log"
 )
 
@@ -27,6 +28,7 @@ import (
 			<enc_data>enc</enc_data>
 			<enc_data>enc</enc_data>
 			<enc_data>enc</enc_data>
+			<enc_aggregating_attribute>optional, enc of 1 (real patient) or 0 (dummy)</enc_aggregating_attribute>
 		</patient>
 	</enc_patients_data>
 
@@ -46,13 +48,17 @@ type XMLMedCoQuery struct {
 	ResultMode         string              `xml:"result_mode"`
 }
 
-// XMLEncPatientData is a parsed patient data in XML
+// XMLEncPatientData is a parsed patient data in XML. EncAggregatingAttribute encrypts 1 for a real patient and 0 for
+// a dummy; a site pads its patients with dummies to hide their number. If it is empty, the patient counts as a real one.
 type XMLEncPatientData struct {
-	EncData []string `xml:"enc_data"`
+	EncData                 []string `xml:"enc_data"`
+	EncAggregatingAttribute string   `xml:"enc_aggregating_attribute"`
 }
 
-// PatientsDataToUnlynxFormat parses and decodes the base64-encoded values in the XML, returns slice of patients ready for input to unlynx
-func (xml *XMLMedCoQuery) PatientsDataToUnlynxFormat(el *onet.Roster) ([]ProcessResponse, error) {
+// PatientsDataToUnlynxFormat parses and decodes the base64-encoded values in the XML, returns slice of patients ready for input to unlynx.
+// collectiveKey is the key the data is encrypted under: the threshold collective key of the servers if they hold one,
+// the aggregate of their keys otherwise.
+func (xml *XMLMedCoQuery) PatientsDataToUnlynxFormat(collectiveKey abstract.Point) ([]ProcessResponse, error) {
 
 	// iter over patients
 	patientsProcessResponse := make([]ProcessResponse, len(xml.EncPatientsData))
@@ -62,22 +68,27 @@ func (xml *XMLMedCoQuery) PatientsDataToUnlynxFormat(el *onet.Roster) ([]Process
 		patientsProcessResponse[patientIdx].WhereEnc = make(CipherVector, len(patient.EncData))
 		for encDataIdx, encData := range patient.EncData {
 
-			err := patientsProcessResponse[patientIdx].WhereEnc[encDataIdx].Deserialize(encData)
+			ct, err := NewCipherTextFromBase64(encData)
 			if err != nil {
 				log.Error("Error while decoding CipherVector.")
-				return nil, err
+				return nil, fmt.Errorf("patient %d, enc_data %d: %v", patientIdx, encDataIdx, err)
 			}
+			patientsProcessResponse[patientIdx].WhereEnc[encDataIdx] = *ct
 		}
 
-		// TODO: here is generated the encrypted aggregating attribute, hardcoded to 1
-		// TODO: this attribute is either 1 or 0 according to the dummy status
-		// TODO: thus, this part is to be changed to support dummies in the future
-		nbrAggr := 1
-		aggr := make(CipherVector, nbrAggr)
-		for j := 0; j < nbrAggr; j++ {
-			aggr[j] = *EncryptInt(el.Aggregate, int64(1))
+		// the aggregating attribute is either 1 or 0 according to the dummy status, a dummy never changes a count
+		var aggr CipherText
+		if patient.EncAggregatingAttribute == "" {
+			aggr = *EncryptInt(collectiveKey, int64(1))
+		} else {
+			ct, err := NewCipherTextFromBase64(patient.EncAggregatingAttribute)
+			if err != nil {
+				log.Error("Error while decoding aggregating attribute.")
+				return nil, fmt.Errorf("patient %d, enc_aggregating_attribute: %v", patientIdx, err)
+			}
+			aggr = *ct
 		}
-		patientsProcessResponse[patientIdx].AggregatingAttributes = aggr
+		patientsProcessResponse[patientIdx].AggregatingAttributes = CipherVector{aggr}
 	}
 
 	return patientsProcessResponse, nil
@@ -85,3 +85,29 @@ func TestQueryResultXMLNoError(t *testing.T) {
 	assert.Equal(t, parsed_xml.ResultMode, " result mode (0 or 1)")
 	assert.Equal(t, parsed_xml.Error, "")
 }
+
+func TestPatientsDataWithDummies(t *testing.T) {
+	secKey, pubKey := lib.GenKey()
+
+	where := lib.EncryptInt(pubKey, 5).Serialize()
+	query := lib.XMLMedCoQuery{EncPatientsData: []lib.XMLEncPatientData{
+		{EncData: []string{where}},
+		{EncData: []string{where}, EncAggregatingAttribute: lib.EncryptInt(pubKey, 0).Serialize()},
+		{EncData: []string{where}, EncAggregatingAttribute: lib.EncryptInt(pubKey, 1).Serialize()},
+	}}
+
+	responses, err := query.PatientsDataToUnlynxFormat(pubKey)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(responses))
+
+	total := lib.NewCipherText()
+	for _, r := range responses {
+		assert.Equal(t, int64(5), lib.DecryptInt(secKey, r.WhereEnc[0]))
+		total.Add(*total, r.AggregatingAttributes[0])
+	}
+	assert.Equal(t, int64(2), lib.DecryptInt(secKey, *total))
+
+	query.EncPatientsData[1].EncAggregatingAttribute = "not a ciphertext"
+	_, err = query.PatientsDataToUnlynxFormat(pubKey)
+	assert.NotNil(t, err)
+}
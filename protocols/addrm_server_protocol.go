@@ -28,11 +28,18 @@ type AddRmServerProtocol struct {
 	// Protocol feedback channel
 	FeedbackChannel chan []lib.DpResponse
 
+	// Transformed responses passed from Start to Dispatch
+	result chan []lib.DpResponse
+
 	// Protocol state data
 	TargetOfTransformation []lib.DpResponse
 	KeyToRm                abstract.Scalar
 	Proofs                 bool
 	Add                    bool
+
+	// PublishedProofs are the proofs of the transformation (if Proofs), three per response: for its aggregating,
+	// grouping and where attributes
+	PublishedProofs []lib.PublishedAddRmProof
 }
 
 // NewAddRmProtocol is constructor of add/rm protocol instances.
@@ -40,13 +47,12 @@ func NewAddRmProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
 	pvp := &AddRmServerProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []lib.DpResponse),
+		result:           make(chan []lib.DpResponse, 1),
 	}
 
 	return pvp, nil
 }
 
-var finalResultAddrm = make(chan []lib.DpResponse)
-
 // Start is called at the root to start the execution of the Add/Rm protocol.
 func (p *AddRmServerProtocol) Start() error {
 
@@ -74,21 +80,23 @@ func (p *AddRmServerProtocol) Start() error {
 	roundProof := lib.StartTimer(p.Name() + "_AddRmServer(PROOFS)")
 	pubs := make([]lib.PublishedAddRmProof, 0)
 	if p.Proofs {
+		pubs = make([]lib.PublishedAddRmProof, 3*len(result))
 		wg := lib.StartParallelize(len(result))
 		for i, v := range result {
 			if lib.PARALLELIZE {
 				go func(i int, v lib.DpResponse) {
 					defer wg.Done()
-					proofsCreation(pubs, p.TargetOfTransformation[i], v, p.KeyToRm, p.Add)
+					copy(pubs[3*i:], proofsCreation(p.TargetOfTransformation[i], v, p.KeyToRm, p.Add))
 				}(i, v)
 
 			} else {
-				proofsCreation(pubs, p.TargetOfTransformation[i], v, p.KeyToRm, p.Add)
+				copy(pubs[3*i:], proofsCreation(p.TargetOfTransformation[i], v, p.KeyToRm, p.Add))
 			}
 
 		}
 		lib.EndParallelize(wg)
 	}
+	p.PublishedProofs = pubs
 
 	lib.EndTimer(roundProof)
 
@@ -108,13 +116,13 @@ func (p *AddRmServerProtocol) Start() error {
 	lib.EndParallelize(wg)
 	lib.EndTimer(roundProof)
 
-	finalResultAddrm <- result
+	p.result <- result
 	return nil
 }
 
 // Dispatch is called on each node. It waits for incoming messages and handle them.
 func (p *AddRmServerProtocol) Dispatch() error {
-	aux := <-finalResultAddrm
+	aux := <-p.result
 	p.FeedbackChannel <- aux
 	return nil
 }
@@ -148,7 +156,9 @@ func changeEncryption(response lib.DpResponse, keyToRm abstract.Scalar, add bool
 	return result
 }
 
-func proofsCreation(pubs []lib.PublishedAddRmProof, target, v lib.DpResponse, keyToRm abstract.Scalar, add bool) {
+// proofsCreation creates the proofs of the transformation of a response, for its aggregating, grouping and where
+// attributes (in this order)
+func proofsCreation(target, v lib.DpResponse, keyToRm abstract.Scalar, add bool) []lib.PublishedAddRmProof {
 	targetAggregatingAttributesEnc := target.AggregatingAttributesEnc
 	targetGroupingAttributes := target.GroupByEnc
 	targetWhereAttributes := target.WhereEnc
@@ -158,8 +168,8 @@ func proofsCreation(pubs []lib.PublishedAddRmProof, target, v lib.DpResponse, ke
 	prfWhere := lib.VectorAddRmProofCreation(targetWhereAttributes, v.WhereEnc, keyToRm, add)
 	ktopub := network.Suite.Point().Mul(network.Suite.Point().Base(), keyToRm)
 	pub1 := lib.PublishedAddRmProof{Arp: prfAggr, VectBefore: targetAggregatingAttributesEnc, VectAfter: v.AggregatingAttributesEnc, Krm: ktopub, ToAdd: add}
-	pub2 := lib.PublishedAddRmProof{Arp: prfGrp, VectBefore: v.GroupByEnc, VectAfter: v.GroupByEnc, Krm: ktopub, ToAdd: add}
-	pub3 := lib.PublishedAddRmProof{Arp: prfWhere, VectBefore: v.WhereEnc, VectAfter: v.WhereEnc, Krm: ktopub, ToAdd: add}
+	pub2 := lib.PublishedAddRmProof{Arp: prfGrp, VectBefore: targetGroupingAttributes, VectAfter: v.GroupByEnc, Krm: ktopub, ToAdd: add}
+	pub3 := lib.PublishedAddRmProof{Arp: prfWhere, VectBefore: targetWhereAttributes, VectAfter: v.WhereEnc, Krm: ktopub, ToAdd: add}
 
-	pubs = append(pubs, pub1, pub2, pub3)
+	return []lib.PublishedAddRmProof{pub1, pub2, pub3}
 }
@@ -83,6 +83,11 @@ func TestAddRmServer(t *testing.T) {
 		}
 		//decryptedResult := lib.DecryptIntVector(secKeyAfter, &results[0].AggregatingAttributesEnc)
 		assert.Equal(t, decryptedResult, expectedResults)
+
+		assert.Equal(t, 3*len(dpResponses), len(protocol.PublishedProofs))
+		for _, prf := range protocol.PublishedProofs {
+			assert.True(t, lib.PublishedAddRmCheckProof(prf))
+		}
 	case <-time.After(timeout):
 		t.Fatal("Didn't finish in time")
 
@@ -0,0 +1,199 @@
+// Failure handling of the circuit protocols (key switching, deterministic tagging and shuffling).
+// Each server of a circuit waits for the message of the previous one, so a single server which crashes or cannot
+// reach the next one would block the whole circuit. A server which cannot carry on sends a CircuitAbortMessage to
+// the root and to the next server of the circuit, which forwards it until it reaches the root, and the root stops
+// waiting when its deadline expires. The root then reports the failure on the FailureChannel of the protocol.
+// The root announces the time given to the circuit to the other servers when it starts it, so that they all stop
+// waiting at about the same time.
+
+package protocols
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// DefaultCircuitTimeout is the time given to a circuit protocol to complete when no timeout is set.
+const DefaultCircuitTimeout = 10 * time.Minute
+
+// ErrCircuitTimeout is returned when a circuit protocol did not complete before its deadline.
+var ErrCircuitTimeout = errors.New("protocol did not complete before its deadline")
+
+func init() {
+	network.RegisterMessage(CircuitAbortMessage{})
+	network.RegisterMessage(CircuitAnnounceMessage{})
+}
+
+// CircuitAnnounceMessage is sent by the root to the other servers when it starts a circuit protocol, with the time left
+// to complete it.
+type CircuitAnnounceMessage struct {
+	Timeout time.Duration
+}
+
+type circuitAnnounceStruct struct {
+	*onet.TreeNode
+	CircuitAnnounceMessage
+}
+
+// CircuitAbortMessage is sent when a server cannot carry on a circuit protocol.
+type CircuitAbortMessage struct {
+	Reason string
+}
+
+type circuitAbortStruct struct {
+	*onet.TreeNode
+	CircuitAbortMessage
+}
+
+// abortedError is the error of a server which received a CircuitAbortMessage (it does not need to abort again)
+type abortedError struct {
+	reason string
+}
+
+func (e abortedError) Error() string {
+	return e.reason
+}
+
+// circuit holds the failure handling state of a circuit protocol instance.
+type circuit struct {
+	node *onet.TreeNodeInstance
+	next *onet.TreeNode
+	// deadline is set by Start at the root (and by the announcement at the other servers) while Dispatch waits for it
+	deadline      time.Time
+	deadlineMutex sync.Mutex
+	// localFailure reports failures of Start to Dispatch
+	localFailure chan error
+	// announced receives the announcement of the root
+	announced chan circuitAnnounceStruct
+}
+
+// newCircuit creates the circuit state of a protocol instance, the next server being the next one in Tree().List().
+func newCircuit(n *onet.TreeNodeInstance) (*circuit, error) {
+	c := &circuit{node: n, localFailure: make(chan error, 1)}
+	if err := n.RegisterChannel(&c.announced); err != nil {
+		return nil, errors.New("couldn't register announcement channel: " + err.Error())
+	}
+	nodeList := n.Tree().List()
+	for i, node := range nodeList {
+		if n.TreeNode().Equal(node) {
+			c.next = nodeList[(i+1)%len(nodeList)]
+			break
+		}
+	}
+	c.setTimeout(0)
+	return c, nil
+}
+
+// start sets the deadline of the protocol instance at the root (DefaultCircuitTimeout if timeout is 0) and announces
+// it to the other servers.
+func (c *circuit) start(timeout time.Duration) {
+	c.setTimeout(timeout)
+	msg := &CircuitAnnounceMessage{Timeout: c.remaining()}
+	for _, node := range c.node.Tree().List() {
+		if node.Equal(c.node.TreeNode()) {
+			continue
+		}
+		if err := c.node.SendTo(node, msg); err != nil {
+			log.Lvl1(c.node.ServerIdentity(), " couldn't announce the deadline to ", node.ServerIdentity, ": ", err)
+		}
+	}
+}
+
+// onAnnounce sets the deadline announced by the root.
+func (c *circuit) onAnnounce(msg circuitAnnounceStruct) {
+	if !c.node.IsRoot() && msg.Timeout > 0 {
+		c.setTimeout(msg.Timeout)
+	}
+}
+
+// setTimeout sets the deadline of the protocol instance (DefaultCircuitTimeout if timeout is 0).
+func (c *circuit) setTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultCircuitTimeout
+	}
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.deadline = time.Now().Add(timeout)
+}
+
+// remaining returns the time left before the deadline.
+func (c *circuit) remaining() time.Duration {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	return c.deadline.Sub(time.Now())
+}
+
+// expired returns a channel signalling the deadline.
+func (c *circuit) expired() <-chan time.Time {
+	return time.After(c.remaining())
+}
+
+// sendToNext sends msg to the next server of the circuit.
+func (c *circuit) sendToNext(msg interface{}) error {
+	if err := c.node.SendTo(c.next, msg); err != nil {
+		return errors.New("couldn't reach " + c.next.ServerIdentity.String() + ": " + err.Error())
+	}
+	return nil
+}
+
+// startFailed makes Dispatch return err at the root when Start fails.
+func (c *circuit) startFailed(err error) error {
+	select {
+	case c.localFailure <- err:
+	default:
+	}
+	return err
+}
+
+// onAbort forwards an abort message along the circuit and returns the corresponding error.
+func (c *circuit) onAbort(msg circuitAbortStruct) error {
+	if !c.node.IsRoot() && !c.next.Equal(c.node.Root()) {
+		if err := c.node.SendTo(c.next, &msg.CircuitAbortMessage); err != nil {
+			log.Lvl1(c.node.ServerIdentity(), " couldn't forward abort: ", err)
+		}
+	}
+	return abortedError{msg.Reason}
+}
+
+// onTimeout returns the error of an expired deadline.
+func (c *circuit) onTimeout() error {
+	return errors.New(c.node.ServerIdentity().String() + ": " + ErrCircuitTimeout.Error())
+}
+
+// fail notifies the other servers that this server stopped because of err (unless it was aborted by another one).
+func (c *circuit) fail(err error) {
+	if _, ok := err.(abortedError); ok {
+		return
+	}
+	log.Error(c.node.ServerIdentity(), " aborts ", c.node.ProtocolName(), ": ", err)
+
+	msg := &CircuitAbortMessage{Reason: c.node.ServerIdentity().String() + ": " + err.Error()}
+	if !c.node.IsRoot() {
+		if sendErr := c.node.SendTo(c.node.Root(), msg); sendErr != nil {
+			log.Lvl1(c.node.ServerIdentity(), " couldn't notify the root: ", sendErr)
+		}
+	}
+	if !c.next.Equal(c.node.Root()) {
+		if sendErr := c.node.SendTo(c.next, msg); sendErr != nil {
+			log.Lvl1(c.node.ServerIdentity(), " couldn't notify the next server: ", sendErr)
+		}
+	}
+}
+
+// done handles the outcome of Dispatch: on failure, the other servers are notified and the root reports err on
+// failures.
+func (c *circuit) done(err error, failures chan<- error) error {
+	if err == nil {
+		return nil
+	}
+	c.fail(err)
+	if c.node.IsRoot() {
+		failures <- err
+	}
+	return err
+}
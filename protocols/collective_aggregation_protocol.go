@@ -3,15 +3,27 @@
 // It uses the tree structure of the cothority. The root sends down an aggregation trigger message. The leafs
 // respond with their local result and other nodes aggregate what they receive before forwarding the
 // aggregation result up the tree until the root can produce the final result.
+// Every server signs its contribution (for the session chosen by the root) and forwards the signed contributions of
+// its subtree with its own, so that each server checks the contributions of its whole subtree itself instead of
+// trusting what its children report. With proofs, a contribution also holds the local data of its server (with the
+// range proofs of its aggregating attributes when the root requires them) and the children whose data it added, and
+// it must add up to them. A server whose signed contribution is wrong is reported up to the root by its server
+// identity and, if the root asked for it, its contribution is left out and the result is flagged as partial.
+// With a timeout, a server which does not get the data of all its children in time either fails or, if the root
+// allows it, goes on without the missing subtrees and flags the result as partial. The result lists the servers whose
+// data was aggregated.
 
 package protocols
 
 import (
+	"crypto/rand"
 	"errors"
-
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/onet.v1"
 	"gopkg.in/dedis/onet.v1/log"
 	"gopkg.in/dedis/onet.v1/network"
@@ -24,7 +36,6 @@ func init() {
 	network.RegisterMessage(DataReferenceMessage{})
 	network.RegisterMessage(ChildAggregatedDataMessage{})
 	network.RegisterMessage(ChildAggregatedDataBytesMessage{})
-	network.RegisterMessage(CADBLengthMessage{})
 	onet.GlobalProtocolRegister(CollectiveAggregationProtocolName, NewCollectiveAggregationProtocol)
 }
 
@@ -34,27 +45,58 @@ func init() {
 // CothorityAggregatedData is the collective aggregation result.
 type CothorityAggregatedData struct {
 	GroupedData map[lib.GroupingKey]lib.FilteredResponse
+	// Misbehaving lists the servers whose contribution was found wrong
+	Misbehaving []Misbehavior
+	// Partial is true when the contribution of some servers was left out
+	Partial bool
+	// Contributors are the servers whose local data was aggregated
+	Contributors []*network.ServerIdentity
 }
 
-// DataReferenceMessage message sent to trigger an aggregation protocol.
-type DataReferenceMessage struct{}
+// Misbehavior reports a server whose contribution to the aggregation was wrong.
+type Misbehavior struct {
+	Server *network.ServerIdentity
+	Reason string
+	// Excluded is true when the contribution of the server (and thus of its subtree) was left out
+	Excluded bool
+}
 
-// ChildAggregatedDataMessage contains one node's aggregated data.
+// DataReferenceMessage message sent to trigger an aggregation protocol, with the checks applied by the servers to the
+// contributions of their children and the time they wait for them.
+type DataReferenceMessage struct {
+	Proofs             bool
+	ExcludeMisbehaving bool
+	RangeProofBits     int
+	// CollectiveKey is the (wire-encoded) key of the range proofs
+	CollectiveKey []byte
+	// Session identifies the run, the contributions are signed for it
+	Session         []byte
+	Timeout         time.Duration
+	SkipUnavailable bool
+}
+
+// ChildAggregatedDataMessage is the contribution of one node: its aggregated data and the (public keys of the)
+// children whose data it added to its own. With proofs, it also contains the local data of the node and the range
+// proofs of its aggregating attributes.
 type ChildAggregatedDataMessage struct {
-	ChildData []lib.FilteredResponseDet
+	ChildData   []lib.FilteredResponseDet
+	LocalData   []lib.FilteredResponseDet
+	RangeProofs [][]lib.RangeProof
+	Children    []abstract.Point
 }
 
-// ChildAggregatedDataBytesMessage is ChildAggregatedDataMessage in bytes.
+// ChildAggregatedDataBytesMessage contains the signed contributions of the servers of the subtree of a node
+// (wire-encoded): its own and the ones it received from its children.
 type ChildAggregatedDataBytesMessage struct {
 	Data []byte
 }
 
-// CADBLengthMessage is a message containing the lengths to read a shuffling message in bytes
-type CADBLengthMessage struct {
-	GacbLength int
-	AabLength  int
-	//PgaebLength int
-	DtbLength int
+// signedContribution is the wire-encoded contribution (ChildAggregatedDataMessage) of a server, signed with its
+// private key for the session of the aggregation.
+type signedContribution struct {
+	Server    abstract.Point
+	Data      []byte
+	Signature []byte
 }
 
 // Structs
@@ -75,11 +117,6 @@ type childAggregatedDataBytesStruct struct {
 	ChildAggregatedDataBytesMessage
 }
 
-type cadmbLengthStruct struct {
-	*onet.TreeNode
-	CADBLengthMessage
-}
-
 // Protocol
 //______________________________________________________________________________________________________________________
 
@@ -87,17 +124,35 @@ type cadmbLengthStruct struct {
 type CollectiveAggregationProtocol struct {
 	*onet.TreeNodeInstance
 
-	// Protocol feedback channel
+	// Protocol feedback channels
 	FeedbackChannel chan CothorityAggregatedData
+	FailureChannel  chan error
 
 	// Protocol communication channels
 	DataReferenceChannel chan dataReferenceStruct
-	LengthNodeChannel    chan []cadmbLengthStruct
-	ChildDataChannel     chan []childAggregatedDataBytesStruct
+	ChildDataChannel     chan childAggregatedDataBytesStruct
 
 	// Protocol state data
 	GroupedData *map[lib.GroupingKey]lib.FilteredResponse
-	Proofs      bool
+	// LocalData are the responses aggregated in GroupedData (its groups if it is nil) and RangeProofs the range
+	// proofs of their aggregating attributes, sent to the parent with proofs
+	LocalData   []lib.FilteredResponseDet
+	RangeProofs [][]lib.RangeProof
+	// the following fields are set at the root and sent down the tree
+	Proofs             bool
+	ExcludeMisbehaving bool
+	RangeProofBits     int
+	CollectiveKey      abstract.Point
+	// Timeout is the time given to the servers one level down the tree to send their data (0 means waiting for all
+	// of them); each server waits for its children as many times as there are levels below it
+	Timeout time.Duration
+	// SkipUnavailable makes the servers aggregate the data received before the timeout instead of failing
+	SkipUnavailable bool
+
+	session      []byte
+	misbehaving  []Misbehavior
+	partial      bool
+	contributors []*network.ServerIdentity
 }
 
 // NewCollectiveAggregationProtocol initializes the protocol instance.
@@ -105,6 +160,7 @@ func NewCollectiveAggregationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolIn
 	pap := &CollectiveAggregationProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan CothorityAggregatedData),
+		FailureChannel:   make(chan error, 1),
 	}
 
 	err := pap.RegisterChannel(&pap.DataReferenceChannel)
@@ -117,8 +173,12 @@ func NewCollectiveAggregationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolIn
 		return nil, errors.New("couldn't register child-data channel: " + err.Error())
 	}
 
-	if err := pap.RegisterChannel(&pap.LengthNodeChannel); err != nil {
-		return nil, errors.New("couldn't register data reference channel: " + err.Error())
+	// the root chooses the session of the run
+	if n.IsRoot() {
+		pap.session = make([]byte, 32)
+		if _, err := rand.Read(pap.session); err != nil {
+			return nil, errors.New("couldn't choose the session: " + err.Error())
+		}
 	}
 
 	return pap, nil
@@ -129,8 +189,20 @@ func (p *CollectiveAggregationProtocol) Start() error {
 	if p.GroupedData == nil {
 		return errors.New("No data reference provided for aggregation")
 	}
+	msg := DataReferenceMessage{Proofs: p.Proofs, ExcludeMisbehaving: p.ExcludeMisbehaving, RangeProofBits: p.RangeProofBits,
+		Session: p.session, Timeout: p.Timeout, SkipUnavailable: p.SkipUnavailable}
+	if p.Proofs && p.RangeProofBits > 0 {
+		if p.CollectiveKey == nil {
+			return errors.New("No collective key provided to check the range proofs")
+		}
+		w := lib.NewWireWriter()
+		if err := w.WritePoint(p.CollectiveKey); err != nil {
+			return err
+		}
+		msg.CollectiveKey = w.Bytes()
+	}
 	log.Lvl1(p.ServerIdentity(), " started a Colective Aggregation Protocol (", len(*p.GroupedData), "local group(s) )")
-	p.SendToChildren(&DataReferenceMessage{})
+	p.SendToChildren(&msg)
 	return nil
 }
 
@@ -143,12 +215,20 @@ func (p *CollectiveAggregationProtocol) Dispatch() error {
 	}
 
 	// 2. Ascending aggregation phase
-	aggregatedData := p.ascendingAggregationPhase()
+	aggregatedData, err := p.ascendingAggregationPhase()
+	if err != nil {
+		log.Error(p.ServerIdentity(), " aggregation failed: ", err)
+		if p.IsRoot() {
+			p.FailureChannel <- err
+		}
+		return err
+	}
 	log.Lvl1(p.ServerIdentity(), " completed aggregation phase (", len(*aggregatedData), "group(s) )")
 
 	// 3. Result reporting
 	if p.IsRoot() {
-		p.FeedbackChannel <- CothorityAggregatedData{*aggregatedData}
+		p.FeedbackChannel <- CothorityAggregatedData{GroupedData: *aggregatedData, Misbehaving: p.misbehaving,
+			Partial: p.partial, Contributors: p.contributors}
 	}
 	return nil
 }
@@ -159,10 +239,24 @@ func (p *CollectiveAggregationProtocol) aggregationAnnouncementPhase() {
 	if !p.IsLeaf() {
 		p.SendToChildren(&dataReferenceMessage.DataReferenceMessage)
 	}
+
+	p.Proofs = dataReferenceMessage.Proofs
+	p.ExcludeMisbehaving = dataReferenceMessage.ExcludeMisbehaving
+	p.RangeProofBits = dataReferenceMessage.RangeProofBits
+	p.session = dataReferenceMessage.Session
+	p.Timeout = dataReferenceMessage.Timeout
+	p.SkipUnavailable = dataReferenceMessage.SkipUnavailable
+	if p.Proofs && p.RangeProofBits > 0 {
+		var err error
+		if p.CollectiveKey, err = decodeCollectiveKey(dataReferenceMessage.CollectiveKey); err != nil {
+			// without the key, no range proof is valid and every child is reported
+			log.Error(p.ServerIdentity(), " couldn't decode the key of the range proofs: ", err)
+		}
+	}
 }
 
 // Results pushing up the tree containing aggregation results.
-func (p *CollectiveAggregationProtocol) ascendingAggregationPhase() *map[lib.GroupingKey]lib.FilteredResponse {
+func (p *CollectiveAggregationProtocol) ascendingAggregationPhase() (*map[lib.GroupingKey]lib.FilteredResponse, error) {
 
 	if p.GroupedData == nil {
 		emptyMap := make(map[lib.GroupingKey]lib.FilteredResponse, 0)
@@ -171,151 +265,467 @@ func (p *CollectiveAggregationProtocol) ascendingAggregationPhase() *map[lib.Gro
 
 	roundTotComput := lib.StartTimer(p.Name() + "_CollectiveAggregation(ascendingAggregation)")
 
-	if !p.IsLeaf() {
+	// the local data is kept to prove the aggregation to the parent
+	localData := p.LocalData
+	if localData == nil {
+		localData = detResponses(*p.GroupedData)
+	}
+	p.contributors = []*network.ServerIdentity{p.ServerIdentity()}
 
-		length := make([]cadmbLengthStruct, 0)
-		for _, v := range <-p.LengthNodeChannel {
-			length = append(length, v)
-		}
-		datas := make([]childAggregatedDataBytesStruct, 0)
-		for _, v := range <-p.ChildDataChannel {
-			datas = append(datas, v)
+	// the signed contributions of the servers of the subtree, by public key
+	received := make(map[string]*signedContribution)
+	var included []abstract.Point
+	if !p.IsLeaf() {
+		var deadline <-chan time.Time
+		if p.Timeout > 0 {
+			deadline = time.After(p.Timeout * time.Duration(subtreeHeight(p.TreeNode())))
 		}
-		for i, v := range length {
-			childrenContribution := ChildAggregatedDataMessage{}
-			childrenContribution.FromBytes(datas[i].Data, v.GacbLength, v.AabLength, v.DtbLength)
-			c1 := make(map[lib.GroupingKey]lib.FilteredResponse)
-			roundProofs := lib.StartTimer(p.Name() + "_CollectiveAggregation(Proof-1stPart)")
 
-			if p.Proofs {
-				//need to save previous state
-				for i, v := range *p.GroupedData {
-					c1[i] = v
+		answered := make(map[onet.TreeNodeID]bool)
+	children:
+		for range p.Children() {
+			var v childAggregatedDataBytesStruct
+			select {
+			case v = <-p.ChildDataChannel:
+			case <-deadline:
+				if err := p.skipUnavailableChildren(answered); err != nil {
+					return nil, err
 				}
+				break children
 			}
-			lib.EndTimer(roundProofs)
-			roundComput := lib.StartTimer(p.Name() + "_CollectiveAggregation(Aggregation)")
-
-			for _, aggr := range childrenContribution.ChildData {
-				localAggr, ok := (*p.GroupedData)[aggr.DetTagGroupBy]
-				if ok {
-					tmp := lib.NewCipherVector(len(localAggr.AggregatingAttributes))
-					tmp.Add(localAggr.AggregatingAttributes, aggr.Fr.AggregatingAttributes)
-
-					localAggr.AggregatingAttributes = *tmp
-				} else {
-					localAggr = aggr.Fr
-				}
-				(*p.GroupedData)[aggr.DetTagGroupBy] = localAggr
-			}
+			answered[v.TreeNode.ID] = true
+			p.receiveContributions(v, received)
+		}
 
-			lib.EndTimer(roundComput)
-			roundProofs2 := lib.StartTimer(p.Name() + "_CollectiveAggregation(Proof-2ndPart)")
-			if p.Proofs {
-				PublishedCollectiveAggregationProof := lib.CollectiveAggregationProofCreation(c1, childrenContribution.ChildData, *p.GroupedData)
-				//publication
-				_ = PublishedCollectiveAggregationProof
+		roundProofs := lib.StartTimer(p.Name() + "_CollectiveAggregation(Proofs)")
+		checked := make(map[string]*checkedContribution)
+		for _, child := range p.Children() {
+			c := p.checkSubtree(child, received, checked)
+			if !p.included(c) {
+				continue
+			}
+			aggregateInto(*p.GroupedData, c.data)
+			p.contributors = append(p.contributors, c.contributors...)
+			included = append(included, child.ServerIdentity.Public)
+		}
+		// the contributions which are not part of the result are checked for evidence of misbehavior
+		for _, node := range subtreeNodes(p.TreeNode()) {
+			if _, ok := received[node.ServerIdentity.Public.String()]; ok {
+				p.checkSubtree(node, received, checked)
 			}
-			lib.EndTimer(roundProofs2)
 		}
+		lib.EndTimer(roundProofs)
+	}
+	if p.IsRoot() {
+		p.partial = p.partial || len(p.contributors) < len(p.Tree().List())
 	}
 
 	lib.EndTimer(roundTotComput)
 
 	if !p.IsRoot() {
-		detAggrResponses := make([]lib.FilteredResponseDet, len(*p.GroupedData))
-		count := 0
-		for i, v := range *p.GroupedData {
-			detAggrResponses[count].DetTagGroupBy = i
-			detAggrResponses[count].Fr = v
-			count++
+		contribution := ChildAggregatedDataMessage{ChildData: detResponses(*p.GroupedData), Children: included}
+		if p.Proofs {
+			contribution.LocalData = localData
+			contribution.RangeProofs = p.RangeProofs
+		}
+		own, err := p.signContribution(&contribution)
+		if err != nil {
+			return nil, errors.New("couldn't sign aggregated data: " + err.Error())
+		}
+		contributions := []*signedContribution{own}
+		for _, c := range received {
+			contributions = append(contributions, c)
 		}
-
 		message := ChildAggregatedDataBytesMessage{}
+		if message.Data, err = contributionsToBytes(contributions); err != nil {
+			return nil, errors.New("couldn't encode aggregated data: " + err.Error())
+		}
+		p.SendToParent(&message)
+	}
 
-		var gacbLength, aabLength, dtbLength int
+	return p.GroupedData, nil
+}
 
-		message.Data, gacbLength, aabLength, dtbLength = (&ChildAggregatedDataMessage{detAggrResponses}).ToBytes()
-		childrenContribution := ChildAggregatedDataMessage{}
-		childrenContribution.FromBytes(message.Data, gacbLength, aabLength, dtbLength)
+// signContribution signs the contribution of this server for the session.
+func (p *CollectiveAggregationProtocol) signContribution(c *ChildAggregatedDataMessage) (*signedContribution, error) {
+	data, err := c.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+	signature, err := lib.SchnorrSign(p.Private(), contributionSignedData(p.session, data))
+	if err != nil {
+		return nil, err
+	}
+	return &signedContribution{Server: p.Public(), Data: data, Signature: signature}, nil
+}
 
-		p.SendToParent(&CADBLengthMessage{gacbLength, aabLength, dtbLength})
-		p.SendToParent(&message)
+// receiveContributions keeps the contributions sent by a child which are signed (for the session) by a server of its
+// subtree. The others cannot be attributed to any server and are ignored.
+func (p *CollectiveAggregationProtocol) receiveContributions(v childAggregatedDataBytesStruct, received map[string]*signedContribution) {
+	contributions, err := contributionsFromBytes(v.Data)
+	if err != nil {
+		log.Error(p.ServerIdentity(), " couldn't decode the contributions sent by ", v.ServerIdentity, ": ", err)
+		return
+	}
+	subtree := make(map[string]bool)
+	for _, node := range subtreeNodes(v.TreeNode) {
+		subtree[node.ServerIdentity.Public.String()] = true
 	}
+	for _, c := range contributions {
+		key := c.Server.String()
+		if !subtree[key] {
+			log.Error(p.ServerIdentity(), " ignores a contribution of a server outside of the subtree of ", v.ServerIdentity)
+			continue
+		}
+		if err := lib.SchnorrVerify(c.Server, contributionSignedData(p.session, c.Data), c.Signature); err != nil {
+			log.Error(p.ServerIdentity(), " ignores a contribution with an invalid signature sent by ", v.ServerIdentity)
+			continue
+		}
+		received[key] = c
+	}
+}
 
-	return p.GroupedData
+// checkedContribution is the outcome of the check of the contribution of a server: whether it is missing or wrong,
+// and the aggregated data it adds to the one of its parent and the servers whose data it contains.
+type checkedContribution struct {
+	missing      bool
+	wrong        bool
+	data         []lib.FilteredResponseDet
+	contributors []*network.ServerIdentity
 }
 
-// Conversion
-//______________________________________________________________________________________________________________________
+// included checks whether a contribution is part of the aggregation.
+func (p *CollectiveAggregationProtocol) included(c *checkedContribution) bool {
+	return !c.missing && !(c.wrong && p.ExcludeMisbehaving)
+}
 
-// ToBytes converts a ChildAggregatedDataMessage to a byte array
-func (sm *ChildAggregatedDataMessage) ToBytes() ([]byte, int, int, int) {
+// checkSubtree checks the contribution of node and the ones it includes. A missing contribution, or one including
+// contributions which are missing, is left out without blaming anyone: it may have been dropped on its way. A signed
+// contribution which is wrong is reported and left out if the root asked for it.
+func (p *CollectiveAggregationProtocol) checkSubtree(node *onet.TreeNode, received map[string]*signedContribution, checked map[string]*checkedContribution) *checkedContribution {
+	key := node.ServerIdentity.Public.String()
+	if c, ok := checked[key]; ok {
+		return c
+	}
+	result := &checkedContribution{missing: true}
+	checked[key] = result
 
-	b := make([]byte, 0)
-	bb := make([][]byte, len((*sm).ChildData))
+	signed, ok := received[key]
+	if !ok {
+		return result
+	}
+	result.missing = false
+	c := ChildAggregatedDataMessage{}
+	if err := c.FromBytes(signed.Data); err != nil {
+		result.wrong = true
+		p.reportMisbehavior(node.ServerIdentity, "couldn't decode its contribution: "+err.Error(), p.ExcludeMisbehaving)
+		return result
+	}
 
-	var gacbLength int
-	var aabLength int
-	//var pgaebLength int
-	var dtbLength int
+	contributors := []*network.ServerIdentity{node.ServerIdentity}
+	var childrenData []lib.FilteredResponseDet
+	reason := ""
+	for _, public := range c.Children {
+		child := childWithKey(node, public)
+		if child == nil {
+			reason = "it added the data of a server which is not its child"
+			break
+		}
+		cc := p.checkSubtree(child, received, checked)
+		if cc.missing {
+			// the contribution of the child was lost on its way, the one of node cannot be checked
+			result.missing = true
+			return result
+		}
+		if !p.included(cc) {
+			reason = "it added the wrong contribution of " + child.ServerIdentity.String()
+			break
+		}
+		childrenData = append(childrenData, cc.data...)
+		contributors = append(contributors, cc.contributors...)
+	}
+	if reason == "" && p.Proofs {
+		if err := p.checkContribution(&c, childrenData); err != nil {
+			reason = err.Error()
+		}
+	}
+	if reason != "" {
+		result.wrong = true
+		p.reportMisbehavior(node.ServerIdentity, reason, p.ExcludeMisbehaving)
+	}
 
-	wg := lib.StartParallelize(len((*sm).ChildData))
-	var mutexCD sync.Mutex
-	for i := range (*sm).ChildData {
-		if lib.PARALLELIZE {
-			go func(i int) {
-				defer wg.Done()
+	result.data, result.contributors = c.ChildData, contributors
+	return result
+}
 
-				mutexCD.Lock()
-				data := (*sm).ChildData[i]
-				mutexCD.Unlock()
+// childWithKey returns the child of node with the given public key (nil if there is none).
+func childWithKey(node *onet.TreeNode, public abstract.Point) *onet.TreeNode {
+	for _, child := range node.Children {
+		if child.ServerIdentity.Public.Equal(public) {
+			return child
+		}
+	}
+	return nil
+}
 
-				aux, gacbAux, aabAux, dtbAux := data.ToBytes()
+// skipUnavailableChildren goes on without the children which did not send their data in time, or fails if the root
+// did not allow it.
+func (p *CollectiveAggregationProtocol) skipUnavailableChildren(answered map[onet.TreeNodeID]bool) error {
+	var missing []string
+	for _, child := range p.Children() {
+		if !answered[child.ID] {
+			missing = append(missing, child.ServerIdentity.String())
+		}
+	}
+	if !p.SkipUnavailable {
+		return errors.New("no data from " + strings.Join(missing, ", ") + ": " + ErrCircuitTimeout.Error())
+	}
+	log.Error(p.ServerIdentity(), " goes on without the data of ", strings.Join(missing, ", "), ": ", ErrCircuitTimeout)
+	p.partial = true
+	return nil
+}
+
+// subtreeHeight returns the number of levels of the tree below node.
+func subtreeHeight(node *onet.TreeNode) int {
+	height := 0
+	for _, child := range node.Children {
+		if h := subtreeHeight(child) + 1; h > height {
+			height = h
+		}
+	}
+	return height
+}
+
+// subtreeNodes lists node and the nodes below it.
+func subtreeNodes(node *onet.TreeNode) []*onet.TreeNode {
+	nodes := []*onet.TreeNode{node}
+	for _, child := range node.Children {
+		nodes = append(nodes, subtreeNodes(child)...)
+	}
+	return nodes
+}
 
-				mutexCD.Lock()
-				bb[i] = aux
-				gacbLength = gacbAux
-				aabLength = aabAux
-				dtbLength = dtbAux
-				mutexCD.Unlock()
+// reportMisbehavior records a server whose contribution is wrong.
+func (p *CollectiveAggregationProtocol) reportMisbehavior(server *network.ServerIdentity, reason string, excluded bool) {
+	log.Error(p.ServerIdentity(), " found a wrong contribution from ", server, " (excluded: ", excluded, "): ", reason)
+	p.misbehaving = append(p.misbehaving, Misbehavior{Server: server, Reason: reason, Excluded: excluded})
+	p.partial = p.partial || excluded
+}
+
+// checkContribution checks the range proofs of the local data of a contribution and that its aggregated data is the
+// aggregation of its local data and of the data of the children it added.
+func (p *CollectiveAggregationProtocol) checkContribution(c *ChildAggregatedDataMessage, childrenData []lib.FilteredResponseDet) error {
+	if p.RangeProofBits > 0 {
+		if p.CollectiveKey == nil {
+			return errors.New("no key to check the range proofs")
+		}
+		if len(c.RangeProofs) != len(c.LocalData) {
+			return errors.New("missing range proofs")
+		}
+		for i, d := range c.LocalData {
+			if len(c.RangeProofs[i]) != len(d.Fr.AggregatingAttributes) {
+				return errors.New("missing range proofs for local response " + strconv.Itoa(i))
+			}
+			for j, ct := range d.Fr.AggregatingAttributes {
+				if !lib.RangeProofVerification(c.RangeProofs[i][j], ct, p.CollectiveKey, p.RangeProofBits) {
+					return errors.New("invalid range proof for attribute " + strconv.Itoa(j) + " of local response " + strconv.Itoa(i))
+				}
+			}
+		}
+	}
 
-			}(i)
+	expected := make(map[lib.GroupingKey]lib.FilteredResponse)
+	aggregateInto(expected, c.LocalData)
+	aggregateInto(expected, childrenData)
+	if len(expected) != len(c.ChildData) {
+		return errors.New("aggregated data has " + strconv.Itoa(len(c.ChildData)) + " groups instead of " +
+			strconv.Itoa(len(expected)))
+	}
+	for _, d := range c.ChildData {
+		e, ok := expected[d.DetTagGroupBy]
+		if !ok || !equalCipherVectors(e.GroupByEnc, d.Fr.GroupByEnc) ||
+			!equalCipherVectors(e.AggregatingAttributes, d.Fr.AggregatingAttributes) {
+			return errors.New("aggregated data does not match the local and received data")
+		}
+		delete(expected, d.DetTagGroupBy)
+	}
+	return nil
+}
+
+// aggregateInto adds the aggregating attributes of data to the ones of the same group in groupedData (a new group
+// keeps the encrypted group attributes of its first response).
+func aggregateInto(groupedData map[lib.GroupingKey]lib.FilteredResponse, data []lib.FilteredResponseDet) {
+	for _, aggr := range data {
+		localAggr, ok := groupedData[aggr.DetTagGroupBy]
+		if ok {
+			tmp := lib.NewCipherVector(len(localAggr.AggregatingAttributes))
+			tmp.Add(localAggr.AggregatingAttributes, aggr.Fr.AggregatingAttributes)
+
+			localAggr.AggregatingAttributes = *tmp
 		} else {
-			bb[i], gacbLength, aabLength, dtbLength = (*sm).ChildData[i].ToBytes()
+			localAggr = aggr.Fr
 		}
+		groupedData[aggr.DetTagGroupBy] = localAggr
+	}
+}
 
+// detResponses lists the groups of groupedData.
+func detResponses(groupedData map[lib.GroupingKey]lib.FilteredResponse) []lib.FilteredResponseDet {
+	responses := make([]lib.FilteredResponseDet, 0, len(groupedData))
+	for i, v := range groupedData {
+		responses = append(responses, lib.FilteredResponseDet{DetTagGroupBy: i, Fr: v})
 	}
-	lib.EndParallelize(wg)
+	return responses
+}
+
+// Conversion
+//______________________________________________________________________________________________________________________
 
-	for _, el := range bb {
-		b = append(b, el...)
+// ToBytes converts a ChildAggregatedDataMessage to a byte array
+func (sm *ChildAggregatedDataMessage) ToBytes() ([]byte, error) {
+	w := lib.NewWireWriter()
+	for _, data := range [][]lib.FilteredResponseDet{(*sm).ChildData, (*sm).LocalData} {
+		if err := w.WriteBodies(len(data), func(i int, bw *lib.WireWriter) error {
+			return data[i].Encode(bw)
+		}); err != nil {
+			return nil, err
+		}
 	}
-	return b, gacbLength, aabLength, dtbLength
+	if err := w.WriteBodies(len((*sm).RangeProofs), func(i int, bw *lib.WireWriter) error {
+		bw.WriteCount(len((*sm).RangeProofs[i]))
+		for _, rp := range (*sm).RangeProofs[i] {
+			b, err := rp.ToBytes()
+			if err != nil {
+				return err
+			}
+			bw.WriteBytes(b)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := w.WritePoints((*sm).Children); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
 }
 
 // FromBytes converts a byte array to a ChildAggregatedDataMessage. Note that you need to create the (empty) object beforehand.
-func (sm *ChildAggregatedDataMessage) FromBytes(data []byte, gacbLength, aabLength, dtbLength int) {
-	elementLength := (gacbLength*64 + aabLength*64 + dtbLength) //CAUTION: hardcoded 64 (size of el-gamal element C,K)
-
-	if elementLength != 0 && len(data) > 0 {
-		var nbrChildData int
-		nbrChildData = len(data) / elementLength
-
-		(*sm).ChildData = make([]lib.FilteredResponseDet, nbrChildData)
-		wg := lib.StartParallelize(nbrChildData)
-		for i := 0; i < nbrChildData; i++ {
-			v := data[i*elementLength : i*elementLength+elementLength]
-			if lib.PARALLELIZE {
-				go func(v []byte, i int) {
-					defer wg.Done()
-					(*sm).ChildData[i].FromBytes(v, gacbLength, aabLength, dtbLength)
-				}(v, i)
-			} else {
-				(*sm).ChildData[i].FromBytes(v, gacbLength, aabLength, dtbLength)
+func (sm *ChildAggregatedDataMessage) FromBytes(data []byte) error {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	for _, dst := range []*[]lib.FilteredResponseDet{&(*sm).ChildData, &(*sm).LocalData} {
+		bodies, err := r.ReadBodies()
+		if err != nil {
+			return err
+		}
+		*dst = make([]lib.FilteredResponseDet, len(bodies))
+		if err := lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+			return (*dst)[i].Decode(br)
+		}); err != nil {
+			return err
+		}
+	}
+
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return err
+	}
+	(*sm).RangeProofs = make([][]lib.RangeProof, len(bodies))
+	if err := lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		n, err := br.ReadCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < n; j++ {
+			b, err := br.ReadBytes()
+			if err != nil {
+				return err
 			}
+			rp := lib.RangeProof{}
+			if err := rp.FromBytes(b); err != nil {
+				return err
+			}
+			(*sm).RangeProofs[i] = append((*sm).RangeProofs[i], rp)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if (*sm).Children, err = r.ReadPoints(); err != nil {
+		return err
+	}
+	return r.Close()
+}
 
+// contributionsToBytes encodes the signed contributions sent to the parent.
+func contributionsToBytes(contributions []*signedContribution) ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WriteBodies(len(contributions), func(i int, bw *lib.WireWriter) error {
+		if err := bw.WritePoint(contributions[i].Server); err != nil {
+			return err
 		}
-		lib.EndParallelize(wg)
+		bw.WriteBytes(contributions[i].Data)
+		bw.WriteBytes(contributions[i].Signature)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// contributionsFromBytes decodes the signed contributions sent by a child.
+func contributionsFromBytes(data []byte) ([]*signedContribution, error) {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return nil, err
+	}
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	contributions := make([]*signedContribution, len(bodies))
+	err = lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		c := &signedContribution{}
+		var err error
+		if c.Server, err = br.ReadPoint(); err != nil {
+			return err
+		}
+		if c.Data, err = br.ReadBytes(); err != nil {
+			return err
+		}
+		if c.Signature, err = br.ReadBytes(); err != nil {
+			return err
+		}
+		contributions[i] = c
+		return nil
+	})
+	return contributions, err
+}
+
+// contributionSignedData returns the data signed by a server for its contribution to the aggregation session.
+func contributionSignedData(session, data []byte) []byte {
+	w := lib.NewWireWriter()
+	w.WriteBytes(session)
+	w.WriteBytes(data)
+	return w.Bytes()
+}
+
+// decodeCollectiveKey decodes the key of the range proofs sent with the aggregation trigger.
+func decodeCollectiveKey(data []byte) (abstract.Point, error) {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := r.ReadPoint()
+	if err == nil {
+		err = r.Close()
 	}
+	return key, err
 }
@@ -111,3 +111,146 @@ func NewCollectiveAggregationTest(tni *onet.TreeNodeInstance) (onet.ProtocolInst
 
 	return protocol, err
 }
+
+// rangeProofBits is the range of the values aggregated in TestCollectiveAggregationRangeProofs
+const rangeProofBits = 8
+
+var misbehavingServer *network.ServerIdentity
+
+//TestCollectiveAggregationRangeProofs tests that a server sending values without valid range proofs is excluded
+func TestCollectiveAggregationRangeProofs(t *testing.T) {
+	local := onet.NewLocalTest()
+
+	// You must register this protocol before creating the servers
+	onet.GlobalProtocolRegister("CollectiveAggregationRangeTest", NewCollectiveAggregationRangeTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	p, err := local.CreateProtocol("CollectiveAggregationRangeTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := p.(*protocols.CollectiveAggregationProtocol)
+	protocol.Proofs = true
+	protocol.ExcludeMisbehaving = true
+	protocol.RangeProofBits = rangeProofBits
+	protocol.CollectiveKey = clientPublic
+
+	go protocol.Start()
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		// the value of server 3 is left out: 1 + 2 + 3 + 5
+		aggr := result.GroupedData[groupingAttrA.Key()].AggregatingAttributes
+		assert.Equal(t, []int64{11}, lib.DecryptIntVector(clientPrivate, &aggr))
+		assert.True(t, result.Partial)
+		if assert.Equal(t, 1, len(result.Misbehaving)) {
+			assert.True(t, result.Misbehaving[0].Server.Equal(misbehavingServer))
+			assert.True(t, result.Misbehaving[0].Excluded)
+		}
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
+
+// NewCollectiveAggregationRangeTest is a test specific protocol instance constructor that injects test data with
+// range proofs, except on server 3 which sends an out of range value.
+func NewCollectiveAggregationRangeTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := protocols.NewCollectiveAggregationProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*protocols.CollectiveAggregationProtocol)
+
+	var value *lib.CipherText
+	var rangeProofs []lib.RangeProof
+	if tni.Index() == 3 {
+		misbehavingServer = tni.ServerIdentity()
+		value = lib.EncryptInt(clientPublic, 1000)
+	} else {
+		var rp *lib.RangeProof
+		if value, rp, err = lib.EncryptIntWithRangeProof(clientPublic, int64(tni.Index()+1), rangeProofBits); err != nil {
+			return nil, err
+		}
+		rangeProofs = []lib.RangeProof{*rp}
+	}
+
+	testCVMap := make(map[lib.GroupingKey]lib.FilteredResponse)
+	testCVMap[groupingAttrA.Key()] = lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(clientPublic, []int64{1, 1}),
+		AggregatingAttributes: lib.CipherVector{*value}}
+	protocol.GroupedData = &testCVMap
+	protocol.LocalData = []lib.FilteredResponseDet{{DetTagGroupBy: groupingAttrA.Key(), Fr: testCVMap[groupingAttrA.Key()]}}
+	protocol.RangeProofs = [][]lib.RangeProof{rangeProofs}
+	return protocol, nil
+}
+
+var unavailableServer *network.ServerIdentity
+
+//TestCollectiveAggregationUnavailable tests that the aggregation goes on without a server which does not send its data
+func TestCollectiveAggregationUnavailable(t *testing.T) {
+	local := onet.NewLocalTest()
+
+	// You must register this protocol before creating the servers
+	onet.GlobalProtocolRegister("CollectiveAggregationUnavailableTest", NewCollectiveAggregationUnavailableTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	p, err := local.CreateProtocol("CollectiveAggregationUnavailableTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := p.(*protocols.CollectiveAggregationProtocol)
+	protocol.Timeout = time.Second
+	protocol.SkipUnavailable = true
+
+	go protocol.Start()
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		// the value of server 2 is left out: 1 + 2 + 4 + 5
+		aggr := result.GroupedData[groupingAttrA.Key()].AggregatingAttributes
+		assert.Equal(t, []int64{12}, lib.DecryptIntVector(clientPrivate, &aggr))
+		assert.True(t, result.Partial)
+		assert.Equal(t, nbrNodes-1, len(result.Contributors))
+		for _, si := range result.Contributors {
+			assert.False(t, si.Equal(unavailableServer))
+		}
+	case err := <-protocol.FailureChannel:
+		t.Fatal("Aggregation failed:", err)
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
+
+// unavailableAggregation is a server which never sends its data.
+type unavailableAggregation struct {
+	*protocols.CollectiveAggregationProtocol
+}
+
+// Dispatch ignores the aggregation trigger.
+func (p *unavailableAggregation) Dispatch() error {
+	return nil
+}
+
+// NewCollectiveAggregationUnavailableTest is a test specific protocol instance constructor in which server 2 does not
+// take part.
+func NewCollectiveAggregationUnavailableTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := protocols.NewCollectiveAggregationProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	protocol := pi.(*protocols.CollectiveAggregationProtocol)
+
+	testCVMap := make(map[lib.GroupingKey]lib.FilteredResponse)
+	testCVMap[groupingAttrA.Key()] = lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(clientPublic, []int64{1, 1}),
+		AggregatingAttributes: *lib.EncryptIntVector(clientPublic, []int64{int64(tni.Index() + 1)})}
+	protocol.GroupedData = &testCVMap
+
+	if tni.Index() == 2 {
+		unavailableServer = tni.ServerIdentity()
+		return &unavailableAggregation{protocol}, nil
+	}
+	return protocol, nil
+}
@@ -0,0 +1,123 @@
+package protocols_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+const nbrConcurrentInstances = 10
+
+// TestConcurrentLocalProtocols runs many instances of the local protocols at the same time on one server and checks
+// that each instance gets its own result (run with -race).
+func TestConcurrentLocalProtocols(t *testing.T) {
+	local := onet.NewLocalTest()
+	_, _, tree := local.GenTree(1, true)
+	defer local.CloseAll()
+
+	secKey := network.Suite.Scalar().Pick(random.Stream)
+	pubKey := network.Suite.Point().Mul(network.Suite.Point().Base(), secKey)
+	secKeyNew := network.Suite.Scalar().Pick(random.Stream)
+	pubKeyNew := network.Suite.Point().Mul(network.Suite.Point().Base(), secKeyNew)
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	var wg sync.WaitGroup
+	errs := make(chan string, 3*nbrConcurrentInstances)
+
+	for i := 0; i < nbrConcurrentInstances; i++ {
+		value := int64(i + 1)
+
+		// local aggregation: two responses of value i+1 in a single group
+		rootInstance, err := local.CreateProtocol("LocalAggregation", tree)
+		if err != nil {
+			t.Fatal("Couldn't start protocol:", err)
+		}
+		aggregation := rootInstance.(*protocols.LocalAggregationProtocol)
+		aggregation.TargetOfAggregation = []lib.FilteredResponseDet{
+			{DetTagGroupBy: "group", Fr: lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{*lib.EncryptInt(pubKey, value)}}},
+			{DetTagGroupBy: "group", Fr: lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{*lib.EncryptInt(pubKey, value)}}},
+		}
+
+		// add/rm server: a response of value i+1 switched to the key secKey + secKeyNew
+		rootInstance, err = local.CreateProtocol("AddRmServer", tree)
+		if err != nil {
+			t.Fatal("Couldn't start protocol:", err)
+		}
+		addRm := rootInstance.(*protocols.AddRmServerProtocol)
+		addRm.TargetOfTransformation = []lib.DpResponse{{AggregatingAttributesEnc: map[string]lib.CipherText{"0": *lib.EncryptInt(pubKey, value)}}}
+		addRm.KeyToRm = secKeyNew
+		addRm.Add = true
+
+		// proofs verification: a key switching proof which is valid for even instances only
+		rootInstance, err = local.CreateProtocol("ProofsVerification", tree)
+		if err != nil {
+			t.Fatal("Couldn't start protocol:", err)
+		}
+		verification := rootInstance.(*protocols.ProofsVerificationProtocol)
+		cipherVect := lib.CipherVector{*lib.EncryptInt(pubKey, value)}
+		origEphemKeys := []abstract.Point{cipherVect[0].K}
+		switchedVect := lib.NewCipherVector(1)
+		rs := switchedVect.KeySwitching(cipherVect, origEphemKeys, pubKeyNew, secKey)
+		proofKey := pubKey
+		if i%2 != 0 {
+			proofKey = pubKeyNew
+		}
+		cps := lib.VectorSwitchKeyProofCreation(cipherVect, *switchedVect, rs, secKey, origEphemKeys, pubKeyNew)
+		verification.TargetOfVerification = protocols.ProofsToVerify{KeySwitchingProofs: []lib.PublishedSwitchKeyProof{
+			{Skp: cps, VectBefore: cipherVect, VectAfter: *switchedVect, K: proofKey, Q: pubKeyNew}}}
+
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			go aggregation.Start()
+			select {
+			case result := <-aggregation.FeedbackChannel:
+				if got := lib.DecryptInt(secKey, result["group"].AggregatingAttributes[0]); got != 2*value {
+					errs <- "local aggregation " + strconv.Itoa(i) + " got " + strconv.FormatInt(got, 10)
+				}
+			case <-time.After(timeout):
+				errs <- "local aggregation " + strconv.Itoa(i) + " didn't finish in time"
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			go addRm.Start()
+			select {
+			case result := <-addRm.FeedbackChannel:
+				secKeyAfter := network.Suite.Scalar().Add(secKey, secKeyNew)
+				if got := lib.DecryptInt(secKeyAfter, result[0].AggregatingAttributesEnc["0"]); got != value {
+					errs <- "add/rm server " + strconv.Itoa(i) + " got " + strconv.FormatInt(got, 10)
+				}
+			case <-time.After(timeout):
+				errs <- "add/rm server " + strconv.Itoa(i) + " didn't finish in time"
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			go verification.Start()
+			select {
+			case result := <-verification.FeedbackChannel:
+				if len(result) != 1 || result[0] != (i%2 == 0) {
+					errs <- "proofs verification " + strconv.Itoa(i) + " got a wrong result"
+				}
+			case <-time.After(timeout):
+				errs <- "proofs verification " + strconv.Itoa(i) + " didn't finish in time"
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
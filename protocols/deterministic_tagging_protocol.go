@@ -10,11 +10,7 @@ package protocols
 
 import (
 	"errors"
-
-	"reflect"
-	"sync"
 	"time"
-	"unsafe"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
 	"gopkg.in/dedis/crypto.v0/abstract"
@@ -29,7 +25,6 @@ const DeterministicTaggingProtocolName = "DeterministicTagging"
 func init() {
 	network.RegisterMessage(DeterministicTaggingMessage{})
 	network.RegisterMessage(DeterministicTaggingBytesMessage{})
-	network.RegisterMessage(DTBLengthMessage{})
 	network.RegisterMessage(lib.ProcessResponseDet{})
 	onet.GlobalProtocolRegister(DeterministicTaggingProtocolName, NewDeterministicTaggingProtocol)
 }
@@ -48,16 +43,11 @@ type DeterministicTaggingMessage struct {
 	Data []GroupingAttributes
 }
 
-// DeterministicTaggingBytesMessage represents a deterministic tagging message in bytes
+// DeterministicTaggingBytesMessage represents a deterministic tagging message in bytes (wire-encoded)
 type DeterministicTaggingBytesMessage struct {
 	Data []byte
 }
 
-// DTBLengthMessage represents a message containing the lengths of a DeterministicTaggingMessageBytes message
-type DTBLengthMessage struct {
-	CVLengths []byte
-}
-
 // Structs
 //______________________________________________________________________________________________________________________
 
@@ -67,12 +57,6 @@ type deterministicTaggingBytesStruct struct {
 	DeterministicTaggingBytesMessage
 }
 
-// dtmbLengthStruct is a structure containing a message for message length
-type dtmbLengthStruct struct {
-	*onet.TreeNode
-	DTBLengthMessage
-}
-
 // Protocol
 //______________________________________________________________________________________________________________________
 
@@ -80,18 +64,21 @@ type dtmbLengthStruct struct {
 type DeterministicTaggingProtocol struct {
 	*onet.TreeNodeInstance
 
-	// Protocol feedback channel
+	// Protocol feedback channels
 	FeedbackChannel chan []lib.ProcessResponseDet
+	FailureChannel  chan error
 
 	// Protocol communication channels
 	PreviousNodeInPathChannel chan deterministicTaggingBytesStruct
-	LengthNodeChannel         chan dtmbLengthStruct
+	AbortChannel              chan circuitAbortStruct
 
 	// Protocol state data
-	nextNodeInCircuit *onet.TreeNode
-	TargetOfSwitch    *[]lib.ProcessResponse
-	SurveySecretKey   *abstract.Scalar
-	Proofs            bool
+	circuit         *circuit
+	TargetOfSwitch  *[]lib.ProcessResponse
+	SurveySecretKey *abstract.Scalar
+	Proofs          bool
+	// Timeout is the time given to the whole circuit to complete (set at the root)
+	Timeout time.Duration
 
 	ExecTime time.Duration
 }
@@ -101,23 +88,18 @@ func NewDeterministicTaggingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolIns
 	dsp := &DeterministicTaggingProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []lib.ProcessResponseDet),
+		FailureChannel:   make(chan error, 1),
+	}
+	var err error
+	if dsp.circuit, err = newCircuit(n); err != nil {
+		return nil, err
 	}
 
 	if err := dsp.RegisterChannel(&dsp.PreviousNodeInPathChannel); err != nil {
 		return nil, errors.New("couldn't register data reference channel: " + err.Error())
 	}
-	if err := dsp.RegisterChannel(&dsp.LengthNodeChannel); err != nil {
-		return nil, errors.New("couldn't register data reference channel: " + err.Error())
-	}
-
-	var i int
-	var node *onet.TreeNode
-	var nodeList = n.Tree().List()
-	for i, node = range nodeList {
-		if n.TreeNode().Equal(node) {
-			dsp.nextNodeInCircuit = nodeList[(i+1)%len(nodeList)]
-			break
-		}
+	if err := dsp.RegisterChannel(&dsp.AbortChannel); err != nil {
+		return nil, errors.New("couldn't register abort channel: " + err.Error())
 	}
 
 	return dsp, nil
@@ -127,12 +109,13 @@ func NewDeterministicTaggingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolIns
 func (p *DeterministicTaggingProtocol) Start() error {
 
 	roundTotalStart := lib.StartTimer(p.Name() + "_DetTagging(START)")
+	p.circuit.start(p.Timeout)
 
 	if p.TargetOfSwitch == nil {
-		return errors.New("No data on which to do a deterministic tagging")
+		return p.circuit.startFailed(errors.New("No data on which to do a deterministic tagging"))
 	}
 	if p.SurveySecretKey == nil {
-		return errors.New("No survey secret key given")
+		return p.circuit.startFailed(errors.New("No survey secret key given"))
 	}
 
 	p.ExecTime = 0
@@ -149,18 +132,45 @@ func (p *DeterministicTaggingProtocol) Start() error {
 	}
 	lib.EndTimer(roundTotalStart)
 
-	sendingDet(*p, DeterministicTaggingMessage{detTarget})
-
+	if err := sendingDet(*p, DeterministicTaggingMessage{detTarget}); err != nil {
+		return p.circuit.startFailed(err)
+	}
 	return nil
 }
 
 // Dispatch is called on each tree node. It waits for incoming messages and handles them.
 func (p *DeterministicTaggingProtocol) Dispatch() error {
+	return p.circuit.done(p.dispatch(), p.FailureChannel)
+}
+
+// receive waits for the message of the previous server in the circuit.
+func (p *DeterministicTaggingProtocol) receive() ([]byte, error) {
+	for {
+		select {
+		case msg := <-p.PreviousNodeInPathChannel:
+			return msg.Data, nil
+		case msg := <-p.AbortChannel:
+			return nil, p.circuit.onAbort(msg)
+		case err := <-p.circuit.localFailure:
+			return nil, err
+		case msg := <-p.circuit.announced:
+			p.circuit.onAnnounce(msg)
+		case <-p.circuit.expired():
+			return nil, p.circuit.onTimeout()
+		}
+	}
+}
+
+func (p *DeterministicTaggingProtocol) dispatch() error {
 	//************ ----- first round, add value derivated from ephemeral secret to message ---- ********************
-	lengthBef := <-p.LengthNodeChannel
-	deterministicTaggingTargetBytesBef := <-p.PreviousNodeInPathChannel
+	deterministicTaggingTargetBytesBef, err := p.receive()
+	if err != nil {
+		return err
+	}
 	deterministicTaggingTargetBef := DeterministicTaggingMessage{Data: make([]GroupingAttributes, 0)}
-	deterministicTaggingTargetBef.FromBytes(deterministicTaggingTargetBytesBef.Data, lengthBef.CVLengths)
+	if err := deterministicTaggingTargetBef.FromBytes(deterministicTaggingTargetBytesBef); err != nil {
+		return errors.New("couldn't decode deterministic tagging message: " + err.Error())
+	}
 
 	startT := time.Now()
 	wg := lib.StartParallelize(len(deterministicTaggingTargetBef.Data))
@@ -199,13 +209,19 @@ func (p *DeterministicTaggingProtocol) Dispatch() error {
 	if p.IsRoot() {
 		p.ExecTime += time.Since(startT)
 	}
-	sendingDet(*p, deterministicTaggingTargetBef)
+	if err := sendingDet(*p, deterministicTaggingTargetBef); err != nil {
+		return err
+	}
 
 	//************ ----- second round, deterministic tag creation  ---- ********************
-	length := <-p.LengthNodeChannel
-	deterministicTaggingTargetBytes := <-p.PreviousNodeInPathChannel
+	deterministicTaggingTargetBytes, err := p.receive()
+	if err != nil {
+		return err
+	}
 	deterministicTaggingTarget := DeterministicTaggingMessage{Data: make([]GroupingAttributes, 0)}
-	deterministicTaggingTarget.FromBytes(deterministicTaggingTargetBytes.Data, length.CVLengths)
+	if err := deterministicTaggingTarget.FromBytes(deterministicTaggingTargetBytes); err != nil {
+		return errors.New("couldn't decode deterministic tagging message: " + err.Error())
+	}
 
 	startT = time.Now()
 	roundTotalComputation := lib.StartTimer(p.Name() + "_DetTagging(DISPATCH)")
@@ -262,26 +278,19 @@ func (p *DeterministicTaggingProtocol) Dispatch() error {
 		p.FeedbackChannel <- TaggedData
 	} else {
 		// Forward switched message.
-		sendingDet(*p, deterministicTaggingTarget)
+		return sendingDet(*p, deterministicTaggingTarget)
 	}
 
 	return nil
 }
 
-// sendToNext sends the message msg to the next node in the circuit based on the next TreeNode in Tree.List() If not visited yet.
-// If the message already visited the next node, doesn't send and returns false. Otherwise, return true.
-func (p *DeterministicTaggingProtocol) sendToNext(msg interface{}) {
-	err := p.SendTo(p.nextNodeInCircuit, msg)
+// sendingDet sends DeterministicTaggingBytes messages
+func sendingDet(p DeterministicTaggingProtocol, detTarget DeterministicTaggingMessage) error {
+	data, err := detTarget.ToBytes()
 	if err != nil {
-		log.Lvl1("Had an error sending a message: ", err)
+		return errors.New("couldn't encode deterministic tagging message: " + err.Error())
 	}
-}
-
-// sendingDet sends DeterministicTaggingBytes messages
-func sendingDet(p DeterministicTaggingProtocol, detTarget DeterministicTaggingMessage) {
-	data, cvLengths := detTarget.ToBytes()
-	p.sendToNext(&DTBLengthMessage{CVLengths: cvLengths})
-	p.sendToNext(&DeterministicTaggingBytesMessage{Data: data})
+	return p.circuit.sendToNext(&DeterministicTaggingBytesMessage{Data: data})
 }
 
 // DeterministicTagFormat creates a response with a deterministic tag
@@ -305,88 +314,35 @@ func deterministicTagFormat(i int, v GroupingAttributes, targetofSwitch *[]lib.P
 // Conversion
 //______________________________________________________________________________________________________________________
 
-// cast using reflect []int <-> []byte
-// from http://stackoverflow.com/questions/17539001/converting-int32-to-byte-array-in-go
-
-// IntByteSize is the byte size of an int in memory
-const IntByteSize = int(unsafe.Sizeof(int(0)))
-
-// UnsafeCastIntsToBytes casts a slice of ints to a slice of bytes
-func UnsafeCastIntsToBytes(ints []int) []byte {
-	length := len(ints) * IntByteSize
-	hdr := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&ints[0])), Len: length, Cap: length}
-	return *(*[]byte)(unsafe.Pointer(&hdr))
-}
-
-// UnsafeCastBytesToInts casts a slice of bytes to a slice of ints
-func UnsafeCastBytesToInts(bytes []byte) []int {
-	length := len(bytes) / IntByteSize
-	hdr := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&bytes[0])), Len: length, Cap: length}
-	return *(*[]int)(unsafe.Pointer(&hdr))
-}
-
 // ToBytes converts a DeterministicTaggingMessage to a byte array
-func (dtm *DeterministicTaggingMessage) ToBytes() ([]byte, []byte) {
-
-	length := len((*dtm).Data)
-	cvLengths := make([]int, length)
-
-	b := make([]byte, 0)
-	bb := make([][]byte, length)
-
-	wg := lib.StartParallelize(length)
-	var mutexD sync.Mutex
-	for i := range (*dtm).Data {
-		if lib.PARALLELIZE {
-			go func(i int) {
-				defer wg.Done()
-
-				mutexD.Lock()
-				data := (*dtm).Data[i].Vector
-				mutexD.Unlock()
-				bb[i], cvLengths[i] = data.ToBytes()
-			}(i)
-		} else {
-			bb[i], cvLengths[i] = (*dtm).Data[i].Vector.ToBytes()
-		}
-
-	}
-	lib.EndParallelize(wg)
-	for _, v := range bb {
-		b = append(b, v...)
+func (dtm *DeterministicTaggingMessage) ToBytes() ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WriteBodies(len((*dtm).Data), func(i int, bw *lib.WireWriter) error {
+		return bw.WriteCipherVector((*dtm).Data[i].Vector)
+	}); err != nil {
+		return nil, err
 	}
-	return b, UnsafeCastIntsToBytes(cvLengths)
+	return w.Bytes(), nil
 }
 
 // FromBytes converts a byte array to a DeterministicTaggingMessage. Note that you need to create the (empty) object beforehand.
-func (dtm *DeterministicTaggingMessage) FromBytes(data []byte, cvLengthsByte []byte) {
-
-	cvLengths := UnsafeCastBytesToInts(cvLengthsByte)
-	(*dtm).Data = make([]GroupingAttributes, len(cvLengths))
-
-	wg := lib.StartParallelize(len(cvLengths))
-
-	// iter over each value in the flatten data byte array
-	bytePos := 0
-	for i := 0; i < len(cvLengths); i++ {
-		nextBytePos := bytePos + cvLengths[i]*64 //TODO: hardcoded 64 (size of el-gamal element C,K)
-
-		cv := make(lib.CipherVector, cvLengths[i])
-		v := data[bytePos:nextBytePos]
-
-		if lib.PARALLELIZE {
-			go func(v []byte, i int) {
-				defer wg.Done()
-				cv.FromBytes(v, cvLengths[i])
-				(*dtm).Data[i] = GroupingAttributes{cv}
-			}(v, i)
-		} else {
-			cv.FromBytes(v, cvLengths[i])
-			(*dtm).Data[i] = GroupingAttributes{cv}
-		}
-
-		// advance pointer
-		bytePos = nextBytePos
+func (dtm *DeterministicTaggingMessage) FromBytes(data []byte) error {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return err
 	}
-	lib.EndParallelize(wg)
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	(*dtm).Data = make([]GroupingAttributes, len(bodies))
+	return lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		var err error
+		(*dtm).Data[i].Vector, err = br.ReadCipherVector()
+		return err
+	})
 }
@@ -0,0 +1,400 @@
+// The distributed key generation (DKG) protocol creates a t-of-n threshold collective key: unlike the aggregate of the
+// servers' public keys, any t servers can then key switch the data encrypted under this key.
+// It uses a star tree. The root announces the threshold, every server answers with its deal (commitments to a
+// random polynomial and one encrypted share per server), the root broadcasts all the deals and every server checks
+// and combines the shares dealt to it. The shares are encrypted with a key derived from the Diffie-Hellman secrets
+// of the dealer and receiver identities and of an ephemeral key of the dealer, and from a session identifier chosen
+// by the root for the run, so that the root, which relays them, cannot read them and that the masks of two runs
+// differ. The root finally tells the servers whether all of them obtained the same key before they keep their share.
+// Servers other than the root can refuse to take part (see Authorize), in which case no server gets a key.
+
+package protocols
+
+import (
+	"crypto/rand"
+	"errors"
+	"strconv"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// DKGProtocolName is the registered name for the distributed key generation protocol.
+const DKGProtocolName = "DKG"
+
+func init() {
+	network.RegisterMessage(DKGAnnounceMessage{})
+	network.RegisterMessage(DKGDealMessage{})
+	network.RegisterMessage(DKGDealsMessage{})
+	network.RegisterMessage(DKGResultMessage{})
+	network.RegisterMessage(DKGConfirmMessage{})
+	onet.GlobalProtocolRegister(DKGProtocolName, NewDKGProtocol)
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// DKGAnnounceMessage starts the key generation. Session identifies the run and Request is the request the root
+// received, passed to Authorize.
+type DKGAnnounceMessage struct {
+	Threshold int
+	Session   []byte
+	Request   []byte
+}
+
+// DKGDealMessage contains the (wire-encoded) deal of one server and the ephemeral key its shares are encrypted with,
+// or the reason why it does not take part.
+type DKGDealMessage struct {
+	Index     int
+	Data      []byte
+	Ephemeral []byte
+	Error     string
+}
+
+// DKGDealsMessage contains the (wire-encoded) deals and ephemeral keys of all servers, ordered by index, or the reason
+// why the key generation stopped.
+type DKGDealsMessage struct {
+	Deals      [][]byte
+	Ephemerals [][]byte
+	Error      string
+}
+
+// DKGResultMessage reports the collective key obtained by a server or the reason why it could not obtain it.
+type DKGResultMessage struct {
+	CollectiveKey []byte
+	Error         string
+}
+
+// DKGConfirmMessage tells the servers whether all of them obtained the same key (Error is empty) or not.
+type DKGConfirmMessage struct {
+	Error string
+}
+
+// DKGResult is the outcome of the key generation at one server.
+type DKGResult struct {
+	Key *lib.ThresholdKey
+	Err error
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type dkgAnnounceStruct struct {
+	*onet.TreeNode
+	DKGAnnounceMessage
+}
+
+type dkgDealStruct struct {
+	*onet.TreeNode
+	DKGDealMessage
+}
+
+type dkgDealsStruct struct {
+	*onet.TreeNode
+	DKGDealsMessage
+}
+
+type dkgResultStruct struct {
+	*onet.TreeNode
+	DKGResultMessage
+}
+
+type dkgConfirmStruct struct {
+	*onet.TreeNode
+	DKGConfirmMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// DKGProtocol is a struct holding the state of a protocol instance.
+type DKGProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel, the result is reported at every node
+	FeedbackChannel chan DKGResult
+
+	// Protocol communication channels
+	AnnounceChannel chan dkgAnnounceStruct
+	DealChannel     chan dkgDealStruct
+	DealsChannel    chan dkgDealsStruct
+	ResultChannel   chan dkgResultStruct
+	ConfirmChannel  chan dkgConfirmStruct
+
+	// Protocol state data
+	Threshold int
+	// Request is sent by the root to the other servers, which check it with Authorize before they deal (a server
+	// without Authorize takes part in any key generation)
+	Request   []byte
+	Authorize func(threshold int, request []byte) error
+	index     int
+	nodes     []*onet.TreeNode
+	session   []byte
+}
+
+// NewDKGProtocol is constructor of distributed key generation protocol instances.
+func NewDKGProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &DKGProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan DKGResult, 1),
+		nodes:            n.Tree().List(),
+	}
+
+	if err := p.RegisterChannels(&p.AnnounceChannel, &p.DealChannel, &p.DealsChannel, &p.ResultChannel,
+		&p.ConfirmChannel); err != nil {
+		return nil, errors.New("couldn't register channels: " + err.Error())
+	}
+
+	// the root chooses the session identifier of the run
+	if n.IsRoot() {
+		p.session = make([]byte, 32)
+		if _, err := rand.Read(p.session); err != nil {
+			return nil, errors.New("couldn't choose a session identifier: " + err.Error())
+		}
+	}
+
+	// the index of a server in the threshold key is its position in the tree (1-based)
+	for i, node := range p.nodes {
+		if n.TreeNode().Equal(node) {
+			p.index = i + 1
+			break
+		}
+	}
+	return p, nil
+}
+
+// Start is called at the root to start the key generation.
+func (p *DKGProtocol) Start() error {
+	if p.Threshold < 1 || p.Threshold > len(p.nodes) {
+		return errors.New("threshold must be between 1 and " + strconv.Itoa(len(p.nodes)))
+	}
+	log.Lvl1(p.ServerIdentity(), " starts a ", p.Threshold, "-of-", len(p.nodes), " key generation")
+	msg := DKGAnnounceMessage{Threshold: p.Threshold, Session: p.session, Request: p.Request}
+	if errs := p.SendToChildrenInParallel(&msg); len(errs) != 0 {
+		return errors.New("couldn't announce key generation: " + errs[0].Error())
+	}
+	return nil
+}
+
+// Dispatch is called on each node. It waits for incoming messages and handles them.
+func (p *DKGProtocol) Dispatch() error {
+	key, err := p.generate()
+	if err != nil {
+		log.Error(p.ServerIdentity(), " key generation failed: ", err)
+	}
+	p.FeedbackChannel <- DKGResult{Key: key, Err: err}
+	return err
+}
+
+// generate runs the key generation at one server.
+func (p *DKGProtocol) generate() (*lib.ThresholdKey, error) {
+	if !p.IsRoot() {
+		announce := <-p.AnnounceChannel
+		p.Threshold, p.session = announce.Threshold, announce.Session
+		if len(p.session) == 0 {
+			return nil, p.refuse(errors.New("no session identifier in the announcement"))
+		}
+		if p.Authorize != nil {
+			if err := p.Authorize(p.Threshold, announce.Request); err != nil {
+				return nil, p.refuse(err)
+			}
+		}
+	}
+
+	// 1. deal
+	deal, ephemeral, err := p.deal()
+	if err != nil {
+		if !p.IsRoot() {
+			return nil, p.refuse(err)
+		}
+		return nil, p.abort(err)
+	}
+	if !p.IsRoot() {
+		if err := p.SendToParent(&DKGDealMessage{Index: p.index, Data: deal, Ephemeral: ephemeral}); err != nil {
+			return nil, errors.New("couldn't send deal: " + err.Error())
+		}
+	}
+
+	// 2. deals distribution
+	var deals, ephemerals [][]byte
+	if p.IsRoot() {
+		deals = make([][]byte, len(p.nodes))
+		ephemerals = make([][]byte, len(p.nodes))
+		deals[p.index-1], ephemerals[p.index-1] = deal, ephemeral
+		var refused error
+		for range p.Children() {
+			d := <-p.DealChannel
+			if d.Error != "" {
+				if refused == nil {
+					refused = errors.New(d.ServerIdentity.String() + " does not take part in the key generation: " + d.Error)
+				}
+				continue
+			}
+			if d.Index < 1 || d.Index > len(deals) || deals[d.Index-1] != nil {
+				return nil, p.abort(errors.New("unexpected deal index " + strconv.Itoa(d.Index) + " from " +
+					d.ServerIdentity.String()))
+			}
+			deals[d.Index-1], ephemerals[d.Index-1] = d.Data, d.Ephemeral
+		}
+		if refused != nil {
+			return nil, p.abort(refused)
+		}
+		if errs := p.SendToChildrenInParallel(&DKGDealsMessage{Deals: deals, Ephemerals: ephemerals}); len(errs) != 0 {
+			return nil, errors.New("couldn't distribute deals: " + errs[0].Error())
+		}
+	} else {
+		msg := <-p.DealsChannel
+		if msg.Error != "" {
+			return nil, errors.New("the key generation stopped: " + msg.Error)
+		}
+		deals, ephemerals = msg.Deals, msg.Ephemerals
+	}
+
+	// 3. share computation
+	key, err := p.combine(deals, ephemerals)
+	if !p.IsRoot() {
+		result := DKGResultMessage{}
+		if err != nil {
+			result.Error = err.Error()
+		} else if result.CollectiveKey, err = key.CollectiveKey.MarshalBinary(); err != nil {
+			result.Error = err.Error()
+		}
+		if sendErr := p.SendToParent(&result); sendErr != nil {
+			return nil, errors.New("couldn't send result: " + sendErr.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// 5. the share is only kept if all servers obtained the same key
+		if confirm := <-p.ConfirmChannel; confirm.Error != "" {
+			return nil, errors.New("the key generation failed: " + confirm.Error)
+		}
+		return key, nil
+	}
+
+	// 4. the root checks that all servers obtained the same collective key
+	var expected []byte
+	if err == nil {
+		expected, err = key.CollectiveKey.MarshalBinary()
+	}
+	for range p.Children() {
+		r := <-p.ResultChannel
+		if err != nil {
+			continue
+		}
+		if r.Error != "" {
+			err = errors.New(r.ServerIdentity.String() + " could not complete key generation: " + r.Error)
+		} else if string(r.CollectiveKey) != string(expected) {
+			err = errors.New(r.ServerIdentity.String() + " obtained a different collective key")
+		}
+	}
+
+	// 5. the root tells the servers whether to keep their share
+	confirm := DKGConfirmMessage{}
+	if err != nil {
+		confirm.Error = err.Error()
+	}
+	if errs := p.SendToChildrenInParallel(&confirm); len(errs) != 0 && err == nil {
+		err = errors.New("couldn't confirm the key generation: " + errs[0].Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Lvl1(p.ServerIdentity(), " completed key generation")
+	return key, nil
+}
+
+// refuse tells the root that this server does not take part in the key generation and why.
+func (p *DKGProtocol) refuse(reason error) error {
+	log.Error(p.ServerIdentity(), " refuses the key generation: ", reason)
+	if err := p.SendToParent(&DKGDealMessage{Index: p.index, Error: reason.Error()}); err != nil {
+		log.Error(p.ServerIdentity(), " couldn't send its refusal: ", err)
+	}
+	return reason
+}
+
+// abort stops the key generation at the root before the deals are distributed.
+func (p *DKGProtocol) abort(reason error) error {
+	if errs := p.SendToChildrenInParallel(&DKGDealsMessage{Error: reason.Error()}); len(errs) != 0 {
+		log.Error(p.ServerIdentity(), " couldn't stop the key generation: ", errs[0])
+	}
+	return reason
+}
+
+// deal creates the deal of this server with the shares encrypted for their receivers, and the ephemeral key of the
+// encryption.
+func (p *DKGProtocol) deal() ([]byte, []byte, error) {
+	deal, err := lib.NewDKGDeal(p.Threshold, len(p.nodes))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the ephemeral key is only used for this run
+	private := network.Suite.Scalar().Pick(random.Stream)
+	ephemeral, err := network.Suite.Point().Mul(nil, private).MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	for j := range deal.Shares {
+		ephemeralDH := network.Suite.Point().Mul(p.nodes[j].ServerIdentity.Public, private)
+		mask, err := p.shareMask(p.nodes[j], ephemeralDH, p.index, j+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		deal.Shares[j] = lib.CurrentSuite().Scalar().Add(deal.Shares[j], mask)
+	}
+	data, err := deal.ToBytes()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, ephemeral, nil
+}
+
+// combine decrypts the shares dealt to this server and computes its part of the threshold key.
+func (p *DKGProtocol) combine(encodedDeals, encodedEphemerals [][]byte) (*lib.ThresholdKey, error) {
+	if len(encodedDeals) != len(p.nodes) || len(encodedEphemerals) != len(p.nodes) {
+		return nil, errors.New("expected " + strconv.Itoa(len(p.nodes)) + " deals, got " + strconv.Itoa(len(encodedDeals)))
+	}
+	deals := make([]lib.DKGDeal, len(encodedDeals))
+	for i, data := range encodedDeals {
+		if err := deals[i].FromBytes(data); err != nil {
+			return nil, errors.New("couldn't decode deal of server " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		if len(deals[i].Shares) != len(p.nodes) {
+			return nil, errors.New("deal of server " + strconv.Itoa(i+1) + " has a wrong number of shares")
+		}
+		ephemeral := network.Suite.Point()
+		if err := ephemeral.UnmarshalBinary(encodedEphemerals[i]); err != nil {
+			return nil, errors.New("invalid ephemeral key of server " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+		ephemeralDH := network.Suite.Point().Mul(ephemeral, p.Private())
+		mask, err := p.shareMask(p.nodes[i], ephemeralDH, i+1, p.index)
+		if err != nil {
+			return nil, err
+		}
+		deals[i].Shares[p.index-1] = lib.CurrentSuite().Scalar().Sub(deals[i].Shares[p.index-1], mask)
+	}
+	return lib.NewThresholdKey(deals, p.index, p.Threshold)
+}
+
+// shareMask derives the mask of the share dealt by server dealer to server receiver in this run from the
+// Diffie-Hellman secret between this server and peer (the other one of the two), the Diffie-Hellman secret of the
+// ephemeral key of the dealer and the receiver identity, and the session identifier.
+func (p *DKGProtocol) shareMask(peer *onet.TreeNode, ephemeralDH abstract.Point, dealer, receiver int) (abstract.Scalar, error) {
+	dh := network.Suite.Point().Mul(peer.ServerIdentity.Public, p.Private())
+	h := network.Suite.Hash()
+	for _, point := range []abstract.Point{dh, ephemeralDH} {
+		b, err := point.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		h.Write(b)
+	}
+	h.Write(p.session)
+	h.Write([]byte(DKGProtocolName + ":" + strconv.Itoa(dealer) + ":" + strconv.Itoa(receiver)))
+	return lib.CurrentSuite().Scalar().Pick(lib.CurrentSuite().Cipher(h.Sum(nil))), nil
+}
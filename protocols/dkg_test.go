@@ -0,0 +1,234 @@
+package protocols_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+var dkgInstances []*protocols.DKGProtocol
+var dkgInstancesMutex sync.Mutex
+var dkgRefusing string
+
+var thresholdKeys []*lib.ThresholdKey
+
+func TestDKG(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	log.TestOutput(testing.Verbose(), 1)
+
+	// You must register this protocol before creating the servers
+	onet.GlobalProtocolRegister("DKGTest", NewDKGTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("DKGTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.DKGProtocol)
+	protocol.Threshold = 3
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*nbrNodes*2) * time.Millisecond
+
+	var rootKey *lib.ThresholdKey
+	select {
+	case result := <-protocol.FeedbackChannel:
+		if result.Err != nil {
+			t.Fatal("Key generation failed:", result.Err)
+		}
+		rootKey = result.Key
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+
+	// every server obtained a valid share of the same key
+	dkgInstancesMutex.Lock()
+	defer dkgInstancesMutex.Unlock()
+	shares := make(map[int]*lib.ThresholdKey)
+	shares[rootKey.Index] = rootKey
+	for _, p := range dkgInstances {
+		if p.IsRoot() {
+			continue
+		}
+		result := <-p.FeedbackChannel
+		if result.Err != nil {
+			t.Fatal("Key generation failed on", p.ServerIdentity(), ":", result.Err)
+		}
+		if !result.Key.CollectiveKey.Equal(rootKey.CollectiveKey) {
+			t.Fatal("Servers obtained different collective keys")
+		}
+		shares[result.Key.Index] = result.Key
+	}
+	if len(shares) != nbrNodes {
+		t.Fatal("Expected", nbrNodes, "distinct shares, got", len(shares))
+	}
+
+	// any 3 shares recover the secret key
+	participants := []int{1, 3, 5}
+	secret := lib.CurrentSuite().Scalar().Zero()
+	for _, i := range participants {
+		secret.Add(secret, lib.CurrentSuite().Scalar().Mul(shares[i].Share, lib.LagrangeCoefficient(i, participants)))
+	}
+	if !lib.CurrentSuite().Point().Mul(lib.CurrentSuite().Point().Base(), secret).Equal(rootKey.CollectiveKey) {
+		t.Fatal("Shares do not match the collective key")
+	}
+}
+
+func TestDKGRefused(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	log.TestOutput(testing.Verbose(), 1)
+
+	onet.GlobalProtocolRegister("DKGRefusedTest", NewDKGTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	// a server which refuses the request makes the key generation fail everywhere
+	dkgRefusing = tree.List()[2].ServerIdentity.String()
+	defer func() { dkgRefusing = "" }()
+	dkgInstancesMutex.Lock()
+	dkgInstances = nil
+	dkgInstancesMutex.Unlock()
+
+	rootInstance, err := local.CreateProtocol("DKGRefusedTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.DKGProtocol)
+	protocol.Threshold = 3
+	protocol.Request = []byte("request")
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*nbrNodes*2) * time.Millisecond
+	select {
+	case result := <-protocol.FeedbackChannel:
+		if result.Err == nil {
+			t.Fatal("Key generation should have failed")
+		}
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+
+	dkgInstancesMutex.Lock()
+	defer dkgInstancesMutex.Unlock()
+	for _, p := range dkgInstances {
+		if p.IsRoot() {
+			continue
+		}
+		select {
+		case result := <-p.FeedbackChannel:
+			if result.Err == nil {
+				t.Fatal(p.ServerIdentity(), "obtained a key although the key generation was refused")
+			}
+		case <-time.After(timeout):
+			t.Fatal(p.ServerIdentity(), "didn't finish in time")
+		}
+	}
+}
+
+// NewDKGTest is a special purpose protocol constructor specific to tests.
+func NewDKGTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := protocols.NewDKGProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	dkg := pi.(*protocols.DKGProtocol)
+	name := tni.ServerIdentity().String()
+	dkg.Authorize = func(threshold int, request []byte) error {
+		if name == dkgRefusing {
+			return errors.New("request refused")
+		}
+		return nil
+	}
+	dkgInstancesMutex.Lock()
+	dkgInstances = append(dkgInstances, dkg)
+	dkgInstancesMutex.Unlock()
+	return pi, nil
+}
+
+func TestThresholdKeySwitching(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	log.TestOutput(testing.Verbose(), 1)
+
+	// shares of a 3-of-5 key generated locally
+	deals := make([]lib.DKGDeal, nbrNodes)
+	for i := range deals {
+		d, err := lib.NewDKGDeal(3, nbrNodes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deals[i] = *d
+	}
+	thresholdKeys = make([]*lib.ThresholdKey, nbrNodes)
+	for i := range thresholdKeys {
+		var err error
+		if thresholdKeys[i], err = lib.NewThresholdKey(deals, i+1, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// You must register this protocol before creating the servers
+	onet.GlobalProtocolRegister("ThresholdKeySwitchingTest", NewThresholdKeySwitchingTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("ThresholdKeySwitchingTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.ThresholdKeySwitchingProtocol)
+
+	collectiveKey := thresholdKeys[0].CollectiveKey
+	expRes := []int64{1, 2, 3, 6}
+	expGrp := []int64{7, 8}
+	tabi := []lib.FilteredResponse{{GroupByEnc: *lib.EncryptIntVector(collectiveKey, expGrp),
+		AggregatingAttributes: *lib.EncryptIntVector(collectiveKey, expRes)}}
+
+	clientPrivate := lib.CurrentSuite().Scalar().Pick(random.Stream)
+	clientPublic := lib.CurrentSuite().Point().Mul(lib.CurrentSuite().Point().Base(), clientPrivate)
+
+	protocol.TargetOfSwitch = &tabi
+	protocol.TargetPublicKey = &clientPublic
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*nbrNodes*2) * time.Millisecond
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		res := lib.DecryptIntVector(clientPrivate, &result[0].AggregatingAttributes)
+		grp := lib.DecryptIntVector(clientPrivate, &result[0].GroupByEnc)
+		for i := range expRes {
+			if res[i] != expRes[i] {
+				t.Fatal("Wrong results, expected", expRes, "but got", res)
+			}
+		}
+		for i := range expGrp {
+			if grp[i] != expGrp[i] {
+				t.Fatal("Wrong groups, expected", expGrp, "but got", grp)
+			}
+		}
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
+
+// NewThresholdKeySwitchingTest is a special purpose protocol constructor specific to tests.
+func NewThresholdKeySwitchingTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := protocols.NewThresholdKeySwitchingProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	pi.(*protocols.ThresholdKeySwitchingProtocol).Key = thresholdKeys[tni.Index()]
+	return pi, nil
+}
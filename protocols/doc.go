@@ -11,9 +11,15 @@
 // the nodes can:
 //	- transform an El-Gamal ciphertext encrypted under one key to another key without decrypting it
 //	  (key_switching_protocol)
+//	  or with all servers switching in parallel down a tree (parallel_key_switching_protocol)
 //	- collectively aggregate their local results (private_aggregate_protocol)
 //	- participates in the deterministic distributed tag creation (deterministic_tagging_protocol)
 //	- participates in the Shuffling protocol (shuffling_protocol)
+//	  or shuffle the grouped results before they are released (filtered_response_shuffling_protocol)
 //	- a server leyving or joining the cothority can change data encryption to adapt to new collectiv key
 //	  by using addrm_server_protocol
+//	- generate a t-of-n threshold collective key (dkg_protocol) and key switch data encrypted under it with any
+//	  t servers (threshold_key_switching_protocol)
+//	- move the data stored by all servers to a new collective key, or leave it under the current one if any server
+//	  cannot rotate its data (key_rotation_protocol)
 package protocols
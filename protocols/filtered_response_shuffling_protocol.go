@@ -0,0 +1,328 @@
+// The filtered response shuffling protocol rerandomizes and shuffles the final (grouped) results of a query before
+// they are key switched, so that their order does not reveal which server or which row produced each group.
+// Like the shuffling protocol, it uses a circuit between the servers, but it works on FilteredResponses (group
+// attributes and aggregated values are shuffled together) and, as the results are released to a querier, a list of
+// less than 2 responses is not padded with dummies (it is forwarded as is). When proofs are requested, every server
+// appends the proof of its shuffle to the message and the root checks the whole chain of proofs.
+
+package protocols
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// FilteredResponseShufflingProtocolName is the registered name for the filtered response shuffling protocol.
+const FilteredResponseShufflingProtocolName = "FilteredResponseShuffling"
+
+func init() {
+	network.RegisterMessage(FilteredResponseShufflingBytesMessage{})
+	onet.GlobalProtocolRegister(FilteredResponseShufflingProtocolName, NewFilteredResponseShufflingProtocol)
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// FilteredResponseShufflingMessage contains the responses being shuffled, the key they are encrypted with and the
+// proofs of the shuffles already done.
+type FilteredResponseShufflingMessage struct {
+	CollectiveKey abstract.Point
+	Data          []lib.ProcessResponse
+	Proofs        []lib.PublishedShufflingProof
+}
+
+// FilteredResponseShufflingBytesMessage is the FilteredResponseShufflingMessage in bytes (wire-encoded).
+type FilteredResponseShufflingBytesMessage struct {
+	Data   []byte
+	Proofs bool
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type filteredResponseShufflingBytesStruct struct {
+	*onet.TreeNode
+	FilteredResponseShufflingBytesMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// FilteredResponseShufflingProtocol holds the state of a filtered response shuffling protocol instance.
+type FilteredResponseShufflingProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channels
+	FeedbackChannel chan []lib.FilteredResponse
+	FailureChannel  chan error
+
+	// Protocol communication channels
+	PreviousNodeInPathChannel chan filteredResponseShufflingBytesStruct
+	AbortChannel              chan circuitAbortStruct
+
+	// Protocol state data
+	circuit         *circuit
+	TargetOfShuffle *[]lib.FilteredResponse
+	// CollectiveKey is the key the responses are encrypted with (the aggregate key of the roster if nil, set at the root)
+	CollectiveKey abstract.Point
+	Proofs        bool
+	// Timeout is the time given to the whole circuit to complete (set at the root)
+	Timeout time.Duration
+	// PublishedProofs are the (checked) proofs of the shuffles of all servers, available at the root once the
+	// result is sent on FeedbackChannel
+	PublishedProofs []lib.PublishedShufflingProof
+
+	original []lib.ProcessResponse
+}
+
+// NewFilteredResponseShufflingProtocol constructs filtered response shuffling protocol instances.
+func NewFilteredResponseShufflingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &FilteredResponseShufflingProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan []lib.FilteredResponse),
+		FailureChannel:   make(chan error, 1),
+	}
+	var err error
+	if p.circuit, err = newCircuit(n); err != nil {
+		return nil, err
+	}
+
+	if err := p.RegisterChannels(&p.PreviousNodeInPathChannel, &p.AbortChannel); err != nil {
+		return nil, errors.New("couldn't register channels: " + err.Error())
+	}
+	return p, nil
+}
+
+// Start is called at the root node and starts the execution of the protocol.
+func (p *FilteredResponseShufflingProtocol) Start() error {
+	p.circuit.start(p.Timeout)
+
+	if p.TargetOfShuffle == nil {
+		return p.circuit.startFailed(errors.New("No responses given as shuffling target"))
+	}
+
+	if p.CollectiveKey == nil {
+		p.CollectiveKey = p.Roster().Aggregate
+	}
+	log.Lvl1(p.ServerIdentity(), " started a filtered response shuffling (", len(*p.TargetOfShuffle), " responses)")
+
+	p.original = lib.FilteredResponsesToProcessResponses(*p.TargetOfShuffle)
+	msg := &FilteredResponseShufflingMessage{CollectiveKey: p.CollectiveKey, Data: p.original}
+	if !sameShape(p.original) {
+		return p.circuit.startFailed(errors.New("responses to shuffle have different sizes"))
+	}
+	p.shuffle(msg)
+	if err := p.send(msg); err != nil {
+		return p.circuit.startFailed(err)
+	}
+	return nil
+}
+
+// Dispatch is called on each tree node. It waits for incoming messages and handles them.
+func (p *FilteredResponseShufflingProtocol) Dispatch() error {
+	return p.circuit.done(p.dispatch(), p.FailureChannel)
+}
+
+// receive waits for the message of the previous server in the circuit.
+func (p *FilteredResponseShufflingProtocol) receive() (*FilteredResponseShufflingBytesMessage, error) {
+	for {
+		select {
+		case msg := <-p.PreviousNodeInPathChannel:
+			return &msg.FilteredResponseShufflingBytesMessage, nil
+		case msg := <-p.AbortChannel:
+			return nil, p.circuit.onAbort(msg)
+		case err := <-p.circuit.localFailure:
+			return nil, err
+		case msg := <-p.circuit.announced:
+			p.circuit.onAnnounce(msg)
+		case <-p.circuit.expired():
+			return nil, p.circuit.onTimeout()
+		}
+	}
+}
+
+func (p *FilteredResponseShufflingProtocol) dispatch() error {
+	bytesMsg, err := p.receive()
+	if err != nil {
+		return err
+	}
+	msg := &FilteredResponseShufflingMessage{}
+	if err := msg.FromBytes(bytesMsg.Data); err != nil {
+		return errors.New("couldn't decode shuffling message: " + err.Error())
+	}
+
+	if !p.IsRoot() {
+		if !sameShape(msg.Data) {
+			return errors.New("responses to shuffle have different sizes")
+		}
+		p.Proofs = bytesMsg.Proofs
+		p.shuffle(msg)
+		log.Lvl1(p.ServerIdentity(), " carried on shuffling.")
+		return p.send(msg)
+	}
+
+	if p.Proofs {
+		if err := p.checkProofs(msg); err != nil {
+			return err
+		}
+		p.PublishedProofs = msg.Proofs
+	}
+	log.Lvl1(p.ServerIdentity(), " completed shuffling (", len(msg.Data), " responses)")
+	p.FeedbackChannel <- lib.ProcessResponsesToFilteredResponses(msg.Data)
+	return nil
+}
+
+// shuffle rerandomizes and shuffles the responses of msg (if there are at least 2 of them) and adds the proof.
+func (p *FilteredResponseShufflingProtocol) shuffle(msg *FilteredResponseShufflingMessage) {
+	if len(msg.Data) < 2 {
+		return
+	}
+	round := lib.StartTimer(p.Name() + "_FilteredResponseShuffling")
+	shuffled, pi, beta := lib.ShuffleSequence(msg.Data, nil, msg.CollectiveKey, nil)
+	if p.Proofs {
+		msg.Proofs = append(msg.Proofs, lib.ShufflingProofCreation(msg.Data, shuffled, nil, msg.CollectiveKey, beta, pi))
+	}
+	msg.Data = shuffled
+	lib.EndTimer(round)
+}
+
+// send forwards msg to the next server in the circuit.
+func (p *FilteredResponseShufflingProtocol) send(msg *FilteredResponseShufflingMessage) error {
+	data, err := msg.ToBytes()
+	if err != nil {
+		return errors.New("couldn't encode shuffling message: " + err.Error())
+	}
+	return p.circuit.sendToNext(&FilteredResponseShufflingBytesMessage{Data: data, Proofs: p.Proofs})
+}
+
+// checkProofs checks that each server shuffled the output of the previous one with a valid proof, from the responses
+// given at the root to the ones received at the end of the circuit.
+func (p *FilteredResponseShufflingProtocol) checkProofs(msg *FilteredResponseShufflingMessage) error {
+	if !msg.CollectiveKey.Equal(p.CollectiveKey) {
+		return errors.New("responses were shuffled with another key")
+	}
+	if len(p.original) < 2 {
+		if len(msg.Proofs) != 0 || !equalProcessResponses(p.original, msg.Data) {
+			return errors.New("responses were modified during shuffling")
+		}
+		return nil
+	}
+
+	nbrServers := len(p.Tree().List())
+	if len(msg.Proofs) != nbrServers {
+		return errors.New("got " + strconv.Itoa(len(msg.Proofs)) + " shuffling proofs for " + strconv.Itoa(nbrServers) + " servers")
+	}
+	previous := p.original
+	for i, proof := range msg.Proofs {
+		if !equalProcessResponses(previous, proof.OriginalList) || !sameShape(append([]lib.ProcessResponse{previous[0]}, proof.ShuffledList...)) ||
+			proof.G != nil || !proof.H.Equal(p.CollectiveKey) || !lib.ShufflingProofVerification(proof, p.CollectiveKey) {
+			return errors.New("wrong proof for shuffle " + strconv.Itoa(i+1) + " of " + strconv.Itoa(nbrServers))
+		}
+		previous = proof.ShuffledList
+	}
+	if !equalProcessResponses(previous, msg.Data) {
+		return errors.New("shuffled responses do not match the last shuffling proof")
+	}
+	return nil
+}
+
+// sameShape checks that all process responses have the same number of elements as the first one.
+func sameShape(prs []lib.ProcessResponse) bool {
+	for _, pr := range prs {
+		if len(pr.GroupByEnc) != len(prs[0].GroupByEnc) || len(pr.WhereEnc) != len(prs[0].WhereEnc) ||
+			len(pr.AggregatingAttributes) != len(prs[0].AggregatingAttributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalProcessResponses checks that two lists of process responses contain the same ciphertexts.
+func equalProcessResponses(a, b []lib.ProcessResponse) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !equalCipherVectors(a[i].GroupByEnc, b[i].GroupByEnc) || !equalCipherVectors(a[i].WhereEnc, b[i].WhereEnc) ||
+			!equalCipherVectors(a[i].AggregatingAttributes, b[i].AggregatingAttributes) {
+			return false
+		}
+	}
+	return true
+}
+
+// equalCipherVectors checks that two cipher vectors contain the same ciphertexts.
+func equalCipherVectors(cv1, cv2 lib.CipherVector) bool {
+	if len(cv1) != len(cv2) {
+		return false
+	}
+	for i := range cv1 {
+		if !cv1[i].K.Equal(cv2[i].K) || !cv1[i].C.Equal(cv2[i].C) {
+			return false
+		}
+	}
+	return true
+}
+
+// Conversion
+//______________________________________________________________________________________________________________________
+
+// ToBytes converts a FilteredResponseShufflingMessage to a byte array
+func (msg *FilteredResponseShufflingMessage) ToBytes() ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WritePoint(msg.CollectiveKey); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBodies(len(msg.Data), func(i int, bw *lib.WireWriter) error {
+		return msg.Data[i].Encode(bw)
+	}); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBodies(len(msg.Proofs), func(i int, bw *lib.WireWriter) error {
+		return msg.Proofs[i].Encode(bw)
+	}); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// FromBytes converts a byte array to a FilteredResponseShufflingMessage. Note that you need to create the (empty)
+// object beforehand.
+func (msg *FilteredResponseShufflingMessage) FromBytes(data []byte) error {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	if msg.CollectiveKey, err = r.ReadPoint(); err != nil {
+		return err
+	}
+	dataBodies, err := r.ReadBodies()
+	if err != nil {
+		return err
+	}
+	proofBodies, err := r.ReadBodies()
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	msg.Data = make([]lib.ProcessResponse, len(dataBodies))
+	if err := lib.DecodeBodies(dataBodies, func(i int, br *lib.WireReader) error {
+		return msg.Data[i].Decode(br)
+	}); err != nil {
+		return err
+	}
+	msg.Proofs = make([]lib.PublishedShufflingProof, len(proofBodies))
+	return lib.DecodeBodies(proofBodies, func(i int, br *lib.WireReader) error {
+		return msg.Proofs[i].Decode(br)
+	})
+}
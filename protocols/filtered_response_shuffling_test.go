@@ -0,0 +1,69 @@
+package protocols_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestFilteredResponseShuffling(t *testing.T) {
+	local := onet.NewLocalTest()
+	_, _, tree := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("FilteredResponseShuffling", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.FilteredResponseShufflingProtocol)
+
+	// the responses are encrypted under a test key (sent by the root to the other servers)
+	secKey := network.Suite.Scalar().Pick(random.Stream)
+	pubKey := network.Suite.Point().Mul(network.Suite.Point().Base(), secKey)
+
+	// group i has count 10*i
+	tabi := make([]lib.FilteredResponse, 4)
+	for i := range tabi {
+		tabi[i] = lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(pubKey, []int64{int64(i)}),
+			AggregatingAttributes: *lib.EncryptIntVector(pubKey, []int64{int64(10 * i)})}
+	}
+
+	protocol.TargetOfShuffle = &tabi
+	protocol.CollectiveKey = pubKey
+	protocol.Proofs = true
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		seen := make(map[int64]bool)
+		for _, fr := range result {
+			group := lib.DecryptInt(secKey, fr.GroupByEnc[0])
+			if count := lib.DecryptInt(secKey, fr.AggregatingAttributes[0]); count != 10*group || seen[group] {
+				t.Fatal("Group", group, "has a wrong count", count, "or is duplicated")
+			}
+			seen[group] = true
+		}
+		if len(seen) != len(tabi) {
+			t.Fatal("Expected", len(tabi), "groups, got", len(seen))
+		}
+		if len(protocol.PublishedProofs) != 5 {
+			t.Fatal("Expected 5 shuffling proofs, got", len(protocol.PublishedProofs))
+		}
+		for _, psp := range protocol.PublishedProofs {
+			if !lib.ShufflingProofVerification(psp, pubKey) {
+				t.Fatal("Wrong shuffling proof")
+			}
+		}
+	case err := <-protocol.FailureChannel:
+		t.Fatal("Shuffling failed:", err)
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
@@ -0,0 +1,401 @@
+// The key rotation protocol moves the data stored by all servers to a new collective key in three phases, so that
+// either every server or no server switches to the new key.
+// It uses a star tree. The root sends the new key to all servers, each server re-encrypts its data under it (Prepare)
+// without replacing the stored data yet and votes. If all servers voted for the rotation before the deadline, the
+// root tells them to replace their data (Commit), otherwise to discard the re-encrypted data. A server which does not
+// get the decision before the deadline discards its re-encrypted data as well. Once the servers acknowledged the
+// decision to commit, the root ends the rotation (End): if one of them could not replace its data, the others restore
+// theirs, otherwise they forget their previous data.
+
+package protocols
+
+import (
+	"errors"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// KeyRotationProtocolName is the registered name for the key rotation protocol.
+const KeyRotationProtocolName = "KeyRotation"
+
+func init() {
+	network.RegisterMessage(KeyRotationPrepareMessage{})
+	network.RegisterMessage(KeyRotationVoteMessage{})
+	network.RegisterMessage(KeyRotationCommitMessage{})
+	network.RegisterMessage(KeyRotationAckMessage{})
+	network.RegisterMessage(KeyRotationEndMessage{})
+	onet.GlobalProtocolRegister(KeyRotationProtocolName, NewKeyRotationProtocol)
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// KeyRotationPrepareMessage contains the new collective key (wire-encoded) and the time given to each phase.
+type KeyRotationPrepareMessage struct {
+	Data    []byte
+	Timeout time.Duration
+}
+
+// KeyRotationVoteMessage reports why a server cannot rotate its data (empty if it is ready to).
+type KeyRotationVoteMessage struct {
+	Error string
+}
+
+// KeyRotationCommitMessage tells the servers whether to replace their data or to discard the re-encrypted data.
+type KeyRotationCommitMessage struct {
+	Commit bool
+}
+
+// KeyRotationAckMessage reports why a server could not apply the decision, or end the rotation if Final is set (empty
+// if it did).
+type KeyRotationAckMessage struct {
+	Error string
+	Final bool
+}
+
+// KeyRotationEndMessage tells the servers whether to restore the data they replaced (Rollback) or to forget it.
+type KeyRotationEndMessage struct {
+	Rollback bool
+}
+
+// KeyRotationResult is the outcome of the key rotation, reported at the root.
+type KeyRotationResult struct {
+	Committed bool
+	Err       error
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type keyRotationPrepareStruct struct {
+	*onet.TreeNode
+	KeyRotationPrepareMessage
+}
+
+type keyRotationVoteStruct struct {
+	*onet.TreeNode
+	KeyRotationVoteMessage
+}
+
+type keyRotationCommitStruct struct {
+	*onet.TreeNode
+	KeyRotationCommitMessage
+}
+
+type keyRotationAckStruct struct {
+	*onet.TreeNode
+	KeyRotationAckMessage
+}
+
+type keyRotationEndStruct struct {
+	*onet.TreeNode
+	KeyRotationEndMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// KeyRotationProtocol is a struct holding the state of a protocol instance.
+type KeyRotationProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channel
+	FeedbackChannel chan KeyRotationResult
+
+	// Protocol communication channels
+	PrepareChannel chan keyRotationPrepareStruct
+	VoteChannel    chan keyRotationVoteStruct
+	CommitChannel  chan keyRotationCommitStruct
+	AckChannel     chan keyRotationAckStruct
+	EndChannel     chan keyRotationEndStruct
+
+	// Protocol state data
+	NewKey abstract.Point
+	// Prepare re-encrypts the data of the server under the new key and keeps it until Commit is called
+	Prepare func(newKey abstract.Point) error
+	// Commit replaces the data of the server by its re-encryption (commit is true) or discards the re-encryption
+	Commit func(commit bool) error
+	// End is called after a commit: it restores the data replaced by Commit (rollback is true) or forgets it
+	End func(rollback bool) error
+	// Timeout is the time given to all servers to prepare the rotation, and then to apply the decision (set at the root)
+	Timeout time.Duration
+
+	startFailure chan error
+}
+
+// NewKeyRotationProtocol is constructor of key rotation protocol instances.
+func NewKeyRotationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &KeyRotationProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan KeyRotationResult, 1),
+		startFailure:     make(chan error, 1),
+	}
+
+	if err := p.RegisterChannels(&p.PrepareChannel, &p.VoteChannel, &p.CommitChannel, &p.AckChannel, &p.EndChannel); err != nil {
+		return nil, errors.New("couldn't register channels: " + err.Error())
+	}
+	return p, nil
+}
+
+// Start is called at the root to start the key rotation.
+func (p *KeyRotationProtocol) Start() error {
+	if err := p.start(); err != nil {
+		p.startFailure <- err
+		return err
+	}
+	return nil
+}
+
+func (p *KeyRotationProtocol) start() error {
+	if p.NewKey == nil {
+		return errors.New("No new collective key provided")
+	}
+
+	log.Lvl1(p.ServerIdentity(), " starts a key rotation on ", len(p.Tree().List()), " servers")
+
+	w := lib.NewWireWriter()
+	if err := w.WritePoint(p.NewKey); err != nil {
+		return err
+	}
+	msg := KeyRotationPrepareMessage{Data: w.Bytes(), Timeout: p.timeout()}
+	if errs := p.SendToChildrenInParallel(&msg); len(errs) != 0 {
+		return errors.New("couldn't announce key rotation: " + errs[0].Error())
+	}
+	return nil
+}
+
+// timeout returns the time given to the rotation.
+func (p *KeyRotationProtocol) timeout() time.Duration {
+	if p.Timeout > 0 {
+		return p.Timeout
+	}
+	return DefaultCircuitTimeout
+}
+
+// Dispatch is called on each node. It waits for incoming messages and handles them.
+func (p *KeyRotationProtocol) Dispatch() error {
+	if !p.IsRoot() {
+		return p.follow()
+	}
+
+	result := p.coordinate()
+	if result.Err != nil {
+		log.Error(p.ServerIdentity(), " key rotation failed (committed: ", result.Committed, "): ", result.Err)
+	} else {
+		log.Lvl1(p.ServerIdentity(), " completed key rotation")
+	}
+	p.FeedbackChannel <- result
+	return result.Err
+}
+
+// coordinate runs the three phases at the root and reports whether the rotation was committed.
+func (p *KeyRotationProtocol) coordinate() KeyRotationResult {
+	deadline := time.After(p.timeout())
+
+	// Start reports why it cannot run without the new key
+	if p.NewKey == nil {
+		return KeyRotationResult{Err: <-p.startFailure}
+	}
+
+	// 1. every server (this one included) prepares the rotation and votes
+	reason := p.prepare(p.NewKey)
+	for range p.Children() {
+		select {
+		case vote := <-p.VoteChannel:
+			if vote.Error != "" && reason == nil {
+				reason = errors.New(vote.ServerIdentity.String() + " cannot rotate its data: " + vote.Error)
+			}
+		case err := <-p.startFailure:
+			reason = err
+		case <-deadline:
+			reason = errors.New("not all servers prepared the rotation: " + ErrCircuitTimeout.Error())
+		}
+		if reason != nil {
+			break
+		}
+	}
+
+	// 2. the decision is applied everywhere
+	deadline = time.After(p.timeout())
+	commit := reason == nil
+	if errs := p.SendToChildrenInParallel(&KeyRotationCommitMessage{Commit: commit}); len(errs) != 0 && reason == nil {
+		reason = errors.New("couldn't send the decision to all servers: " + errs[0].Error())
+	}
+	if err := p.commit(commit); err != nil && reason == nil {
+		reason = err
+	}
+	applied := p.collectAcks(false, deadline)
+	if !commit {
+		if applied != nil && reason == nil {
+			reason = applied
+		}
+		return KeyRotationResult{Err: reason}
+	}
+
+	// 3. the servers which replaced their data restore it if one of them could not
+	rollback := reason != nil || applied != nil
+	if reason == nil {
+		reason = applied
+	}
+	deadline = time.After(p.timeout())
+	errs := p.SendToChildrenInParallel(&KeyRotationEndMessage{Rollback: rollback})
+	if err := p.end(rollback); err != nil {
+		return KeyRotationResult{Committed: !rollback, Err: p.endError(rollback, reason, err)}
+	}
+	if len(errs) != 0 {
+		err := errors.New("couldn't end the rotation on all servers: " + errs[0].Error())
+		return KeyRotationResult{Committed: !rollback, Err: p.endError(rollback, reason, err)}
+	}
+	if err := p.collectAcks(true, deadline); err != nil {
+		return KeyRotationResult{Committed: !rollback, Err: p.endError(rollback, reason, err)}
+	}
+	return KeyRotationResult{Committed: !rollback, Err: reason}
+}
+
+// collectAcks waits for the acknowledgements of a phase (the end of the rotation if final) of all children and
+// returns the first problem reported.
+func (p *KeyRotationProtocol) collectAcks(final bool, deadline <-chan time.Time) error {
+	var reason error
+	for range p.Children() {
+		for received := false; !received; {
+			select {
+			case ack := <-p.AckChannel:
+				// late acknowledgements of the decision are ignored at the end
+				if ack.Final != final {
+					continue
+				}
+				received = true
+				if ack.Error != "" && reason == nil {
+					reason = errors.New(ack.ServerIdentity.String() + " could not apply the decision: " + ack.Error)
+				}
+			case <-deadline:
+				if reason == nil {
+					reason = errors.New("not all servers applied the decision: " + ErrCircuitTimeout.Error())
+				}
+				return reason
+			}
+		}
+	}
+	return reason
+}
+
+// endError describes a failure to end the rotation.
+func (p *KeyRotationProtocol) endError(rollback bool, reason, err error) error {
+	if !rollback {
+		return errors.New("the rotation was committed but could not be ended everywhere: " + err.Error())
+	}
+	return errors.New(reason.Error() + "; the data could not be restored everywhere: " + err.Error())
+}
+
+// follow runs the three phases at a (non-root) server.
+func (p *KeyRotationProtocol) follow() error {
+	var prepare keyRotationPrepareStruct
+	select {
+	case prepare = <-p.PrepareChannel:
+	case <-time.After(DefaultCircuitTimeout):
+		return errors.New(p.ServerIdentity().String() + ": " + ErrCircuitTimeout.Error())
+	}
+	// the root may use the whole timeout to collect the votes before it sends the decision
+	deadline := time.After(2 * prepare.Timeout)
+
+	vote := KeyRotationVoteMessage{}
+	newKey, err := decodeRotationKey(prepare.Data)
+	if err == nil {
+		err = p.prepare(newKey)
+	}
+	if err != nil {
+		log.Error(p.ServerIdentity(), " cannot rotate its data: ", err)
+		vote.Error = err.Error()
+	}
+	if err := p.SendToParent(&vote); err != nil {
+		log.Error(p.ServerIdentity(), " couldn't send its vote: ", err)
+	}
+
+	// without the decision, the data stays under the current key
+	commit := false
+	select {
+	case msg := <-p.CommitChannel:
+		commit = msg.Commit
+	case <-deadline:
+		log.Error(p.ServerIdentity(), " got no decision for the key rotation: ", ErrCircuitTimeout)
+	}
+
+	ack := KeyRotationAckMessage{}
+	err = p.commit(commit)
+	if err != nil {
+		log.Error(p.ServerIdentity(), " could not apply the key rotation decision: ", err)
+		ack.Error = err.Error()
+	}
+	if sendErr := p.SendToParent(&ack); sendErr != nil {
+		return errors.New("couldn't send acknowledgement: " + sendErr.Error())
+	}
+	if !commit {
+		return err
+	}
+
+	// without the end of the rotation, the servers are assumed to have all replaced their data
+	rollback := false
+	select {
+	case msg := <-p.EndChannel:
+		rollback = msg.Rollback
+	case <-time.After(2 * prepare.Timeout):
+		log.Error(p.ServerIdentity(), " got no end for the key rotation: ", ErrCircuitTimeout)
+	}
+	ack = KeyRotationAckMessage{Final: true}
+	if err = p.end(rollback); err != nil {
+		log.Error(p.ServerIdentity(), " could not end the key rotation: ", err)
+		ack.Error = err.Error()
+	}
+	if sendErr := p.SendToParent(&ack); sendErr != nil {
+		return errors.New("couldn't send acknowledgement: " + sendErr.Error())
+	}
+	return err
+}
+
+// prepare calls the Prepare function of the server.
+func (p *KeyRotationProtocol) prepare(newKey abstract.Point) error {
+	if p.Prepare == nil {
+		return errors.New("no data to rotate on " + p.ServerIdentity().String())
+	}
+	return p.Prepare(newKey)
+}
+
+// commit calls the Commit function of the server.
+func (p *KeyRotationProtocol) commit(commit bool) error {
+	if p.Commit == nil {
+		return nil
+	}
+	return p.Commit(commit)
+}
+
+// end calls the End function of the server.
+func (p *KeyRotationProtocol) end(rollback bool) error {
+	if p.End == nil {
+		return nil
+	}
+	return p.End(rollback)
+}
+
+// Conversion
+//______________________________________________________________________________________________________________________
+
+// decodeRotationKey decodes the new key of a prepare message.
+func decodeRotationKey(data []byte) (abstract.Point, error) {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return nil, errors.New("couldn't decode key rotation announcement: " + err.Error())
+	}
+	newKey, err := r.ReadPoint()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		return nil, errors.New("couldn't decode key rotation announcement: " + err.Error())
+	}
+	return newKey, nil
+}
@@ -0,0 +1,161 @@
+package protocols_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// rotationStore is the data of one server in the key rotation tests.
+type rotationStore struct {
+	value    lib.CipherText
+	prepared *lib.CipherText
+	previous *lib.CipherText
+}
+
+var rotationStores map[string]*rotationStore
+var rotationStoresMutex sync.Mutex
+var rotationPrivate, rotationNewPrivate abstract.Scalar
+var rotationFailing, rotationCommitFailing string
+
+func TestKeyRotation(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	log.TestOutput(testing.Verbose(), 1)
+
+	// You must register this protocol before creating the servers
+	onet.GlobalProtocolRegister("KeyRotationTest", NewKeyRotationTest)
+	_, _, tree := local.GenBigTree(nbrNodes, nbrNodes, nbrNodes-1, true)
+	defer local.CloseAll()
+
+	rotationPrivate = lib.CurrentSuite().Scalar().Pick(random.Stream)
+	rotationNewPrivate = lib.CurrentSuite().Scalar().Pick(random.Stream)
+	publicKey := lib.CurrentSuite().Point().Mul(lib.CurrentSuite().Point().Base(), rotationPrivate)
+	newKey := lib.CurrentSuite().Point().Mul(lib.CurrentSuite().Point().Base(), rotationNewPrivate)
+
+	rotationStores = make(map[string]*rotationStore)
+	for i, node := range tree.List() {
+		rotationStores[node.ServerIdentity.String()] = &rotationStore{value: *lib.EncryptInt(publicKey, int64(i))}
+	}
+
+	// a server which cannot prepare the rotation makes all servers keep their data
+	rotationFailing = tree.List()[2].ServerIdentity.String()
+	result := runKeyRotation(t, local, tree, newKey)
+	if result.Committed || result.Err == nil {
+		t.Fatal("Rotation should have been aborted")
+	}
+	for i, node := range tree.List() {
+		if v := lib.DecryptInt(rotationPrivate, rotationStoreOf(node).value); v != int64(i) {
+			t.Fatal("Data of", node.ServerIdentity, "changed after an aborted rotation")
+		}
+	}
+
+	// a server which cannot replace its data makes the others restore theirs
+	rotationFailing = ""
+	rotationCommitFailing = tree.List()[1].ServerIdentity.String()
+	result = runKeyRotation(t, local, tree, newKey)
+	if result.Committed || result.Err == nil {
+		t.Fatal("Rotation should have been rolled back")
+	}
+	for i, node := range tree.List() {
+		if v := lib.DecryptInt(rotationPrivate, rotationStoreOf(node).value); v != int64(i) {
+			t.Fatal("Data of", node.ServerIdentity, "was not restored after a rolled back rotation")
+		}
+	}
+
+	rotationCommitFailing = ""
+	result = runKeyRotation(t, local, tree, newKey)
+	if !result.Committed || result.Err != nil {
+		t.Fatal("Rotation failed:", result.Err)
+	}
+	for i, node := range tree.List() {
+		if v := lib.DecryptInt(rotationNewPrivate, rotationStoreOf(node).value); v != int64(i) {
+			t.Fatal("Data of", node.ServerIdentity, "was not moved to the new key")
+		}
+	}
+}
+
+// runKeyRotation runs a key rotation on the tree and returns its result.
+func runKeyRotation(t *testing.T, local *onet.LocalTest, tree *onet.Tree, newKey abstract.Point) protocols.KeyRotationResult {
+	rootInstance, err := local.CreateProtocol("KeyRotationTest", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.KeyRotationProtocol)
+	protocol.NewKey = newKey
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*nbrNodes*2) * time.Millisecond
+	select {
+	case result := <-protocol.FeedbackChannel:
+		// the servers apply the decision before they acknowledge it
+		return result
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+	return protocols.KeyRotationResult{}
+}
+
+func rotationStoreOf(node *onet.TreeNode) *rotationStore {
+	rotationStoresMutex.Lock()
+	defer rotationStoresMutex.Unlock()
+	return rotationStores[node.ServerIdentity.String()]
+}
+
+// NewKeyRotationTest is a special purpose protocol constructor specific to tests.
+func NewKeyRotationTest(tni *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	pi, err := protocols.NewKeyRotationProtocol(tni)
+	if err != nil {
+		return nil, err
+	}
+	rotation := pi.(*protocols.KeyRotationProtocol)
+	store := rotationStoreOf(tni.TreeNode())
+	name := tni.ServerIdentity().String()
+
+	// the data is switched locally with the whole secret key, the servers only have to agree on the rotation
+	rotation.Prepare = func(newKey abstract.Point) error {
+		if name == rotationFailing {
+			return errors.New("database unavailable")
+		}
+		rotationStoresMutex.Lock()
+		defer rotationStoresMutex.Unlock()
+		prepared := lib.NewCipherText()
+		nullEphemeral := lib.CipherText{K: lib.CurrentSuite().Point().Null(), C: store.value.C}
+		prepared.KeySwitching(nullEphemeral, store.value.K, newKey, rotationPrivate)
+		store.prepared = prepared
+		return nil
+	}
+	rotation.Commit = func(commit bool) error {
+		rotationStoresMutex.Lock()
+		defer rotationStoresMutex.Unlock()
+		if commit && name == rotationCommitFailing {
+			store.prepared = nil
+			return errors.New("disk full")
+		}
+		if commit {
+			previous := store.value
+			store.value, store.previous = *store.prepared, &previous
+		}
+		store.prepared = nil
+		return nil
+	}
+	rotation.End = func(rollback bool) error {
+		rotationStoresMutex.Lock()
+		defer rotationStoresMutex.Unlock()
+		if rollback && store.previous != nil {
+			store.value = *store.previous
+		}
+		store.previous = nil
+		return nil
+	}
+	return pi, nil
+}
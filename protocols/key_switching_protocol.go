@@ -7,12 +7,13 @@
 // This is done by creating a circuit between the servers. The ciphertext is sent through this circuit and
 // each server applies its transformation on the ciphertext and forwards it to the next node in the circuit
 // until it comes back to the server who started the protocol.
+// For large result sets, the root can split the data in chunks of ChunkSize responses which are pipelined through the
+// circuit (a server forwards a chunk as soon as it switched it) and reassembled in order at the root.
 package protocols
 
 import (
 	"errors"
-
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
@@ -28,7 +29,6 @@ const KeySwitchingProtocolName = "KeySwitching"
 func init() {
 	network.RegisterMessage(KeySwitchedCipherMessage{})
 	network.RegisterMessage(KeySwitchedCipherBytesMessage{})
-	network.RegisterMessage(KSCBLengthMessage{})
 	onet.GlobalProtocolRegister(KeySwitchingProtocolName, NewKeySwitchingProtocol)
 }
 
@@ -54,18 +54,12 @@ type KeySwitchedCipherMessage struct {
 	NewKey  abstract.Point
 }
 
-// KeySwitchedCipherBytesMessage is the KeySwitchedCipherMessage in bytes.
+// KeySwitchedCipherBytesMessage is the KeySwitchedCipherMessage in bytes (wire-encoded, see lib.WireWriter), it is
+// chunk number Chunk of the Chunks chunks of the data.
 type KeySwitchedCipherBytesMessage struct {
-	Data []byte
-}
-
-// KSCBLengthMessage represents a message containing the lengths needed to read the KeySwitchedCipherBytesMessage
-type KSCBLengthMessage struct {
-	L1 int
-	L2 int
-	L4 int
-	L5 int
-	L6 int
+	Data   []byte
+	Chunk  int
+	Chunks int
 }
 
 // Structs
@@ -77,12 +71,6 @@ type keySwitchedCipherBytesStruct struct {
 	KeySwitchedCipherBytesMessage
 }
 
-// kscbLengthStruct is the structure containing a lengths message
-type kscbLengthStruct struct {
-	*onet.TreeNode
-	KSCBLengthMessage
-}
-
 // Protocol
 //______________________________________________________________________________________________________________________
 
@@ -90,20 +78,25 @@ type kscbLengthStruct struct {
 type KeySwitchingProtocol struct {
 	*onet.TreeNodeInstance
 
-	// Protocol feedback channel
+	// Protocol feedback channels
 	FeedbackChannel chan []lib.FilteredResponse
+	FailureChannel  chan error
 
 	// Protocol communication channels
 	PreviousNodeInPathChannel chan keySwitchedCipherBytesStruct
-	LengthNodeChannel         chan kscbLengthStruct
+	AbortChannel              chan circuitAbortStruct
 
 	ExecTime time.Duration
 
 	// Protocol state data
-	nextNodeInCircuit *onet.TreeNode
-	TargetOfSwitch    *[]lib.FilteredResponse
-	TargetPublicKey   *abstract.Point
-	Proofs            bool
+	circuit         *circuit
+	TargetOfSwitch  *[]lib.FilteredResponse
+	TargetPublicKey *abstract.Point
+	Proofs          bool
+	// Timeout is the time given to the whole circuit to complete (set at the root)
+	Timeout time.Duration
+	// ChunkSize is the number of responses sent in one message (set at the root, 0 sends all of them at once)
+	ChunkSize int
 }
 
 // NewKeySwitchingProtocol is constructor of Key Switching protocol instances.
@@ -111,24 +104,18 @@ func NewKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, e
 	ksp := &KeySwitchingProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []lib.FilteredResponse),
+		FailureChannel:   make(chan error, 1),
 	}
-
-	if err := ksp.RegisterChannel(&ksp.PreviousNodeInPathChannel); err != nil {
-		return nil, errors.New("couldn't register data reference channel: " + err.Error())
+	var err error
+	if ksp.circuit, err = newCircuit(n); err != nil {
+		return nil, err
 	}
 
-	if err := ksp.RegisterChannel(&ksp.LengthNodeChannel); err != nil {
+	if err := ksp.RegisterChannel(&ksp.PreviousNodeInPathChannel); err != nil {
 		return nil, errors.New("couldn't register data reference channel: " + err.Error())
 	}
-
-	var i int
-	var node *onet.TreeNode
-	var nodeList = n.Tree().List()
-	for i, node = range nodeList {
-		if n.TreeNode().Equal(node) {
-			ksp.nextNodeInCircuit = nodeList[(i+1)%len(nodeList)]
-			break
-		}
+	if err := ksp.RegisterChannel(&ksp.AbortChannel); err != nil {
+		return nil, errors.New("couldn't register abort channel: " + err.Error())
 	}
 
 	return ksp, nil
@@ -138,32 +125,56 @@ func NewKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, e
 func (p *KeySwitchingProtocol) Start() error {
 
 	startRound := lib.StartTimer(p.Name() + "_KeySwitching(START)")
+	p.circuit.start(p.Timeout)
 
 	if p.TargetOfSwitch == nil {
-		return errors.New("No ciphertext given as key switching target")
+		return p.circuit.startFailed(errors.New("No ciphertext given as key switching target"))
 	}
 
 	if p.TargetPublicKey == nil {
-		return errors.New("No new public key to be switched on provided")
+		return p.circuit.startFailed(errors.New("No new public key to be switched on provided"))
 	}
 
 	p.ExecTime = 0
 
 	log.Lvl1(p.ServerIdentity(), " starts the Key Switching Protocol")
 
-	// Initializes the target ciphertext and extract the original ephemeral keys.
 	dataLength := len(*p.TargetOfSwitch)
-	initialTab := make([]DataAndOriginalEphemeralKeys, dataLength)
+	nbrChunks := 1
+	if p.ChunkSize > 0 && dataLength > p.ChunkSize {
+		nbrChunks = (dataLength + p.ChunkSize - 1) / p.ChunkSize
+	}
+	lib.EndTimer(startRound)
+
+	for chunk := 0; chunk < nbrChunks; chunk++ {
+		begin, end := 0, dataLength
+		if nbrChunks > 1 {
+			begin = chunk * p.ChunkSize
+			if end = begin + p.ChunkSize; end > dataLength {
+				end = dataLength
+			}
+		}
+		initialTab := initialDataAndEphemKeys((*p.TargetOfSwitch)[begin:end])
+		if err := sending(p, &KeySwitchedCipherMessage{initialTab, *p.TargetPublicKey}, chunk, nbrChunks); err != nil {
+			return p.circuit.startFailed(err)
+		}
+	}
+	return nil
+}
+
+// initialDataAndEphemKeys initializes the target ciphertexts and extracts the original ephemeral keys.
+func initialDataAndEphemKeys(responses []lib.FilteredResponse) []DataAndOriginalEphemeralKeys {
+	initialTab := make([]DataAndOriginalEphemeralKeys, len(responses))
 
 	wg := lib.StartParallelize(0)
 
 	if lib.PARALLELIZE {
-		for i := 0; i < len(*p.TargetOfSwitch); i = i + lib.VPARALLELIZE {
+		for i := 0; i < len(responses); i = i + lib.VPARALLELIZE {
 			wg.Add(1)
 			go func(i int) {
-				for j := 0; j < lib.VPARALLELIZE && (j+i < len(*p.TargetOfSwitch)); j++ {
-					initialAttrAttributes, originalAttrEphemKeys := getAttributesAndEphemKeys((*p.TargetOfSwitch)[i+j].AggregatingAttributes)
-					initialGrpAttributes, originalGrpEphemKeys := getAttributesAndEphemKeys((*p.TargetOfSwitch)[i+j].GroupByEnc)
+				for j := 0; j < lib.VPARALLELIZE && (j+i < len(responses)); j++ {
+					initialAttrAttributes, originalAttrEphemKeys := getAttributesAndEphemKeys(responses[i+j].AggregatingAttributes)
+					initialGrpAttributes, originalGrpEphemKeys := getAttributesAndEphemKeys(responses[i+j].GroupByEnc)
 
 					initialTab[i+j] = DataAndOriginalEphemeralKeys{Response: lib.FilteredResponse{GroupByEnc: initialGrpAttributes, AggregatingAttributes: initialAttrAttributes},
 						OriginalEphemeralKeys: OriginalEphemeralKeys{GroupOriginalKeys: originalGrpEphemKeys, AttrOriginalKeys: originalAttrEphemKeys}}
@@ -174,7 +185,7 @@ func (p *KeySwitchingProtocol) Start() error {
 		}
 		lib.EndParallelize(wg)
 	} else {
-		for k, v := range *p.TargetOfSwitch {
+		for k, v := range responses {
 			initialAttrAttributes, originalAttrEphemKeys := getAttributesAndEphemKeys(v.AggregatingAttributes)
 			initialGrpAttributes, originalGrpEphemKeys := getAttributesAndEphemKeys(v.GroupByEnc)
 
@@ -182,10 +193,7 @@ func (p *KeySwitchingProtocol) Start() error {
 				OriginalEphemeralKeys: OriginalEphemeralKeys{GroupOriginalKeys: originalGrpEphemKeys, AttrOriginalKeys: originalAttrEphemKeys}}
 		}
 	}
-	lib.EndTimer(startRound)
-	sending(p, &KeySwitchedCipherMessage{initialTab, *p.TargetPublicKey})
-
-	return nil
+	return initialTab
 }
 
 // getAttributesAndEphemKeys retrieves attributes and ephemeral keys in a CipherVector to be key switched
@@ -202,11 +210,79 @@ func getAttributesAndEphemKeys(cv lib.CipherVector) (lib.CipherVector, []abstrac
 
 // Dispatch is called on each node. It waits for incoming messages and handles them.
 func (p *KeySwitchingProtocol) Dispatch() error {
+	return p.circuit.done(p.dispatch(), p.FailureChannel)
+}
+
+// receive waits for the next message of the previous server in the circuit.
+func (p *KeySwitchingProtocol) receive() (*KeySwitchedCipherBytesMessage, error) {
+	for {
+		select {
+		case msg := <-p.PreviousNodeInPathChannel:
+			return &msg.KeySwitchedCipherBytesMessage, nil
+		case msg := <-p.AbortChannel:
+			return nil, p.circuit.onAbort(msg)
+		case err := <-p.circuit.localFailure:
+			return nil, err
+		case msg := <-p.circuit.announced:
+			p.circuit.onAnnounce(msg)
+		case <-p.circuit.expired():
+			return nil, p.circuit.onTimeout()
+		}
+	}
+}
+
+func (p *KeySwitchingProtocol) dispatch() error {
+	var chunks [][]lib.FilteredResponse
+	var received []bool
+
+	for nbrChunks, count := 1, 0; count < nbrChunks; count++ {
+		msg, err := p.receive()
+		if err != nil {
+			return err
+		}
+		if count == 0 && msg.Chunks > 0 {
+			nbrChunks = msg.Chunks
+			chunks = make([][]lib.FilteredResponse, nbrChunks)
+			received = make([]bool, nbrChunks)
+		}
+		if msg.Chunks != nbrChunks || msg.Chunk < 0 || msg.Chunk >= nbrChunks || received[msg.Chunk] {
+			return errors.New("unexpected key switching chunk " + strconv.Itoa(msg.Chunk) + " of " + strconv.Itoa(msg.Chunks))
+		}
+		received[msg.Chunk] = true
+
+		keySwitchingTarget := &KeySwitchedCipherMessage{}
+		if err := (*keySwitchingTarget).FromBytes(msg.Data); err != nil {
+			return errors.New("couldn't decode key switching message: " + err.Error())
+		}
+		p.switchChunk(keySwitchingTarget)
 
-	length := <-p.LengthNodeChannel
-	keySwitchingTargetBytes := (<-p.PreviousNodeInPathChannel).KeySwitchedCipherBytesMessage.Data
-	keySwitchingTarget := &KeySwitchedCipherMessage{}
-	(*keySwitchingTarget).FromBytes(keySwitchingTargetBytes, length.L1, length.L2, length.L4, length.L5, length.L6)
+		if p.IsRoot() {
+			chunks[msg.Chunk] = make([]lib.FilteredResponse, len(keySwitchingTarget.DataKey))
+			for i, v := range keySwitchingTarget.DataKey {
+				chunks[msg.Chunk][i] = v.Response
+			}
+		} else {
+			log.Lvl1(p.ServerIdentity(), " carries on key switching on ", len(keySwitchingTarget.DataKey), " .")
+			if err := sending(p, keySwitchingTarget, msg.Chunk, msg.Chunks); err != nil {
+				return err
+			}
+		}
+	}
+
+	// If the tree node is the root then protocol returns.
+	if p.IsRoot() {
+		log.Lvl1(p.ServerIdentity(), " completes key switching")
+		var result []lib.FilteredResponse
+		for _, chunk := range chunks {
+			result = append(result, chunk...)
+		}
+		p.FeedbackChannel <- result
+	}
+	return nil
+}
+
+// switchChunk removes the secret contribution of this server from a chunk and adds the one of the new key.
+func (p *KeySwitchingProtocol) switchChunk(keySwitchingTarget *KeySwitchedCipherMessage) {
 	round := lib.StartTimer(p.Name() + "_KeySwitching(DISPATCH)")
 	startT := time.Now()
 
@@ -229,38 +305,18 @@ func (p *KeySwitchingProtocol) Dispatch() error {
 
 	lib.EndParallelize(wg)
 	lib.EndTimer(round)
-
-	// If the tree node is the root then protocol returns.
 	if p.IsRoot() {
-		log.Lvl1(p.ServerIdentity(), " completes key switching")
-		result := make([]lib.FilteredResponse, len(keySwitchingTarget.DataKey))
-		for i, v := range keySwitchingTarget.DataKey {
-			result[i] = v.Response
-		}
 		p.ExecTime += time.Since(startT)
-		p.FeedbackChannel <- result
-	} else {
-		log.Lvl1(p.ServerIdentity(), " carries on key switching on ", len(keySwitchingTarget.DataKey), " .")
-		sending(p, keySwitchingTarget)
 	}
-
-	return nil
 }
 
-// sendToNext sends the message msg to the next node in the circuit based on the next TreeNode in Tree.List() If not visited yet.
-// If the message already visited the next node, doesn't send and returns false. Otherwise, return true.
-func (p *KeySwitchingProtocol) sendToNext(msg interface{}) {
-	err := p.SendTo(p.nextNodeInCircuit, msg)
+// sending sends KeySwitchedCipherBytes messages
+func sending(p *KeySwitchingProtocol, kscm *KeySwitchedCipherMessage, chunk, nbrChunks int) error {
+	data, err := kscm.ToBytes()
 	if err != nil {
-		log.Lvl1(p.Name(), " has an error sending a message: ", err)
+		return errors.New("couldn't encode key switching message: " + err.Error())
 	}
-}
-
-// sending sends KeySwitchedCipherBytes messages
-func sending(p *KeySwitchingProtocol, kscm *KeySwitchedCipherMessage) {
-	data, l1, l2, l4, l5, l6 := kscm.ToBytes()
-	p.sendToNext(&KSCBLengthMessage{l1, l2, l4, l5, l6})
-	p.sendToNext(&KeySwitchedCipherBytesMessage{data})
+	return p.circuit.sendToNext(&KeySwitchedCipherBytesMessage{Data: data, Chunk: chunk, Chunks: nbrChunks})
 }
 
 //FilteredResponseKeySwitching applies key switching on a filtered response
@@ -290,111 +346,72 @@ func FilteredResponseKeySwitching(cv *lib.FilteredResponse, v lib.FilteredRespon
 //______________________________________________________________________________________________________________________
 
 // ToBytes converts a KeySwitchedCipherMessage to a byte array
-func (kscm *KeySwitchedCipherMessage) ToBytes() ([]byte, int, int, int, int, int) {
-	bb := make([][]byte, len(kscm.DataKey))
-	var l1, l2, l4, l5 int
-
-	wg := lib.StartParallelize(len(kscm.DataKey))
-	var mutexDK sync.Mutex
-	for i := range (*kscm).DataKey {
-		if lib.PARALLELIZE {
-			go func(i int) {
-				defer wg.Done()
-
-				mutexDK.Lock()
-				data := (*kscm).DataKey[i]
-				mutexDK.Unlock()
-
-				aux, l1Aux, l2Aux, l4Aux, l5Aux := data.ToBytes()
-
-				mutexDK.Lock()
-				bb[i] = aux
-				l1 = l1Aux
-				l2 = l2Aux
-				l4 = l4Aux
-				l5 = l5Aux
-				mutexDK.Unlock()
-
-			}(i)
-		} else {
-			bb[i], l1, l2, l4, l5 = (*kscm).DataKey[i].ToBytes()
-		}
-
+func (kscm *KeySwitchedCipherMessage) ToBytes() ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WritePoint((*kscm).NewKey); err != nil {
+		return nil, err
 	}
-	lib.EndParallelize(wg)
-	nkb := lib.AbstractPointsToBytes([]abstract.Point{(*kscm).NewKey})
-
-	b := make([]byte, 0)
-	for i := range bb {
-		b = append(b, bb[i]...)
+	if err := w.WriteBodies(len((*kscm).DataKey), func(i int, bw *lib.WireWriter) error {
+		return (*kscm).DataKey[i].Encode(bw)
+	}); err != nil {
+		return nil, err
 	}
-	l6 := len(b)
-	return append(b, nkb...), l1, l2, l4, l5, l6
+	return w.Bytes(), nil
 }
 
 // FromBytes converts a byte array to a KeySwitchedCipherMessage. Note that you need to create the (empty) object beforehand.
-func (kscm *KeySwitchedCipherMessage) FromBytes(data []byte, l1, l2, l4, l5, l6 int) {
-	bb := make([][]byte, 0)
-	tmp := l1*64 + l2*64 + l4 + l5
-	for i := 0; i < l6-32; i += tmp {
-		bb = append(bb, data[i:i+tmp])
+func (kscm *KeySwitchedCipherMessage) FromBytes(data []byte) error {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return err
 	}
-
-	wg := lib.StartParallelize(len(bb))
-	(*kscm).DataKey = make([]DataAndOriginalEphemeralKeys, len(bb))
-	for i := range bb {
-		if lib.PARALLELIZE {
-			go func(i int) {
-				defer wg.Done()
-				daoek := DataAndOriginalEphemeralKeys{}
-				daoek.FromBytes(bb[i], l1, l2, l4)
-				(*kscm).DataKey[i] = daoek
-			}(i)
-		} else {
-			daoek := DataAndOriginalEphemeralKeys{}
-			daoek.FromBytes(bb[i], l1, l2, l4)
-			(*kscm).DataKey[i] = daoek
-		}
+	if (*kscm).NewKey, err = r.ReadPoint(); err != nil {
+		return err
+	}
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
 	}
-	lib.EndParallelize(wg)
-	point := (data)[l6:]
-	temp := lib.BytesToAbstractPoints(point)
-	(*kscm).NewKey = temp[0]
-}
-
-// ToBytes converts a DataAndOriginalEphemeralKeys to a byte array
-func (daoek *DataAndOriginalEphemeralKeys) ToBytes() ([]byte, int, int, int, int) {
-	b := make([]byte, 0)
-	b1, l1, l2 := (*daoek).Response.ToBytes()
-	b2, l4, l5 := daoek.OriginalEphemeralKeys.ToBytes()
-	b = append(b1, b2...)
 
-	return b, l1, l2, l4, l5
+	(*kscm).DataKey = make([]DataAndOriginalEphemeralKeys, len(bodies))
+	return lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		return (*kscm).DataKey[i].Decode(br)
+	})
 }
 
-// FromBytes converts a byte array to a DataAndOriginalEphemeralKeys. Note that you need to create the (empty) object beforehand.
-func (daoek *DataAndOriginalEphemeralKeys) FromBytes(data []byte, l1, l2, l4 int) {
-	resp := lib.FilteredResponse{}
-	resp.FromBytes(data[:l1*64+l2*64], l2, l1)
-	(*daoek).Response = resp
-
-	oek := OriginalEphemeralKeys{}
-	oek.FromBytes(data[l1*64+l2*64:], l4)
-	(*daoek).OriginalEphemeralKeys = oek
+// Encode writes a DataAndOriginalEphemeralKeys in a wire-encoded body
+func (daoek *DataAndOriginalEphemeralKeys) Encode(w *lib.WireWriter) error {
+	if err := (*daoek).Response.Encode(w); err != nil {
+		return err
+	}
+	return (*daoek).OriginalEphemeralKeys.Encode(w)
 }
 
-// ToBytes converts a OriginalEphemeralKeys to a byte array
-func (oek *OriginalEphemeralKeys) ToBytes() ([]byte, int, int) {
-	groupBytes := lib.AbstractPointsToBytes(oek.GroupOriginalKeys)
-	aggrBytes := lib.AbstractPointsToBytes(oek.AttrOriginalKeys)
-	return append(groupBytes, aggrBytes...), len(groupBytes), len(aggrBytes)
+// Decode reads a DataAndOriginalEphemeralKeys from a wire-encoded body
+func (daoek *DataAndOriginalEphemeralKeys) Decode(r *lib.WireReader) error {
+	if err := (*daoek).Response.Decode(r); err != nil {
+		return err
+	}
+	return (*daoek).OriginalEphemeralKeys.Decode(r)
 }
 
-// FromBytes converts a byte array to a OriginalEphemeralKeys. Note that you need to create the (empty) object beforehand.
-func (oek *OriginalEphemeralKeys) FromBytes(data []byte, groupLength int) {
-	group := lib.BytesToAbstractPoints(data[:groupLength])
-	aggr := lib.BytesToAbstractPoints(data[groupLength:])
+// Encode writes a OriginalEphemeralKeys in a wire-encoded body
+func (oek *OriginalEphemeralKeys) Encode(w *lib.WireWriter) error {
+	if err := w.WritePoints(oek.GroupOriginalKeys); err != nil {
+		return err
+	}
+	return w.WritePoints(oek.AttrOriginalKeys)
+}
 
-	(*oek).GroupOriginalKeys = group
-	(*oek).AttrOriginalKeys = aggr
+// Decode reads a OriginalEphemeralKeys from a wire-encoded body
+func (oek *OriginalEphemeralKeys) Decode(r *lib.WireReader) error {
+	var err error
+	if (*oek).GroupOriginalKeys, err = r.ReadPoints(); err != nil {
+		return err
+	}
+	(*oek).AttrOriginalKeys, err = r.ReadPoints()
+	return err
 }
@@ -74,3 +74,82 @@ func TestKeySwitching(t *testing.T) {
 		t.Fatal("Didn't finish in time")
 	}
 }
+
+func TestKeySwitchingFailure(t *testing.T) {
+	local := onet.NewLocalTest()
+	servers, entityList, tree := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("KeySwitching", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.KeySwitchingProtocol)
+
+	tabi := []lib.FilteredResponse{{AggregatingAttributes: *lib.EncryptIntVector(entityList.Aggregate, []int64{1, 2})}}
+	clientPublic := network.Suite.Point().Mul(network.Suite.Point().Base(), network.Suite.Scalar().Pick(random.Stream))
+
+	// a server of the circuit crashes
+	if err := servers[2].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	protocol.TargetOfSwitch = &tabi
+	protocol.TargetPublicKey = &clientPublic
+	protocol.Timeout = 5 * time.Second
+	go protocol.Start()
+
+	select {
+	case <-protocol.FeedbackChannel:
+		t.Fatal("Key switching should not complete without all servers")
+	case err := <-protocol.FailureChannel:
+		log.Lvl1("Key switching failed as expected: ", err)
+	case <-time.After(2 * protocol.Timeout):
+		t.Fatal("Failure was not reported in time")
+	}
+}
+
+func TestKeySwitchingChunks(t *testing.T) {
+	local := onet.NewLocalTest()
+	_, entityList, tree := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("KeySwitching", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.KeySwitchingProtocol)
+
+	// 11 groups in chunks of 3 (the last chunk is smaller)
+	tabi := make([]lib.FilteredResponse, 11)
+	for i := range tabi {
+		tabi[i] = lib.FilteredResponse{GroupByEnc: *lib.EncryptIntVector(entityList.Aggregate, []int64{int64(i)}),
+			AggregatingAttributes: *lib.EncryptIntVector(entityList.Aggregate, []int64{int64(10 * i), 1})}
+	}
+	clientPrivate := network.Suite.Scalar().Pick(random.Stream)
+	clientPublic := network.Suite.Point().Mul(network.Suite.Point().Base(), clientPrivate)
+
+	protocol.TargetOfSwitch = &tabi
+	protocol.TargetPublicKey = &clientPublic
+	protocol.ChunkSize = 3
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	select {
+	case encryptedResult := <-protocol.FeedbackChannel:
+		if len(encryptedResult) != len(tabi) {
+			t.Fatal("Expected", len(tabi), "groups, got", len(encryptedResult))
+		}
+		// the groups are reassembled in their original order
+		for i, v := range encryptedResult {
+			grp := lib.DecryptIntVector(clientPrivate, &v.GroupByEnc)
+			res := lib.DecryptIntVector(clientPrivate, &v.AggregatingAttributes)
+			if !reflect.DeepEqual(grp, []int64{int64(i)}) || !reflect.DeepEqual(res, []int64{int64(10 * i), 1}) {
+				t.Fatal("Wrong results for group", i, ": got", grp, res)
+			}
+		}
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
@@ -18,8 +18,6 @@ func init() {
 // Protocol
 //______________________________________________________________________________________________________________________
 
-var finalResultAggr = make(chan map[lib.GroupingKey]lib.FilteredResponse)
-
 // LocalAggregationProtocol is a struct holding the state of a protocol instance.
 type LocalAggregationProtocol struct {
 	*onet.TreeNodeInstance
@@ -27,6 +25,9 @@ type LocalAggregationProtocol struct {
 	// Protocol feedback channel
 	FeedbackChannel chan map[lib.GroupingKey]lib.FilteredResponse
 
+	// Result of Start, read by Dispatch (one per instance so that concurrent queries do not mix their results)
+	result chan map[lib.GroupingKey]lib.FilteredResponse
+
 	// Protocol state data
 	TargetOfAggregation []lib.FilteredResponseDet
 	Proofs              bool
@@ -37,6 +38,7 @@ func NewLocalAggregationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstanc
 	pvp := &LocalAggregationProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan map[lib.GroupingKey]lib.FilteredResponse),
+		result:           make(chan map[lib.GroupingKey]lib.FilteredResponse, 1),
 	}
 
 	return pvp, nil
@@ -65,14 +67,14 @@ func (p *LocalAggregationProtocol) Start() error {
 
 	lib.EndTimer(roundProof)
 
-	finalResultAggr <- resultingMap
+	p.result <- resultingMap
 
 	return nil
 }
 
 // Dispatch is called on each node. It waits for incoming messages and handle them.
 func (p *LocalAggregationProtocol) Dispatch() error {
-	aux := <-finalResultAggr
+	aux := <-p.result
 	p.FeedbackChannel <- aux
 	return nil
 }
@@ -25,6 +25,9 @@ type LocalClearAggregationProtocol struct {
 	// Protocol feedback channel
 	FeedbackChannel chan []lib.DpClearResponse
 
+	// Aggregated responses passed from Start to Dispatch
+	result chan []lib.DpClearResponse
+
 	// Protocol state data
 	TargetOfAggregation []lib.DpClearResponse
 }
@@ -34,26 +37,25 @@ func NewLocalClearAggregationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolIn
 	pvp := &LocalClearAggregationProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []lib.DpClearResponse),
+		result:           make(chan []lib.DpClearResponse, 1),
 	}
 
 	return pvp, nil
 }
 
-var finalResultClearAggr = make(chan []lib.DpClearResponse)
-
 // Start is called at the root to start the execution of the local clear aggregation.
 func (p *LocalClearAggregationProtocol) Start() error {
 	log.Lvl1(p.ServerIdentity(), "started a local clear aggregation protocol")
 	roundComput := lib.StartTimer(p.Name() + "_LocalClearAggregation(START)")
 	result := lib.AddInClear(p.TargetOfAggregation)
 	lib.EndTimer(roundComput)
-	finalResultClearAggr <- result
+	p.result <- result
 	return nil
 }
 
 // Dispatch is called on each node. It waits for incoming messages and handle them.
 func (p *LocalClearAggregationProtocol) Dispatch() error {
-	aux := <-finalResultClearAggr
+	aux := <-p.result
 	p.FeedbackChannel <- aux
 	return nil
 }
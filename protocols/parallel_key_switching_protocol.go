@@ -0,0 +1,391 @@
+// The parallel key switching protocol is an alternative to the key switching circuit whose latency does not grow
+// linearly with the number of servers.
+// The root announces the new key and the original ephemeral keys down the tree. Every server then computes in parallel
+// its contribution (rB, rQ - kK) to the switch of each ciphertext, as a key switching of a null ciphertext, and the
+// contributions are summed up the tree. When proofs are requested, each server attaches to its contribution the proof
+// created by VectorSwitchKeyProofCreation, and the root checks all of them before applying the sum.
+
+package protocols
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ParallelKeySwitchingProtocolName is the registered name for the parallel key switching protocol.
+const ParallelKeySwitchingProtocolName = "ParallelKeySwitching"
+
+func init() {
+	network.RegisterMessage(ParallelKeySwitchingAnnounceMessage{})
+	network.RegisterMessage(ParallelKeySwitchingContributionMessage{})
+	onet.GlobalProtocolRegister(ParallelKeySwitchingProtocolName, NewParallelKeySwitchingProtocol)
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// ParallelKeySwitchingAnnounceMessage contains the new key followed by the ephemeral keys to switch (wire-encoded).
+type ParallelKeySwitchingAnnounceMessage struct {
+	Data   []byte
+	Proofs bool
+}
+
+// ParallelKeySwitchingContributionMessage contains the sum of the contributions of a subtree followed by their proofs
+// (wire-encoded), or the reason why the subtree could not contribute.
+type ParallelKeySwitchingContributionMessage struct {
+	Data  []byte
+	Error string
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type parallelKeySwitchingAnnounceStruct struct {
+	*onet.TreeNode
+	ParallelKeySwitchingAnnounceMessage
+}
+
+type parallelKeySwitchingContributionStruct struct {
+	*onet.TreeNode
+	ParallelKeySwitchingContributionMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// ParallelKeySwitchingProtocol is a struct holding the state of a protocol instance.
+type ParallelKeySwitchingProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channels
+	FeedbackChannel chan []lib.FilteredResponse
+	FailureChannel  chan error
+
+	// Protocol communication channels
+	AnnounceChannel     chan parallelKeySwitchingAnnounceStruct
+	ContributionChannel chan parallelKeySwitchingContributionStruct
+
+	// Protocol state data
+	TargetOfSwitch  *[]lib.FilteredResponse
+	TargetPublicKey *abstract.Point
+	Proofs          bool
+	// Timeout is the time given to all servers to contribute (set at the root)
+	Timeout time.Duration
+
+	startFailure chan error
+}
+
+// NewParallelKeySwitchingProtocol is constructor of parallel key switching protocol instances.
+func NewParallelKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &ParallelKeySwitchingProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan []lib.FilteredResponse),
+		FailureChannel:   make(chan error, 1),
+		startFailure:     make(chan error, 1),
+	}
+
+	if err := p.RegisterChannels(&p.AnnounceChannel, &p.ContributionChannel); err != nil {
+		return nil, errors.New("couldn't register channels: " + err.Error())
+	}
+	return p, nil
+}
+
+// Start is called at the root to start the execution of the key switching.
+func (p *ParallelKeySwitchingProtocol) Start() error {
+	if err := p.start(); err != nil {
+		p.startFailure <- err
+		return err
+	}
+	return nil
+}
+
+func (p *ParallelKeySwitchingProtocol) start() error {
+	if p.TargetOfSwitch == nil {
+		return errors.New("No ciphertext given as key switching target")
+	}
+	if p.TargetPublicKey == nil {
+		return errors.New("No new public key to be switched on provided")
+	}
+
+	log.Lvl1(p.ServerIdentity(), " starts a parallel key switching on ", len(p.Tree().List()), " servers")
+
+	w := lib.NewWireWriter()
+	if err := w.WritePoint(*p.TargetPublicKey); err != nil {
+		return err
+	}
+	if err := w.WritePoints(ephemeralKeys(*p.TargetOfSwitch)); err != nil {
+		return err
+	}
+	return p.announce(&ParallelKeySwitchingAnnounceMessage{Data: w.Bytes(), Proofs: p.Proofs})
+}
+
+// announce forwards the announcement to the children of this server.
+func (p *ParallelKeySwitchingProtocol) announce(msg *ParallelKeySwitchingAnnounceMessage) error {
+	if p.IsLeaf() {
+		return nil
+	}
+	if errs := p.SendToChildrenInParallel(msg); len(errs) != 0 {
+		return errors.New("couldn't announce key switching: " + errs[0].Error())
+	}
+	return nil
+}
+
+// Dispatch is called on each node. It waits for incoming messages and handles them.
+func (p *ParallelKeySwitchingProtocol) Dispatch() error {
+	timeout := DefaultCircuitTimeout
+	if p.IsRoot() && p.Timeout > 0 {
+		timeout = p.Timeout
+	}
+	deadline := time.After(timeout)
+
+	if !p.IsRoot() {
+		sum, proofs, err := p.contribute(deadline)
+		msg := ParallelKeySwitchingContributionMessage{}
+		if err == nil {
+			msg.Data, err = encodeContributions(sum, proofs)
+		}
+		if err != nil {
+			log.Error(p.ServerIdentity(), " aborts parallel key switching: ", err)
+			msg.Error = err.Error()
+		}
+		if sendErr := p.SendToParent(&msg); sendErr != nil {
+			return errors.New("couldn't send contribution: " + sendErr.Error())
+		}
+		return err
+	}
+
+	result, err := p.combine(deadline)
+	if err != nil {
+		log.Error(p.ServerIdentity(), " aborts parallel key switching: ", err)
+		p.FailureChannel <- err
+		return err
+	}
+	log.Lvl1(p.ServerIdentity(), " completes parallel key switching")
+	p.FeedbackChannel <- result
+	return nil
+}
+
+// contribute waits for the announcement and returns the sum of the contributions of the subtree of this server with
+// their proofs.
+func (p *ParallelKeySwitchingProtocol) contribute(deadline <-chan time.Time) (lib.CipherVector, []lib.PublishedSwitchKeyProof, error) {
+	var announce parallelKeySwitchingAnnounceStruct
+	select {
+	case announce = <-p.AnnounceChannel:
+	case <-deadline:
+		return nil, nil, errors.New(p.ServerIdentity().String() + ": " + ErrCircuitTimeout.Error())
+	}
+	if err := p.announce(&announce.ParallelKeySwitchingAnnounceMessage); err != nil {
+		return nil, nil, err
+	}
+	p.Proofs = announce.Proofs
+
+	r, err := lib.NewWireReader(announce.Data)
+	if err != nil {
+		return nil, nil, errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+	newKey, err := r.ReadPoint()
+	if err != nil {
+		return nil, nil, errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+	ephemKeys, err := r.ReadPoints()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		return nil, nil, errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+	return p.subtreeContributions(ephemKeys, newKey, deadline)
+}
+
+// subtreeContributions computes the contribution of this server and adds the ones of its children.
+func (p *ParallelKeySwitchingProtocol) subtreeContributions(ephemKeys []abstract.Point, newKey abstract.Point, deadline <-chan time.Time) (lib.CipherVector, []lib.PublishedSwitchKeyProof, error) {
+	sum, proof := switchingContribution(ephemKeys, newKey, p.Private(), p.Proofs)
+	var proofs []lib.PublishedSwitchKeyProof
+	if proof != nil {
+		proofs = append(proofs, *proof)
+	}
+
+	for range p.Children() {
+		var msg parallelKeySwitchingContributionStruct
+		select {
+		case msg = <-p.ContributionChannel:
+		case err := <-p.startFailure:
+			return nil, nil, err
+		case <-deadline:
+			return nil, nil, errors.New(p.ServerIdentity().String() + ": " + ErrCircuitTimeout.Error())
+		}
+		if msg.Error != "" {
+			return nil, nil, errors.New(msg.Error)
+		}
+		childSum, childProofs, err := decodeContributions(msg.Data)
+		if err != nil {
+			return nil, nil, errors.New("couldn't decode contribution from " + msg.ServerIdentity.String() + ": " + err.Error())
+		}
+		if len(childSum) != len(ephemKeys) {
+			return nil, nil, errors.New("contribution from " + msg.ServerIdentity.String() + " has " +
+				strconv.Itoa(len(childSum)) + " elements instead of " + strconv.Itoa(len(ephemKeys)))
+		}
+		sum.Add(sum, childSum)
+		proofs = append(proofs, childProofs...)
+	}
+	return sum, proofs, nil
+}
+
+// combine gathers the contributions of all servers, checks their proofs and applies them to the target.
+func (p *ParallelKeySwitchingProtocol) combine(deadline <-chan time.Time) ([]lib.FilteredResponse, error) {
+	// Start reports why it cannot run without the target
+	if p.TargetOfSwitch == nil || p.TargetPublicKey == nil {
+		return nil, <-p.startFailure
+	}
+
+	ephemKeys := ephemeralKeys(*p.TargetOfSwitch)
+	sum, proofs, err := p.subtreeContributions(ephemKeys, *p.TargetPublicKey, deadline)
+	if err != nil {
+		return nil, err
+	}
+	if p.Proofs {
+		if err := p.checkContributions(sum, proofs, ephemKeys); err != nil {
+			return nil, err
+		}
+	}
+	return applyContributions(*p.TargetOfSwitch, sum), nil
+}
+
+// checkContributions checks that every server contributed once with a valid proof and that sum is the sum of the
+// proven contributions.
+func (p *ParallelKeySwitchingProtocol) checkContributions(sum lib.CipherVector, proofs []lib.PublishedSwitchKeyProof, ephemKeys []abstract.Point) error {
+	servers := p.Tree().List()
+	if len(proofs) != len(servers) {
+		return errors.New("got " + strconv.Itoa(len(proofs)) + " proofs for " + strconv.Itoa(len(servers)) + " servers")
+	}
+
+	proven := lib.NewCipherVector(len(ephemKeys))
+	contributed := make([]bool, len(servers))
+	for _, proof := range proofs {
+		server := -1
+		for i, node := range servers {
+			if !contributed[i] && node.ServerIdentity.Public.Equal(proof.K) {
+				server = i
+				break
+			}
+		}
+		if server < 0 {
+			return errors.New("proof of key switching from an unexpected or duplicated server")
+		}
+		contributed[server] = true
+
+		name := servers[server].ServerIdentity.String()
+		if !proof.Q.Equal(*p.TargetPublicKey) || !isNullVector(proof.VectBefore) || len(proof.VectAfter) != len(ephemKeys) {
+			return errors.New("proof of key switching from " + name + " does not match the switch")
+		}
+		if !lib.SwitchKeyCheckEphemeralKeys(proof, ephemKeys) || !lib.PublishedSwitchKeyCheckProof(proof) {
+			return errors.New("wrong proof of key switching from " + name)
+		}
+		proven.Add(*proven, proof.VectAfter)
+	}
+
+	for i := range sum {
+		if !sum[i].K.Equal((*proven)[i].K) || !sum[i].C.Equal((*proven)[i].C) {
+			return errors.New("the sum of the contributions does not match their proofs")
+		}
+	}
+	return nil
+}
+
+// switchingContribution computes the contribution of a server to the switch of each ephemeral key (and its proof).
+func switchingContribution(ephemKeys []abstract.Point, newKey abstract.Point, private abstract.Scalar, proofs bool) (lib.CipherVector, *lib.PublishedSwitchKeyProof) {
+	null := lib.NewCipherVector(len(ephemKeys))
+	contribution := lib.NewCipherVector(len(ephemKeys))
+	r := contribution.KeySwitching(*null, ephemKeys, newKey, private)
+	if !proofs {
+		return *contribution, nil
+	}
+
+	skp := lib.VectorSwitchKeyProofCreation(*null, *contribution, r, private, ephemKeys, newKey)
+	pubKey := lib.CurrentSuite().Point().Mul(lib.CurrentSuite().Point().Base(), private)
+	return *contribution, &lib.PublishedSwitchKeyProof{Skp: skp, VectBefore: *null, VectAfter: *contribution, K: pubKey, Q: newKey}
+}
+
+// applyContributions replaces the ephemeral keys of the responses by the ones of the summed contributions and adds
+// their values.
+func applyContributions(responses []lib.FilteredResponse, sum lib.CipherVector) []lib.FilteredResponse {
+	switchCipherVector := func(cv lib.CipherVector, pos int) lib.CipherVector {
+		result := make(lib.CipherVector, len(cv))
+		for i, c := range cv {
+			result[i] = lib.CipherText{K: sum[pos+i].K, C: lib.CurrentSuite().Point().Add(c.C, sum[pos+i].C)}
+		}
+		return result
+	}
+
+	result := make([]lib.FilteredResponse, len(responses))
+	pos := 0
+	for i, fr := range responses {
+		result[i].GroupByEnc = switchCipherVector(fr.GroupByEnc, pos)
+		pos += len(fr.GroupByEnc)
+		result[i].AggregatingAttributes = switchCipherVector(fr.AggregatingAttributes, pos)
+		pos += len(fr.AggregatingAttributes)
+	}
+	return result
+}
+
+// isNullVector checks that all the ciphertexts of cv are null.
+func isNullVector(cv lib.CipherVector) bool {
+	null := lib.CurrentSuite().Point().Null()
+	for _, c := range cv {
+		if !c.K.Equal(null) || !c.C.Equal(null) {
+			return false
+		}
+	}
+	return true
+}
+
+// Conversion
+//______________________________________________________________________________________________________________________
+
+// encodeContributions wire-encodes the sum of the contributions of a subtree followed by their proofs.
+func encodeContributions(sum lib.CipherVector, proofs []lib.PublishedSwitchKeyProof) ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WriteCipherVector(sum); err != nil {
+		return nil, err
+	}
+	if err := w.WriteBodies(len(proofs), func(i int, bw *lib.WireWriter) error {
+		return proofs[i].Encode(bw)
+	}); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// decodeContributions decodes the sum of the contributions of a subtree and their proofs.
+func decodeContributions(data []byte) (lib.CipherVector, []lib.PublishedSwitchKeyProof, error) {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum, err := r.ReadCipherVector()
+	if err != nil {
+		return nil, nil, err
+	}
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := r.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	proofs := make([]lib.PublishedSwitchKeyProof, len(bodies))
+	if err := lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		return proofs[i].Decode(br)
+	}); err != nil {
+		return nil, nil, err
+	}
+	return sum, proofs, nil
+}
@@ -0,0 +1,57 @@
+package protocols_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"gopkg.in/dedis/crypto.v0/random"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+func TestParallelKeySwitching(t *testing.T) {
+	local := onet.NewLocalTest()
+	_, entityList, tree := local.GenTree(5, true)
+	defer local.CloseAll()
+
+	rootInstance, err := local.CreateProtocol("ParallelKeySwitching", tree)
+	if err != nil {
+		t.Fatal("Couldn't start protocol:", err)
+	}
+	protocol := rootInstance.(*protocols.ParallelKeySwitchingProtocol)
+
+	expRes := []int64{1, 2, 3, 6}
+	expGrp := []int64{7, 8}
+	tabi := []lib.FilteredResponse{
+		{GroupByEnc: *lib.EncryptIntVector(entityList.Aggregate, expGrp), AggregatingAttributes: *lib.EncryptIntVector(entityList.Aggregate, expRes)},
+		{GroupByEnc: *lib.EncryptIntVector(entityList.Aggregate, expRes), AggregatingAttributes: *lib.EncryptIntVector(entityList.Aggregate, expGrp)},
+	}
+
+	clientPrivate := network.Suite.Scalar().Pick(random.Stream)
+	clientPublic := network.Suite.Point().Mul(network.Suite.Point().Base(), clientPrivate)
+
+	protocol.TargetOfSwitch = &tabi
+	protocol.TargetPublicKey = &clientPublic
+	protocol.Proofs = true
+	go protocol.Start()
+
+	timeout := network.WaitRetry * time.Duration(network.MaxRetryConnect*5*2) * time.Millisecond
+
+	select {
+	case result := <-protocol.FeedbackChannel:
+		for i, exp := range [][2][]int64{{expGrp, expRes}, {expRes, expGrp}} {
+			grp := lib.DecryptIntVector(clientPrivate, &result[i].GroupByEnc)
+			res := lib.DecryptIntVector(clientPrivate, &result[i].AggregatingAttributes)
+			if !reflect.DeepEqual(grp, exp[0]) || !reflect.DeepEqual(res, exp[1]) {
+				t.Fatal("Wrong results, expected", exp, "but got", grp, res)
+			}
+		}
+	case err := <-protocol.FailureChannel:
+		t.Fatal("Key switching failed:", err)
+	case <-time.After(timeout):
+		t.Fatal("Didn't finish in time")
+	}
+}
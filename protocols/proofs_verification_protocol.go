@@ -36,6 +36,9 @@ type ProofsVerificationProtocol struct {
 	// Protocol feedback channel
 	FeedbackChannel chan []bool
 
+	// Verification results passed from Start to Dispatch
+	result chan []bool
+
 	// Protocol state data
 	TargetOfVerification ProofsToVerify
 }
@@ -45,13 +48,12 @@ func NewProofsVerificationProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInsta
 	pvp := &ProofsVerificationProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []bool),
+		result:           make(chan []bool, 1),
 	}
 
 	return pvp, nil
 }
 
-var finalResult = make(chan []bool)
-
 // Start is called at the root to start the execution of the key switching.
 func (p *ProofsVerificationProtocol) Start() error {
 
@@ -172,13 +174,13 @@ func (p *ProofsVerificationProtocol) Start() error {
 	lib.EndParallelize(wg)
 	lib.EndTimer(collAggrTime)
 
-	finalResult <- result
+	p.result <- result
 	return nil
 }
 
 // Dispatch is called on each node. It waits for incoming messages and handle them.
 func (p *ProofsVerificationProtocol) Dispatch() error {
-	aux := <-finalResult
+	aux := <-p.result
 	p.FeedbackChannel <- aux
 	return nil
 }
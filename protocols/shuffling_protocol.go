@@ -8,8 +8,6 @@ package protocols
 
 import (
 	"errors"
-
-	"sync"
 	"time"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
@@ -25,7 +23,6 @@ const ShufflingProtocolName = "Shuffling"
 func init() {
 	network.RegisterMessage(ShufflingMessage{})
 	network.RegisterMessage(ShufflingBytesMessage{})
-	network.RegisterMessage(SBLengthMessage{})
 	onet.GlobalProtocolRegister(ShufflingProtocolName, NewShufflingProtocol)
 }
 
@@ -37,18 +34,11 @@ type ShufflingMessage struct {
 	Data []lib.ProcessResponse
 }
 
-// ShufflingBytesMessage represents a shuffling message in bytes
+// ShufflingBytesMessage represents a shuffling message in bytes (wire-encoded)
 type ShufflingBytesMessage struct {
 	Data []byte
 }
 
-// SBLengthMessage is a message containing the lengths to read a shuffling message in bytes
-type SBLengthMessage struct {
-	GacbLength  int
-	AabLength   int
-	PgaebLength int
-}
-
 // Structs
 //______________________________________________________________________________________________________________________
 
@@ -64,12 +54,6 @@ type shufflingBytesStruct struct {
 	ShufflingBytesMessage
 }
 
-// SbLengthStruct contains a length message
-type sbLengthStruct struct {
-	*onet.TreeNode
-	SBLengthMessage
-}
-
 // Protocol
 //______________________________________________________________________________________________________________________
 
@@ -77,19 +61,22 @@ type sbLengthStruct struct {
 type ShufflingProtocol struct {
 	*onet.TreeNodeInstance
 
-	// Protocol feedback channel
+	// Protocol feedback channels
 	FeedbackChannel chan []lib.ProcessResponse
+	FailureChannel  chan error
 
 	// Protocol communication channels
-	LengthNodeChannel         chan sbLengthStruct
 	PreviousNodeInPathChannel chan shufflingBytesStruct
+	AbortChannel              chan circuitAbortStruct
 
 	ExecTimeStart time.Duration
 	ExecTime      time.Duration
 
 	// Protocol state data
-	nextNodeInCircuit *onet.TreeNode
-	TargetOfShuffle   *[]lib.ProcessResponse
+	circuit         *circuit
+	TargetOfShuffle *[]lib.ProcessResponse
+	// Timeout is the time given to the whole circuit to complete (set at the root)
+	Timeout time.Duration
 
 	CollectiveKey abstract.Point //only use in order to test the protocol
 	Proofs        bool
@@ -101,24 +88,18 @@ func NewShufflingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, erro
 	dsp := &ShufflingProtocol{
 		TreeNodeInstance: n,
 		FeedbackChannel:  make(chan []lib.ProcessResponse),
+		FailureChannel:   make(chan error, 1),
 	}
-
-	if err := dsp.RegisterChannel(&dsp.PreviousNodeInPathChannel); err != nil {
-		return nil, errors.New("couldn't register data reference channel: " + err.Error())
+	var err error
+	if dsp.circuit, err = newCircuit(n); err != nil {
+		return nil, err
 	}
 
-	if err := dsp.RegisterChannel(&dsp.LengthNodeChannel); err != nil {
+	if err := dsp.RegisterChannel(&dsp.PreviousNodeInPathChannel); err != nil {
 		return nil, errors.New("couldn't register data reference channel: " + err.Error())
 	}
-
-	var i int
-	var node *onet.TreeNode
-	var nodeList = n.Tree().List()
-	for i, node = range nodeList {
-		if n.TreeNode().Equal(node) {
-			dsp.nextNodeInCircuit = nodeList[(i+1)%len(nodeList)]
-			break
-		}
+	if err := dsp.RegisterChannel(&dsp.AbortChannel); err != nil {
+		return nil, errors.New("couldn't register abort channel: " + err.Error())
 	}
 	return dsp, nil
 }
@@ -127,9 +108,10 @@ func NewShufflingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, erro
 func (p *ShufflingProtocol) Start() error {
 
 	roundTotalStart := lib.StartTimer(p.Name() + "_Shuffling(START)")
+	p.circuit.start(p.Timeout)
 
 	if p.TargetOfShuffle == nil {
-		return errors.New("No map given as shuffling target")
+		return p.circuit.startFailed(errors.New("No map given as shuffling target"))
 	}
 
 	p.ExecTimeStart = 0
@@ -181,13 +163,16 @@ func (p *ShufflingProtocol) Start() error {
 	//sendingStart := lib.StartTimer(p.Name() + "_Sending")
 
 	message := ShufflingBytesMessage{}
-	var cgaLength, eaaLength, egaLength int
-	message.Data, cgaLength, eaaLength, egaLength = (&ShufflingMessage{shuffledData}).ToBytes()
+	var err error
+	if message.Data, err = (&ShufflingMessage{shuffledData}).ToBytes(); err != nil {
+		return p.circuit.startFailed(errors.New("couldn't encode shuffling message: " + err.Error()))
+	}
 
 	sendingStart := lib.StartTimer(p.Name() + "_Sending")
 
-	p.sendToNext(&SBLengthMessage{cgaLength, eaaLength, egaLength})
-	p.sendToNext(&message)
+	if err := p.circuit.sendToNext(&message); err != nil {
+		return p.circuit.startFailed(err)
+	}
 
 	lib.EndTimer(sendingStart)
 
@@ -196,16 +181,41 @@ func (p *ShufflingProtocol) Start() error {
 
 // Dispatch is called on each tree node. It waits for incoming messages and handles them.
 func (p *ShufflingProtocol) Dispatch() error {
+	return p.circuit.done(p.dispatch(), p.FailureChannel)
+}
 
-	shufflingLength := <-p.LengthNodeChannel
+// receive waits for the message of the previous server in the circuit.
+func (p *ShufflingProtocol) receive() ([]byte, error) {
+	for {
+		select {
+		case msg := <-p.PreviousNodeInPathChannel:
+			return msg.Data, nil
+		case msg := <-p.AbortChannel:
+			return nil, p.circuit.onAbort(msg)
+		case err := <-p.circuit.localFailure:
+			return nil, err
+		case msg := <-p.circuit.announced:
+			p.circuit.onAnnounce(msg)
+		case <-p.circuit.expired():
+			return nil, p.circuit.onTimeout()
+		}
+	}
+}
+
+func (p *ShufflingProtocol) dispatch() error {
 
 	receiving := lib.StartTimer(p.Name() + "_Receiving")
-	tmp := <-p.PreviousNodeInPathChannel
+	tmp, err := p.receive()
+	if err != nil {
+		return err
+	}
 
 	lib.EndTimer(receiving)
 
 	sm := ShufflingMessage{}
-	sm.FromBytes(tmp.Data, shufflingLength.GacbLength, shufflingLength.AabLength, shufflingLength.PgaebLength)
+	if err := sm.FromBytes(tmp); err != nil {
+		return errors.New("couldn't decode shuffling message: " + err.Error())
+	}
 	shufflingTarget := sm.Data
 
 	startT := time.Now()
@@ -262,13 +272,16 @@ func (p *ShufflingProtocol) Dispatch() error {
 		//sending := lib.StartTimer(p.Name() + "_Sending")
 
 		message := ShufflingBytesMessage{}
-		var cgaLength, eaaLength, egaLength int
-		message.Data, cgaLength, eaaLength, egaLength = (&ShufflingMessage{shuffledData}).ToBytes()
+		var err error
+		if message.Data, err = (&ShufflingMessage{shuffledData}).ToBytes(); err != nil {
+			return errors.New("couldn't encode shuffling message: " + err.Error())
+		}
 
 		sending := lib.StartTimer(p.Name() + "_Sending")
 
-		p.sendToNext(&SBLengthMessage{cgaLength, eaaLength, egaLength})
-		p.sendToNext(&message)
+		if err := p.circuit.sendToNext(&message); err != nil {
+			return err
+		}
 
 		lib.EndTimer(sending)
 	}
@@ -276,81 +289,36 @@ func (p *ShufflingProtocol) Dispatch() error {
 	return nil
 }
 
-// Sends the message msg to the next node in the circuit based on the next TreeNode in Tree.List() If not visited yet.
-// If the message already visited the next node, doesn't send and returns false. Otherwise, return true.
-func (p *ShufflingProtocol) sendToNext(msg interface{}) {
-	err := p.SendTo(p.nextNodeInCircuit, msg)
-	if err != nil {
-		log.Lvl1("Had an error sending a message: ", err)
-	}
-}
-
 // Conversion
 //______________________________________________________________________________________________________________________
 
 // ToBytes converts a ShufflingMessage to a byte array
-func (sm *ShufflingMessage) ToBytes() ([]byte, int, int, int) {
-	b := make([]byte, 0)
-	bb := make([][]byte, len((*sm).Data))
-
-	var gacbLength int
-	var aabLength int
-	var pgaebLength int
-
-	wg := lib.StartParallelize(len((*sm).Data))
-	var mutexD sync.Mutex
-	for i := range (*sm).Data {
-		if lib.PARALLELIZE {
-			go func(i int) {
-				defer wg.Done()
-
-				mutexD.Lock()
-				data := (*sm).Data[i]
-				mutexD.Unlock()
-
-				aux, gacbAux, aabAux, pgaebAux := data.ToBytes()
-
-				mutexD.Lock()
-				bb[i] = aux
-				gacbLength = gacbAux
-				aabLength = aabAux
-				pgaebLength = pgaebAux
-				mutexD.Unlock()
-			}(i)
-		} else {
-			bb[i], gacbLength, aabLength, pgaebLength = (*sm).Data[i].ToBytes()
-		}
-
+func (sm *ShufflingMessage) ToBytes() ([]byte, error) {
+	w := lib.NewWireWriter()
+	if err := w.WriteBodies(len((*sm).Data), func(i int, bw *lib.WireWriter) error {
+		return (*sm).Data[i].Encode(bw)
+	}); err != nil {
+		return nil, err
 	}
-	lib.EndParallelize(wg)
-
-	for _, el := range bb {
-		b = append(b, el...)
-	}
-
-	return b, gacbLength, aabLength, pgaebLength
+	return w.Bytes(), nil
 }
 
 // FromBytes converts a byte array to a ShufflingMessage. Note that you need to create the (empty) object beforehand.
-func (sm *ShufflingMessage) FromBytes(data []byte, gacbLength, aabLength, pgaebLength int) {
-	var nbrData int
-
-	elementLength := (gacbLength*64 + aabLength*64 + pgaebLength*64) //CAUTION: hardcoded 64 (size of el-gamal element C,K)
-	nbrData = len(data) / elementLength
-
-	(*sm).Data = make([]lib.ProcessResponse, nbrData)
-	wg := lib.StartParallelize(nbrData)
-	for i := 0; i < nbrData; i++ {
-		v := data[i*elementLength : i*elementLength+elementLength]
-		if lib.PARALLELIZE {
-			go func(v []byte, i int) {
-				defer wg.Done()
-				(*sm).Data[i].FromBytes(v, gacbLength, aabLength, pgaebLength)
-			}(v, i)
-		} else {
-			(*sm).Data[i].FromBytes(v, gacbLength, aabLength, pgaebLength)
-		}
-
+func (sm *ShufflingMessage) FromBytes(data []byte) error {
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return err
+	}
+	bodies, err := r.ReadBodies()
+	if err != nil {
+		return err
 	}
-	lib.EndParallelize(wg)
+	if err := r.Close(); err != nil {
+		return err
+	}
+
+	(*sm).Data = make([]lib.ProcessResponse, len(bodies))
+	return lib.DecodeBodies(bodies, func(i int, br *lib.WireReader) error {
+		return (*sm).Data[i].Decode(br)
+	})
 }
@@ -0,0 +1,345 @@
+// The threshold key switching protocol switches data encrypted under a threshold collective key (see the DKG
+// protocol) to another key with the help of any t servers instead of all of them.
+// It uses a star tree. The root sends the ephemeral keys of the ciphertexts to all servers, each server answers with
+// its contribution (rB, rQ - sK) computed with its share s and the root combines the first t contributions it gets
+// with their Lagrange coefficients. Servers which are down or slow are thus simply ignored.
+// When proofs are requested, each contribution comes with a key switching proof for the public key of the share
+// (see lib.ThresholdKey.PublicShares) and the root only combines contributions whose proof is valid.
+
+package protocols
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ThresholdKeySwitchingProtocolName is the registered name for the threshold key switching protocol.
+const ThresholdKeySwitchingProtocolName = "ThresholdKeySwitching"
+
+func init() {
+	network.RegisterMessage(ThresholdKeySwitchingAnnounceMessage{})
+	network.RegisterMessage(ThresholdKeySwitchingContributionMessage{})
+	onet.GlobalProtocolRegister(ThresholdKeySwitchingProtocolName, NewThresholdKeySwitchingProtocol)
+}
+
+// Messages
+//______________________________________________________________________________________________________________________
+
+// ThresholdKeySwitchingAnnounceMessage contains the new key followed by the ephemeral keys to switch (wire-encoded).
+type ThresholdKeySwitchingAnnounceMessage struct {
+	Data   []byte
+	Proofs bool
+}
+
+// ThresholdKeySwitchingContributionMessage contains the contributions of the server with the given share index,
+// followed by their proof (wire-encoded).
+type ThresholdKeySwitchingContributionMessage struct {
+	Index int
+	Data  []byte
+}
+
+// Structs
+//______________________________________________________________________________________________________________________
+
+type thresholdKeySwitchingAnnounceStruct struct {
+	*onet.TreeNode
+	ThresholdKeySwitchingAnnounceMessage
+}
+
+type thresholdKeySwitchingContributionStruct struct {
+	*onet.TreeNode
+	ThresholdKeySwitchingContributionMessage
+}
+
+// Protocol
+//______________________________________________________________________________________________________________________
+
+// ThresholdKeySwitchingProtocol is a struct holding the state of a protocol instance.
+type ThresholdKeySwitchingProtocol struct {
+	*onet.TreeNodeInstance
+
+	// Protocol feedback channels
+	FeedbackChannel chan []lib.FilteredResponse
+	FailureChannel  chan error
+
+	// Protocol communication channels
+	AnnounceChannel     chan thresholdKeySwitchingAnnounceStruct
+	ContributionChannel chan thresholdKeySwitchingContributionStruct
+
+	// Protocol state data
+	Key             *lib.ThresholdKey
+	TargetOfSwitch  *[]lib.FilteredResponse
+	TargetPublicKey *abstract.Point
+	Proofs          bool
+	// Timeout is the time given to t servers to send their contributions (set at the root)
+	Timeout time.Duration
+
+	startFailure chan error
+}
+
+// NewThresholdKeySwitchingProtocol is constructor of threshold key switching protocol instances.
+func NewThresholdKeySwitchingProtocol(n *onet.TreeNodeInstance) (onet.ProtocolInstance, error) {
+	p := &ThresholdKeySwitchingProtocol{
+		TreeNodeInstance: n,
+		FeedbackChannel:  make(chan []lib.FilteredResponse),
+		FailureChannel:   make(chan error, 1),
+		startFailure:     make(chan error, 1),
+	}
+
+	if err := p.RegisterChannels(&p.AnnounceChannel, &p.ContributionChannel); err != nil {
+		return nil, errors.New("couldn't register channels: " + err.Error())
+	}
+	return p, nil
+}
+
+// Start is called at the root to start the execution of the key switching.
+func (p *ThresholdKeySwitchingProtocol) Start() error {
+	if err := p.start(); err != nil {
+		p.startFailure <- err
+		return err
+	}
+	return nil
+}
+
+func (p *ThresholdKeySwitchingProtocol) start() error {
+	if p.Key == nil {
+		return errors.New("No threshold key share available for key switching")
+	}
+	if p.TargetOfSwitch == nil {
+		return errors.New("No ciphertext given as key switching target")
+	}
+	if p.TargetPublicKey == nil {
+		return errors.New("No new public key to be switched on provided")
+	}
+
+	log.Lvl1(p.ServerIdentity(), " starts a ", p.Key.T, "-of-", p.Key.N, " threshold key switching")
+
+	w := lib.NewWireWriter()
+	if err := w.WritePoint(*p.TargetPublicKey); err != nil {
+		return err
+	}
+	if err := w.WritePoints(ephemeralKeys(*p.TargetOfSwitch)); err != nil {
+		return err
+	}
+
+	// unreachable servers do not prevent the switch as long as t servers answer
+	msg := ThresholdKeySwitchingAnnounceMessage{Data: w.Bytes(), Proofs: p.Proofs}
+	for _, err := range p.SendToChildrenInParallel(&msg) {
+		log.Lvl1(p.ServerIdentity(), " could not reach a server: ", err)
+	}
+	return nil
+}
+
+// Dispatch is called on each node. It waits for incoming messages and handles them.
+func (p *ThresholdKeySwitchingProtocol) Dispatch() error {
+	if !p.IsRoot() {
+		return p.contribute()
+	}
+	if err := p.combine(); err != nil {
+		log.Error(p.ServerIdentity(), " aborts threshold key switching: ", err)
+		p.FailureChannel <- err
+		return err
+	}
+	return nil
+}
+
+// combine collects the contributions of t servers (this one included) and applies them at the root.
+func (p *ThresholdKeySwitchingProtocol) combine() error {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultCircuitTimeout
+	}
+	deadline := time.After(timeout)
+
+	// Start reports why it cannot run without the key or the target
+	if p.Key == nil || p.TargetOfSwitch == nil || p.TargetPublicKey == nil {
+		return <-p.startFailure
+	}
+
+	newKey := *p.TargetPublicKey
+	ephemKeys := ephemeralKeys(*p.TargetOfSwitch)
+	contributions := make(map[int]lib.CipherVector, p.Key.T)
+	contributions[p.Key.Index] = computeContributions(ephemKeys, newKey, p.Key.Share)
+
+	for len(contributions) < p.Key.T {
+		var msg thresholdKeySwitchingContributionStruct
+		select {
+		case msg = <-p.ContributionChannel:
+		case err := <-p.startFailure:
+			return err
+		case <-deadline:
+			return errors.New("only " + strconv.Itoa(len(contributions)) + " of the " + strconv.Itoa(p.Key.T) +
+				" required servers contributed: " + ErrCircuitTimeout.Error())
+		}
+		if _, ok := contributions[msg.Index]; ok || msg.Index < 1 || msg.Index > p.Key.N {
+			log.Lvl1(p.ServerIdentity(), " ignores contribution with index ", msg.Index, " from ", msg.ServerIdentity)
+			continue
+		}
+		cv, proofs, err := decodeContributions(msg.Data)
+		if err != nil {
+			return errors.New("couldn't decode contribution from " + msg.ServerIdentity.String() + ": " + err.Error())
+		}
+		if len(cv) != len(ephemKeys) {
+			return errors.New("contribution from " + msg.ServerIdentity.String() + " has " + strconv.Itoa(len(cv)) +
+				" elements instead of " + strconv.Itoa(len(ephemKeys)))
+		}
+		if p.Proofs {
+			// a wrong contribution is ignored like a missing one, another server can still replace it
+			if err := p.checkContribution(msg.Index, cv, proofs, ephemKeys, newKey); err != nil {
+				log.Error(p.ServerIdentity(), " ignores contribution from ", msg.ServerIdentity, ": ", err)
+				continue
+			}
+		}
+		contributions[msg.Index] = cv
+	}
+
+	log.Lvl1(p.ServerIdentity(), " completes threshold key switching")
+	p.FeedbackChannel <- combineContributions(*p.TargetOfSwitch, contributions)
+	return nil
+}
+
+// contribute computes and sends the contribution of a (non-root) server.
+func (p *ThresholdKeySwitchingProtocol) contribute() error {
+	announce := <-p.AnnounceChannel
+	if p.Key == nil {
+		return errors.New("no threshold key share on " + p.ServerIdentity().String())
+	}
+
+	r, err := lib.NewWireReader(announce.Data)
+	if err != nil {
+		return errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+	newKey, err := r.ReadPoint()
+	if err != nil {
+		return errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+	ephemKeys, err := r.ReadPoints()
+	if err == nil {
+		err = r.Close()
+	}
+	if err != nil {
+		return errors.New("couldn't decode key switching announcement: " + err.Error())
+	}
+
+	var proofs []lib.PublishedSwitchKeyProof
+	var contribution lib.CipherVector
+	if announce.Proofs {
+		var proof *lib.PublishedSwitchKeyProof
+		contribution, proof = switchingContribution(ephemKeys, newKey, p.Key.Share, true)
+		proofs = append(proofs, *proof)
+	} else {
+		contribution = computeContributions(ephemKeys, newKey, p.Key.Share)
+	}
+
+	data, err := encodeContributions(contribution, proofs)
+	if err != nil {
+		return err
+	}
+	return p.SendToParent(&ThresholdKeySwitchingContributionMessage{Index: p.Key.Index, Data: data})
+}
+
+// checkContribution checks that the contribution of the share with the given index comes with a valid proof for the
+// public key of this share.
+func (p *ThresholdKeySwitchingProtocol) checkContribution(index int, cv lib.CipherVector, proofs []lib.PublishedSwitchKeyProof, ephemKeys []abstract.Point, newKey abstract.Point) error {
+	if len(p.Key.PublicShares) < index {
+		return errors.New("the public key of share " + strconv.Itoa(index) + " is unknown, its proof cannot be checked")
+	}
+	if len(proofs) != 1 {
+		return errors.New("got " + strconv.Itoa(len(proofs)) + " proofs instead of 1")
+	}
+
+	proof := proofs[0]
+	if !proof.K.Equal(p.Key.PublicShares[index-1]) || !proof.Q.Equal(newKey) || !isNullVector(proof.VectBefore) ||
+		len(proof.VectAfter) != len(cv) {
+		return errors.New("proof of key switching does not match the switch")
+	}
+	if !lib.SwitchKeyCheckEphemeralKeys(proof, ephemKeys) || !lib.PublishedSwitchKeyCheckProof(proof) {
+		return errors.New("wrong proof of key switching")
+	}
+	for i := range cv {
+		if !cv[i].K.Equal(proof.VectAfter[i].K) || !cv[i].C.Equal(proof.VectAfter[i].C) {
+			return errors.New("the contribution does not match its proof")
+		}
+	}
+	return nil
+}
+
+// ephemeralKeys lists the ephemeral keys of the group and aggregating attributes of the responses.
+func ephemeralKeys(responses []lib.FilteredResponse) []abstract.Point {
+	var keys []abstract.Point
+	for _, fr := range responses {
+		for _, c := range fr.GroupByEnc {
+			keys = append(keys, c.K)
+		}
+		for _, c := range fr.AggregatingAttributes {
+			keys = append(keys, c.K)
+		}
+	}
+	return keys
+}
+
+// computeContributions computes the contribution of a share to the switch of each ephemeral key.
+func computeContributions(ephemKeys []abstract.Point, newKey abstract.Point, share abstract.Scalar) lib.CipherVector {
+	cv := make(lib.CipherVector, len(ephemKeys))
+	wg := lib.StartParallelize(0)
+	if lib.PARALLELIZE {
+		for i := 0; i < len(ephemKeys); i = i + lib.VPARALLELIZE {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < lib.VPARALLELIZE && (j+i < len(ephemKeys)); j++ {
+					cv[i+j].ThresholdKeySwitchingContribution(ephemKeys[i+j], newKey, share)
+				}
+			}(i)
+		}
+		lib.EndParallelize(wg)
+	} else {
+		for i := range ephemKeys {
+			cv[i].ThresholdKeySwitchingContribution(ephemKeys[i], newKey, share)
+		}
+	}
+	return cv
+}
+
+// combineContributions applies the Lagrange-weighted contributions of t servers to the responses.
+func combineContributions(responses []lib.FilteredResponse, contributions map[int]lib.CipherVector) []lib.FilteredResponse {
+	participants := make([]int, 0, len(contributions))
+	for index := range contributions {
+		participants = append(participants, index)
+	}
+	lambdas := make(map[int]abstract.Scalar, len(participants))
+	for _, index := range participants {
+		lambdas[index] = lib.LagrangeCoefficient(index, participants)
+	}
+
+	switchCipherText := func(c lib.CipherText, pos int) lib.CipherText {
+		result := lib.CipherText{K: lib.CurrentSuite().Point().Null(), C: lib.CurrentSuite().Point().Add(lib.CurrentSuite().Point().Null(), c.C)}
+		for index, cv := range contributions {
+			result.AddThresholdKeySwitchingContribution(cv[pos], lambdas[index])
+		}
+		return result
+	}
+
+	result := make([]lib.FilteredResponse, len(responses))
+	pos := 0
+	for i, fr := range responses {
+		result[i].GroupByEnc = make(lib.CipherVector, len(fr.GroupByEnc))
+		for j, c := range fr.GroupByEnc {
+			result[i].GroupByEnc[j] = switchCipherText(c, pos)
+			pos++
+		}
+		result[i].AggregatingAttributes = make(lib.CipherVector, len(fr.AggregatingAttributes))
+		for j, c := range fr.AggregatingAttributes {
+			result[i].AggregatingAttributes[j] = switchCipherText(c, pos)
+			pos++
+		}
+	}
+	return result
+}
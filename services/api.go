@@ -1,9 +1,12 @@
 package serviceI2B2dc
 
 import (
+	"errors"
+	"strconv"
 	"time"
 
 	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
 	"gopkg.in/dedis/crypto.v0/abstract"
 	"gopkg.in/dedis/crypto.v0/config"
 	"gopkg.in/dedis/onet.v1"
@@ -18,12 +21,25 @@ type API struct {
 	entryPoint *network.ServerIdentity
 	public     abstract.Point
 	private    abstract.Scalar
+	// Timeouts are sent with the queries to bound the time spent in each protocol
+	Timeouts ProtocolTimeouts
+	// KeySwitchingChunkSize splits the results in chunks of this size during the key switching (0 means no chunks)
+	KeySwitchingChunkSize int
+	// ParallelKeySwitching selects the parallel (tree-based) key switching instead of the circuit
+	ParallelKeySwitching bool
+	// PartialResults lets the queries go on without the servers which do not send their data before
+	// Timeouts.Aggregation
+	PartialResults bool
 }
 
 // NewClient constructor of a client.
 func NewClient(entryPoint *network.ServerIdentity, clientID string) *API {
-	keys := config.NewKeyPair(network.Suite)
+	return NewClientWithKeys(entryPoint, clientID, config.NewKeyPair(lib.CurrentSuite()))
+}
 
+// NewClientWithKeys constructor of a client using a given key pair (e.g. to get the results of several queries under
+// the same key).
+func NewClientWithKeys(entryPoint *network.ServerIdentity, clientID string, keys *config.KeyPair) *API {
 	newClient := &API{
 		Client:     onet.NewClient(ServiceName),
 		clientID:   clientID,
@@ -47,6 +63,12 @@ func (c *API) SendQuery(entities *onet.Roster, queryID QueryID, clientPubKey abs
 		QueryID:      queryID,
 		Roster:       *entities,
 		ClientPubKey: clientPubKey,
+		Suite:        lib.CurrentSuite().String(),
+		Timeouts:     c.Timeouts,
+
+		KeySwitchingChunkSize: c.KeySwitchingChunkSize,
+		ParallelKeySwitching:  c.ParallelKeySwitching,
+		PartialResults:        c.PartialResults,
 
 		// query statement
 		Locations: locations,
@@ -65,24 +87,185 @@ func (c *API) SendQuery(entities *onet.Roster, queryID QueryID, clientPubKey abs
 	return &newQueryID, nil
 }
 
+// QueryResult contains the decrypted results of a query and how they were computed.
+type QueryResult struct {
+	QueryID QueryID
+	Groups  []string
+	// Counts are negative when the noise of differential privacy exceeds them
+	Counts []int64
+	// Contributors are the servers whose data is in the results
+	Contributors []*network.ServerIdentity
+	// Misbehaving are the servers whose contribution to the aggregation was found wrong
+	Misbehaving []protocols.Misbehavior
+	// DifferentialPrivacy is the configuration of the noise added to the counts (Epsilon is 0 if there is none)
+	DifferentialPrivacy DifferentialPrivacyConfig
+	// Timings are the durations of the phases run by the entry point
+	Timings PhaseTimings
+}
+
 // SendResultsQuery to get the result from associated server and decrypt the response using its private key.
 func (c *API) ExecuteQuery(queryID QueryID) (*[]string, *[]int64, error) {
+	result, err := c.ExecuteQueryResult(queryID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &result.Groups, &result.Counts, nil
+}
+
+// ExecuteQueryResult is ExecuteQuery which also returns the servers whose data is in the results, the ones found
+// misbehaving, the noise added to the counts and the timings of the query.
+func (c *API) ExecuteQueryResult(queryID QueryID) (*QueryResult, error) {
 	log.Lvl1(c, " asks the server to run the query with ID: ", queryID)
 	resp := ServiceResult{}
 	err := c.SendProtobuf(c.entryPoint, &ResultsQueryDC{false, queryID, c.public}, &resp)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	log.Lvl1(c, " receives the query results from ", c.entryPoint)
 
-	//grpClear := make([][]int64, len(resp.Results))
+	// each (shuffled) response contains the position of its group in resp.Groups and its count
 	start := time.Now()
-	aggr := lib.DecryptIntVector(c.private, &((*resp.Results)[0].AggregatingAttributes))
+	groups := make([]string, len(*resp.Results))
+	aggr := make([]int64, len(*resp.Results))
+	for i, fr := range *resp.Results {
+		if len(fr.GroupByEnc) != 1 || len(fr.AggregatingAttributes) != 1 {
+			return nil, errors.New("result " + strconv.Itoa(i) + " is malformed")
+		}
+		group := lib.DecryptInt(c.private, fr.GroupByEnc[0])
+		if group < 0 || group >= int64(len(*resp.Groups)) {
+			return nil, errors.New("result " + strconv.Itoa(i) + " refers to an unknown group")
+		}
+		groups[i] = (*resp.Groups)[group]
+		// the noise of differential privacy can make a count negative
+		aggr[i] = lib.DecryptIntWithNeg(c.private, fr.AggregatingAttributes[0])
+	}
 	log.LLvl1("Decryption Time:", time.Since(start))
-	groups := *resp.Groups
 
-	return &groups, &aggr, nil
+	return &QueryResult{QueryID: queryID, Groups: groups, Counts: aggr, Contributors: resp.Contributors,
+		Misbehaving: resp.Misbehaving, DifferentialPrivacy: resp.DifferentialPrivacy, Timings: resp.Timings}, nil
+}
+
+// Threshold collective key
+//______________________________________________________________________________________________________________________
+
+// GenerateThresholdKey asks the roster to generate a threshold collective key usable by any threshold servers and
+// returns it serialized. The request is signed with the key of the client, which the servers holding a threshold key
+// only accept from their administrators, with overwrite set.
+func (c *API) GenerateThresholdKey(entities *onet.Roster, threshold int, overwrite bool) (*CollectiveKeyResponse, error) {
+	log.Lvl1(c, " asks for a ", threshold, "-of-", len(entities.List), " collective key")
+	request, err := signKeyRequest(keyGenerationOperation, entities, threshold, overwrite, c.private)
+	if err != nil {
+		return nil, err
+	}
+	resp := CollectiveKeyResponse{}
+	query := DKGQuery{Roster: *entities, Threshold: threshold, Overwrite: overwrite, Request: request}
+	if err := c.SendProtobuf(c.entryPoint, &query, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// RotateCollectiveKey asks the roster to generate a new threshold collective key usable by any threshold servers and
+// to re-encrypt the data stored by every server under it, and returns it serialized. The request is signed with the
+// key of the client, which has to be an administrator of the servers.
+func (c *API) RotateCollectiveKey(entities *onet.Roster, threshold int, timeout time.Duration) (*CollectiveKeyResponse, error) {
+	log.Lvl1(c, " asks for a rotation to a new ", threshold, "-of-", len(entities.List), " collective key")
+	request, err := signKeyRequest(keyRotationOperation, entities, threshold, false, c.private)
+	if err != nil {
+		return nil, err
+	}
+	resp := CollectiveKeyResponse{}
+	query := KeyRotationQuery{Roster: *entities, Threshold: threshold, Timeout: timeout, Request: request}
+	if err := c.SendProtobuf(c.entryPoint, &query, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetCollectiveKey returns the (serialized) threshold collective key of the entry point.
+func (c *API) GetCollectiveKey() (*CollectiveKeyResponse, error) {
+	resp := CollectiveKeyResponse{}
+	if err := c.SendProtobuf(c.entryPoint, &CollectiveKeyQuery{}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// GetServerInfo returns the keys held by the entry point, signed for nonce (see ServerInfoResponse.Verify).
+func (c *API) GetServerInfo(nonce []byte) (*ServerInfoResponse, error) {
+	resp := ServerInfoResponse{}
+	if err := c.SendProtobuf(c.entryPoint, &ServerInfoQuery{Nonce: nonce}, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Roster membership
+//______________________________________________________________________________________________________________________
+
+// AddRmServer asks the entry point, a server of roster, to add its contribution to (or remove it from) the collective
+// key of the encrypted attributes of responses, checks the proofs of the transformation and returns the transformed
+// responses. key is the key under which the responses are encrypted; the request is signed with the key of the
+// client, which has to be the one of a server of roster.
+func (c *API) AddRmServer(roster *onet.Roster, add bool, key abstract.Point, responses []lib.DpResponse) ([]lib.DpResponse, error) {
+	data, err := lib.DpResponsesToBytes(responses)
+	if err != nil {
+		return nil, err
+	}
+	request, err := signAddRmRequest(add, roster, key, data, c.private)
+	if err != nil {
+		return nil, err
+	}
+	resp := AddRmResponse{}
+	query := AddRmQuery{Add: add, Roster: *roster, CollectiveKey: key, Data: data, Request: request}
+	if err := c.SendProtobuf(c.entryPoint, &query, &resp); err != nil {
+		return nil, err
+	}
+	proofs, err := lib.AddRmProofsFromBytes(resp.Proofs)
+	if err != nil {
+		return nil, errors.New("invalid proofs from " + c.entryPoint.String() + ": " + err.Error())
+	}
+	if len(proofs) != 3*len(responses) {
+		return nil, errors.New(c.entryPoint.String() + " sent " + strconv.Itoa(len(proofs)) + " proofs for " +
+			strconv.Itoa(len(responses)) + " responses")
+	}
+
+	// the transformed responses are the ones proven, from the responses that were sent, with the key of the entry point
+	result := make([]lib.DpResponse, len(responses))
+	for i, r := range responses {
+		attributes := []map[string]lib.CipherText{r.AggregatingAttributesEnc, r.GroupByEnc, r.WhereEnc}
+		for j, before := range attributes {
+			prf := proofs[3*i+j]
+			if prf.ToAdd != add || !prf.Krm.Equal(c.entryPoint.Public) || !sameCipherTexts(before, prf.VectBefore) ||
+				!lib.PublishedAddRmCheckProof(prf) {
+				return nil, errors.New("invalid proof from " + c.entryPoint.String() + " for response " + strconv.Itoa(i))
+			}
+		}
+		result[i] = lib.DpResponse{
+			WhereClear:                 r.WhereClear,
+			WhereEnc:                   proofs[3*i+2].VectAfter,
+			GroupByClear:               r.GroupByClear,
+			GroupByEnc:                 proofs[3*i+1].VectAfter,
+			AggregatingAttributesClear: r.AggregatingAttributesClear,
+			AggregatingAttributesEnc:   proofs[3*i].VectAfter,
+		}
+	}
+	return result, nil
+}
+
+// sameCipherTexts checks that two maps hold the same ciphertexts.
+func sameCipherTexts(m1, m2 map[string]lib.CipherText) bool {
+	if len(m1) != len(m2) {
+		return false
+	}
+	for k, v1 := range m1 {
+		v2, ok := m2[k]
+		if !ok || !v1.K.Equal(v2.K) || !v1.C.Equal(v2.C) {
+			return false
+		}
+	}
+	return true
 }
 
 // String permits to have the string representation of a client.
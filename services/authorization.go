@@ -0,0 +1,277 @@
+package serviceI2B2dc
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+)
+
+// KeyRequest is the signature of a key generation or rotation request by an administrator of the servers (see
+// ServerConfig.AuthorizedAdmins), which the root forwards to the other servers, or of a re-keying request by a server
+// of the roster.
+type KeyRequest struct {
+	// Time is when the request was signed (Unix time in seconds)
+	Time      int64
+	Signer    abstract.Point
+	Signature []byte
+}
+
+// operations authorized by a key request
+const (
+	keyGenerationOperation = "key-generation"
+	keyRotationOperation   = "key-rotation"
+	addRmOperation         = "add-rm"
+)
+
+// KeyRequestValidity is how long a key request is accepted after (or before, for clocks ahead) the time it was signed.
+const KeyRequestValidity = 5 * time.Minute
+
+// keyRequestData returns the data signed for a key request: the operation and its parameters, the public keys of the
+// roster and the time of the signature.
+func keyRequestData(operation string, roster *onet.Roster, threshold int, overwrite bool, signed int64) ([]byte, error) {
+	w := lib.NewWireWriter()
+	w.WriteBytes([]byte(operation))
+	w.WriteCount(threshold)
+	w.WriteBytes([]byte(strconv.FormatBool(overwrite)))
+	w.WriteBytes([]byte(strconv.FormatInt(signed, 10)))
+	keys := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		keys[i] = si.Public
+	}
+	if err := w.WritePoints(keys); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// addRmRequestData returns the data signed for a re-keying request: the operation, the roster, the key under which
+// the responses are encrypted, the responses and the time of the signature.
+func addRmRequestData(add bool, roster *onet.Roster, key abstract.Point, data []byte, signed int64) ([]byte, error) {
+	w := lib.NewWireWriter()
+	w.WriteBytes([]byte(addRmOperation))
+	w.WriteBytes([]byte(strconv.FormatBool(add)))
+	w.WriteBytes([]byte(strconv.FormatInt(signed, 10)))
+	keys := make([]abstract.Point, len(roster.List))
+	for i, si := range roster.List {
+		keys[i] = si.Public
+	}
+	if err := w.WritePoints(keys); err != nil {
+		return nil, err
+	}
+	if err := w.WritePoint(key); err != nil {
+		return nil, err
+	}
+	w.WriteBytes(data)
+	return w.Bytes(), nil
+}
+
+// signAddRmRequest signs a re-keying request with the private key of a server of roster.
+func signAddRmRequest(add bool, roster *onet.Roster, key abstract.Point, data []byte, private abstract.Scalar) (KeyRequest, error) {
+	req := KeyRequest{Time: time.Now().Unix(), Signer: lib.CurrentSuite().Point().Mul(nil, private)}
+	signed, err := addRmRequestData(add, roster, key, data, req.Time)
+	if err != nil {
+		return KeyRequest{}, err
+	}
+	req.Signature, err = lib.SchnorrSign(private, signed)
+	return req, err
+}
+
+// signKeyRequest signs a key request for roster with the private key of an administrator.
+func signKeyRequest(operation string, roster *onet.Roster, threshold int, overwrite bool, private abstract.Scalar) (KeyRequest, error) {
+	req := KeyRequest{Time: time.Now().Unix(), Signer: lib.CurrentSuite().Point().Mul(nil, private)}
+	data, err := keyRequestData(operation, roster, threshold, overwrite, req.Time)
+	if err != nil {
+		return KeyRequest{}, err
+	}
+	req.Signature, err = lib.SchnorrSign(private, data)
+	return req, err
+}
+
+// toBytes encodes a key request and the overwrite flag it was signed with, as forwarded by the root.
+func (req *KeyRequest) toBytes(overwrite bool) ([]byte, error) {
+	w := lib.NewWireWriter()
+	w.WriteBytes([]byte(strconv.FormatBool(overwrite)))
+	w.WriteBytes([]byte(strconv.FormatInt(req.Time, 10)))
+	signer := req.Signer
+	if signer == nil {
+		// unsigned request
+		signer = lib.CurrentSuite().Point().Null()
+	}
+	if err := w.WritePoint(signer); err != nil {
+		return nil, err
+	}
+	w.WriteBytes(req.Signature)
+	return w.Bytes(), nil
+}
+
+// keyRequestFromBytes decodes a key request and its overwrite flag encoded by toBytes.
+func keyRequestFromBytes(data []byte) (*KeyRequest, bool, error) {
+	fail := func(err error) (*KeyRequest, bool, error) {
+		return nil, false, errors.New("malformed key request: " + err.Error())
+	}
+	r, err := lib.NewWireReader(data)
+	if err != nil {
+		return fail(err)
+	}
+	flag, err := r.ReadBytes()
+	if err != nil {
+		return fail(err)
+	}
+	overwrite, err := strconv.ParseBool(string(flag))
+	if err != nil {
+		return fail(err)
+	}
+	signed, err := r.ReadBytes()
+	if err != nil {
+		return fail(err)
+	}
+	req := &KeyRequest{}
+	if req.Time, err = strconv.ParseInt(string(signed), 10, 64); err != nil {
+		return fail(err)
+	}
+	if req.Signer, err = r.ReadPoint(); err != nil {
+		return fail(err)
+	}
+	if req.Signature, err = r.ReadBytes(); err != nil {
+		return fail(err)
+	}
+	if err := r.Close(); err != nil {
+		return fail(err)
+	}
+	if len(req.Signature) == 0 {
+		req.Signer = nil
+	}
+	return req, overwrite, nil
+}
+
+// authorizeKeyRequest checks that this server may take part in a key generation or rotation of roster requested by
+// req. Without administrators, a server only takes part in the generation of a first key. Otherwise the request has
+// to be recently signed by one of them (and not be replayed), and a key generation replacing the threshold key of
+// the server has to be explicitly requested with overwrite.
+func (s *Service) authorizeKeyRequest(operation string, roster *onet.Roster, threshold int, overwrite bool, req *KeyRequest) error {
+	if min := thresholds().MinKeyThreshold; threshold < min {
+		return errors.New(s.ServerIdentity().String() + " only generates keys with a threshold of at least " +
+			strconv.Itoa(min))
+	}
+	hasKey := s.ThresholdKey != nil
+	if !hasAdmins() {
+		if operation == keyGenerationOperation && !hasKey {
+			return nil
+		}
+		return errors.New(s.ServerIdentity().String() + " has no authorized administrators, it only takes part in the " +
+			"generation of a first threshold key")
+	}
+
+	if req == nil || req.Signer == nil || len(req.Signature) == 0 {
+		return errors.New("the request is not signed by an administrator of " + s.ServerIdentity().String())
+	}
+	if !authorizedAdmin(req.Signer) {
+		return errors.New("the signer of the request is not an administrator of " + s.ServerIdentity().String())
+	}
+	if err := s.checkKeyRequestTime(req); err != nil {
+		return err
+	}
+	data, err := keyRequestData(operation, roster, threshold, overwrite, req.Time)
+	if err != nil {
+		return err
+	}
+	if err := lib.SchnorrVerify(req.Signer, data, req.Signature); err != nil {
+		return errors.New("the signature of the request is not valid: " + err.Error())
+	}
+	if operation == keyGenerationOperation && hasKey && !overwrite {
+		return errors.New(s.ServerIdentity().String() + " already holds a threshold key, the request has to " +
+			"explicitly overwrite it")
+	}
+	return s.useKeyRequest(req)
+}
+
+// authorizeAddRmQuery checks that a re-keying request concerns a roster this server is part of and that it was
+// recently signed by one of its servers (and is not replayed).
+func (s *Service) authorizeAddRmQuery(arq *AddRmQuery) error {
+	if arq.CollectiveKey == nil {
+		return errors.New("the request does not give the key under which the responses are encrypted")
+	}
+	member, signer := false, false
+	for _, si := range arq.Roster.List {
+		member = member || si.Public.Equal(s.ServerIdentity().Public)
+		signer = signer || (arq.Request.Signer != nil && si.Public.Equal(arq.Request.Signer))
+	}
+	if !member {
+		return errors.New(s.ServerIdentity().String() + " is not part of the roster of the request")
+	}
+	if !signer || len(arq.Request.Signature) == 0 {
+		return errors.New("the request is not signed by a server of the roster")
+	}
+	if err := s.checkKeyRequestTime(&arq.Request); err != nil {
+		return err
+	}
+	data, err := addRmRequestData(arq.Add, &arq.Roster, arq.CollectiveKey, arq.Data, arq.Request.Time)
+	if err != nil {
+		return err
+	}
+	if err := lib.SchnorrVerify(arq.Request.Signer, data, arq.Request.Signature); err != nil {
+		return errors.New("the signature of the request is not valid: " + err.Error())
+	}
+	return s.useKeyRequest(&arq.Request)
+}
+
+// checkKeyRequestTime checks that a request was signed within KeyRequestValidity.
+func (s *Service) checkKeyRequestTime(req *KeyRequest) error {
+	signed := time.Unix(req.Time, 0)
+	if age := time.Since(signed); age > KeyRequestValidity || age < -KeyRequestValidity {
+		return errors.New("the request was signed at " + signed.String() + ", outside the validity of " +
+			KeyRequestValidity.String() + " of " + s.ServerIdentity().String())
+	}
+	return nil
+}
+
+// useKeyRequest records a key request so that it cannot be replayed while it is valid.
+func (s *Service) useKeyRequest(req *KeyRequest) error {
+	s.keyRequestsMutex.Lock()
+	defer s.keyRequestsMutex.Unlock()
+	for signature, signed := range s.usedKeyRequests {
+		if time.Since(signed) > 2*KeyRequestValidity {
+			delete(s.usedKeyRequests, signature)
+		}
+	}
+	if _, ok := s.usedKeyRequests[string(req.Signature)]; ok {
+		return errors.New("the request was already used on " + s.ServerIdentity().String())
+	}
+	s.usedKeyRequests[string(req.Signature)] = time.Unix(req.Time, 0)
+	return nil
+}
+
+// serverInfoData returns the data signed by a server for its description: the nonce of the client and the fields of
+// the response.
+func serverInfoData(nonce []byte, info *ServerInfoResponse) ([]byte, error) {
+	w := lib.NewWireWriter()
+	w.WriteBytes(nonce)
+	if err := w.WritePoint(info.Public); err != nil {
+		return nil, err
+	}
+	w.WriteBytes([]byte(info.Suite))
+	w.WriteBytes([]byte(info.CollectiveKey))
+	w.WriteCount(info.T)
+	w.WriteCount(info.N)
+	return w.Bytes(), nil
+}
+
+// Verify checks that the description was signed for nonce with the private key of info.Public, which proves that the
+// server answering holds it.
+func (info *ServerInfoResponse) Verify(nonce []byte) error {
+	if info.Public == nil {
+		return errors.New("the server did not give its public key")
+	}
+	signed, err := serverInfoData(nonce, info)
+	if err != nil {
+		return err
+	}
+	if err := lib.SchnorrVerify(info.Public, signed, info.Signature); err != nil {
+		return errors.New("the server did not prove it holds the private key of its public key: " + err.Error())
+	}
+	return nil
+}
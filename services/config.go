@@ -0,0 +1,360 @@
+package serviceI2B2dc
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// ServerConfig is the configuration of a server, loaded and validated once when it starts. Its first fields are the
+// ones of the onet configuration (private.toml), so that the same file holds the identity of the conode and the
+// configuration of the service.
+type ServerConfig struct {
+	Public      string
+	Private     string
+	Address     network.Address
+	Description string
+	// AuthorizedQueriers are the (serialized) public keys of the clients allowed to get the results of the queries
+	// sent to this server; any client can query it if there is none
+	AuthorizedQueriers []string
+	// AuthorizedAdmins are the (serialized) public keys of the administrators allowed to request key generations and
+	// rotations; without any, this server only takes part in the generation of a first threshold key
+	AuthorizedAdmins []string
+
+	Database            DatabaseConfig
+	DifferentialPrivacy DifferentialPrivacyConfig
+	Thresholds          ThresholdsConfig
+
+	// path of the configuration and databaseFile, the file the database configuration was read from if it is not in
+	// the Database section
+	path         string
+	databaseFile string
+}
+
+// DifferentialPrivacyConfig sets the noise added by the root server to the aggregated counts, before they are shuffled.
+type DifferentialPrivacyConfig struct {
+	// Epsilon is the privacy budget of a query; no noise is added if it is 0
+	Epsilon float64
+	// Sensitivity is the largest change of a count caused by one patient (1 if 0)
+	Sensitivity float64
+}
+
+// ThresholdsConfig holds the limits this server puts on the queries and keys of the roster.
+type ThresholdsConfig struct {
+	// MinContributors is the smallest number of servers whose data must be in partial results (0 for no limit)
+	MinContributors int
+	// MinKeyThreshold is the smallest number of servers needed to decrypt a threshold collective key generated by this
+	// server (0 for no limit)
+	MinKeyThreshold int
+}
+
+// noiseListSize is the number of values of the discretized Laplace distribution the noise is drawn from.
+const noiseListSize = 10000
+
+// sqlIdentifier and sqlTable match the column and (schema qualified) table names accepted in the database
+// configuration, which are put in the queries as they are.
+var sqlIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var sqlTable = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*\.)?[A-Za-z_][A-Za-z0-9_]*$`)
+
+// databaseDriver is the database/sql driver of the database configurations.
+var databaseDriver = "postgres"
+
+// serverConfig is the configuration given to SetServerConfig and noiseValues the noise drawn from with it.
+var serverConfig *ServerConfig
+var noiseValues []float64
+
+// LoadServerConfig reads the configuration of a server. If it has no Database section, the database configuration is
+// read from DatabaseConfigFile next to it, as written by older setups, or else from the working directory, where older
+// versions read it. Moving it to a Database section of the server configuration makes it independent of both.
+func LoadServerConfig(path string) (*ServerConfig, error) {
+	conf := &ServerConfig{path: path}
+	md, err := toml.DecodeFile(path, conf)
+	if err != nil {
+		return nil, errors.New("invalid server configuration " + path + ": " + err.Error())
+	}
+	if md.IsDefined("Database") {
+		return conf, nil
+	}
+	for _, file := range []string{filepath.Join(filepath.Dir(path), DatabaseConfigFile), DatabaseConfigFile} {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			continue
+		}
+		conf.databaseFile = file
+		if _, err := toml.DecodeFile(file, &conf.Database); err != nil {
+			return nil, errors.New("invalid database configuration " + file + ": " + err.Error())
+		}
+		return conf, nil
+	}
+	// the problems of the empty configuration are reported with the file expected
+	conf.databaseFile = filepath.Join(filepath.Dir(path), DatabaseConfigFile)
+	return conf, nil
+}
+
+// DatabaseSource describes where the database configuration comes from.
+func (conf *ServerConfig) DatabaseSource() string {
+	if conf.databaseFile != "" {
+		return conf.databaseFile
+	}
+	return "the Database section"
+}
+
+// Validate checks the configuration without connecting to anything and returns the problems found.
+func (conf *ServerConfig) Validate() []error {
+	var problems []error
+	problem := func(msg string) {
+		problems = append(problems, errors.New(msg))
+	}
+
+	// identity of the conode
+	public, err := crypto.StringHexToPoint(network.Suite, conf.Public)
+	if err != nil {
+		problem("invalid public key: " + err.Error())
+	}
+	private, err := crypto.StringHexToScalar(network.Suite, conf.Private)
+	if err != nil {
+		problem("invalid private key: " + err.Error())
+	}
+	if public != nil && private != nil && !network.Suite.Point().Mul(nil, private).Equal(public) {
+		problem("the private key does not match the public key")
+	}
+	if !conf.Address.Valid() {
+		problem("invalid address \"" + string(conf.Address) + "\"")
+	}
+
+	for i, q := range conf.AuthorizedQueriers {
+		if _, err := lib.DeserializePoint(q); err != nil {
+			problem("invalid public key of authorized querier " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+	for i, a := range conf.AuthorizedAdmins {
+		if _, err := lib.DeserializePoint(a); err != nil {
+			problem("invalid public key of authorized administrator " + strconv.Itoa(i+1) + ": " + err.Error())
+		}
+	}
+
+	// database
+	dbc := &conf.Database
+	if dbc.Table == "" {
+		problem("no database table (in " + conf.DatabaseSource() + ")")
+	}
+	if dbc.DSN == "" && dbc.DbName == "" {
+		problem("no database name nor DSN (in " + conf.DatabaseSource() + ")")
+	}
+	if dbc.Table != "" && !sqlTable.MatchString(dbc.Table) {
+		problem("invalid table name \"" + dbc.Table + "\"")
+	}
+	for _, name := range dbc.Columns() {
+		if !sqlIdentifier.MatchString(name) {
+			problem("invalid column name \"" + name + "\"")
+		}
+	}
+	databaseFile := conf.databaseFile
+	if databaseFile == "" {
+		databaseFile = conf.path
+	}
+	problems = append(problems, dbc.CheckCredentials(databaseFile)...)
+	if dbc.Port < 0 || dbc.Port > 65535 {
+		problem("invalid database port " + strconv.Itoa(dbc.Port))
+	}
+	if dbc.RangeProofBits < 0 || dbc.RangeProofBits > lib.MaxRangeProofBits {
+		problem("RangeProofBits must be between 0 and " + strconv.Itoa(lib.MaxRangeProofBits))
+	}
+
+	// noise and thresholds
+	if conf.DifferentialPrivacy.Epsilon < 0 {
+		problem("the differential privacy Epsilon cannot be negative")
+	}
+	if conf.DifferentialPrivacy.Sensitivity < 0 {
+		problem("the differential privacy Sensitivity cannot be negative")
+	}
+	if conf.Thresholds.MinContributors < 0 {
+		problem("MinContributors cannot be negative")
+	}
+	if conf.Thresholds.MinKeyThreshold < 0 {
+		problem("MinKeyThreshold cannot be negative")
+	}
+	return problems
+}
+
+// CheckDatabase connects to the database and checks that the table has the columns read by the servers.
+func (conf *ServerConfig) CheckDatabase() error {
+	db, err := conf.Database.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT " + strings.Join(conf.Database.QuotedColumns(), ", ") + " FROM " +
+		conf.Database.Table + " LIMIT 0")
+	if err != nil {
+		return errors.New("cannot read the columns (" + strings.Join(conf.Database.Columns(), ", ") + ") of " +
+			conf.Database.Table + ": " + err.Error())
+	}
+	return rows.Close()
+}
+
+// SetServerConfig makes a validated configuration the one of the services of this process.
+func SetServerConfig(conf *ServerConfig) {
+	serverConfig = conf
+	dbConfig = conf.Database
+	noiseValues = nil
+	if dp := conf.DifferentialPrivacy; dp.Epsilon > 0 {
+		noiseValues = lib.GenerateNoiseValues(noiseListSize, 0, dp.sensitivity()/dp.Epsilon, 1/float64(noiseListSize))
+	}
+}
+
+func (dp DifferentialPrivacyConfig) sensitivity() float64 {
+	if dp.Sensitivity == 0 {
+		return 1
+	}
+	return dp.Sensitivity
+}
+
+// drawNoise returns a value of the noise of the configuration (0 if there is none).
+func drawNoise() (int64, error) {
+	if len(noiseValues) == 0 {
+		return 0, nil
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(noiseValues))))
+	if err != nil {
+		return 0, err
+	}
+	return int64(noiseValues[i.Int64()]), nil
+}
+
+// serverPrivateKey returns the private key of the configuration given to SetServerConfig, which has to be the one of
+// public.
+func serverPrivateKey(public abstract.Point) (abstract.Scalar, error) {
+	if serverConfig == nil {
+		return nil, errors.New("the server has no configuration holding its private key")
+	}
+	private, err := crypto.StringHexToScalar(network.Suite, serverConfig.Private)
+	if err != nil {
+		return nil, errors.New("invalid private key in the server configuration: " + err.Error())
+	}
+	if !network.Suite.Point().Mul(nil, private).Equal(public) {
+		return nil, errors.New("the private key of the server configuration is not the one of " + public.String())
+	}
+	return private, nil
+}
+
+// authorizedQuerier tells whether a client may get the results of a query from this server.
+func authorizedQuerier(client abstract.Point) bool {
+	if serverConfig == nil || len(serverConfig.AuthorizedQueriers) == 0 {
+		return true
+	}
+	if client == nil {
+		return false
+	}
+	for _, q := range serverConfig.AuthorizedQueriers {
+		if key, err := lib.DeserializePoint(q); err == nil && key.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizedAdmin tells whether a key belongs to an administrator of this server.
+func authorizedAdmin(key abstract.Point) bool {
+	if serverConfig == nil || key == nil {
+		return false
+	}
+	for _, a := range serverConfig.AuthorizedAdmins {
+		if admin, err := lib.DeserializePoint(a); err == nil && admin.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAdmins tells whether administrators are configured for this server.
+func hasAdmins() bool {
+	return serverConfig != nil && len(serverConfig.AuthorizedAdmins) > 0
+}
+
+// thresholds returns the limits of the configuration of this process.
+func thresholds() ThresholdsConfig {
+	if serverConfig == nil {
+		return ThresholdsConfig{}
+	}
+	return serverConfig.Thresholds
+}
+
+// DataSourceName returns the connection string of the database (DSN if it is set).
+func (dbc *DatabaseConfig) DataSourceName() string {
+	if dbc.DSN != "" {
+		return dbc.DSN
+	}
+	params := []string{"user", dbc.Username, "password", dbc.Password, "dbname", dbc.DbName, "host", dbc.Host}
+	if dbc.Port != 0 {
+		params = append(params, "port", strconv.Itoa(dbc.Port))
+	}
+	sslMode := dbc.SslMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	params = append(params, "sslmode", sslMode)
+
+	var dsn []string
+	for i := 0; i < len(params); i += 2 {
+		if params[i+1] != "" {
+			value := strings.Replace(strings.Replace(params[i+1], `\`, `\\`, -1), `'`, `\'`, -1)
+			dsn = append(dsn, params[i]+"='"+value+"'")
+		}
+	}
+	return strings.Join(dsn, " ")
+}
+
+// Open opens a connection to the database and checks it.
+func (dbc *DatabaseConfig) Open() (*sql.DB, error) {
+	db, err := sql.Open(databaseDriver, dbc.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.New("could not connect to database " + dbc.DbName + ": " + err.Error())
+	}
+	return db, nil
+}
+
+// column returns the name of a column of the table, or its default one.
+func column(name, defaultName string) string {
+	if name != "" {
+		return name
+	}
+	return defaultName
+}
+
+// Columns returns the columns read by the servers, in order: location, time, concept, encrypted count and (with range
+// proofs) range proof.
+func (dbc *DatabaseConfig) Columns() []string {
+	count := column(dbc.CountColumn, "totalnum")
+	columns := []string{column(dbc.LocationColumn, "location_cd"), column(dbc.TimeColumn, "time"),
+		column(dbc.ConceptColumn, "concept_cd"), count}
+	if dbc.RangeProofBits > 0 {
+		columns = append(columns, column(dbc.RangeProofColumn, count+"_range_proof"))
+	}
+	return columns
+}
+
+// QuotedColumns returns the columns of the table quoted for the queries (time is a keyword).
+func (dbc *DatabaseConfig) QuotedColumns() []string {
+	columns := dbc.Columns()
+	for i, c := range columns {
+		columns[i] = `"` + c + `"`
+	}
+	return columns
+}
@@ -0,0 +1,230 @@
+package serviceI2B2dc
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/config"
+	"gopkg.in/dedis/onet.v1/crypto"
+	"gopkg.in/dedis/onet.v1/network"
+)
+
+// newTestServerConfig returns a valid server configuration with a new key pair.
+func newTestServerConfig(t *testing.T) *ServerConfig {
+	kp := config.NewKeyPair(network.Suite)
+	public, err := crypto.PointToStringHex(network.Suite, kp.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := crypto.ScalarToStringHex(network.Suite, kp.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ServerConfig{Public: public, Private: private, Address: network.NewTCPAddress("127.0.0.1:2000"),
+		Database: DatabaseConfig{DbName: "i2b2demodata", Table: "public.demo_data_encrypted"}}
+}
+
+func TestServerConfigValidate(t *testing.T) {
+	assert.Empty(t, newTestServerConfig(t).Validate())
+
+	_, otherKey := lib.GenKey()
+	other, err := crypto.PointToStringHex(network.Suite, otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := map[string]func(conf *ServerConfig){
+		"invalid public key":                           func(conf *ServerConfig) { conf.Public = "zz" },
+		"invalid private key":                          func(conf *ServerConfig) { conf.Private = "zz" },
+		"the private key does not match":               func(conf *ServerConfig) { conf.Public = other },
+		"invalid public key of authorized querier 1":   func(conf *ServerConfig) { conf.AuthorizedQueriers = []string{"zz"} },
+		"invalid public key of authorized administrat": func(conf *ServerConfig) { conf.AuthorizedAdmins = []string{"zz"} },
+		"no database table":                            func(conf *ServerConfig) { conf.Database.Table = "" },
+		"no database name nor DSN":                     func(conf *ServerConfig) { conf.Database.DbName = "" },
+		"invalid table name":                           func(conf *ServerConfig) { conf.Database.Table = "t; DROP TABLE t" },
+		"invalid column name":                          func(conf *ServerConfig) { conf.Database.CountColumn = `c"` },
+		"invalid database port":                        func(conf *ServerConfig) { conf.Database.Port = 70000 },
+		"RangeProofBits must be between":               func(conf *ServerConfig) { conf.Database.RangeProofBits = -1 },
+		"Epsilon cannot be negative":                   func(conf *ServerConfig) { conf.DifferentialPrivacy.Epsilon = -1 },
+		"Sensitivity cannot be negative":               func(conf *ServerConfig) { conf.DifferentialPrivacy.Sensitivity = -1 },
+		"MinContributors cannot be negative":           func(conf *ServerConfig) { conf.Thresholds.MinContributors = -1 },
+		"MinKeyThreshold cannot be negative":           func(conf *ServerConfig) { conf.Thresholds.MinKeyThreshold = -1 },
+	}
+	for problem, change := range invalid {
+		conf := newTestServerConfig(t)
+		change(conf)
+		problems := conf.Validate()
+		if assert.Len(t, problems, 1, problem) {
+			assert.Contains(t, problems[0].Error(), problem)
+		}
+	}
+}
+
+func TestLoadServerConfigDatabaseFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverDir := filepath.Join(dir, "server")
+	if err := os.Mkdir(serverDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(serverDir, "private.toml")
+	if err := ioutil.WriteFile(path, []byte("Address = \"tcp://127.0.0.1:2000\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// db.toml is read from the working directory, as by older versions, unless it is next to the configuration
+	if err := ioutil.WriteFile(DatabaseConfigFile, []byte("Table = \"working_directory\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadServerConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "working_directory", conf.Database.Table)
+		assert.Equal(t, DatabaseConfigFile, conf.DatabaseSource())
+	}
+
+	next := filepath.Join(serverDir, DatabaseConfigFile)
+	if err := ioutil.WriteFile(next, []byte("Table = \"next\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err = LoadServerConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "next", conf.Database.Table)
+		assert.Equal(t, next, conf.DatabaseSource())
+	}
+
+	// a Database section replaces both
+	if err := ioutil.WriteFile(path, []byte("[Database]\nTable = \"section\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf, err = LoadServerConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "section", conf.Database.Table)
+		assert.Equal(t, "the Database section", conf.DatabaseSource())
+	}
+}
+
+func TestDataSourceName(t *testing.T) {
+	dbc := DatabaseConfig{Username: "i2b2", Password: `it's a \secret`, DbName: "i2b2demodata", Port: 5432}
+	assert.Equal(t, `user='i2b2' password='it\'s a \\secret' dbname='i2b2demodata' port='5432' sslmode='disable'`,
+		dbc.DataSourceName())
+
+	// a password cannot add parameters to the connection string
+	dbc = DatabaseConfig{Password: "x' host='attacker", SslMode: "require"}
+	assert.Equal(t, `password='x\' host=\'attacker' sslmode='require'`, dbc.DataSourceName())
+
+	dbc.DSN = "postgres://localhost/i2b2demodata"
+	assert.Equal(t, dbc.DSN, dbc.DataSourceName())
+}
+
+func TestAuthorizedQuerier(t *testing.T) {
+	defer func(conf *ServerConfig) { serverConfig = conf }(serverConfig)
+	_, querier := lib.GenKey()
+	_, other := lib.GenKey()
+
+	// without a list, anyone can query
+	serverConfig = nil
+	assert.True(t, authorizedQuerier(other))
+	serverConfig = &ServerConfig{}
+	assert.True(t, authorizedQuerier(other))
+
+	key, err := lib.SerializePoint(querier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig = &ServerConfig{AuthorizedQueriers: []string{"invalid", key}}
+	assert.True(t, authorizedQuerier(querier))
+	assert.False(t, authorizedQuerier(other))
+	assert.False(t, authorizedQuerier(nil))
+}
+
+// testTableColumns are the columns of the tables of the testdb driver.
+var testTableColumns = []string{"location_cd", "time", "concept_cd", "totalnum"}
+
+var registerTestDriver sync.Once
+
+// testDriver is a database/sql driver whose tables have testTableColumns; the databases named "unreachable" cannot
+// be connected to.
+type testDriver struct{}
+
+func (testDriver) Open(name string) (driver.Conn, error) {
+	if name == "dbname='unreachable' sslmode='disable'" {
+		return nil, errors.New("connection refused")
+	}
+	return testConn{}, nil
+}
+
+type testConn struct{}
+
+func (testConn) Prepare(query string) (driver.Stmt, error) { return testStmt(query), nil }
+func (testConn) Close() error                              { return nil }
+func (testConn) Begin() (driver.Tx, error)                 { return nil, errors.New("no transactions") }
+
+type testStmt string
+
+func (testStmt) Close() error                                    { return nil }
+func (testStmt) NumInput() int                                   { return -1 }
+func (testStmt) Exec(args []driver.Value) (driver.Result, error) { return nil, errors.New("read only") }
+
+// Query answers the queries of the columns of a table.
+func (s testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns := strings.Split(strings.TrimPrefix(strings.SplitN(string(s), " FROM ", 2)[0], "SELECT "), ", ")
+	for _, c := range columns {
+		found := false
+		for _, tc := range testTableColumns {
+			found = found || c == `"`+tc+`"`
+		}
+		if !found {
+			return nil, errors.New("column " + c + " does not exist")
+		}
+	}
+	return testRows(columns), nil
+}
+
+type testRows []string
+
+func (r testRows) Columns() []string            { return r }
+func (testRows) Close() error                   { return nil }
+func (testRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestCheckDatabase(t *testing.T) {
+	registerTestDriver.Do(func() { sql.Register("testdb", testDriver{}) })
+	defer func(name string) { databaseDriver = name }(databaseDriver)
+	databaseDriver = "testdb"
+
+	conf := &ServerConfig{Database: DatabaseConfig{DbName: "i2b2demodata", Table: "demo_data_encrypted"}}
+	assert.NoError(t, conf.CheckDatabase())
+
+	// the range proofs column is missing
+	conf.Database.RangeProofBits = 16
+	err := conf.CheckDatabase()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot read the columns")
+		assert.Contains(t, err.Error(), "totalnum_range_proof")
+	}
+
+	conf.Database = DatabaseConfig{DbName: "unreachable", Table: "demo_data_encrypted"}
+	err = conf.CheckDatabase()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "could not connect to database unreachable")
+	}
+}
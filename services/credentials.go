@@ -0,0 +1,176 @@
+package serviceI2B2dc
+
+import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+)
+
+// passwordAD is authenticated with the encrypted database passwords, so that another secret sealed with the same
+// passphrase cannot be used as one.
+const passwordAD = "i2b2dc database password"
+
+// LoadDatabaseConfig reads a database configuration file (like db.toml) or the Database section of a server
+// configuration, and checks its credentials (see CheckCredentials).
+func LoadDatabaseConfig(path string) (*DatabaseConfig, error) {
+	dbc := DatabaseConfig{}
+	md, err := toml.DecodeFile(path, &dbc)
+	if err == nil && md.IsDefined("Database") {
+		conf := ServerConfig{}
+		_, err = toml.DecodeFile(path, &conf)
+		dbc = conf.Database
+	}
+	if err != nil {
+		return nil, errors.New("invalid database configuration " + path + ": " + err.Error())
+	}
+	if problems := dbc.CheckCredentials(path); len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return &dbc, nil
+}
+
+// CheckCredentials returns the problems of the credentials of a database configuration read from path: more than one
+// source for the password (a DSN replaces all the others), a missing environment variable, a password file (or a
+// configuration holding the password, or a DSN with one) readable by all users, or an invalid encrypted password.
+func (dbc *DatabaseConfig) CheckCredentials(path string) []error {
+	var problems []error
+	sources := 0
+	for _, s := range []string{dbc.DSN, dbc.Password, dbc.PasswordEnv, dbc.PasswordFile, dbc.EncryptedPassword} {
+		if s != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		problems = append(problems, errors.New("only one of DSN, Password, PasswordEnv, PasswordFile and "+
+			"EncryptedPassword can be set (in "+path+")"))
+	}
+
+	if dbc.Password != "" || dsnHasPassword(dbc.DSN) {
+		if err := checkNotWorldReadable(path); err != nil {
+			problems = append(problems, errors.New(err.Error()+": move the password to PasswordFile, PasswordEnv "+
+				"or EncryptedPassword, or restrict the permissions of the file"))
+		}
+	}
+	for _, name := range []string{dbc.UsernameEnv, dbc.PasswordEnv} {
+		if _, ok := os.LookupEnv(name); name != "" && !ok {
+			problems = append(problems, errors.New("environment variable "+name+" is not set"))
+		}
+	}
+	if dbc.PasswordFile != "" {
+		if err := checkNotWorldReadable(dbc.PasswordFile); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	if dbc.EncryptedPassword != "" {
+		if _, _, _, err := splitEncryptedPassword(dbc.EncryptedPassword); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	return problems
+}
+
+// dsnHasPassword tells whether a connection string, a URL or key=value pairs, holds a password.
+func dsnHasPassword(dsn string) bool {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		if u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return true
+			}
+		}
+		return u.Query().Get("password") != ""
+	}
+	for _, field := range strings.Fields(dsn) {
+		if strings.HasPrefix(field, "password") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNotWorldReadable returns an error if a credentials file cannot be read or can be read by all users.
+func checkNotWorldReadable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0007 != 0 {
+		return errors.New(path + " holds credentials but is accessible to all users (" + info.Mode().Perm().String() +
+			")")
+	}
+	return nil
+}
+
+// ResolveCredentials sets the username and password from their environment variables, the password file or the
+// encrypted password, whose passphrase is asked to passphrase. It has to be called before the database is opened.
+func (dbc *DatabaseConfig) ResolveCredentials(passphrase func() (string, error)) error {
+	if dbc.UsernameEnv != "" {
+		dbc.Username = os.Getenv(dbc.UsernameEnv)
+	}
+
+	switch {
+	case dbc.PasswordEnv != "":
+		password, ok := os.LookupEnv(dbc.PasswordEnv)
+		if !ok {
+			return errors.New("environment variable " + dbc.PasswordEnv + " is not set")
+		}
+		dbc.Password = password
+
+	case dbc.PasswordFile != "":
+		if err := checkNotWorldReadable(dbc.PasswordFile); err != nil {
+			return err
+		}
+		password, err := ioutil.ReadFile(dbc.PasswordFile)
+		if err != nil {
+			return err
+		}
+		dbc.Password = strings.TrimRight(string(password), "\r\n")
+
+	case dbc.EncryptedPassword != "":
+		sealed, salt, nonce, err := splitEncryptedPassword(dbc.EncryptedPassword)
+		if err != nil {
+			return err
+		}
+		p, err := passphrase()
+		if err != nil {
+			return err
+		}
+		password, err := lib.OpenWithPassphrase(p, sealed, salt, nonce, []byte(passwordAD))
+		if err != nil {
+			return errors.New("cannot decrypt the database password: " + err.Error())
+		}
+		dbc.Password = string(password)
+	}
+	return nil
+}
+
+// EncryptPassword returns the EncryptedPassword of a database configuration: the password sealed with a passphrase,
+// followed by the salt and nonce of the encryption.
+func EncryptPassword(password, passphrase string) (string, error) {
+	sealed, salt, nonce, err := lib.SealWithPassphrase(passphrase, []byte(password), []byte(passwordAD))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed) + ":" + base64.StdEncoding.EncodeToString(salt) + ":" +
+		base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// splitEncryptedPassword decodes the parts of an EncryptedPassword.
+func splitEncryptedPassword(encrypted string) (sealed, salt, nonce []byte, err error) {
+	parts := strings.Split(encrypted, ":")
+	if len(parts) != 3 {
+		return nil, nil, nil, errors.New("invalid EncryptedPassword (see server encrypt-password)")
+	}
+	decoded := make([][]byte, len(parts))
+	for i, p := range parts {
+		if decoded[i], err = base64.StdEncoding.DecodeString(p); err != nil {
+			return nil, nil, nil, errors.New("invalid EncryptedPassword (see server encrypt-password): " + err.Error())
+		}
+	}
+	return decoded[0], decoded[1], decoded[2], nil
+}
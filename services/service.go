@@ -2,7 +2,12 @@ package serviceI2B2dc
 
 import (
 	"database/sql"
-
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -28,6 +33,19 @@ type CreationQueryDC struct {
 	QueryID      QueryID
 	Roster       onet.Roster
 	ClientPubKey abstract.Point
+	// Suite is the name of the cipher suite used by the roster for keys and ciphertexts
+	Suite string
+
+	// Timeouts are the deadlines of the protocols run for the query
+	Timeouts ProtocolTimeouts
+	// KeySwitchingChunkSize is the number of results sent in one message during the key switching (0 means no chunks)
+	KeySwitchingChunkSize int
+	// ParallelKeySwitching makes all servers switch the results at the same time instead of one after the other (it
+	// cannot be used by servers holding a threshold key, which always use the threshold key switching)
+	ParallelKeySwitching bool
+	// PartialResults makes the query go on with the servers which sent their data before Timeouts.Aggregation. The
+	// key switching then only completes without the others if the servers hold a threshold key.
+	PartialResults bool
 
 	// query statement
 	Locations []string
@@ -36,6 +54,82 @@ type CreationQueryDC struct {
 	GroupBy   []string
 }
 
+// ProtocolTimeouts contains the time given to each protocol to complete (0 means protocols.DefaultCircuitTimeout).
+type ProtocolTimeouts struct {
+	Aggregation  time.Duration
+	KeySwitching time.Duration
+	Shuffling    time.Duration
+}
+
+// DKGQuery asks the roster to generate a threshold collective key usable by any Threshold servers. The servers which
+// already hold a threshold key only replace it if Overwrite is set and the request is signed by an administrator.
+type DKGQuery struct {
+	Roster    onet.Roster
+	Threshold int
+	Overwrite bool
+	Request   KeyRequest
+}
+
+// KeyRotationQuery asks the roster to generate a new threshold collective key and to re-encrypt the data stored by
+// every server under it. The servers keep using the current key if any of them cannot rotate its data. The request has
+// to be signed by an administrator of the servers.
+type KeyRotationQuery struct {
+	Roster    onet.Roster
+	Threshold int
+	// Timeout is the time given to all servers to re-encrypt their data (0 means protocols.DefaultCircuitTimeout)
+	Timeout time.Duration
+	Request KeyRequest
+}
+
+// CollectiveKeyQuery asks a server for the threshold collective key it holds a share of.
+type CollectiveKeyQuery struct{}
+
+// CollectiveKeyResponse contains a (serialized) threshold collective key and its parameters.
+type CollectiveKeyResponse struct {
+	CollectiveKey string
+	T             int
+	N             int
+}
+
+// ServerInfoQuery asks a server for the keys it actually holds. The server signs its answer with the Nonce chosen by
+// the client.
+type ServerInfoQuery struct {
+	Nonce []byte
+}
+
+// ServerInfoResponse describes the keys of a server: its public key (to compare with the one of the group file), the
+// suite of its ciphertexts and the threshold collective key it holds a share of, if any (CollectiveKey is empty
+// otherwise). It is signed with the private key of the server (see Verify).
+type ServerInfoResponse struct {
+	Public        abstract.Point
+	Suite         string
+	CollectiveKey string
+	T             int
+	N             int
+	Signature     []byte
+}
+
+// AddRmQuery asks a server to add its contribution to (or remove it from) the collective key under which responses
+// are encrypted. The server only accepts it while its operator opened a re-keying window (see RekeyFile), if it is
+// signed by a server of Roster.
+type AddRmQuery struct {
+	Add bool
+	// Roster is the roster the server joins (or leaves)
+	Roster onet.Roster
+	// CollectiveKey is the key under which the responses are encrypted
+	CollectiveKey abstract.Point
+	// Data are the wire-encoded responses (lib.DpResponsesToBytes)
+	Data []byte
+	// Request is the signature of the query by a server of Roster
+	Request KeyRequest
+}
+
+// AddRmResponse contains the wire-encoded proofs of the transformation (lib.AddRmProofsToBytes), three per response,
+// from which the transformed responses are read.
+type AddRmResponse struct {
+	Proofs []byte
+}
+
 // MsgTypes defines the Message Type ID for all the service's intra-messages.
 type MsgTypes struct {
 	msgCreationQueryDC network.MessageTypeID
@@ -56,26 +150,179 @@ type ServiceState struct {
 
 // DatabaseConfig represents the configuration of the database
 type DatabaseConfig struct {
+	// DSN is the connection string of the database; the other connection fields are ignored if it is set, and it
+	// cannot be combined with another source of the password
+	DSN      string
+	Host     string
+	Port     int
+	SslMode  string
 	Username string
 	Password string
-	DbName   string
-	Table    string
+	// the username and password can instead be read from environment variables, the password from a file (which
+	// must not be readable by all users) or decrypted with a passphrase asked when the server starts (see
+	// ResolveCredentials)
+	UsernameEnv       string
+	PasswordEnv       string
+	PasswordFile      string
+	EncryptedPassword string
+	DbName            string
+	Table             string
+	// RangeProofBits is the size (in bits) of the range proven for each encrypted count; when it is > 0, the table
+	// has an additional column holding the range proofs and they are all checked before aggregation.
+	RangeProofBits int
+	// CountColumn is the column holding the encrypted counts (totalnum if empty)
+	CountColumn string
+	// columns of the groups (location_cd, time and concept_cd if empty) and of the range proofs
+	// (<CountColumn>_range_proof if empty)
+	LocationColumn   string
+	TimeColumn       string
+	ConceptColumn    string
+	RangeProofColumn string
 }
 
 // ServiceResult will contain final results of a query and be sent to querier.
 type ServiceResult struct {
 	Results *[]lib.FilteredResponse
 	Groups  *[]string
+	// Contributors are the servers whose data is in the results
+	Contributors []*network.ServerIdentity
+	// Misbehaving are the servers whose contribution to the aggregation was found wrong
+	Misbehaving []protocols.Misbehavior
+	// DifferentialPrivacy is the configuration of the noise added to the counts (Epsilon is 0 if there is none)
+	DifferentialPrivacy DifferentialPrivacyConfig
+	Timings             PhaseTimings
+}
+
+// PhaseTimings contains the time spent by the server answering the client in each phase of a query.
+type PhaseTimings struct {
+	SQL                   time.Duration
+	LocalAggregation      time.Duration
+	CollectiveAggregation time.Duration
+	Shuffling             time.Duration
+	KeySwitching          time.Duration
 }
 
-//TODO: use concurrent map to deal with multiple clients
 // Service defines a service in i2b2dc.
 type Service struct {
 	*onet.ServiceProcessor
+	// queries received by this server and not answered yet, by ID
+	queries      map[QueryID]*queryState
+	queriesMutex sync.Mutex
+	// ThresholdKey is the share of the threshold collective key held by this server (nil if there is none)
+	ThresholdKey *lib.ThresholdKey
+	// key generations started by this server, by configuration data of their protocol
+	keyGenerations      map[string]*keyGeneration
+	keyGenerationsMutex sync.Mutex
+	// signatures of the key requests received recently (see useKeyRequest)
+	usedKeyRequests  map[string]time.Time
+	keyRequestsMutex sync.Mutex
+	// re-keyings run by this server, by configuration data of their protocol
+	addRms      map[string]*addRm
+	addRmsMutex sync.Mutex
+	// key rotations this server takes part in, by configuration data of their protocols
+	rotations      map[string]*keyRotation
+	rotationsMutex sync.Mutex
+}
+
+// queryState holds a query and its results while the servers run it.
+type queryState struct {
 	Query                        CreationQueryDC
 	AggregatedResults            []lib.FilteredResponse
 	KeySwitchedAggregatedResults []lib.FilteredResponse
 	Groups                       []string
+	Contributors                 []*network.ServerIdentity
+	Misbehaving                  []protocols.Misbehavior
+	DifferentialPrivacy          DifferentialPrivacyConfig
+	Timings                      PhaseTimings
+	// local data of this server, aggregated with the one of the others, its rows and their range proofs (proving the
+	// aggregation to the parent of this server)
+	groupedData *map[lib.GroupingKey]lib.FilteredResponse
+	localData   []lib.FilteredResponseDet
+	rangeProofs [][]lib.RangeProof
+}
+
+// keyGeneration holds the parameters of a key generation started by this server, given to its protocol.
+type keyGeneration struct {
+	threshold int
+	// request is the encoded key request forwarded to the other servers
+	request []byte
+}
+
+// addRm holds the responses transformed by a run of the add/rm server protocol.
+type addRm struct {
+	target []lib.DpResponse
+	add    bool
+}
+
+// keyRotation holds the state of a key rotation on a server: the share of the new collective key and the counts of
+// its database re-encrypted under it until the rotation is committed (the table stays locked meanwhile). Once
+// committed, the previous counts and share are kept until the rotation ends, to be restored if another server could
+// not commit.
+type keyRotation struct {
+	// new collective key and time given to the servers (set at the root)
+	newKey  abstract.Point
+	timeout time.Duration
+	// shares of the new collective keys generated for the rotation
+	keys    chan *lib.ThresholdKey
+	created time.Time
+	// active is set once the rotation is prepared on this server
+	active bool
+
+	key     *lib.ThresholdKey
+	db      *sql.DB
+	tx      *sql.Tx
+	update  *sql.Stmt
+	ctids   []string
+	target  []lib.FilteredResponse
+	rotated []lib.FilteredResponse
+
+	// committed is set once the counts are replaced, updated are the ctids of their rows and previous the share
+	// replaced (nil if there was none)
+	committed bool
+	updated   []string
+	previous  *lib.ThresholdKey
+}
+
+// DatabaseConfigFile is the configuration of the database of the servers whose configuration has no Database section
+// (see LoadServerConfig): it is read next to their configuration, or from the working directory as by older versions.
+// Services started without a configuration read it from the working directory.
+const DatabaseConfigFile = "db.toml"
+
+// ThresholdKeyFile is the file in which a server stores its share of the threshold collective key.
+const ThresholdKeyFile = "dkg.toml"
+
+// rotatedKeyFile holds the share of the new collective key while a key rotation is committed.
+const rotatedKeyFile = ThresholdKeyFile + ".new"
+
+// keyGenerationConfig prefixes the configuration data of the key generations (followed by an identifier of the run).
+const keyGenerationConfig = "key-generation:"
+
+// addRmConfig prefixes the configuration data of the re-keyings (followed by an identifier of the run).
+const addRmConfig = "add-rm:"
+
+// keyRotationConfig prefixes the configuration data of the protocols run for a key rotation (followed by an
+// identifier of the rotation).
+const keyRotationConfig = "key-rotation:"
+
+// RekeyFile is the file in which the operator of a server opens a window during which the server adds its
+// contribution to (or removes it from) the collective key of the data sent to it.
+const RekeyFile = "rekey.toml"
+
+// RekeyWindow is the content of RekeyFile.
+type RekeyWindow struct {
+	Add     bool
+	Expires time.Time
+}
+
+// thresholdKeyToml is the content of ThresholdKeyFile.
+type thresholdKeyToml struct {
+	Suite         string
+	Index         int
+	T             int
+	N             int
+	Share         string
+	CollectiveKey string
+	PublicShares  []string
 }
 
 var msgTypes = MsgTypes{}
@@ -89,12 +336,25 @@ func init() {
 
 	network.RegisterMessage(&ServiceState{})
 	network.RegisterMessage(&ServiceResult{})
+	network.RegisterMessage(&DKGQuery{})
+	network.RegisterMessage(&KeyRotationQuery{})
+	network.RegisterMessage(&CollectiveKeyQuery{})
+	network.RegisterMessage(&CollectiveKeyResponse{})
+	network.RegisterMessage(&AddRmQuery{})
+	network.RegisterMessage(&AddRmResponse{})
+	network.RegisterMessage(&ServerInfoQuery{})
+	network.RegisterMessage(&ServerInfoResponse{})
 }
 
 // NewService constructor which registers the needed messages.
 func NewService(c *onet.Context) onet.Service {
 	newServiceInstance := &Service{
 		ServiceProcessor: onet.NewServiceProcessor(c),
+		queries:          make(map[QueryID]*queryState),
+		keyGenerations:   make(map[string]*keyGeneration),
+		addRms:           make(map[string]*addRm),
+		usedKeyRequests:  make(map[string]time.Time),
+		rotations:        make(map[string]*keyRotation),
 	}
 	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleCreationQueryDC); cerr != nil {
 		log.Fatal("Wrong Handler.", cerr)
@@ -102,6 +362,34 @@ func NewService(c *onet.Context) onet.Service {
 	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleResultsQueryDC); cerr != nil {
 		log.Fatal("Wrong Handler.", cerr)
 	}
+	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleDKGQuery); cerr != nil {
+		log.Fatal("Wrong Handler.", cerr)
+	}
+	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleKeyRotationQuery); cerr != nil {
+		log.Fatal("Wrong Handler.", cerr)
+	}
+	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleCollectiveKeyQuery); cerr != nil {
+		log.Fatal("Wrong Handler.", cerr)
+	}
+	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleAddRmQuery); cerr != nil {
+		log.Fatal("Wrong Handler.", cerr)
+	}
+	if cerr := newServiceInstance.RegisterHandler(newServiceInstance.HandleServerInfoQuery); cerr != nil {
+		log.Fatal("Wrong Handler.", cerr)
+	}
+
+	// without a server configuration (e.g. in simulations), the database configuration of the working directory is used
+	if serverConfig == nil {
+		if _, err := toml.DecodeFile(DatabaseConfigFile, &dbConfig); err != nil {
+			log.Error("No database configuration: ", err)
+		}
+	}
+
+	tk, err := loadThresholdKey(ThresholdKeyFile)
+	if err != nil {
+		log.Error("Ignoring threshold key share: ", err)
+	}
+	newServiceInstance.ThresholdKey = tk
 
 	c.RegisterProcessor(newServiceInstance, msgTypes.msgCreationQueryDC)
 	c.RegisterProcessor(newServiceInstance, msgTypes.msgResultsQueryDC)
@@ -126,25 +414,52 @@ func (s *Service) Process(msg *network.Envelope) {
 func (s *Service) HandleCreationQueryDC(recq *CreationQueryDC) (network.Message, onet.ClientError) {
 	log.Lvl1(s.ServerIdentity().String(), " receives a Query Creation Request")
 
+	// the servers' secret contributions only exist in the suite of this server
+	if recq.Suite != "" && recq.Suite != lib.CurrentSuite().String() {
+		return nil, onet.NewClientError(errors.New("query uses suite " + recq.Suite + " but server " +
+			s.ServerIdentity().String() + " uses " + lib.CurrentSuite().String()))
+	}
+
 	// if this server is the one receiving the query from the client
 	if recq.QueryID == "" {
+		if recq.ParallelKeySwitching && s.ThresholdKey != nil {
+			return nil, onet.NewClientError(errors.New(s.ServerIdentity().String() + " holds a threshold key, the " +
+				"results are switched by any " + strconv.Itoa(s.ThresholdKey.T) + " servers and the parallel key " +
+				"switching cannot be used"))
+		}
 		u, _ := uuid.NewV4()
 		newID := QueryID(u.String())
 		recq.QueryID = newID
 		//TODO: add checks on input to avoid SQL injections (regex)
 
+		// the other servers aggregate their own data for the query
+		for _, si := range recq.Roster.List {
+			if si.Equal(s.ServerIdentity()) {
+				continue
+			}
+			if err := s.SendRaw(si, recq); err != nil {
+				if !recq.PartialResults {
+					return nil, onet.NewClientError(errors.New("couldn't send query to " + si.String() + ": " + err.Error()))
+				}
+				log.Error(s.ServerIdentity(), " couldn't send query to ", si, " (going on without it): ", err)
+			}
+		}
+
 		log.Lvl1(s.ServerIdentity().String(), " sends back confirmation to the client for query with ID: ", recq.QueryID)
 
 	}
 
-	// save the input query in the current service
-	s.Query = *recq
-	// initialize results containers
-	s.AggregatedResults = make([]lib.FilteredResponse, 0, 0)
-	s.KeySwitchedAggregatedResults = make([]lib.FilteredResponse, 0, 0)
-	s.Groups = make([]string, 0, 0)
+	// save the input query in the current service and initialize its results containers
+	s.queriesMutex.Lock()
+	s.queries[recq.QueryID] = &queryState{
+		Query:                        *recq,
+		AggregatedResults:            make([]lib.FilteredResponse, 0, 0),
+		KeySwitchedAggregatedResults: make([]lib.FilteredResponse, 0, 0),
+		Groups:                       make([]string, 0, 0),
+	}
+	s.queriesMutex.Unlock()
 
-	return &ServiceState{s.Query.QueryID}, nil
+	return &ServiceState{recq.QueryID}, nil
 }
 
 // HandleSurveyResultsQuery handles the survey result query by the surveyor.
@@ -152,14 +467,240 @@ func (s *Service) HandleResultsQueryDC(resq *ResultsQueryDC) (network.Message, o
 
 	log.Lvl1(s.ServerIdentity(), " receives an execution request for query with ID: ", resq.QueryID)
 
-	s.Query.ClientPubKey = resq.ClientPublic
+	q, err := s.query(resq.QueryID)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	defer s.forgetQuery(resq.QueryID)
+	if !authorizedQuerier(resq.ClientPublic) {
+		return nil, onet.NewClientError(errors.New("the client is not authorized to query " +
+			s.ServerIdentity().String()))
+	}
+	q.Query.ClientPubKey = resq.ClientPublic
 
-	s.StartService(resq.QueryID, true)
+	if err := s.StartService(resq.QueryID, true); err != nil {
+		log.Error(s.ServerIdentity(), " could not run query ", resq.QueryID, ": ", err)
+		return nil, onet.NewClientError(err)
+	}
 
 	log.Lvl1(s.ServerIdentity(), " sends result back to the client")
 
-	return &ServiceResult{Results: &s.KeySwitchedAggregatedResults, Groups: &s.Groups}, nil
+	return &ServiceResult{Results: &q.KeySwitchedAggregatedResults, Groups: &q.Groups, Contributors: q.Contributors,
+		Misbehaving: q.Misbehaving, DifferentialPrivacy: q.DifferentialPrivacy, Timings: q.Timings}, nil
+
+}
+
+// query returns the state of the query with the given ID.
+func (s *Service) query(id QueryID) (*queryState, error) {
+	s.queriesMutex.Lock()
+	defer s.queriesMutex.Unlock()
+	q, ok := s.queries[id]
+	if !ok {
+		return nil, errors.New(s.ServerIdentity().String() + " has no query " + string(id))
+	}
+	return q, nil
+}
+
+// forgetQuery drops the state of the query with the given ID.
+func (s *Service) forgetQuery(id QueryID) {
+	s.queriesMutex.Lock()
+	defer s.queriesMutex.Unlock()
+	delete(s.queries, id)
+}
+
+// HandleDKGQuery runs a distributed key generation with the servers of the roster (this server being the root) and
+// returns the new threshold collective key.
+func (s *Service) HandleDKGQuery(dq *DKGQuery) (network.Message, onet.ClientError) {
+	log.Lvl1(s.ServerIdentity(), " receives a key generation request (threshold ", dq.Threshold, ")")
+
+	if dq.Threshold < 1 || dq.Threshold > len(dq.Roster.List) {
+		return nil, onet.NewClientError(errors.New("threshold must be between 1 and the number of servers (" +
+			strconv.Itoa(len(dq.Roster.List)) + ")"))
+	}
+	if err := s.authorizeKeyRequest(keyGenerationOperation, &dq.Roster, dq.Threshold, dq.Overwrite, &dq.Request); err != nil {
+		log.Error(s.ServerIdentity(), " refuses the key generation: ", err)
+		return nil, onet.NewClientError(err)
+	}
+	request, err := dq.Request.toBytes(dq.Overwrite)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	config := keyGenerationConfig + u.String()
+	s.startKeyGeneration(config, &keyGeneration{threshold: dq.Threshold, request: request})
+	defer s.endKeyGeneration(config)
+	pi, err := s.startProtocolWithConfig(protocols.DKGProtocolName, starTree(&dq.Roster, s.ServerIdentity()), config)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	result := <-pi.(*protocols.DKGProtocol).FeedbackChannel
+	if err := s.storeThresholdKey(result); err != nil {
+		return nil, onet.NewClientError(err)
+	}
+
+	resp, err := thresholdKeyResponse(result.Key)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return resp, nil
+}
+
+// HandleKeyRotationQuery generates a new threshold collective key with the servers of the roster (this server being
+// the root), re-encrypts the data of all servers under it and returns it once every server switched to it.
+func (s *Service) HandleKeyRotationQuery(krq *KeyRotationQuery) (network.Message, onet.ClientError) {
+	log.Lvl1(s.ServerIdentity(), " receives a key rotation request (threshold ", krq.Threshold, ")")
+
+	if krq.Threshold < 1 || krq.Threshold > len(krq.Roster.List) {
+		return nil, onet.NewClientError(errors.New("threshold must be between 1 and the number of servers (" +
+			strconv.Itoa(len(krq.Roster.List)) + ")"))
+	}
+	if err := s.authorizeKeyRequest(keyRotationOperation, &krq.Roster, krq.Threshold, false, &krq.Request); err != nil {
+		log.Error(s.ServerIdentity(), " refuses the key rotation: ", err)
+		return nil, onet.NewClientError(err)
+	}
+	request, err := krq.Request.toBytes(false)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	config := keyRotationConfig + u.String()
+	tree := starTree(&krq.Roster, s.ServerIdentity())
+
+	// the new shares are kept aside until the data is re-encrypted under the new key
+	kr := s.keyRotation(config)
+	kr.timeout = krq.Timeout
+	defer s.forgetKeyRotation(config)
+	s.startKeyGeneration(config, &keyGeneration{threshold: krq.Threshold, request: request})
+	defer s.endKeyGeneration(config)
+	pi, err := s.startProtocolWithConfig(protocols.DKGProtocolName, tree, config)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	result := <-pi.(*protocols.DKGProtocol).FeedbackChannel
+	if result.Err != nil {
+		return nil, onet.NewClientError(errors.New("key generation failed: " + result.Err.Error()))
+	}
+	s.keepRotationKey(config, result.Key)
+
+	kr.newKey = result.Key.CollectiveKey
+	pi, err = s.startProtocolWithConfig(protocols.KeyRotationProtocolName, tree, config)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	rotation := <-pi.(*protocols.KeyRotationProtocol).FeedbackChannel
+	if rotation.Err != nil {
+		if rotation.Committed {
+			return nil, onet.NewClientError(errors.New("the rotation was committed but not by all servers: " +
+				rotation.Err.Error()))
+		}
+		return nil, onet.NewClientError(errors.New("the rotation was aborted, the data stays under the current key: " +
+			rotation.Err.Error()))
+	}
+
+	resp, err := thresholdKeyResponse(result.Key)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return resp, nil
+}
+
+// HandleCollectiveKeyQuery returns the threshold collective key this server holds a share of.
+func (s *Service) HandleCollectiveKeyQuery(ckq *CollectiveKeyQuery) (network.Message, onet.ClientError) {
+	if s.ThresholdKey == nil {
+		return nil, onet.NewClientError(errors.New(s.ServerIdentity().String() + " holds no threshold key share, run a key generation first"))
+	}
+	resp, err := thresholdKeyResponse(s.ThresholdKey)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return resp, nil
+}
+
+// HandleServerInfoQuery returns the keys held by this server, signed for the nonce of the client.
+func (s *Service) HandleServerInfoQuery(siq *ServerInfoQuery) (network.Message, onet.ClientError) {
+	resp := &ServerInfoResponse{Public: s.ServerIdentity().Public, Suite: lib.CurrentSuite().String()}
+	if s.ThresholdKey != nil {
+		tk, err := thresholdKeyResponse(s.ThresholdKey)
+		if err != nil {
+			return nil, onet.NewClientError(err)
+		}
+		resp.CollectiveKey, resp.T, resp.N = tk.CollectiveKey, tk.T, tk.N
+	}
+
+	private, err := serverPrivateKey(resp.Public)
+	if err != nil {
+		log.Error(err)
+		return nil, onet.NewClientError(err)
+	}
+	signed, err := serverInfoData(siq.Nonce, resp)
+	if err == nil {
+		resp.Signature, err = lib.SchnorrSign(private, signed)
+	}
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return resp, nil
+}
+
+// HandleAddRmQuery adds the contribution of this server to (or removes it from) the collective key of the given
+// responses and returns the proofs of the transformation. The contribution of a server is its private key: responses
+// encrypted under the threshold collective key can only be re-encrypted by a key rotation.
+func (s *Service) HandleAddRmQuery(arq *AddRmQuery) (network.Message, onet.ClientError) {
+	if err := s.checkRekeyWindow(arq.Add); err != nil {
+		log.Error(err)
+		return nil, onet.NewClientError(err)
+	}
+	if err := s.authorizeAddRmQuery(arq); err != nil {
+		log.Error(s.ServerIdentity(), " refuses the re-keying: ", err)
+		return nil, onet.NewClientError(err)
+	}
+	if s.ThresholdKey != nil && arq.CollectiveKey.Equal(s.ThresholdKey.CollectiveKey) {
+		return nil, onet.NewClientError(errors.New("the responses are encrypted under the threshold collective key, " +
+			"which cannot be re-keyed (rotate the key instead)"))
+	}
+	responses, err := lib.DpResponsesFromBytes(arq.Data)
+	if err != nil {
+		return nil, onet.NewClientError(errors.New("invalid responses: " + err.Error()))
+	}
+	log.Lvl1(s.ServerIdentity(), " re-keys ", len(responses), " responses (add: ", arq.Add, ")")
+
+	// the protocol only runs locally, with the private key of this server
+	u, err := uuid.NewV4()
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	config := addRmConfig + u.String()
+	s.startAddRm(config, &addRm{target: responses, add: arq.Add})
+	defer s.endAddRm(config)
+	roster := onet.NewRoster([]*network.ServerIdentity{s.ServerIdentity()})
+	pi, err := s.startProtocolWithConfig(protocols.AddRmServerProtocolName, roster.GenerateNaryTreeWithRoot(1, s.ServerIdentity()), config)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	addRm := pi.(*protocols.AddRmServerProtocol)
+	<-addRm.FeedbackChannel
+
+	proofs, err := lib.AddRmProofsToBytes(addRm.PublishedProofs)
+	if err != nil {
+		return nil, onet.NewClientError(err)
+	}
+	return &AddRmResponse{Proofs: proofs}, nil
+}
 
+// thresholdKeyResponse creates the response describing a threshold key
+func thresholdKeyResponse(tk *lib.ThresholdKey) (*CollectiveKeyResponse, error) {
+	key, err := lib.SerializePoint(tk.CollectiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &CollectiveKeyResponse{CollectiveKey: key, T: tk.T, N: tk.N}, nil
 }
 
 // Protocol Handlers
@@ -173,6 +714,40 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 	var err error
 
 	switch tn.ProtocolName() {
+	case protocols.CollectiveAggregationProtocolName:
+		pi, err = protocols.NewCollectiveAggregationProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		// a server without the query (or its data) does not take part and is seen as unavailable
+		q, err := s.query(QueryID(conf.Data))
+		if err != nil {
+			return nil, err
+		}
+		aggregation := pi.(*protocols.CollectiveAggregationProtocol)
+		if tn.IsRoot() {
+			aggregation.GroupedData = q.groupedData
+			aggregation.Proofs = true
+			aggregation.RangeProofBits = dbConfig.RangeProofBits
+			aggregation.CollectiveKey = s.collectiveKey(&q.Query.Roster)
+			aggregation.ExcludeMisbehaving = q.Query.PartialResults
+			aggregation.Timeout = q.Query.Timeouts.Aggregation
+			if aggregation.Timeout == 0 {
+				aggregation.Timeout = protocols.DefaultCircuitTimeout
+			}
+			aggregation.SkipUnavailable = q.Query.PartialResults
+		} else {
+			// the other servers only need the query for their local data (computed unless they already have it)
+			s.forgetQuery(q.Query.QueryID)
+			if q.groupedData == nil {
+				if q.groupedData, err = s.LocalAggregation(q); err != nil {
+					return nil, err
+				}
+			}
+			aggregation.GroupedData = q.groupedData
+		}
+		aggregation.LocalData, aggregation.RangeProofs = q.localData, q.rangeProofs
 	case protocols.KeySwitchingProtocolName:
 		pi, err = protocols.NewKeySwitchingProtocol(tn)
 		if err != nil {
@@ -181,9 +756,149 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 
 		keySwitch := pi.(*protocols.KeySwitchingProtocol)
 		if tn.IsRoot() {
+			q, err := s.query(QueryID(conf.Data))
+			if err != nil {
+				return nil, err
+			}
+			keySwitch.TargetOfSwitch = &q.AggregatedResults
+			keySwitch.TargetPublicKey = &q.Query.ClientPubKey
+			keySwitch.Timeout = q.Query.Timeouts.KeySwitching
+			keySwitch.ChunkSize = q.Query.KeySwitchingChunkSize
+		}
+	case protocols.FilteredResponseShufflingProtocolName:
+		pi, err = protocols.NewFilteredResponseShufflingProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		shuffle := pi.(*protocols.FilteredResponseShufflingProtocol)
+		if tn.IsRoot() {
+			q, err := s.query(QueryID(conf.Data))
+			if err != nil {
+				return nil, err
+			}
+			shuffle.TargetOfShuffle = &q.AggregatedResults
+			shuffle.CollectiveKey = s.collectiveKey(&q.Query.Roster)
+			shuffle.Proofs = true
+			shuffle.Timeout = q.Query.Timeouts.Shuffling
+		}
+	case protocols.ParallelKeySwitchingProtocolName:
+		pi, err = protocols.NewParallelKeySwitchingProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		keySwitch := pi.(*protocols.ParallelKeySwitchingProtocol)
+		if tn.IsRoot() && isKeyRotation(conf) {
+			kr := s.keyRotation(string(conf.Data))
+			keySwitch.TargetOfSwitch = &kr.target
+			keySwitch.TargetPublicKey = &kr.key.CollectiveKey
+			keySwitch.Timeout = kr.timeout
+			keySwitch.Proofs = true
+		} else if tn.IsRoot() {
+			q, err := s.query(QueryID(conf.Data))
+			if err != nil {
+				return nil, err
+			}
+			keySwitch.TargetOfSwitch = &q.AggregatedResults
+			keySwitch.TargetPublicKey = &q.Query.ClientPubKey
+			keySwitch.Timeout = q.Query.Timeouts.KeySwitching
+			keySwitch.Proofs = true
+		}
+	case protocols.ThresholdKeySwitchingProtocolName:
+		pi, err = protocols.NewThresholdKeySwitchingProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		keySwitch := pi.(*protocols.ThresholdKeySwitchingProtocol)
+		keySwitch.Key = s.ThresholdKey
+		if tn.IsRoot() && isKeyRotation(conf) {
+			kr := s.keyRotation(string(conf.Data))
+			keySwitch.TargetOfSwitch = &kr.target
+			keySwitch.TargetPublicKey = &kr.key.CollectiveKey
+			keySwitch.Timeout = kr.timeout
+			keySwitch.Proofs = true
+		} else if tn.IsRoot() {
+			q, err := s.query(QueryID(conf.Data))
+			if err != nil {
+				return nil, err
+			}
+			keySwitch.TargetOfSwitch = &q.AggregatedResults
+			keySwitch.TargetPublicKey = &q.Query.ClientPubKey
+			keySwitch.Timeout = q.Query.Timeouts.KeySwitching
+		}
+	case protocols.AddRmServerProtocolName:
+		pi, err = protocols.NewAddRmProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		ar, err := s.addRm(string(conf.Data))
+		if err != nil {
+			return nil, err
+		}
+		addRm := pi.(*protocols.AddRmServerProtocol)
+		addRm.TargetOfTransformation = ar.target
+		addRm.Add = ar.add
+		addRm.KeyToRm = tn.Private()
+		addRm.Proofs = true
+	case protocols.DKGProtocolName:
+		pi, err = protocols.NewDKGProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
+
+		dkg := pi.(*protocols.DKGProtocol)
+		if tn.IsRoot() {
+			kg, err := s.keyGeneration(string(conf.Data))
+			if err != nil {
+				return nil, err
+			}
+			dkg.Threshold = kg.threshold
+			dkg.Request = kg.request
+		} else {
+			roster := tn.Roster()
+			operation := keyGenerationOperation
+			if isKeyRotation(conf) {
+				operation = keyRotationOperation
+			}
+			dkg.Authorize = func(threshold int, request []byte) error {
+				req, overwrite, err := keyRequestFromBytes(request)
+				if err != nil {
+					return err
+				}
+				return s.authorizeKeyRequest(operation, roster, threshold, overwrite, req)
+			}
+			if isKeyRotation(conf) {
+				config := string(conf.Data)
+				go func() {
+					if result := <-dkg.FeedbackChannel; result.Err == nil {
+						s.keepRotationKey(config, result.Key)
+					}
+				}()
+			} else {
+				go func() { s.storeThresholdKey(<-dkg.FeedbackChannel) }()
+			}
+		}
+	case protocols.KeyRotationProtocolName:
+		pi, err = protocols.NewKeyRotationProtocol(tn)
+		if err != nil {
+			return nil, err
+		}
 
-			keySwitch.TargetOfSwitch = &s.AggregatedResults
-			keySwitch.TargetPublicKey = &s.Query.ClientPubKey
+		if !isKeyRotation(conf) {
+			return nil, errors.New("key rotation without identifier")
+		}
+		rotation := pi.(*protocols.KeyRotationProtocol)
+		roster, config := tn.Roster(), string(conf.Data)
+		rotation.Prepare = func(newKey abstract.Point) error { return s.prepareKeyRotation(config, roster, newKey) }
+		rotation.Commit = func(commit bool) error { return s.commitKeyRotation(config, commit) }
+		rotation.End = func(rollback bool) error { return s.endKeyRotation(config, rollback) }
+		if tn.IsRoot() {
+			kr := s.keyRotation(config)
+			rotation.NewKey = kr.newKey
+			rotation.Timeout = kr.timeout
 		}
 	default:
 		return nil, errors.New("Service attempts to start an unknown protocol: " + tn.ProtocolName() + ".")
@@ -192,26 +907,47 @@ func (s *Service) NewProtocol(tn *onet.TreeNodeInstance, conf *onet.GenericConfi
 	return pi, nil
 }
 
-// StartProtocol starts a specific protocol (Pipeline, Shuffling, etc.)
-func (s *Service) StartProtocol(name string) (onet.ProtocolInstance, error) {
+// StartProtocol starts a specific protocol (Pipeline, Shuffling, etc.) for a query
+func (s *Service) StartProtocol(name string, targetQuery QueryID) (onet.ProtocolInstance, error) {
+	q, err := s.query(targetQuery)
+	if err != nil {
+		return nil, err
+	}
+	return s.startProtocolWithConfig(name, q.Query.Roster.GenerateNaryTreeWithRoot(2, s.ServerIdentity()), string(targetQuery))
+}
+
+// starTree creates a tree in which all the servers of the roster are children of root.
+func starTree(roster *onet.Roster, root *network.ServerIdentity) *onet.Tree {
+	branchingFactor := len(roster.List) - 1
+	if branchingFactor < 1 {
+		branchingFactor = 1
+	}
+	return roster.GenerateNaryTreeWithRoot(branchingFactor, root)
+}
 
-	tree := s.Query.Roster.GenerateNaryTreeWithRoot(2, s.ServerIdentity())
+// startProtocolOnTree starts a protocol which is not run for a query on a given tree.
+func (s *Service) startProtocolOnTree(name string, tree *onet.Tree) (onet.ProtocolInstance, error) {
+	return s.startProtocolWithConfig(name, tree, "")
+}
 
+// startProtocolWithConfig starts a protocol on a given tree with the given configuration data.
+func (s *Service) startProtocolWithConfig(name string, tree *onet.Tree, data string) (onet.ProtocolInstance, error) {
 	var tn *onet.TreeNodeInstance
 	tn = s.NewTreeNodeInstance(tree, tree.Root, name)
 
-	conf := onet.GenericConfig{Data: []byte(string(s.Query.QueryID))}
+	conf := onet.GenericConfig{Data: []byte(data)}
 
+	// a protocol which cannot be created for this request fails it, not the server
 	pi, err := s.NewProtocol(tn, &conf)
 	if err != nil {
-		log.Fatal("Error running" + name)
+		return nil, errors.New("couldn't start " + name + ": " + err.Error())
 	}
 
 	s.RegisterProtocolInstance(pi)
 	go pi.Dispatch()
 	go pi.Start()
 
-	return pi, err
+	return pi, nil
 }
 
 // Service Phases
@@ -222,94 +958,820 @@ func (s *Service) StartService(targetQuery QueryID, root bool) error {
 
 	log.Lvl1(s.ServerIdentity(), " starts  Protocol for query ", targetQuery)
 
-	//get DB configuration
-	if _, err := toml.DecodeFile("db.toml", &dbConfig); err != nil {
-		log.Fatal("Error: The database configuration is not valid")
+	q, err := s.query(targetQuery)
+	if err != nil {
+		return err
+	}
+	groupedData, err := s.LocalAggregation(q)
+	if err != nil {
+		return err
 	}
 
-	//prepare SQL query statement
-	queryStmt := s.PrepareQueryStatement()
-
-	//execute query to DB along with aggregation
-	start0 := time.Now()
-	resultSet, counts := s.ExecuteSqlQuery(&queryStmt)
-	log.LLvl1("SQL Query Time: ", time.Since(start0))
-
-	//perform aggregation
-	start1 := time.Now()
-	aggregatedResultSet := s.AggregateResultSet(resultSet, counts)
-	log.LLvl1("Aggregation Time: ", time.Since(start1))
-
-	//TODO: add obfuscation for differential privacy
-
-	//copy aggregatedResultSet groups in list of string and aggregated counts in a CipherVector
-	s.AggregatedResults = append(s.AggregatedResults, lib.NewFilteredResponse(0, 0))
-
-	for key := range *aggregatedResultSet {
-		s.Groups = append(s.Groups, key)
-		s.AggregatedResults[0].AggregatingAttributes = append(s.AggregatedResults[0].AggregatingAttributes, *((*aggregatedResultSet)[key]))
+	// Collective Aggregation Phase
+	if root == true {
+		start := time.Now()
+		q.groupedData = groupedData
+		if err := s.CollectiveAggregationPhase(q); err != nil {
+			return errors.New("collective aggregation failed: " + err.Error())
+		}
+		q.Timings.CollectiveAggregation = time.Since(start)
+		log.LLvl1("Collective Aggregation Time: ", q.Timings.CollectiveAggregation)
+	}
 
+	// Obfuscation Phase (differential privacy)
+	if root == true {
+		if err := s.ObfuscationPhase(q); err != nil {
+			return errors.New("obfuscation failed: " + err.Error())
+		}
 	}
 
-	//log.Lvl1(s.ServerIdentity(), " tests database ", *aggregatedResultSet)
+	// Shuffling Phase
+	if root == true {
+		start := time.Now()
+		if err := s.ShufflingPhase(q); err != nil {
+			return errors.New("shuffling failed: " + err.Error())
+		}
+		q.Timings.Shuffling = time.Since(start)
+		log.LLvl1("Shuffling Time: ", q.Timings.Shuffling)
+	}
 
 	// Key Switch Phase
 	start2 := time.Now()
 	if root == true {
 		start := lib.StartTimer(s.ServerIdentity().String() + "_KeySwitchingPhase")
 
-		s.KeySwitchingPhase()
+		if err := s.KeySwitchingPhase(q); err != nil {
+			return errors.New("key switching failed: " + err.Error())
+		}
 
 		lib.EndTimer(start)
 	}
-	log.LLvl1("Re-encryption Time: ", time.Since(start2))
+	q.Timings.KeySwitching = time.Since(start2)
+	log.LLvl1("Re-encryption Time: ", q.Timings.KeySwitching)
 
 	return nil
 }
 
-// KeySwitchingPhase performs the switch to the querier's key on the currently aggregated data.
-func (s *Service) KeySwitchingPhase() error {
-	pi, err := s.StartProtocol(protocols.KeySwitchingProtocolName)
-	if err != nil {
-		return err
+// LocalAggregation runs the query on the database of this server and returns its counts per group. The rows of the
+// result and their range proofs are kept in q to prove the aggregation to the other servers.
+func (s *Service) LocalAggregation(q *queryState) (*map[lib.GroupingKey]lib.FilteredResponse, error) {
+	if dbConfig.Table == "" {
+		return nil, errors.New(s.ServerIdentity().String() + " has no database configured")
 	}
 
-	s.KeySwitchedAggregatedResults = <-pi.(*protocols.KeySwitchingProtocol).FeedbackChannel
+	//prepare SQL query statement
+	queryStmt := s.PrepareQueryStatement(&q.Query)
 
-	return err
-}
+	//execute query to DB along with aggregation
+	start0 := time.Now()
+	resultSet, counts, rangeProofs, err := s.ExecuteSqlQuery(&queryStmt, s.collectiveKey(&q.Query.Roster))
+	if err != nil {
+		return nil, err
+	}
+	q.Timings.SQL = time.Since(start0)
+	log.LLvl1("SQL Query Time: ", q.Timings.SQL)
 
-// Query and DB management
-//______________________________________________________________________________________________________________________
-func (s *Service) ExecuteSqlQuery(query *string) (*map[string][]string, *lib.CipherVector) {
+	//perform aggregation
+	start1 := time.Now()
+	aggregatedResultSet := s.AggregateResultSet(q.Query.GroupBy, resultSet, counts)
+	q.Timings.LocalAggregation = time.Since(start1)
+	log.LLvl1("Aggregation Time: ", q.Timings.LocalAggregation)
+
+	q.localData = make([]lib.FilteredResponseDet, len(*counts))
+	for i, count := range *counts {
+		q.localData[i] = lib.FilteredResponseDet{DetTagGroupBy: lib.GroupingKey(groupKey(q.Query.GroupBy, resultSet, i)),
+			Fr: lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{count}}}
+	}
+	q.rangeProofs = nil
+	if rangeProofs != nil {
+		q.rangeProofs = make([][]lib.RangeProof, len(rangeProofs))
+		for i := range rangeProofs {
+			q.rangeProofs[i] = []lib.RangeProof{rangeProofs[i]}
+		}
+	}
 
-	// open connection to DB
-	db, err := sql.Open("postgres", "user="+dbConfig.Username+" password="+dbConfig.Password+" dbname="+dbConfig.DbName+" sslmode=disable")
-	if err != nil {
-		log.Fatal("Error: The data source arguments are not valid")
+	// the groups are aggregated across servers by their clear value
+	groupedData := make(map[lib.GroupingKey]lib.FilteredResponse, len(*aggregatedResultSet))
+	for key, count := range *aggregatedResultSet {
+		groupedData[lib.GroupingKey(key)] = lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{*count}}
 	}
-	defer db.Close()
+	return &groupedData, nil
+}
 
-	//ping database to check the connection
-	log.Lvl1(s.ServerIdentity(), " tests database connection")
-	err = db.Ping()
+// CollectiveAggregationPhase aggregates the local data of all servers (or of the ones which answered in time if the
+// query accepts partial results) and makes one response per group.
+func (s *Service) CollectiveAggregationPhase(q *queryState) error {
+	pi, err := s.startProtocolWithConfig(protocols.CollectiveAggregationProtocolName,
+		starTree(&q.Query.Roster, s.ServerIdentity()), string(q.Query.QueryID))
 	if err != nil {
-		log.Fatal("Error: could not establish a connection with the database")
+		return err
 	}
 
+	aggregation := pi.(*protocols.CollectiveAggregationProtocol)
+	var result protocols.CothorityAggregatedData
+	select {
+	case result = <-aggregation.FeedbackChannel:
+	case err := <-aggregation.FailureChannel:
+		return err
+	}
+	if result.Partial {
+		log.Lvl1(s.ServerIdentity(), " aggregated the data of ", len(result.Contributors), " of the ",
+			len(q.Query.Roster.List), " servers")
+		if min := thresholds().MinContributors; len(result.Contributors) < min {
+			return errors.New("only " + strconv.Itoa(len(result.Contributors)) + " servers answered, " +
+				s.ServerIdentity().String() + " requires the data of " + strconv.Itoa(min))
+		}
+	}
+	q.Contributors = result.Contributors
+	q.Misbehaving = result.Misbehaving
+
+	//copy the groups in a sorted list of string and make one response per group: its position in the list
+	//(encrypted, so that the responses can be shuffled) and its aggregated count
+	for key := range result.GroupedData {
+		q.Groups = append(q.Groups, string(key))
+	}
+	sort.Strings(q.Groups)
+	collectiveKey := s.collectiveKey(&q.Query.Roster)
+	for i, key := range q.Groups {
+		q.AggregatedResults = append(q.AggregatedResults, lib.FilteredResponse{
+			GroupByEnc:            lib.CipherVector{*lib.EncryptInt(collectiveKey, int64(i))},
+			AggregatingAttributes: result.GroupedData[lib.GroupingKey(key)].AggregatingAttributes})
+	}
+	return nil
+}
+
+// ObfuscationPhase adds to each aggregated count an encrypted noise drawn from the Laplace distribution of the
+// differential privacy configuration of this server (nothing if it has none).
+func (s *Service) ObfuscationPhase(q *queryState) error {
+	if len(noiseValues) == 0 {
+		return nil
+	}
+	dp := serverConfig.DifferentialPrivacy
+	q.DifferentialPrivacy = DifferentialPrivacyConfig{Epsilon: dp.Epsilon, Sensitivity: dp.sensitivity()}
+	collectiveKey := s.collectiveKey(&q.Query.Roster)
+	for i := range q.AggregatedResults {
+		for j := range q.AggregatedResults[i].AggregatingAttributes {
+			noise, err := drawNoise()
+			if err != nil {
+				return err
+			}
+			count := &q.AggregatedResults[i].AggregatingAttributes[j]
+			count.Add(*count, *lib.EncryptInt(collectiveKey, noise))
+		}
+	}
+	return nil
+}
+
+// ShufflingPhase shuffles the aggregated results (with proofs) so that their order does not reveal where they come
+// from. With partial results, only the servers which contributed take part.
+func (s *Service) ShufflingPhase(q *queryState) error {
+	roster := &q.Query.Roster
+	if q.Query.PartialResults {
+		roster = onet.NewRoster(q.Contributors)
+	}
+	pi, err := s.startProtocolWithConfig(protocols.FilteredResponseShufflingProtocolName,
+		roster.GenerateNaryTreeWithRoot(2, s.ServerIdentity()), string(q.Query.QueryID))
+	if err != nil {
+		return err
+	}
+
+	shuffle := pi.(*protocols.FilteredResponseShufflingProtocol)
+	select {
+	case q.AggregatedResults = <-shuffle.FeedbackChannel:
+		return nil
+	case err := <-shuffle.FailureChannel:
+		return err
+	}
+}
+
+// collectiveKey returns the key the data of the queries run on roster is encrypted with.
+func (s *Service) collectiveKey(roster *onet.Roster) abstract.Point {
+	if s.ThresholdKey != nil {
+		return s.ThresholdKey.CollectiveKey
+	}
+	return roster.Aggregate
+}
+
+// KeySwitchingPhase performs the switch to the querier's key on the currently aggregated data. When this server holds
+// a threshold key share, the data is assumed to be encrypted under the threshold collective key and only t servers
+// are needed. Otherwise, the query chooses between the circuit and the parallel key switching.
+func (s *Service) KeySwitchingPhase(q *queryState) error {
+	if s.ThresholdKey != nil {
+		pi, err := s.startProtocolWithConfig(protocols.ThresholdKeySwitchingProtocolName,
+			starTree(&q.Query.Roster, s.ServerIdentity()), string(q.Query.QueryID))
+		if err != nil {
+			return err
+		}
+		keySwitch := pi.(*protocols.ThresholdKeySwitchingProtocol)
+		select {
+		case q.KeySwitchedAggregatedResults = <-keySwitch.FeedbackChannel:
+			return nil
+		case err := <-keySwitch.FailureChannel:
+			return err
+		}
+	}
+
+	if q.Query.ParallelKeySwitching {
+		pi, err := s.StartProtocol(protocols.ParallelKeySwitchingProtocolName, q.Query.QueryID)
+		if err != nil {
+			return err
+		}
+		keySwitch := pi.(*protocols.ParallelKeySwitchingProtocol)
+		select {
+		case q.KeySwitchedAggregatedResults = <-keySwitch.FeedbackChannel:
+			return nil
+		case err := <-keySwitch.FailureChannel:
+			return err
+		}
+	}
+
+	pi, err := s.StartProtocol(protocols.KeySwitchingProtocolName, q.Query.QueryID)
+	if err != nil {
+		return err
+	}
+
+	keySwitch := pi.(*protocols.KeySwitchingProtocol)
+	select {
+	case q.KeySwitchedAggregatedResults = <-keySwitch.FeedbackChannel:
+		return nil
+	case err := <-keySwitch.FailureChannel:
+		return err
+	}
+}
+
+// Threshold key management
+//______________________________________________________________________________________________________________________
+
+// startKeyGeneration keeps the parameters of a key generation started by this server until endKeyGeneration.
+func (s *Service) startKeyGeneration(config string, kg *keyGeneration) {
+	s.keyGenerationsMutex.Lock()
+	defer s.keyGenerationsMutex.Unlock()
+	s.keyGenerations[config] = kg
+}
+
+// endKeyGeneration forgets the parameters of a key generation.
+func (s *Service) endKeyGeneration(config string) {
+	s.keyGenerationsMutex.Lock()
+	defer s.keyGenerationsMutex.Unlock()
+	delete(s.keyGenerations, config)
+}
+
+// keyGeneration returns the parameters of a key generation started by this server.
+func (s *Service) keyGeneration(config string) (*keyGeneration, error) {
+	s.keyGenerationsMutex.Lock()
+	defer s.keyGenerationsMutex.Unlock()
+	kg, ok := s.keyGenerations[config]
+	if !ok {
+		return nil, errors.New("no key generation " + config + " was started on " + s.ServerIdentity().String())
+	}
+	return kg, nil
+}
+
+// startAddRm keeps the responses of a re-keying for its protocol.
+func (s *Service) startAddRm(config string, ar *addRm) {
+	s.addRmsMutex.Lock()
+	defer s.addRmsMutex.Unlock()
+	s.addRms[config] = ar
+}
+
+// endAddRm forgets the responses of a re-keying.
+func (s *Service) endAddRm(config string) {
+	s.addRmsMutex.Lock()
+	defer s.addRmsMutex.Unlock()
+	delete(s.addRms, config)
+}
+
+// addRm returns the responses of a re-keying run by this server.
+func (s *Service) addRm(config string) (*addRm, error) {
+	s.addRmsMutex.Lock()
+	defer s.addRmsMutex.Unlock()
+	ar, ok := s.addRms[config]
+	if !ok {
+		return nil, errors.New("no re-keying " + config + " was started on " + s.ServerIdentity().String())
+	}
+	return ar, nil
+}
+
+// storeThresholdKey saves the share obtained by this server at the end of a key generation. The share it replaces is
+// kept in a versioned file (see archiveThresholdKey).
+func (s *Service) storeThresholdKey(result protocols.DKGResult) error {
+	if result.Err != nil {
+		return result.Err
+	}
+	if archive, err := archiveThresholdKey(); err != nil {
+		log.Error(s.ServerIdentity(), " could not keep its previous threshold key share: ", err)
+		return err
+	} else if archive != "" {
+		log.Lvl1(s.ServerIdentity(), " keeps its previous threshold key share in ", archive)
+	}
+	if err := saveThresholdKey(ThresholdKeyFile, result.Key); err != nil {
+		log.Error(s.ServerIdentity(), " could not save its threshold key share: ", err)
+		return err
+	}
+	s.ThresholdKey = result.Key
+	log.Lvl1(s.ServerIdentity(), " stored its share of the ", result.Key.T, "-of-", result.Key.N, " collective key")
+	return nil
+}
+
+// archiveThresholdKey copies the share of ThresholdKeyFile (if any) to a file named after the current time, before it
+// is replaced, and returns the name of the copy.
+func archiveThresholdKey() (string, error) {
+	data, err := ioutil.ReadFile(ThresholdKeyFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	archive := ThresholdKeyFile + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return "", err
+	}
+	return archive, f.Close()
+}
+
+// saveThresholdKey writes a threshold key share in a file only readable by its owner. The file is replaced at once,
+// so that it never holds a partial share.
+func saveThresholdKey(path string, tk *lib.ThresholdKey) error {
+	share, err := lib.SerializeScalar(tk.Share)
+	if err != nil {
+		return err
+	}
+	key, err := lib.SerializePoint(tk.CollectiveKey)
+	if err != nil {
+		return err
+	}
+
+	publicShares := make([]string, len(tk.PublicShares))
+	for i, ps := range tk.PublicShares {
+		if publicShares[i], err = lib.SerializePoint(ps); err != nil {
+			return err
+		}
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = toml.NewEncoder(f).Encode(thresholdKeyToml{Suite: lib.CurrentSuite().String(), Index: tk.Index, T: tk.T,
+		N: tk.N, Share: share, CollectiveKey: key, PublicShares: publicShares})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loadThresholdKey reads a threshold key share, a missing file meaning that the server has no share.
+func loadThresholdKey(path string) (*lib.ThresholdKey, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	tkt := thresholdKeyToml{}
+	if _, err := toml.DecodeFile(path, &tkt); err != nil {
+		return nil, errors.New("couldn't read " + path + ": " + err.Error())
+	}
+	if tkt.Suite != lib.CurrentSuite().String() {
+		return nil, errors.New(path + " holds a " + tkt.Suite + " key but the server uses " + lib.CurrentSuite().String())
+	}
+	share, err := lib.DeserializeScalar(tkt.Share)
+	if err != nil {
+		return nil, errors.New("invalid share in " + path + ": " + err.Error())
+	}
+	key, err := lib.DeserializePoint(tkt.CollectiveKey)
+	if err != nil {
+		return nil, errors.New("invalid collective key in " + path + ": " + err.Error())
+	}
+	// the public shares are missing in the files written before they were kept
+	var publicShares []abstract.Point
+	for i, ps := range tkt.PublicShares {
+		p, err := lib.DeserializePoint(ps)
+		if err != nil {
+			return nil, errors.New("invalid public share " + strconv.Itoa(i+1) + " in " + path + ": " + err.Error())
+		}
+		publicShares = append(publicShares, p)
+	}
+	return &lib.ThresholdKey{Index: tkt.Index, T: tkt.T, N: tkt.N, Share: share, CollectiveKey: key,
+		PublicShares: publicShares}, nil
+}
+
+// Key rotation
+//______________________________________________________________________________________________________________________
+
+// isKeyRotation checks whether a protocol is run for a key rotation.
+func isKeyRotation(conf *onet.GenericConfig) bool {
+	return conf != nil && strings.HasPrefix(string(conf.Data), keyRotationConfig)
+}
+
+// keyRotation returns the state of the key rotation of config on this server, created if needed. The rotations which
+// this server did not start and which were never prepared are forgotten after twice protocols.DefaultCircuitTimeout.
+func (s *Service) keyRotation(config string) *keyRotation {
+	s.rotationsMutex.Lock()
+	defer s.rotationsMutex.Unlock()
+	for c, kr := range s.rotations {
+		if c != config && kr.newKey == nil && !kr.active && time.Since(kr.created) > 2*protocols.DefaultCircuitTimeout {
+			delete(s.rotations, c)
+		}
+	}
+	kr, ok := s.rotations[config]
+	if !ok {
+		kr = &keyRotation{keys: make(chan *lib.ThresholdKey, 1), created: time.Now()}
+		s.rotations[config] = kr
+	}
+	return kr
+}
+
+// activateKeyRotation marks the key rotation of config as the one whose counts are re-encrypted on this server: a
+// single rotation can lock the table at once.
+func (s *Service) activateKeyRotation(config string) error {
+	s.rotationsMutex.Lock()
+	defer s.rotationsMutex.Unlock()
+	for c, kr := range s.rotations {
+		if c != config && kr.active {
+			return errors.New("a key rotation is already in progress on " + s.ServerIdentity().String())
+		}
+	}
+	kr, ok := s.rotations[config]
+	if !ok {
+		return errors.New("no key rotation " + config + " on " + s.ServerIdentity().String())
+	}
+	if kr.active {
+		return errors.New("the key rotation " + config + " was already prepared on " + s.ServerIdentity().String())
+	}
+	kr.active = true
+	return nil
+}
+
+// forgetKeyRotation removes the state of the key rotation of config and returns it (nil if there is none).
+func (s *Service) forgetKeyRotation(config string) *keyRotation {
+	s.rotationsMutex.Lock()
+	defer s.rotationsMutex.Unlock()
+	kr := s.rotations[config]
+	delete(s.rotations, config)
+	return kr
+}
+
+// keepRotationKey keeps the share of the new collective key generated for a key rotation.
+func (s *Service) keepRotationKey(config string, key *lib.ThresholdKey) {
+	kr := s.keyRotation(config)
+	select {
+	case <-kr.keys:
+	default:
+	}
+	kr.keys <- key
+}
+
+// rotationKey waits for the share of the given new collective key.
+func (s *Service) rotationKey(kr *keyRotation, newKey abstract.Point) (*lib.ThresholdKey, error) {
+	deadline := time.After(protocols.DefaultCircuitTimeout)
+	for {
+		select {
+		case key := <-kr.keys:
+			if key.CollectiveKey.Equal(newKey) {
+				return key, nil
+			}
+		case <-deadline:
+			return nil, errors.New(s.ServerIdentity().String() + " holds no share of the new collective key")
+		}
+	}
+}
+
+// prepareKeyRotation locks the table of the encrypted counts and switches them to the new collective key (with
+// proofs) with the help of the servers of roster. The re-encrypted counts are only written by commitKeyRotation.
+func (s *Service) prepareKeyRotation(config string, roster *onet.Roster, newKey abstract.Point) error {
+	kr := s.keyRotation(config)
+	key, err := s.rotationKey(kr, newKey)
+	if err != nil {
+		s.forgetKeyRotation(config)
+		return err
+	}
+
+	dbc := dbConfig
+	if dbc.RangeProofBits > 0 {
+		s.forgetKeyRotation(config)
+		return errors.New("range proofs cannot be re-encrypted, the data of " + dbc.Table + " has to be encrypted again")
+	}
+	column := dbc.QuotedColumns()[3]
+
+	if err := s.activateKeyRotation(config); err != nil {
+		return err
+	}
+	kr.key = key
+	if kr.db, err = sql.Open("postgres", dbc.DataSourceName()); err != nil {
+		s.forgetKeyRotation(config)
+		return err
+	}
+	if err := kr.read(dbc.Table, column); err != nil {
+		s.forgetKeyRotation(config)
+		kr.close(false)
+		return errors.New("couldn't read " + column + " of table " + dbc.Table + ": " + err.Error())
+	}
+
+	if len(kr.target) > 0 {
+		start := time.Now()
+		if kr.rotated, err = s.rotateCounts(config, roster); err == nil && len(kr.rotated) != len(kr.target) {
+			err = errors.New("got " + strconv.Itoa(len(kr.rotated)) + " re-encrypted counts instead of " +
+				strconv.Itoa(len(kr.target)))
+		}
+		if err != nil {
+			s.forgetKeyRotation(config)
+			kr.close(false)
+			return err
+		}
+		log.LLvl1("Key Rotation Time: ", time.Since(start))
+	}
+	log.Lvl1(s.ServerIdentity(), " re-encrypted ", len(kr.ctids), " counts of table ", dbc.Table, " under the new key")
+	return nil
+}
+
+// rotateCounts switches the counts of the rotation of config to the new collective key with the threshold key
+// switching if the data is encrypted under a threshold collective key, with the parallel key switching otherwise.
+func (s *Service) rotateCounts(config string, roster *onet.Roster) ([]lib.FilteredResponse, error) {
+	tree := starTree(roster, s.ServerIdentity())
+	if s.ThresholdKey != nil {
+		if len(s.ThresholdKey.PublicShares) != s.ThresholdKey.N {
+			return nil, errors.New("the threshold key of " + s.ServerIdentity().String() + " has no public shares to " +
+				"check the key switching proofs against (" + ThresholdKeyFile + " written by an older version)")
+		}
+		pi, err := s.startProtocolWithConfig(protocols.ThresholdKeySwitchingProtocolName, tree, config)
+		if err != nil {
+			return nil, err
+		}
+		keySwitch := pi.(*protocols.ThresholdKeySwitchingProtocol)
+		select {
+		case rotated := <-keySwitch.FeedbackChannel:
+			return rotated, nil
+		case err := <-keySwitch.FailureChannel:
+			return nil, err
+		}
+	}
+
+	pi, err := s.startProtocolWithConfig(protocols.ParallelKeySwitchingProtocolName, tree, config)
+	if err != nil {
+		return nil, err
+	}
+	keySwitch := pi.(*protocols.ParallelKeySwitchingProtocol)
+	select {
+	case rotated := <-keySwitch.FeedbackChannel:
+		return rotated, nil
+	case err := <-keySwitch.FailureChannel:
+		return nil, err
+	}
+}
+
+// commitKeyRotation replaces the counts and the threshold key share of this server by the ones of the rotation of
+// config, or discards them. The previous counts and share are kept until endKeyRotation.
+func (s *Service) commitKeyRotation(config string, commit bool) error {
+	s.rotationsMutex.Lock()
+	kr, ok := s.rotations[config]
+	s.rotationsMutex.Unlock()
+	if !ok || !kr.active {
+		s.forgetKeyRotation(config)
+		if commit {
+			return errors.New("no key rotation was prepared on " + s.ServerIdentity().String())
+		}
+		return nil
+	}
+	if !commit {
+		s.forgetKeyRotation(config)
+		log.Lvl1(s.ServerIdentity(), " discards the counts re-encrypted under the new key")
+		return kr.close(false)
+	}
+
+	if err := kr.write(); err != nil {
+		s.forgetKeyRotation(config)
+		kr.close(false)
+		return err
+	}
+	// the share is written before the counts are committed and only replaces the current one afterwards, so that
+	// the counts are never stored without the share of their key
+	if err := saveThresholdKey(rotatedKeyFile, kr.key); err != nil {
+		s.forgetKeyRotation(config)
+		kr.close(false)
+		return errors.New("couldn't save the new threshold key share: " + err.Error())
+	}
+	if err := kr.close(true); err != nil {
+		s.forgetKeyRotation(config)
+		os.Remove(rotatedKeyFile)
+		return err
+	}
+	// from now on, the rotation can only be undone by endKeyRotation
+	kr.committed = true
+	kr.previous = s.ThresholdKey
+	if archive, err := archiveThresholdKey(); err != nil {
+		return errors.New("the counts are encrypted under the new key but the previous share could not be kept: " +
+			err.Error())
+	} else if archive != "" {
+		log.Lvl1(s.ServerIdentity(), " keeps its previous threshold key share in ", archive)
+	}
+	if err := os.Rename(rotatedKeyFile, ThresholdKeyFile); err != nil {
+		return errors.New("the counts are encrypted under the new key but its share is still in " + rotatedKeyFile +
+			" (to be renamed " + ThresholdKeyFile + "): " + err.Error())
+	}
+	s.ThresholdKey = kr.key
+	log.Lvl1(s.ServerIdentity(), " switched to the new ", kr.key.T, "-of-", kr.key.N, " collective key")
+	return nil
+}
+
+// endKeyRotation forgets the rotation of config once all servers committed it, or restores the counts and threshold
+// key share this server had before it committed (rollback), if another server could not.
+func (s *Service) endKeyRotation(config string, rollback bool) error {
+	kr := s.forgetKeyRotation(config)
+	if kr == nil || !kr.committed || !rollback {
+		return nil
+	}
+
+	dbc := dbConfig
+	if err := kr.restore(dbc.DataSourceName(), dbc.Table, dbc.QuotedColumns()[3]); err != nil {
+		log.Error(s.ServerIdentity(), " could not restore its counts after a failed key rotation: ", err)
+		return err
+	}
+	if s.ThresholdKey != kr.previous {
+		var err error
+		if kr.previous == nil {
+			err = os.Remove(ThresholdKeyFile)
+		} else {
+			err = saveThresholdKey(ThresholdKeyFile, kr.previous)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New("the counts were restored but not the previous threshold key share (archived next to " +
+				ThresholdKeyFile + "): " + err.Error())
+		}
+		s.ThresholdKey = kr.previous
+	}
+	os.Remove(rotatedKeyFile)
+	log.Lvl1(s.ServerIdentity(), " restored its counts and threshold key share after a failed key rotation")
+	return nil
+}
+
+// read locks the table (other transactions can still read it) and reads the ctid and encrypted count of its rows.
+func (kr *keyRotation) read(table, column string) error {
+	var err error
+	if kr.tx, err = kr.db.Begin(); err != nil {
+		return err
+	}
+	if _, err := kr.tx.Exec("LOCK TABLE " + table + " IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+
+	rows, err := kr.tx.Query("SELECT ctid, " + column + " FROM " + table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ctid, value string
+		if err := rows.Scan(&ctid, &value); err != nil {
+			return err
+		}
+		ct, err := lib.NewCipherTextFromBase64(value)
+		if err != nil {
+			return errors.New("invalid encrypted count in row " + ctid + ": " + err.Error())
+		}
+		kr.ctids = append(kr.ctids, ctid)
+		kr.target = append(kr.target, lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{*ct}})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	kr.update, err = kr.tx.Prepare("UPDATE " + table + " SET " + column + " = $1 WHERE ctid = $2::tid RETURNING ctid")
+	return err
+}
+
+// write updates the rows with the re-encrypted counts (in the transaction) and keeps the ctids of the updated rows.
+func (kr *keyRotation) write() error {
+	kr.updated = make([]string, len(kr.ctids))
+	for i, ctid := range kr.ctids {
+		if err := kr.update.QueryRow(kr.rotated[i].AggregatingAttributes[0].Serialize(), ctid).Scan(&kr.updated[i]); err != nil {
+			return errors.New("couldn't update row " + ctid + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// restore writes back the counts replaced by a committed rotation, in a new transaction.
+func (kr *keyRotation) restore(dataSourceName, table, column string) error {
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	update, err := tx.Prepare("UPDATE " + table + " SET " + column + " = $1 WHERE ctid = $2::tid")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, ctid := range kr.updated {
+		if _, err := update.Exec(kr.target[i].AggregatingAttributes[0].Serialize(), ctid); err != nil {
+			tx.Rollback()
+			return errors.New("couldn't restore row " + ctid + ": " + err.Error())
+		}
+	}
+	return tx.Commit()
+}
+
+// close commits or rolls back the transaction and closes the connection to the database.
+func (kr *keyRotation) close(commit bool) error {
+	defer kr.db.Close()
+	if kr.tx == nil {
+		return nil
+	}
+	if !commit {
+		return kr.tx.Rollback()
+	}
+	return kr.tx.Commit()
+}
+
+// Roster membership
+//______________________________________________________________________________________________________________________
+
+// checkRekeyWindow checks that the operator of this server opened a (still open) re-keying window for the operation.
+func (s *Service) checkRekeyWindow(add bool) error {
+	w, err := LoadRekeyWindow(RekeyFile)
+	if err != nil {
+		return err
+	}
+	if w == nil {
+		return errors.New(s.ServerIdentity().String() + " does not accept re-keying requests (no " + RekeyFile + ")")
+	}
+	if time.Now().After(w.Expires) {
+		return errors.New("the re-keying window of " + s.ServerIdentity().String() + " closed at " + w.Expires.String())
+	}
+	if w.Add != add {
+		operation := "removing"
+		if w.Add {
+			operation = "adding"
+		}
+		return errors.New("the re-keying window of " + s.ServerIdentity().String() + " is only open for " + operation +
+			" its contribution to the collective key")
+	}
+	return nil
+}
+
+// SaveRekeyWindow writes a re-keying window in a file only readable by its owner.
+func SaveRekeyWindow(path string, w RekeyWindow) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return toml.NewEncoder(f).Encode(w)
+}
+
+// LoadRekeyWindow reads a re-keying window, a missing file meaning that no window is open.
+func LoadRekeyWindow(path string) (*RekeyWindow, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	w := RekeyWindow{}
+	if _, err := toml.DecodeFile(path, &w); err != nil {
+		return nil, errors.New("couldn't read " + path + ": " + err.Error())
+	}
+	return &w, nil
+}
+
+// Query and DB management
+//______________________________________________________________________________________________________________________
+func (s *Service) ExecuteSqlQuery(query *string, collectiveKey abstract.Point) (*map[string][]string, *lib.CipherVector, []lib.RangeProof, error) {
+
+	// open connection to DB and check it
+	log.Lvl1(s.ServerIdentity(), " tests database connection")
+	db, err := dbConfig.Open()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer db.Close()
+
 	//local variable to store query results
-	var loc, yr, cpt, count string
+	var loc, yr, cpt, count, rangeProof string
 	var cipherText *lib.CipherText
+	var rangeProofs []string
 	//var toEncryptInt int64
 
 	log.Lvl1(s.ServerIdentity(), " runs query: ", *query)
 	//execute query and check for potential errors
 	rows, err := db.Query(*query)
-	if err == sql.ErrNoRows {
-		log.Fatal("No Results Found")
-	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, errors.New("cannot query table " + dbConfig.Table + ": " + err.Error())
 	}
 	defer rows.Close()
 
@@ -321,10 +1783,16 @@ func (s *Service) ExecuteSqlQuery(query *string) (*map[string][]string, *lib.Cip
 	var counts lib.CipherVector
 
 	//read rows obtained after SQL query
-	for rows.Next() {
-		err = rows.Scan(&loc, &yr, &cpt, &count)
+	for rowIdx := 0; rows.Next(); rowIdx++ {
+		if dbConfig.RangeProofBits > 0 {
+			err = rows.Scan(&loc, &yr, &cpt, &count, &rangeProof)
+			rangeProofs = append(rangeProofs, rangeProof)
+		} else {
+			err = rows.Scan(&loc, &yr, &cpt, &count)
+		}
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, nil, errors.New("cannot read row " + strconv.Itoa(rowIdx) + " of table " + dbConfig.Table +
+				": " + err.Error())
 		}
 		resultSet["location_cd"] = append(resultSet["location_cd"], loc)
 		resultSet["year"] = append(resultSet["year"], yr)
@@ -332,7 +1800,11 @@ func (s *Service) ExecuteSqlQuery(query *string) (*map[string][]string, *lib.Cip
 
 		//uncomment for deployed
 		//-------------------------------------------------------------------
-		cipherText = lib.NewCipherTextFromBase64(count)
+		cipherText, err = lib.NewCipherTextFromBase64(count)
+		if err != nil {
+			return nil, nil, nil, errors.New("invalid encrypted count in row " + strconv.Itoa(rowIdx) + " of table " + dbConfig.Table +
+				" (location_cd=" + loc + ", year=" + yr + ", concept_cd=" + cpt + "): " + err.Error())
+		}
 		//-------------------------------------------------------------------
 
 		//uncomment for test
@@ -348,14 +1820,73 @@ func (s *Service) ExecuteSqlQuery(query *string) (*map[string][]string, *lib.Cip
 	}
 	err = rows.Err()
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, nil, errors.New("cannot read table " + dbConfig.Table + ": " + err.Error())
+	}
+
+	var proofs []lib.RangeProof
+	if dbConfig.RangeProofBits > 0 {
+		if proofs, err = s.VerifyRangeProofs(collectiveKey, counts, rangeProofs, &resultSet); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	return &resultSet, &counts
+	return &resultSet, &counts, proofs, nil
 
 }
 
-func (s *Service) AggregateResultSet(resultSet *map[string][]string, counts *lib.CipherVector) *map[string]*lib.CipherText {
+// VerifyRangeProofs checks (in parallel) that every encrypted count is in the range declared in the DB configuration
+// and returns the decoded proofs. The query fails if a single proof is missing or invalid, the rows concerned being
+// listed in the error.
+func (s *Service) VerifyRangeProofs(collectiveKey abstract.Point, counts lib.CipherVector, rangeProofs []string, resultSet *map[string][]string) ([]lib.RangeProof, error) {
+	start := time.Now()
+	valid := make([]bool, len(counts))
+	proofs := make([]lib.RangeProof, len(counts))
+	wg := lib.StartParallelize(0)
+	for i := 0; i < len(counts); i = i + lib.VPARALLELIZE {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := i; j < i+lib.VPARALLELIZE && j < len(counts); j++ {
+				if err := proofs[j].Deserialize(rangeProofs[j]); err != nil {
+					continue
+				}
+				valid[j] = lib.RangeProofVerification(proofs[j], counts[j], collectiveKey, dbConfig.RangeProofBits)
+			}
+		}(i)
+	}
+	lib.EndParallelize(wg)
+	log.LLvl1("Range Proofs Verification Time: ", time.Since(start))
+
+	var invalidRows []string
+	for i, ok := range valid {
+		if !ok {
+			invalidRows = append(invalidRows, strconv.Itoa(i)+" (location_cd="+(*resultSet)["location_cd"][i]+
+				", year="+(*resultSet)["year"][i]+", concept_cd="+(*resultSet)["concept_cd"][i]+")")
+		}
+	}
+	if len(invalidRows) > 0 {
+		return nil, errors.New("invalid range proof for " + strconv.Itoa(len(invalidRows)) + " row(s) of table " +
+			dbConfig.Table + ": " + strings.Join(invalidRows, ", "))
+	}
+	return proofs, nil
+}
+
+// groupKey returns the group of row i of the result set: its values of the group-by attributes.
+func groupKey(groupBy []string, resultSet *map[string][]string, i int) string {
+	if len(groupBy) == 0 {
+		return "total"
+	}
+	key := ""
+	for j, gr := range groupBy {
+		key += (*resultSet)[gr][i]
+		if j < len(groupBy)-1 {
+			key += ","
+		}
+	}
+	return key
+}
+
+func (s *Service) AggregateResultSet(groupBy []string, resultSet *map[string][]string, counts *lib.CipherVector) *map[string]*lib.CipherText {
 
 	log.Lvl1(s.ServerIdentity(), " performs result aggregation of the resultSet")
 	aggregatedResultSet := make(map[string]*lib.CipherText)
@@ -366,21 +1897,13 @@ func (s *Service) AggregateResultSet(resultSet *map[string][]string, counts *lib
 	log.Lvl1(" Total number of records to aggregate: ", len(*counts))
 	for i := 0; i < len(*counts); i++ {
 
-		key := ""
-		if len(s.Query.GroupBy) > 0 {
-			for j, gr := range s.Query.GroupBy {
-				key += (*resultSet)[gr][i]
-				if j < len(s.Query.GroupBy)-1 {
-					key += ","
-				}
-
-			}
-		} else {
-			key += "total"
-		}
+		key := groupKey(groupBy, resultSet, i)
 
 		if _, ok := aggregatedResultSet[key]; !ok {
-			aggregatedResultSet[key] = &((*counts)[i])
+			// the sum gets its own points, the counts are also sent as they are to prove the aggregation
+			sum := lib.NewCipherText()
+			sum.Add(*sum, (*counts)[i])
+			aggregatedResultSet[key] = sum
 		} else {
 			aggregatedResultSet[key].Add(*(aggregatedResultSet[key]), (*counts)[i])
 		}
@@ -397,8 +1920,8 @@ func (s *Service) AggregateResultSet(resultSet *map[string][]string, counts *lib
 				go func(i int) {
 					defer wg.Done()
 					key := ""
-					if len(s.Query.GroupBy) > 0 {
-						for _, gr := range s.Query.GroupBy {
+					if len(groupBy) > 0 {
+						for _, gr := range groupBy {
 							key += (*resultSet)[gr][i]
 							key += ","
 						}
@@ -420,10 +1943,11 @@ func (s *Service) AggregateResultSet(resultSet *map[string][]string, counts *lib
 	return &aggregatedResultSet
 }
 
-func (s *Service) PrepareQueryStatement() string {
+func (s *Service) PrepareQueryStatement(query *CreationQueryDC) string {
 
-	// select statement
-	selectStmt := "SELECT * "
+	// select statement (the columns of the groups are read in the order location, time, concept)
+	columns := dbConfig.QuotedColumns()
+	selectStmt := "SELECT " + strings.Join(columns, ", ") + " "
 
 	// from statement
 	fromStmt := "FROM " + dbConfig.Table
@@ -432,12 +1956,12 @@ func (s *Service) PrepareQueryStatement() string {
 	whereStmt := " WHERE "
 
 	conceptCodes := ""
-	if len(s.Query.Concepts) > 0 {
+	if len(query.Concepts) > 0 {
 		conceptCodes += "("
-		for i, cd := range s.Query.Concepts {
-			conceptCodes += "concept_cd="
+		for i, cd := range query.Concepts {
+			conceptCodes += columns[2] + "="
 			conceptCodes += "'" + cd + "'"
-			if i < len(s.Query.Concepts)-1 {
+			if i < len(query.Concepts)-1 {
 				conceptCodes += " OR "
 			}
 		}
@@ -445,16 +1969,16 @@ func (s *Service) PrepareQueryStatement() string {
 	}
 
 	times := ""
-	if len(s.Query.Times) > 0 {
-		if len(s.Query.Concepts) > 0 {
+	if len(query.Times) > 0 {
+		if len(query.Concepts) > 0 {
 			times += " AND ("
 		} else {
 			times += "("
 		}
-		for i, tm := range s.Query.Times {
-			times += "time LIKE"
+		for i, tm := range query.Times {
+			times += columns[1] + " LIKE"
 			times += " '" + tm + "%'"
-			if i < len(s.Query.Times)-1 {
+			if i < len(query.Times)-1 {
 				times += " OR "
 			}
 		}
@@ -462,16 +1986,16 @@ func (s *Service) PrepareQueryStatement() string {
 	}
 
 	locationCodes := ""
-	if len(s.Query.Locations) > 0 {
-		if len(s.Query.Concepts) > 0 || len(s.Query.Times) > 0 {
+	if len(query.Locations) > 0 {
+		if len(query.Concepts) > 0 || len(query.Times) > 0 {
 			locationCodes += " AND ( "
 		} else {
 			locationCodes += "("
 		}
-		for i, loc := range s.Query.Locations {
-			locationCodes += "location_cd="
+		for i, loc := range query.Locations {
+			locationCodes += columns[0] + "="
 			locationCodes += "'" + loc + "'"
-			if i < len(s.Query.Locations)-1 {
+			if i < len(query.Locations)-1 {
 				locationCodes += " OR "
 			}
 		}
@@ -481,7 +2005,7 @@ func (s *Service) PrepareQueryStatement() string {
 	whereStmt += conceptCodes + times + locationCodes
 
 	//order by statement (optional)
-	orderByStmt := " ORDER BY location_cd ASC;"
+	orderByStmt := " ORDER BY " + columns[0] + " ASC;"
 
 	// query statement
 	queryStmt := selectStmt + fromStmt + whereStmt + orderByStmt
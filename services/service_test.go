@@ -0,0 +1,138 @@
+package serviceI2B2dc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JLRgithub/PrivateDCi2b2/lib"
+	"github.com/JLRgithub/PrivateDCi2b2/protocols"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/dedis/crypto.v0/abstract"
+	"gopkg.in/dedis/onet.v1"
+	"gopkg.in/dedis/onet.v1/log"
+)
+
+// lyingServer is the index of the server which claims a local count its rows do not add up to.
+const lyingServer = 2
+
+// TestCollectiveAggregationMisbehaving tests that the root finds the server whose aggregated data does not match its
+// rows, leaves it out of partial results and reports it in any case.
+func TestCollectiveAggregationMisbehaving(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	servers, roster, _ := local.GenTree(4, true)
+	defer local.CloseAll()
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	secKey, pubKey := lib.GenKey()
+
+	// the counts of the servers are 1, 2, 3 and 4 but the lying server claims 100
+	q := runTestAggregation(t, services, roster, pubKey, "partial", true)
+	assert.Equal(t, []int64{7}, decryptTestResults(secKey, q))
+	assert.Equal(t, len(servers)-1, len(q.Contributors))
+	for _, si := range q.Contributors {
+		assert.False(t, si.Equal(roster.List[lyingServer]))
+	}
+	if assert.Equal(t, 1, len(q.Misbehaving)) {
+		assert.True(t, q.Misbehaving[0].Server.Equal(roster.List[lyingServer]))
+		assert.True(t, q.Misbehaving[0].Excluded)
+	}
+
+	// without partial results, the server is reported but its data is kept
+	q = runTestAggregation(t, services, roster, pubKey, "complete", false)
+	assert.Equal(t, []int64{107}, decryptTestResults(secKey, q))
+	assert.Equal(t, len(servers), len(q.Contributors))
+	if assert.Equal(t, 1, len(q.Misbehaving)) {
+		assert.True(t, q.Misbehaving[0].Server.Equal(roster.List[lyingServer]))
+		assert.False(t, q.Misbehaving[0].Excluded)
+	}
+}
+
+// runTestAggregation gives its local data to every server (without database) and runs the collective aggregation of
+// the query at the first one.
+func runTestAggregation(t *testing.T, services []onet.Service, roster *onet.Roster, pubKey abstract.Point, id QueryID, partial bool) *queryState {
+	query := CreationQueryDC{QueryID: id, Roster: *roster, PartialResults: partial,
+		Timeouts: ProtocolTimeouts{Aggregation: 5 * time.Second}}
+	var root *queryState
+	for i, service := range services {
+		count := int64(i + 1)
+		row := lib.FilteredResponse{AggregatingAttributes: lib.CipherVector{*lib.EncryptInt(pubKey, count)}}
+		if i == lyingServer {
+			count = 100
+		}
+		groupedData := map[lib.GroupingKey]lib.FilteredResponse{
+			"total": {AggregatingAttributes: lib.CipherVector{*lib.EncryptInt(pubKey, count)}}}
+		q := &queryState{Query: query, groupedData: &groupedData,
+			localData: []lib.FilteredResponseDet{{DetTagGroupBy: "total", Fr: row}}}
+
+		s := service.(*Service)
+		s.queriesMutex.Lock()
+		s.queries[id] = q
+		s.queriesMutex.Unlock()
+		if i == 0 {
+			root = q
+		}
+	}
+
+	if err := services[0].(*Service).CollectiveAggregationPhase(root); err != nil {
+		t.Fatal("Aggregation failed:", err)
+	}
+	return root
+}
+
+// decryptTestResults decrypts the aggregated counts of a query.
+func decryptTestResults(secKey abstract.Scalar, q *queryState) []int64 {
+	var counts []int64
+	for _, fr := range q.AggregatedResults {
+		counts = append(counts, lib.DecryptIntVector(secKey, &fr.AggregatingAttributes)...)
+	}
+	return counts
+}
+
+func TestServerInfoSignature(t *testing.T) {
+	private, public := lib.GenKey()
+	info := &ServerInfoResponse{Public: public, Suite: lib.CurrentSuite().String(), CollectiveKey: "key", T: 2, N: 3}
+	signed, err := serverInfoData([]byte("nonce"), info)
+	assert.Nil(t, err)
+	info.Signature, err = lib.SchnorrSign(private, signed)
+	assert.Nil(t, err)
+	assert.Nil(t, info.Verify([]byte("nonce")))
+
+	// an answer replayed for another nonce, altered or claiming another key is refused
+	assert.NotNil(t, info.Verify([]byte("other nonce")))
+	info.T = 1
+	assert.NotNil(t, info.Verify([]byte("nonce")))
+	info.T = 2
+	_, info.Public = lib.GenKey()
+	assert.NotNil(t, info.Verify([]byte("nonce")))
+}
+
+// TestStartProtocolError tests that a protocol which cannot be created for a request (here, for an unknown query) fails
+// the request instead of stopping the server.
+func TestStartProtocolError(t *testing.T) {
+	defer log.AfterTest(t)
+	local := onet.NewLocalTest()
+	servers, roster, _ := local.GenTree(2, true)
+	defer local.CloseAll()
+	services := local.GetServices(servers, onet.ServiceFactory.ServiceID(ServiceName))
+	s := services[0].(*Service)
+
+	tree := roster.GenerateNaryTreeWithRoot(1, s.ServerIdentity())
+	_, err := s.startProtocolWithConfig(protocols.CollectiveAggregationProtocolName, tree, "unknown")
+	assert.NotNil(t, err)
+}
+
+// TestObfuscationNegativeCount tests that a count made negative by the noise is decrypted as such by the client.
+func TestObfuscationNegativeCount(t *testing.T) {
+	defer func(conf *ServerConfig, noise []float64) { serverConfig, noiseValues = conf, noise }(serverConfig, noiseValues)
+	serverConfig = &ServerConfig{DifferentialPrivacy: DifferentialPrivacyConfig{Epsilon: 1}}
+	noiseValues = []float64{-5}
+
+	secKey, pubKey := lib.GenKey()
+	s := &Service{ThresholdKey: &lib.ThresholdKey{CollectiveKey: pubKey}}
+	q := &queryState{AggregatedResults: []lib.FilteredResponse{
+		{AggregatingAttributes: lib.CipherVector{*lib.EncryptInt(pubKey, 2)}}}}
+	assert.Nil(t, s.ObfuscationPhase(q))
+
+	assert.Equal(t, DifferentialPrivacyConfig{Epsilon: 1, Sensitivity: 1}, q.DifferentialPrivacy)
+	assert.Equal(t, int64(-3), lib.DecryptIntWithNeg(secKey, q.AggregatedResults[0].AggregatingAttributes[0]))
+}